@@ -0,0 +1,318 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// What card scans record (the SCAN_MODE setting)
+	MODE_HOMEWORK   = "homework"
+	MODE_ATTENDANCE = "attendance"
+
+	// Attendance statuses; absent is never stored, only reported
+	ATTENDANCE_PRESENT = "present"
+	ATTENDANCE_LATE    = "late"
+	ATTENDANCE_ABSENT  = "absent"
+
+	// How many minutes before a period starts a scan checks in for it
+	CHECK_IN_EARLY = 15
+
+	MINUTES_PER_DAY = 24 * 60
+
+	DAY_FORMAT        = "2006-01-02"
+	CLOCK_FORMAT      = "15:04"
+	ATTENDANCE_SHEET  = "Attendance"
+	CHECK_OUT_ENABLED = "1"
+)
+
+var (
+	INVALID_MODE        = errors.New("Scans record either homework or attendance")
+	INVALID_PERIOD      = errors.New("A period needs a name, and must start before it ends, on the same day")
+	OVERLAPPING_PERIOD  = errors.New("That period overlaps another one")
+	NO_PERIOD           = errors.New("There is no period to check in for at this time")
+	ALREADY_CHECKED_OUT = errors.New("That student has already checked out of this period")
+
+	// Report labels, and the columns repeated for each period
+	ATTENDANCE_LABELS         = map[string]string{ATTENDANCE_PRESENT: "出勤", ATTENDANCE_LATE: "迟到", ATTENDANCE_ABSENT: "缺勤"}
+	ATTENDANCE_PERIOD_COLUMNS = []string{"状态", "签到", "签退"}
+)
+
+// clock formats minutes after midnight as hh:mm
+func clock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// ParseClock returns the minutes after midnight of an hh:mm time
+func ParseClock(value string) (int, error) {
+	t, err := time.Parse(CLOCK_FORMAT, value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// StartTime returns the time the Period starts, as hh:mm
+func (p *Period) StartTime() string {
+	return clock(p.Starts)
+}
+
+// EndTime returns the time the Period ends, as hh:mm
+func (p *Period) EndTime() string {
+	return clock(p.Ends)
+}
+
+// CheckedInTime returns the (local) time of the check-in, as hh:mm
+func (a *Attendance) CheckedInTime() string {
+	return time.Unix(a.CheckedIn, 0).Format(CLOCK_FORMAT)
+}
+
+// CheckedOutTime returns the (local) time of the check-out, if any
+func (a *Attendance) CheckedOutTime() string {
+	if a.CheckedOut == 0 {
+		return ""
+	}
+	return time.Unix(a.CheckedOut, 0).Format(CLOCK_FORMAT)
+}
+
+// GetScanMode returns what card scans record, MODE_HOMEWORK (the default)
+// or MODE_ATTENDANCE, and whether a second scan for the same period
+// checks the student out
+func GetScanMode(s Store) (string, bool, error) {
+	mode, err := s.GetSetting(SCAN_MODE)
+	if err == NOT_FOUND {
+		mode, err = MODE_HOMEWORK, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	checkOut, err := s.GetSetting(ATTENDANCE_CHECK_OUT)
+	if err == NOT_FOUND {
+		err = nil
+	}
+	return mode, checkOut == CHECK_OUT_ENABLED, err
+}
+
+// SetScanMode chooses what card scans record
+func SetScanMode(s Store, mode string, checkOut bool) error {
+	if mode != MODE_HOMEWORK && mode != MODE_ATTENDANCE {
+		return INVALID_MODE
+	}
+	if err := s.SetSetting(SCAN_MODE, mode); err != nil {
+		return err
+	}
+	value := ""
+	if checkOut {
+		value = CHECK_OUT_ENABLED
+	}
+	return s.SetSetting(ATTENDANCE_CHECK_OUT, value)
+}
+
+// AddPeriod adds the Period to the daily schedule, if it does not overlap
+// any of the others
+func AddPeriod(s Store, p *Period) (int64, error) {
+	if p.Name == "" || p.Starts < 0 || p.Starts >= p.Ends || p.Ends > MINUTES_PER_DAY || p.Grace < 0 {
+		return BAD_PK, INVALID_PERIOD
+	}
+	periods, err := s.GetPeriods()
+	if err != nil {
+		return BAD_PK, err
+	}
+	for _, other := range periods {
+		if p.Starts < other.Ends && other.Starts < p.Ends {
+			return BAD_PK, OVERLAPPING_PERIOD
+		}
+	}
+	return s.AddPeriod(p)
+}
+
+// FindPeriod returns the period under way at the given time or, between
+// periods, the one starting within CHECK_IN_EARLY minutes, if any
+func FindPeriod(periods []*Period, now time.Time) *Period {
+	minute := now.Hour()*60 + now.Minute()
+	for _, p := range periods {
+		if p.Starts <= minute && minute < p.Ends {
+			return p
+		}
+	}
+	for _, p := range periods {
+		if p.Starts-CHECK_IN_EARLY <= minute && minute < p.Starts {
+			return p
+		}
+	}
+	return nil
+}
+
+// RecordAttendance checks the student in for the current period, as
+// present, or late if after its grace time, or, on a second scan, checks
+// them out (if check-out is enabled); it returns the attendance as it is
+// now recorded
+func RecordAttendance(s Store, stuid string, now time.Time) (*Attendance, error) {
+	periods, err := s.GetPeriods()
+	if err != nil {
+		return nil, err
+	}
+	p := FindPeriod(periods, now)
+	if p == nil {
+		return nil, NO_PERIOD
+	}
+
+	a := &Attendance{StudentId: stuid, Day: now.Format(DAY_FORMAT), PeriodId: p.Id, CheckedIn: now.Unix(), Status: ATTENDANCE_PRESENT}
+	if now.Hour()*60+now.Minute() > p.Starts+p.Grace {
+		a.Status = ATTENDANCE_LATE
+	}
+	err = s.CheckIn(a)
+	if err != DUPLICATE_ATTENDANCE {
+		return a, err
+	}
+
+	_, checkOut, err := GetScanMode(s)
+	if err != nil {
+		return nil, err
+	}
+	if !checkOut {
+		return nil, DUPLICATE_ATTENDANCE
+	}
+	if err := s.CheckOut(stuid, a.Day, p.Id, now); err != nil {
+		if err == NOT_FOUND {
+			err = ALREADY_CHECKED_OUT
+		}
+		return nil, err
+	}
+	records, err := s.GetAttendance(a.Day)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if record.StudentId == stuid && record.PeriodId == p.Id {
+			return record, nil
+		}
+	}
+	return nil, NOT_FOUND
+}
+
+// AttendanceCell is the attendance of one student for one period
+type AttendanceCell struct {
+	Status     string      // '' for a period not over yet, without a check-in
+	Attendance *Attendance // nil unless they checked in
+}
+
+// Label returns the status, as reported
+func (c *AttendanceCell) Label() string {
+	return ATTENDANCE_LABELS[c.Status]
+}
+
+// PeriodTally counts the statuses of the students for one period
+type PeriodTally struct {
+	Period  *Period
+	Present int
+	Late    int
+	Absent  int
+}
+
+// AttendanceReport is the students x periods attendance matrix of a day
+type AttendanceReport struct {
+	Day      string
+	Students []*Student
+	Periods  []*Period
+	Cells    [][]*AttendanceCell // [student][period]
+	Tallies  []*PeriodTally      // [period]
+}
+
+// GetAttendanceReport builds the AttendanceReport of the roster for the
+// given day; students who did not check in for a period are absent once
+// it is over, as of now
+func GetAttendanceReport(s Store, day, now time.Time) (*AttendanceReport, error) {
+	students, err := s.GetStudents()
+	if err != nil {
+		return nil, err
+	}
+	periods, err := s.GetPeriods()
+	if err != nil {
+		return nil, err
+	}
+	report := &AttendanceReport{Day: day.Format(DAY_FORMAT), Students: students, Periods: periods}
+	records, err := s.GetAttendance(report.Day)
+	if err != nil {
+		return nil, err
+	}
+
+	checkedIn := make(map[attendanceKey]*Attendance)
+	for _, a := range records {
+		checkedIn[attendanceKey{a.StudentId, a.Day, a.PeriodId}] = a
+	}
+
+	today := now.Format(DAY_FORMAT)
+	minute := now.Hour()*60 + now.Minute()
+	report.Tallies = make([]*PeriodTally, len(periods))
+	for j, p := range periods {
+		report.Tallies[j] = &PeriodTally{Period: p}
+	}
+	report.Cells = make([][]*AttendanceCell, len(students))
+	for i, student := range students {
+		report.Cells[i] = make([]*AttendanceCell, len(periods))
+		for j, p := range periods {
+			cell := new(AttendanceCell)
+			tally := report.Tallies[j]
+			if a, ok := checkedIn[attendanceKey{student.Id, report.Day, p.Id}]; ok {
+				cell.Status, cell.Attendance = a.Status, a
+				if a.Status == ATTENDANCE_LATE {
+					tally.Late++
+				} else {
+					tally.Present++
+				}
+			} else if report.Day < today || (report.Day == today && minute >= p.Ends) {
+				cell.Status = ATTENDANCE_ABSENT
+				tally.Absent++
+			}
+			report.Cells[i][j] = cell
+		}
+	}
+	return report, nil
+}
+
+// Rows returns the AttendanceReport as a header row followed by one row
+// per student: the stuid and name, then the status, check-in and
+// check-out times for each period
+func (r *AttendanceReport) Rows() [][]interface{} {
+	header := make([]interface{}, 0)
+	for _, label := range GRADEBOOK_STUDENT_COLUMNS {
+		header = append(header, label)
+	}
+	for _, p := range r.Periods {
+		for _, label := range ATTENDANCE_PERIOD_COLUMNS {
+			header = append(header, p.Name+" "+label)
+		}
+	}
+
+	rows := [][]interface{}{header}
+	for i, student := range r.Students {
+		row := []interface{}{student.Id, student.Name}
+		for _, cell := range r.Cells[i] {
+			checkedIn, checkedOut := "", ""
+			if a := cell.Attendance; a != nil {
+				checkedIn, checkedOut = a.CheckedInTime(), a.CheckedOutTime()
+			}
+			row = append(row, cell.Label(), checkedIn, checkedOut)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// WriteCSV writes the AttendanceReport as UTF-8 CSV (see WriteCSV)
+func (r *AttendanceReport) WriteCSV(w io.Writer) error {
+	return WriteCSV(w, r.Rows())
+}
+
+// WriteXLSX writes the AttendanceReport as a native Excel workbook
+func (r *AttendanceReport) WriteXLSX(w io.Writer) error {
+	return WriteXLSX(w, ATTENDANCE_SHEET, r.Rows())
+}
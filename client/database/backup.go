@@ -0,0 +1,363 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Snapshots are kept as '<dir>/PiScanDB-20060102-150405.sqlite' files
+	BACKUP_DIR         = "backups" // default, under SQLITE_PATH
+	BACKUP_PREFIX      = "PiScanDB-"
+	BACKUP_SUFFIX      = ".sqlite"
+	BACKUP_TIME_FORMAT = "20060102-150405"
+	BACKUP_TEMP_SUFFIX = ".tmp"
+
+	// How often the WebApp takes a snapshot, by default
+	BACKUP_INTERVAL = time.Hour
+
+	// Backup statements
+	VACUUM_INTO     = "vacuum into ?"
+	INTEGRITY_CHECK = "pragma integrity_check"
+	INTEGRITY_OK    = "ok"
+
+	// read-only connection options, for checking a snapshot
+	SQLITE_READ_ONLY = "mode=ro"
+
+	// what to type to confirm a restore
+	RESTORE_CONFIRMATION = "yes"
+)
+
+var (
+	// DEFAULT_RETENTION keeps a day of hourly snapshots, then one a day
+	// for two weeks, one a week for two months, and one a month for a year
+	DEFAULT_RETENTION = RetentionPolicy{Recent: 24, Daily: 14, Weekly: 8, Monthly: 12}
+
+	NO_SNAPSHOT           = errors.New("There is no snapshot from that time")
+	NEWER_SNAPSHOT        = errors.New("The snapshot was taken by a newer version of PiScan, which these binaries cannot use")
+	RESTORE_NOT_CONFIRMED = errors.New("Restore cancelled: the client db was not changed")
+)
+
+// Snapshot is a consistent copy of the client db, taken while in use
+type Snapshot struct {
+	Path  string
+	Taken time.Time
+}
+
+// RetentionPolicy says how many snapshots to keep: the most Recent ones,
+// and the newest one of each of the last Daily days, Weekly (ISO) weeks
+// and Monthly months; all the others are removed by RotateSnapshots
+type RetentionPolicy struct {
+	Recent  int
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// IntegrityError lists the problems 'pragma integrity_check' found
+type IntegrityError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("%s failed the integrity check: %s", e.Path, strings.Join(e.Problems, "; "))
+}
+
+// integrityCheck runs 'pragma integrity_check' on the db
+func integrityCheck(db *sql.DB, name string) error {
+	rows, err := db.Query(INTEGRITY_CHECK)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	problems := make([]string, 0)
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != INTEGRITY_OK {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return &IntegrityError{Path: name, Problems: problems}
+	}
+	return nil
+}
+
+// openReadOnly opens the sqlite db file without allowing any changes
+func openReadOnly(file string) (*sql.DB, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+	return sql.Open(SQLITE_DRIVER, fmt.Sprintf("file:%s?%s", file, SQLITE_READ_ONLY))
+}
+
+// VerifySnapshot checks the integrity of the sqlite db file
+func VerifySnapshot(file string) error {
+	db, err := openReadOnly(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return integrityCheck(db, file)
+}
+
+// IntegrityCheck checks the integrity of the (live) client db
+func (s *SQLiteStore) IntegrityCheck() error {
+	return s.retry(func() error {
+		return integrityCheck(s.db, "the client db")
+	})
+}
+
+// Snapshot writes a consistent copy of the client db into the folder,
+// without blocking the other connections, verifies it, and only then
+// gives it its final name, so a partial or corrupt copy is never listed
+func (s *SQLiteStore) Snapshot(dir string, now time.Time) (*Snapshot, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{Path: path.Join(dir, BACKUP_PREFIX+now.Format(BACKUP_TIME_FORMAT)+BACKUP_SUFFIX), Taken: now}
+	temp := snap.Path + BACKUP_TEMP_SUFFIX
+	os.Remove(temp) // left over from an interrupted snapshot, if any
+
+	if _, err := s.execute(VACUUM_INTO, temp); err != nil {
+		os.Remove(temp)
+		return nil, err
+	}
+	if err := VerifySnapshot(temp); err != nil {
+		os.Remove(temp)
+		return nil, err
+	}
+	if err := os.Rename(temp, snap.Path); err != nil {
+		os.Remove(temp)
+		return nil, err
+	}
+	return snap, nil
+}
+
+// ListSnapshots returns the snapshots in the folder, newest first
+func ListSnapshots(dir string) ([]*Snapshot, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Snapshot{}, nil
+		}
+		return nil, err
+	}
+
+	results := make([]*Snapshot, 0)
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasPrefix(name, BACKUP_PREFIX) || !strings.HasSuffix(name, BACKUP_SUFFIX) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, BACKUP_PREFIX), BACKUP_SUFFIX)
+		taken, err := time.ParseInLocation(BACKUP_TIME_FORMAT, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		results = append(results, &Snapshot{Path: path.Join(dir, name), Taken: taken})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Taken.After(results[j].Taken)
+	})
+	return results, nil
+}
+
+// FindSnapshot returns the newest snapshot in the folder taken at or
+// before the given time
+func FindSnapshot(dir string, at time.Time) (*Snapshot, error) {
+	snapshots, err := ListSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range snapshots {
+		if !snap.Taken.After(at) {
+			return snap, nil
+		}
+	}
+	return nil, NO_SNAPSHOT
+}
+
+// RotateSnapshots removes the snapshots in the folder which the policy
+// does not keep, and returns them
+func RotateSnapshots(dir string, policy RetentionPolicy) ([]*Snapshot, error) {
+	snapshots, err := ListSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	keep := make(map[string]bool)
+	for i, snap := range snapshots {
+		if i < policy.Recent {
+			keep[snap.Path] = true
+		}
+	}
+
+	// the newest snapshot in each of the most recent n periods
+	keepEach := func(n int, period func(time.Time) string) {
+		seen := make(map[string]bool)
+		for _, snap := range snapshots {
+			p := period(snap.Taken)
+			if seen[p] {
+				continue
+			}
+			if len(seen) == n {
+				break
+			}
+			seen[p] = true
+			keep[snap.Path] = true
+		}
+	}
+	keepEach(policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") })
+	keepEach(policy.Weekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%02d", year, week)
+	})
+	keepEach(policy.Monthly, func(t time.Time) string { return t.Format("2006-01") })
+
+	removed := make([]*Snapshot, 0)
+	for _, snap := range snapshots {
+		if keep[snap.Path] {
+			continue
+		}
+		if err := os.Remove(snap.Path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, snap)
+	}
+	return removed, nil
+}
+
+// SnapshotForever takes a snapshot into the folder at every interval,
+// and rotates them by the policy, invoking errorFn on any failure
+func (s *SQLiteStore) SnapshotForever(dir string, interval time.Duration, policy RetentionPolicy, errorFn func(error)) {
+	for now := range time.Tick(interval) {
+		if _, err := s.Snapshot(dir, now); err != nil {
+			errorFn(err)
+			continue
+		}
+		if _, err := RotateSnapshots(dir, policy); err != nil {
+			errorFn(err)
+		}
+	}
+}
+
+// snapshotVersion returns the schema version (see MIGRATIONS) of the
+// sqlite db file
+func snapshotVersion(file string) (int, error) {
+	db, err := openReadOnly(file)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var version int
+	err = db.QueryRow(GET_SCHEMA_VERSION).Scan(&version)
+	return version, err
+}
+
+// ConfirmRestore asks, on prompt, to confirm replacing the client db with
+// the snapshot file, and returns RESTORE_NOT_CONFIRMED unless the answer
+// read is RESTORE_CONFIRMATION
+func ConfirmRestore(answers io.Reader, prompt io.Writer, file string) error {
+	fmt.Fprintf(prompt, "This replaces ALL the data in the client db with %s.\nType '%s' to continue: ", file, RESTORE_CONFIRMATION)
+	answer, _ := bufio.NewReader(answers).ReadString('\n')
+	if strings.TrimSpace(answer) != RESTORE_CONFIRMATION {
+		return RESTORE_NOT_CONFIRMED
+	}
+	return nil
+}
+
+// Restore replaces the contents of the client db with the snapshot file,
+// via the sqlite online backup api, so the other connections (and the
+// other binary) see the restored data at once, and brings it up to date
+// (see MIGRATIONS) if it was taken before the latest ones. The snapshot
+// is verified first, and the current contents are saved as a new
+// snapshot in the folder, which is returned, so the restore can itself
+// be undone.
+func (s *SQLiteStore) Restore(file, dir string) (*Snapshot, error) {
+	if err := VerifySnapshot(file); err != nil {
+		return nil, err
+	}
+	if version, err := snapshotVersion(file); err != nil {
+		return nil, err
+	} else if version > len(MIGRATIONS) {
+		return nil, NEWER_SNAPSHOT
+	}
+	saved, err := s.Snapshot(dir, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := openReadOnly(file)
+	if err != nil {
+		return saved, err
+	}
+	defer src.Close()
+
+	ctx := context.Background()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return saved, err
+	}
+	defer srcConn.Close()
+	destConn, err := s.db.Conn(ctx)
+	if err != nil {
+		return saved, err
+	}
+	defer destConn.Close()
+
+	err = destConn.Raw(func(dest interface{}) error {
+		return srcConn.Raw(func(source interface{}) error {
+			b, err := dest.(*sqlite3.SQLiteConn).Backup("main", source.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			// copy it all in one step, waiting while the db is busy
+			backoff := BUSY_BACKOFF
+			for attempt := 0; ; attempt++ {
+				done, err := b.Step(-1)
+				if err != nil {
+					b.Finish()
+					return err
+				}
+				if done {
+					return b.Finish()
+				}
+				if attempt == BUSY_RETRIES {
+					b.Finish()
+					return sqlite3.Error{Code: sqlite3.ErrBusy}
+				}
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+		})
+	})
+	if err != nil {
+		return saved, err
+	}
+	return saved, migrate(s.db)
+}
@@ -0,0 +1,209 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// at returns the local time of the day and hour, as a snapshot is named
+func at(t *testing.T, stamp string) time.Time {
+	when, err := time.ParseInLocation("2006-01-02 15:04", stamp, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return when
+}
+
+// touchSnapshots adds (empty) snapshot files taken at the given times,
+// since only their names are read when listing and rotating them
+func touchSnapshots(t *testing.T, dir string, stamps []string) {
+	for _, stamp := range stamps {
+		name := BACKUP_PREFIX + at(t, stamp).Format(BACKUP_TIME_FORMAT) + BACKUP_SUFFIX
+		if err := ioutil.WriteFile(path.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// stamps returns when the snapshots were taken
+func stamps(snapshots []*Snapshot) []string {
+	results := make([]string, 0, len(snapshots))
+	for _, snap := range snapshots {
+		results = append(results, snap.Taken.Format("2006-01-02 15:04"))
+	}
+	return results
+}
+
+func TestRotateSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	touchSnapshots(t, dir, []string{
+		"2024-03-20 10:00", "2024-03-20 09:00", "2024-03-20 08:00", // Wednesday, ISO week 12
+		"2024-03-19 23:00", "2024-03-19 12:00",
+		"2024-03-18 12:00", // Monday, still week 12
+		"2024-03-11 12:00", // week 11
+		"2024-03-04 12:00", // week 10
+		"2024-02-15 12:00",
+		"2024-01-15 12:00",
+	})
+	// not snapshots, so never removed
+	for _, name := range []string{"notes.txt", BACKUP_PREFIX + "x" + BACKUP_SUFFIX, BACKUP_PREFIX + "20240101-000000" + BACKUP_SUFFIX + BACKUP_TEMP_SUFFIX} {
+		if err := ioutil.WriteFile(path.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the 2 most recent; the newest of the last 2 days, weeks and months
+	removed, err := RotateSnapshots(dir, RetentionPolicy{Recent: 2, Daily: 2, Weekly: 2, Monthly: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2024-03-20 08:00 2024-03-19 12:00 2024-03-18 12:00 2024-03-04 12:00 2024-01-15 12:00"
+	if got := strings.Join(stamps(removed), " "); got != want {
+		t.Fatalf("removed %s, want %s", got, want)
+	}
+	kept, err := ListSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "2024-03-20 10:00 2024-03-20 09:00 2024-03-19 23:00 2024-03-11 12:00 2024-02-15 12:00"
+	if got := strings.Join(stamps(kept), " "); got != want {
+		t.Fatalf("kept %s, want %s", got, want)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != len(kept)+3 {
+		t.Fatalf("got %d files, want the others left alone", len(files))
+	}
+
+	// rotating again removes nothing more
+	if removed, err := RotateSnapshots(dir, RetentionPolicy{Recent: 2, Daily: 2, Weekly: 2, Monthly: 2}); err != nil || len(removed) != 0 {
+		t.Fatalf("removed %v %v", stamps(removed), err)
+	}
+}
+
+func TestFindSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := FindSnapshot(path.Join(dir, "none"), time.Now()); err != NO_SNAPSHOT {
+		t.Fatalf("got %v, want NO_SNAPSHOT", err)
+	}
+	touchSnapshots(t, dir, []string{"2024-03-20 10:00", "2024-03-19 23:00", "2024-03-11 12:00"})
+	for _, tt := range []struct{ at, want string }{
+		{"2024-03-21 00:00", "2024-03-20 10:00"},
+		{"2024-03-20 09:59", "2024-03-19 23:00"},
+		{"2024-03-11 12:00", "2024-03-11 12:00"},
+	} {
+		snap, err := FindSnapshot(dir, at(t, tt.at))
+		if err != nil || snap.Taken.Format("2006-01-02 15:04") != tt.want {
+			t.Fatalf("at %s: got %v %v, want %s", tt.at, snap, err, tt.want)
+		}
+	}
+	if _, err := FindSnapshot(dir, at(t, "2024-03-11 11:59")); err != NO_SNAPSHOT {
+		t.Fatalf("got %v, want NO_SNAPSHOT", err)
+	}
+}
+
+// changeSnapshot runs the statements on the snapshot file
+func changeSnapshot(t *testing.T, file string, statements ...string) {
+	db, err := sql.Open(SQLITE_DRIVER, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRestore(t *testing.T) {
+	s, dir := openSQLiteStore(t), t.TempDir()
+	addStudents(t, s, map[string]string{"001": "张三"})
+	snap, err := s.Snapshot(dir, at(t, "2024-03-20 10:00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addStudents(t, s, map[string]string{"002": "李四"})
+
+	saved, err := s.Restore(snap.Path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if students, err := s.GetStudents(); err != nil || len(students) != 1 || students[0].Id != "001" {
+		t.Fatalf("got %v %v", students, err)
+	}
+	// the replaced contents were saved, and can be restored in turn (once
+	// the next snapshot, named by the second, would not replace them)
+	time.Sleep(time.Second)
+	if _, err := s.Restore(saved.Path, dir); err != nil {
+		t.Fatal(err)
+	}
+	if students, err := s.GetStudents(); err != nil || len(students) != 2 {
+		t.Fatalf("got %d students, %v", len(students), err)
+	}
+
+	// a snapshot from before the live events is brought up to date
+	changeSnapshot(t, snap.Path, "drop table class_role",
+		"drop trigger live_submission_insert", "drop trigger live_submission_update", "drop trigger live_submission_delete",
+		"drop table live_event", fmt.Sprintf(SET_SCHEMA_VERSION, len(MIGRATIONS)-2))
+	if _, err := s.Restore(snap.Path, dir); err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	if err := s.DB().QueryRow(GET_SCHEMA_VERSION).Scan(&version); err != nil || version != len(MIGRATIONS) {
+		t.Fatalf("got version %d, %v", version, err)
+	}
+	if _, err := s.AddLiveEvent(&LiveEvent{Kind: LIVE_SCAN, Outcome: "submitted", StudentId: "001", Created: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// one from a newer version, or corrupt, is refused
+	changeSnapshot(t, snap.Path, fmt.Sprintf(SET_SCHEMA_VERSION, len(MIGRATIONS)+1))
+	if _, err := s.Restore(snap.Path, dir); err != NEWER_SNAPSHOT {
+		t.Fatalf("got %v, want NEWER_SNAPSHOT", err)
+	}
+	garbage := path.Join(dir, "garbage.sqlite")
+	if err := ioutil.WriteFile(garbage, bytes.Repeat([]byte("x"), 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Restore(garbage, dir); err == nil {
+		t.Fatal("restored a corrupt file")
+	}
+	if _, err := s.Restore(path.Join(dir, "none.sqlite"), dir); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want not found", err)
+	}
+	if students, err := s.GetStudents(); err != nil || len(students) != 1 {
+		t.Fatalf("got %d students, %v", len(students), err)
+	}
+}
+
+func TestConfirmRestore(t *testing.T) {
+	for _, tt := range []struct {
+		answer string
+		err    error
+	}{
+		{"yes\n", nil},
+		{" yes \r\n", nil},
+		{"yes", nil},
+		{"y\n", RESTORE_NOT_CONFIRMED},
+		{"YES\n", RESTORE_NOT_CONFIRMED},
+		{"\n", RESTORE_NOT_CONFIRMED},
+		{"", RESTORE_NOT_CONFIRMED},
+	} {
+		var prompt bytes.Buffer
+		if err := ConfirmRestore(strings.NewReader(tt.answer), &prompt, "snap.sqlite"); err != tt.err {
+			t.Fatalf("%q: got %v, want %v", tt.answer, err, tt.err)
+		}
+		if !strings.Contains(prompt.String(), "snap.sqlite") || !strings.Contains(prompt.String(), RESTORE_CONFIRMATION) {
+			t.Fatalf("prompted %q", prompt.String())
+		}
+	}
+}
@@ -6,13 +6,12 @@
 package database
 
 import (
+	"database/sql"
 	"fmt"
-	"github.com/mxk/go-sqlite/sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"io/ioutil"
 	"math"
 	"path"
-	"strconv"
-	"strings"
 	"time"
 )
 
@@ -24,19 +23,150 @@ const (
 	// Default sql definitions file
 	TABLE_SQL_DEFINITIONS = "tables.sql"
 
+	// database/sql driver name (the sqlite3 driver, with the sql
+	// functions the table definitions need, see init) and connection
+	// options: the db file is shared by the PiScanner and the WebApp, so
+	// use the write-ahead log (readers do not block the writer), wait (in
+	// ms) on a locked file instead of failing at once, and take the write
+	// lock at the start of each transaction
+	SQLITE_DRIVER       = "sqlite3_piscan"
+	SQLITE_OPTIONS      = "_foreign_keys=1&_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate"
+	SQLITE_BUSY_TIMEOUT = 5000
+
+	// Connection pool size, per process
+	SQLITE_MAX_CONNS = 4
+
 	// Execution constants
 	BAD_PK = -1
 
 	// Prepared Statements
 	// Students
-	ADD_STUDENT           = "insert into Student (stuid, name) values ($b, $n)" //EDITED
-	UPDATE_STUDENT        = "update Student set stuid = $d, name = $n where stuid = $i" //EDITED
-	GET_EXISTING_STUDENT  = "select stuid from Student where stuid = $b" //EDITED
-	DELETE_STUDENT        = "delete from Student where stuid = $i"
-	SUBMITTED_STUDENT     = "update Student set submission_status = 1 where stuid = $i"
-	UNSUBMITTED_STUDENT   = "update Student set submission_status = 0 where stuid = $i"
-	GET_SUBMITTED_STUDENT = "select name, stuid, submission_time, submission_status from Student where submission_status = 1 order by posted submission_time"
-	GET_STUDENT           = "select name, stuid, submission_time, submission_status from Student order by posted submission_time"
+	GET_STUDENTS   = "select stuid, name from student where deleted_at = 0 and term = 0 order by name, stuid"
+	GET_STUDENT    = "select stuid, name from student where stuid = ? and deleted_at = 0 and term = 0"
+	ADD_STUDENT    = "insert into student (stuid, name) values (?, ?) on conflict (stuid) do update set name = excluded.name, deleted_at = 0, term = 0 where student.deleted_at != 0 or student.term != 0"
+	UPDATE_STUDENT = "update student set stuid = ?, name = ? where stuid = ? and deleted_at = 0 and term = 0"
+	DELETE_STUDENT = "update student set deleted_at = ? where stuid = ? and deleted_at = 0 and term = 0"
+	MATCH_STUDENTS = "select student.stuid, student.name from student_search join student on student.stuid = student_search.stuid where student_search match ? and student.deleted_at = 0 and student.term = 0 order by rank limit ?"
+
+	// Cards
+	GET_CARDS            = "select barcode, stuid, issued, revoked from card where stuid = ? order by issued, barcode"
+	GET_CARD             = "select barcode, stuid, issued, revoked from card where barcode = ?"
+	ADD_CARD             = "insert into card (barcode, stuid, issued) values (?, ?, ?)"
+	REVOKE_CARD          = "update card set revoked = ? where barcode = ? and revoked = 0"
+	REVOKE_STUDENT_CARDS = "update card set revoked = ? where stuid = ? and revoked = 0"
+
+	// Assignments
+	GET_ASSIGNMENTS   = "select id, title, posted, due, term, scale, max_points from assignment where term = ? order by posted desc, id desc"
+	GET_ASSIGNMENT    = "select id, title, posted, due, term, scale, max_points from assignment where id = ?"
+	ADD_ASSIGNMENT    = "insert into assignment (title, posted, due, scale, max_points, uid) values (?, ?, ?, ?, ?, lower(hex(randomblob(16))))"
+	UPDATE_ASSIGNMENT = "update assignment set title = ?, due = ?, scale = ?, max_points = ? where id = ? and term = 0"
+	DELETE_ASSIGNMENT = "delete from assignment where id = ? and term = 0"
+
+	// Terms
+	GET_TERMS           = "select id, name, started, closed from term order by closed desc, id desc"
+	GET_TERM            = "select id, name, started, closed from term where id = ?"
+	GET_TERM_ROSTER     = "select stuid, name from term_student where term = ? order by name, stuid"
+	TERM_STARTED        = "select coalesce((select max(closed) from term), (select min(posted) from assignment where term = 0), 0)"
+	ADD_TERM            = "insert into term (name, started, closed) values (?, ?, ?)"
+	ARCHIVE_ROSTER      = "insert into term_student (term, stuid, name) select ?, stuid, name from student where deleted_at = 0 and term = 0"
+	ARCHIVE_STUDENTS    = "update student set term = ? where deleted_at = 0 and term = 0"
+	ARCHIVE_ASSIGNMENTS = "update assignment set term = ? where term = 0"
+	ARCHIVE_CLASS_ROLES = "update class_role set term = ? where term = 0"
+	CLEAR_SETTING       = "delete from setting where key = ?"
+
+	// deleting a closed term, whose students on no other term go with it
+	DELETE_TERM_ASSIGNMENTS = "delete from assignment where term = ? and term != 0"
+	DELETE_TERM             = "delete from term where id = ?"
+	DELETE_TERM_STUDENTS    = "delete from student where term = ? and stuid not in (select stuid from term_student)"
+	MOVE_TERM_STUDENTS      = "update student set term = (select max(term) from term_student where term_student.stuid = student.stuid) where term = ?"
+	DELETE_TERM_CLASS_ROLES = "delete from class_role where term = ? and term != 0"
+
+	// Submissions
+	GET_SUBMISSIONS = "select submission.stuid, submission.assignment, submission.posted, submission.grade, submission.comment, coalesce(submission.scanned_by, '') from submission join student on student.stuid = submission.stuid where submission.assignment = ? and submission.deleted_at = 0 and student.deleted_at = 0 order by submission.posted"
+	SUBMIT          = "insert into submission (stuid, assignment, posted) values (?, ?, ?) on conflict (stuid, assignment) do update set posted = excluded.posted, grade = '', comment = '', scanned_by = null, deleted_at = 0 where submission.deleted_at != 0"
+	GRADE           = "update submission set grade = ?, comment = ? where stuid = ? and assignment = ? and deleted_at = 0"
+	UNSUBMIT        = "update submission set deleted_at = ? where stuid = ? and assignment = ? and deleted_at = 0"
+
+	// Groups
+	GET_GROUPS          = "select id, assignment, name from team where assignment = ? order by name, id"
+	GET_GROUP           = "select id, assignment, name from team where id = ?"
+	GET_GROUP_MEMBERS   = "select team_member.team, team_member.stuid, student.name from team_member join student on student.stuid = team_member.stuid where team_member.assignment = ? and student.deleted_at = 0 order by student.name, student.stuid"
+	GET_MEMBER_GROUP    = "select team from team_member where assignment = ? and stuid = ?"
+	ADD_GROUP           = "insert into team (assignment, name) values (?, ?)"
+	ADD_GROUP_MEMBER    = "insert into team_member (team, assignment, stuid) values (?, ?, ?)"
+	REMOVE_GROUP_MEMBER = "delete from team_member where team = ? and stuid = ?"
+	DELETE_GROUP        = "delete from team where id = ?"
+	SUBMIT_FOR_GROUP    = "insert or ignore into submission (stuid, assignment, posted, scanned_by) select team_member.stuid, team_member.assignment, ?, scanner.stuid from team_member join team_member as scanner on scanner.team = team_member.team join student on student.stuid = team_member.stuid where scanner.stuid = ? and team_member.assignment = ? and team_member.stuid != scanner.stuid and student.deleted_at = 0 and student.term = 0"
+
+	// Trash
+	GET_DELETED_STUDENTS        = "select stuid, name, deleted_at from student where deleted_at != 0 order by deleted_at desc, name, stuid"
+	GET_DELETED_SUBMISSIONS     = "select stuid, assignment, posted, deleted_at from submission where deleted_at != 0 order by deleted_at desc, posted"
+	RESTORE_STUDENT             = "update student set deleted_at = 0 where stuid = ? and deleted_at != 0"
+	RESTORE_SUBMISSION          = "update submission set deleted_at = 0 where stuid = ? and assignment = ? and deleted_at != 0"
+	RESTORE_DELETED_STUDENTS    = "update student set deleted_at = 0 where deleted_at != 0 and deleted_at = ?"
+	RESTORE_DELETED_SUBMISSIONS = "update submission set deleted_at = 0 where deleted_at != 0 and deleted_at = ?"
+	PURGE_STUDENTS              = "delete from student where deleted_at != 0 and deleted_at < ?"
+	PURGE_SUBMISSIONS           = "delete from submission where deleted_at != 0 and deleted_at < ?"
+
+	// Retention
+	GET_FORMER_STUDENTS   = "select student.stuid, student.name, student.deleted_at, student.term, coalesce(term.closed, 0), (select count(*) from card where card.stuid = student.stuid) from student left join term on term.id = student.term where student.anonymized_at = 0 and (student.deleted_at != 0 or student.term != 0) order by student.stuid"
+	GET_STUDENT_ROWID     = "select rowid from student where stuid = ? and anonymized_at = 0"
+	ANONYMIZE_STUDENT     = "update student set stuid = ?, name = ?, anonymized_at = ? where stuid = ?"
+	ANONYMIZE_TERM_ROSTER = "update term_student set name = ? where stuid = ?"
+	DELETE_STUDENT_CARDS  = "delete from card where stuid = ?"
+
+	// Attendance
+	GET_PERIODS    = "select id, name, starts, ends, grace from period order by starts, id"
+	ADD_PERIOD     = "insert into period (name, starts, ends, grace) values (?, ?, ?, ?)"
+	DELETE_PERIOD  = "delete from period where id = ?"
+	GET_ATTENDANCE = "select attendance.stuid, attendance.day, attendance.period, attendance.checked_in, attendance.checked_out, attendance.status from attendance join student on student.stuid = attendance.stuid where attendance.day = ? and student.deleted_at = 0 order by attendance.checked_in"
+	CHECK_IN       = "insert or ignore into attendance (stuid, day, period, checked_in, status) values (?, ?, ?, ?, ?)"
+	CHECK_OUT      = "update attendance set checked_out = ? where stuid = ? and day = ? and period = ? and checked_out = 0"
+
+	// Outbox
+	GET_OUTBOX_MESSAGES   = "select id, idempotency_key, method, path, params, created, attempts, next_attempt, status, error, sent from outbox order by id desc"
+	GET_PENDING_MESSAGES  = "select id, idempotency_key, method, path, params, created, attempts, next_attempt, status, error, sent from outbox where status = 'pending' order by id"
+	ADD_OUTBOX_MESSAGE    = "insert into outbox (idempotency_key, method, path, params, created, next_attempt) values (?, ?, ?, ?, ?, ?)"
+	UPDATE_OUTBOX_MESSAGE = "update outbox set attempts = ?, next_attempt = ?, status = ?, error = ?, sent = ? where id = ?"
+	RETRY_OUTBOX_MESSAGE  = "update outbox set status = 'pending', next_attempt = 0 where id = ? and status = 'failed'"
+	PURGE_OUTBOX          = "delete from outbox where status != 'pending' and created < ?"
+
+	// Teachers
+	GET_TEACHERS            = "select id, username, name, hash, role, created, last_login from teacher order by username"
+	GET_TEACHER             = "select id, username, name, hash, role, created, last_login from teacher where id = ?"
+	GET_TEACHER_BY_USERNAME = "select id, username, name, hash, role, created, last_login from teacher where username = ?"
+	ADD_TEACHER             = "insert or ignore into teacher (username, name, hash, role, created) values (?, ?, ?, ?, ?)"
+	UPDATE_TEACHER          = "update teacher set name = ?, hash = ?, role = ?, last_login = ? where id = ?"
+	DELETE_TEACHER          = "delete from teacher where id = ?"
+	DELETE_TEACHER_TOKENS   = "delete from api_token where teacher = ?"
+
+	// Class roles
+	GET_CLASS_ROLES  = "select term, role from class_role where teacher = ?"
+	SET_CLASS_ROLE   = "insert into class_role (teacher, term, role) values (?, ?, ?) on conflict (teacher, term) do update set role = excluded.role"
+	CLEAR_CLASS_ROLE = "delete from class_role where teacher = ? and term = ?"
+
+	// API tokens
+	GET_API_TOKENS        = "select id, teacher, name, hash, created, last_used from api_token order by id"
+	GET_API_TOKEN_BY_HASH = "select id, teacher, name, hash, created, last_used from api_token where hash = ?"
+	ADD_API_TOKEN         = "insert into api_token (teacher, name, hash, created) values (?, ?, ?, ?)"
+	TOUCH_API_TOKEN       = "update api_token set last_used = ? where id = ?"
+	DELETE_API_TOKEN      = "delete from api_token where id = ?"
+
+	// Unknown scans
+	GET_UNKNOWN_SCANS    = "select id, barcode, posted, device, coalesce(assignment, 0) from unknown_scan order by posted, id"
+	GET_UNKNOWN_SCANS_BY = "select id, barcode, posted, device, coalesce(assignment, 0) from unknown_scan where barcode = ? order by posted, id"
+	ADD_UNKNOWN_SCAN     = "insert into unknown_scan (barcode, posted, device, assignment) values (?, ?, ?, nullif(?, 0))"
+	DELETE_UNKNOWN_SCANS = "delete from unknown_scan where barcode = ?"
+
+	// Live events
+	GET_LIVE_EVENTS       = "select id, kind, outcome, stuid, assignment, detail, created from live_event where id > ? order by id limit ?"
+	GET_LATEST_LIVE_EVENT = "select id, kind, outcome, stuid, assignment, detail, created from live_event where ? in ('', kind) order by id desc limit 1"
+	ADD_LIVE_EVENT        = "insert into live_event (kind, outcome, stuid, assignment, detail, created) values (?, ?, ?, ?, ?, ?)"
+	PURGE_LIVE_EVENTS     = "delete from live_event where created < ?"
+
+	// Settings
+	GET_SETTING = "select value from setting where key = ?"
+	SET_SETTING = "insert or replace into setting (key, value) values (?, ?)"
 )
 
 var (
@@ -44,13 +174,23 @@ var (
 	SECONDS_PER = map[string]int64{"minute": 60, "hour": 3600, "day": 86400, "month": 2592000, "year": 31536000}
 )
 
-func calculateTimeSince(posted string) string {
+func init() {
+	// every connection gets the functions used by the student_search and
+	// sync_event triggers
+	sql.Register(SQLITE_DRIVER, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("search_terms", SearchTerms, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("sync_clock", SyncClock, false)
+		}})
+}
+
+func calculateTimeSince(posted int64) string {
 	result := "just now" // default reply
 
-	// try to convert the posted string into unix time
-	i, err := strconv.ParseInt(posted, 10, 64)
-	if err == nil {
-		tm := time.Unix(i, 0)
+	if posted > 0 {
+		tm := time.Unix(posted, 0)
 
 		// calculate the time since posted
 		// and return a human readable
@@ -81,160 +221,72 @@ func calculateTimeSince(posted string) string {
 	return result
 }
 
-func getPK(db *sqlite3.Conn, table string) int64 {
-	// find and return the most recently-inserted
-	// primary key, based on the table name
-	sql := fmt.Sprintf("select seq from sqlite_sequence where name='%s'", table)
-
-	var rowid int64
-	for s, err := db.Query(sql); err == nil; err = s.Next() {
-		s.Scan(&rowid)
-	}
-	return rowid
-}
-
-
-type Student struct {
-	name string
-	stuid string
-	submission_status bool
-	submission_time int64
-}
-
 type ConnCoordinates struct {
-	DBPath string
-	DBFile string
+	DBPath       string
+	DBFile       string
 	DBTablesPath string
+	Passphrase   []byte // encrypts the db, if given (see ReadPassphrase)
 }
 
-func getExistingStudent(db *sqlite3.Conn, barcode string) int64 {
-	// lookup the stuid
-	// combination and return the primary key,
-	// if the product has already been saved
-
-	args := sqlite3.NamedArgs{"$b": barcode}
-
-	var rowid int64
-	rowid = BAD_PK // default value, in case no match
-	for s, err := db.Query(GET_EXISTING_STUDENT, args); err == nil; err = s.Next() {
-		s.Scan(&rowid)
-	}
-	return rowid
-}
-
-func (i *Student) Add(db *sqlite3.Conn, stuid, name string) (int64, error) {
-	// 新增一个学生
-
-	// 首先检查是否与现存数据库内容重复
-	itemPk := getExistingStudent(db, i.stuid)
-	if itemPk != BAD_PK {
-		return itemPk, nil
-	}
-
-	args := sqlite3.NamedArgs{"$b": i.stuid,
-		"$n": i.name}
-	result := db.Exec(ADD_STUDENT, args)
-	//TODO: INTERPRET THE FOLLOWING CODE
-	if result == nil {
-		pk := getPK(db, "product")
-		return pk, result
-	}
-
-	return BAD_PK, result
-}
-
-func (i *Student) Update(db *sqlite3.Conn, original_stuid, stuid, name string) error {
-	// 更新学生的个人信息
-	args := sqlite3.NamedArgs{"$d": i.stuid,
-		"$n": i.name,
-		"$i": original_stuid}
-	return db.Exec(UPDATE_STUDENT, args)
-}
-
-func (i *Student) Delete(db *sqlite3.Conn, stuid string) error {
-	// 删除学生的个人信息
-	args := sqlite3.NamedArgs{"$i": i.stuid}
-	return db.Exec(DELETE_STUDENT, args)
-}
-
-func (i *Student) Submit(db *sqlite3.Conn, stuid string) error {
-	// 更改上交作业的状态为 True
-	args := sqlite3.NamedArgs{"$i": i.stuid}
-	return db.Exec(SUBMITTED_STUDENT, args)
-}
-
-func (i *Student) Unsubmit(db *sqlite3.Conn, stuid string) error {
-	// 更改上交作业的状态为 False
-	args := sqlite3.NamedArgs{"$i": i.stuid}
-	return db.Exec(UNSUBMITTED_STUDENT, args)
-}
-
-func GetStudents(db *sqlite3.Conn, sql string) ([]*Student, error) {
-	results := make([]*Student, 0)
-	row := make(sqlite3.RowMap)
-	for s, err := db.Query(sql); err == nil; err = s.Next() {
-		var rowid int64
-		s.Scan(&rowid, row)
-		stuid, stuidFound := row["stuid"]
-		name := row["name"]
-		submission_time := row["submission_time"]
-		submission_status := row["submission_status"]
-		if stuidFound {
-			result := new(Student)
-			result.stuid = stuid.(string)
-			result.name = name.(string)
-			result.submission_time = submission_time.(int64)
-			result.submission_status = submission_status.(bool)
-			results = append(results,result)
-		}
-	}
-
-	return results, nil
-}
-
-func GetSubmittedStudents(db *sqlite3.Conn) ([]*Student, error) {
-	return GetStudents(db, GET_SUBMITTED_STUDENT)
-}
-
-func GetAllStudents (db *sqlite3.Conn) ([]*Student, error) {
-	return GetStudents(db, GET_STUDENT)
-}
-
-func GetSingleItem(db *sqlite3.Conn, id string) (*Student, error) {
-	student := new(Student)
-	student.stuid = "-1" // if not found
-	students, err := GetAllStudents(db)
-	for _, i := range students {
-		if i.stuid == id {
-			return i, err
-		}
-	}
-	return student, err
-}
-
-func InitializeDB(coords ConnCoordinates) (*sqlite3.Conn, error) {
+// InitializeDB opens the sqlite db file at the given coordinates,
+// creates the tables from the definitions file, if coords.DBTablesPath
+// is defined, and brings them up to date (see MIGRATIONS). The result
+// is a connection pool, meant to be opened once and shared for the life
+// of the process.
+func InitializeDB(coords ConnCoordinates) (*sql.DB, error) {
 	// attempt to open the sqlite db file
-	db, dbErr := sqlite3.Open(path.Join(coords.DBPath, coords.DBFile))
+	options := fmt.Sprintf(SQLITE_OPTIONS, SQLITE_BUSY_TIMEOUT)
+	dsn := fmt.Sprintf("file:%s?%s", path.Join(coords.DBPath, coords.DBFile), options)
+	db, dbErr := sql.Open(SQLITE_DRIVER, dsn)
 	if dbErr != nil {
 		return db, dbErr
 	}
+	db.SetMaxOpenConns(SQLITE_MAX_CONNS)
+	db.SetMaxIdleConns(SQLITE_MAX_CONNS)
+	if pingErr := db.Ping(); pingErr != nil {
+		db.Close()
+		return nil, pingErr
+	}
 
 	// load the table definitions file, if coords.DBTablesPath is defined
 	if len(coords.DBTablesPath) > 0 {
 		content, err := ioutil.ReadFile(path.Join(coords.DBTablesPath, TABLE_SQL_DEFINITIONS))
 		if err != nil {
-			return db, err
+			db.Close()
+			return nil, err
 		}
 
 		// attempt to create (if not exists) each table
-		tables := strings.Split(string(content), ";")
-		for _, table := range tables {
-			err = db.Exec(table)
-			if err != nil {
-				return db, err
-			}
+		if _, err = db.Exec(string(content)); err != nil {
+			db.Close()
+			return nil, err
 		}
 	}
 
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return db, nil
 }
+
+// OpenStore connects to the sqlite db at the given coordinates, and
+// returns it as a Store, to be shared for the life of the process
+func OpenStore(coords ConnCoordinates) (*SQLiteStore, error) {
+	db, err := InitializeDB(coords)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSQLiteStore(db)
+	if coords.Passphrase != nil {
+		err = s.Unlock(coords.Passphrase)
+	} else if _, saltErr := s.GetSetting(ENCRYPTION_SALT); saltErr == nil {
+		err = ENCRYPTED_DB
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
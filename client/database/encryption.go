@@ -0,0 +1,368 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"golang.org/x/crypto/pbkdf2"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// Encrypted values are stored as this prefix and the base64 of the
+	// nonce and sealed value
+	ENCRYPTED_PREFIX = "enc:v1:"
+
+	// The settings which record that the db is encrypted, and with what
+	ENCRYPTION_SALT  = "encryption_salt"
+	ENCRYPTION_CHECK = "encryption_check"
+
+	// What the check setting holds, encrypted, to detect a wrong key
+	ENCRYPTION_CHECK_VALUE = "PiScan"
+
+	// Key derivation (PBKDF2-SHA256) parameters
+	KDF_ITERATIONS = 100000
+	SALT_SIZE      = 16
+	KEY_SIZE       = 32
+
+	// The environment variable the binaries read the passphrase from, if
+	// they are not given a key file
+	PASSPHRASE_ENV = "PISCAN_PASSPHRASE"
+
+	// Statements which encrypt (or decrypt) an existing db
+	GET_STUDENT_NAMES       = "select stuid, name from student"
+	SET_STUDENT_NAME        = "update student set name = ? where stuid = ?"
+	GET_TERM_STUDENT_NAMES  = "select term, stuid, name from term_student"
+	SET_TERM_STUDENT_NAME   = "update term_student set name = ? where term = ? and stuid = ?"
+	GET_CARD_BARCODES       = "select barcode from card"
+	SET_CARD_BARCODE        = "update card set barcode = ? where barcode = ?"
+	DELETE_FIRST_CARD       = "delete from card where barcode = ? and stuid = ?"
+	GET_UNKNOWN_BARCODES    = "select id, barcode from unknown_scan"
+	SET_UNKNOWN_BARCODE     = "update unknown_scan set barcode = ? where id = ?"
+	GET_OUTBOX_PARAMS       = "select id, params from outbox"
+	SET_OUTBOX_PARAMS       = "update outbox set params = ? where id = ?"
+	ADD_SETTING_ONCE        = "insert or ignore into setting (key, value) values (?, ?)"
+	DELETE_ENCRYPTION       = "delete from setting where key in (?, ?)"
+	OPTIMIZE_STUDENT_SEARCH = "insert into student_search (student_search) values ('optimize')"
+	VACUUM                  = "vacuum"
+	CHECKPOINT              = "pragma wal_checkpoint(TRUNCATE)"
+)
+
+var (
+	ENCRYPTED_DB  = errors.New("The client db is encrypted: give its passphrase or key file")
+	WRONG_KEY     = errors.New("That passphrase or key file does not match the client db")
+	BAD_CIPHER    = errors.New("A value in the client db could not be decrypted")
+	NOT_ENCRYPTED = errors.New("The client db is not encrypted")
+
+	STUID_IS_BARCODE = errors.New("In an encrypted client db, a stuid cannot be a card barcode: give the student another one")
+)
+
+// Cipher encrypts the identifying columns of the client db: student
+// names, which are sealed with a random nonce, and card barcodes, which
+// are sealed deterministically (with a nonce derived from the barcode),
+// so they can still be looked up. A nil Cipher leaves values as they are.
+// The stuids are not encrypted, so in an encrypted db no card is made
+// from a stuid, nor a stuid from a card (see GetStuidCards).
+type Cipher struct {
+	aead cipher.AEAD
+	mac  []byte
+}
+
+// ReadPassphrase returns the contents of the key file (without a trailing
+// newline), or, if none is given, the PASSPHRASE_ENV variable, or nil if
+// that is not set either
+func ReadPassphrase(keyFile string) ([]byte, error) {
+	if keyFile != "" {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(content), "\r\n")), nil
+	}
+	if passphrase := os.Getenv(PASSPHRASE_ENV); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, nil
+}
+
+// NewCipher derives the encryption and nonce keys from the passphrase
+func NewCipher(passphrase, salt []byte) (*Cipher, error) {
+	key := pbkdf2.Key(passphrase, salt, KDF_ITERATIONS, 2*KEY_SIZE, sha256.New)
+	block, err := aes.NewCipher(key[:KEY_SIZE])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead, mac: key[KEY_SIZE:]}, nil
+}
+
+// IsEncrypted reports whether the stored value is encrypted
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, ENCRYPTED_PREFIX)
+}
+
+// seal encrypts the value with the nonce
+func (c *Cipher) seal(nonce []byte, value string) string {
+	sealed := c.aead.Seal(nonce, nonce, []byte(value), nil)
+	return ENCRYPTED_PREFIX + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// Encrypt seals the value with a random nonce, so equal values differ
+func (c *Cipher) Encrypt(value string) string {
+	if c == nil || IsEncrypted(value) {
+		return value
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // crypto/rand never fails on linux
+	}
+	return c.seal(nonce, value)
+}
+
+// EncryptKey seals the value with a nonce derived from it, so equal
+// values are equal when encrypted, and can be matched in queries
+func (c *Cipher) EncryptKey(value string) string {
+	if c == nil || IsEncrypted(value) {
+		return value
+	}
+	mac := hmac.New(sha256.New, c.mac)
+	mac.Write([]byte(value))
+	return c.seal(mac.Sum(nil)[:c.aead.NonceSize()], value)
+}
+
+// Decrypt returns the value as it was before Encrypt or EncryptKey; a
+// value which is not encrypted is returned as it is
+func (c *Cipher) Decrypt(value string) (string, error) {
+	if c == nil || !IsEncrypted(value) {
+		return value, nil
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(value[len(ENCRYPTED_PREFIX):])
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", BAD_CIPHER
+	}
+	size := c.aead.NonceSize()
+	plain, err := c.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return "", BAD_CIPHER
+	}
+	return string(plain), nil
+}
+
+// recrypt rewrites the names and barcodes of the db in the transaction,
+// with the given functions (to encrypt or decrypt them), leaving those
+// they do not change as they are; it returns how many it changed
+func recrypt(tx *sql.Tx, name, barcode func(string) (string, error)) (int, error) {
+	// collect each table's changes before making them
+	collect := func(query string, fn func(string) (string, error)) ([][]interface{}, error) {
+		rows, err := tx.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		cols, err := rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+		changes := make([][]interface{}, 0)
+		for rows.Next() {
+			// the value to change is the last column; the others are its key
+			values := make([]interface{}, len(cols))
+			strs := make([]sql.NullString, len(cols))
+			for i := range values {
+				values[i] = &strs[i]
+			}
+			if err := rows.Scan(values...); err != nil {
+				return nil, err
+			}
+			old := strs[len(cols)-1].String
+			updated, err := fn(old)
+			if err != nil {
+				return nil, err
+			}
+			if updated == old {
+				continue
+			}
+			args := []interface{}{updated}
+			for _, key := range strs[:len(cols)-1] {
+				args = append(args, key.String)
+			}
+			if len(cols) == 1 {
+				args = append(args, old)
+			}
+			changes = append(changes, args)
+		}
+		return changes, rows.Err()
+	}
+
+	// the new names are not changes to sync
+	if _, err := tx.Exec(ADD_SETTING_ONCE, SYNC_MUTED, "1"); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, table := range []struct {
+		get, set string
+		fn       func(string) (string, error)
+	}{
+		{GET_STUDENT_NAMES, SET_STUDENT_NAME, name},
+		{GET_TERM_STUDENT_NAMES, SET_TERM_STUDENT_NAME, name},
+		{GET_CARD_BARCODES, SET_CARD_BARCODE, barcode},
+		{GET_UNKNOWN_BARCODES, SET_UNKNOWN_BARCODE, barcode},
+		{GET_SYNC_EVENT_NAMES, SET_SYNC_EVENT_NAME, name},
+		{GET_OUTBOX_PARAMS, SET_OUTBOX_PARAMS, name},
+	} {
+		changes, err := collect(table.get, table.fn)
+		if err != nil {
+			return n, err
+		}
+		for _, args := range changes {
+			if _, err := tx.Exec(table.set, args...); err != nil {
+				return n, err
+			}
+		}
+		n += len(changes)
+	}
+	if _, err := tx.Exec(CLEAR_SETTING, SYNC_MUTED); err != nil || n == 0 {
+		return n, err
+	}
+	// drop the search terms of the old names from the fts index
+	_, err := tx.Exec(OPTIMIZE_STUDENT_SEARCH)
+	return n, err
+}
+
+// encrypt and decrypt, as recrypt functions
+func (c *Cipher) encryptName(value string) (string, error) { return c.Encrypt(value), nil }
+func (c *Cipher) encryptKey(value string) (string, error)  { return c.EncryptKey(value), nil }
+
+// Unlock encrypts the names and barcodes of the client db with a key
+// derived from the passphrase, if they are not already, and decrypts them
+// as they are read from now on; it returns WRONG_KEY if the db was
+// encrypted with another passphrase
+func (s *SQLiteStore) Unlock(passphrase []byte) error {
+	// the first binary to unlock the db chooses the salt
+	salt := make([]byte, SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	if _, err := s.execute(ADD_SETTING_ONCE, ENCRYPTION_SALT, base64.StdEncoding.EncodeToString(salt)); err != nil {
+		return err
+	}
+	encoded, err := s.GetSetting(ENCRYPTION_SALT)
+	if err != nil {
+		return err
+	}
+	if salt, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+		return err
+	}
+	c, err := NewCipher(passphrase, salt)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.execute(ADD_SETTING_ONCE, ENCRYPTION_CHECK, c.Encrypt(ENCRYPTION_CHECK_VALUE)); err != nil {
+		return err
+	}
+	check, err := s.GetSetting(ENCRYPTION_CHECK)
+	if err != nil {
+		return err
+	}
+	if value, err := c.Decrypt(check); err != nil || value != ENCRYPTION_CHECK_VALUE {
+		return WRONG_KEY
+	}
+
+	// encrypt whatever is still plain: everything, the first time
+	var n int
+	err = s.transaction(func(tx *sql.Tx) error {
+		var err error
+		n, err = recrypt(tx, c.encryptName, c.encryptKey)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.cipher = c
+	if n > 0 {
+		err = s.compact()
+	}
+	return err
+}
+
+// compact rewrites the db file, and empties its write-ahead log, so no
+// plain value is left behind in the free pages, or in the log
+func (s *SQLiteStore) compact() error {
+	if _, err := s.execute(VACUUM); err != nil {
+		return err
+	}
+	_, err := s.execute(CHECKPOINT)
+	return err
+}
+
+// IsEncryptedStore reports whether the names and barcodes of the store
+// are encrypted
+func IsEncryptedStore(s Store) (bool, error) {
+	_, err := s.GetSetting(ENCRYPTION_SALT)
+	if err == NOT_FOUND {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetStuidCards returns the valid cards of the students on the roster
+// whose barcode is their stuid (their first card, made before the db was
+// encrypted): encrypting the barcode hides nothing, since the stuid is
+// not, so they should be replaced with new cards
+func GetStuidCards(s Store) ([]*Card, error) {
+	students, err := s.GetStudents()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*Card, 0)
+	for _, student := range students {
+		cards, err := s.GetCards(student.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cards {
+			if c.Barcode == student.Id && c.Revoked == 0 {
+				results = append(results, c)
+			}
+		}
+	}
+	return results, nil
+}
+
+// RemoveEncryption decrypts the names and barcodes of the (unlocked)
+// client db for good, returning how many values it decrypted
+func (s *SQLiteStore) RemoveEncryption() (int, error) {
+	if s.cipher == nil {
+		return 0, NOT_ENCRYPTED
+	}
+	var n int
+	err := s.transaction(func(tx *sql.Tx) error {
+		var err error
+		if n, err = recrypt(tx, s.cipher.Decrypt, s.cipher.Decrypt); err != nil {
+			return err
+		}
+		_, err = tx.Exec(DELETE_ENCRYPTION, ENCRYPTION_SALT, ENCRYPTION_CHECK)
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+	s.cipher = nil
+	return n, nil
+}
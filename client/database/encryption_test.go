@@ -0,0 +1,136 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readable returns the first of the values found in the db file, or its
+// write-ahead log
+func readable(t *testing.T, dir string, values ...string) string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.sqlite*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range values {
+			if bytes.Contains(raw, []byte(value)) {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+func TestEncryption(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	coords := ConnCoordinates{DBPath: dir, DBFile: "test.sqlite", DBTablesPath: wd}
+	s, err := OpenStore(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addStudents(t, s, map[string]string{"001": "张三丰", "002": "Alice Wonder"})
+	if err := s.IssueCard(&Card{Barcode: "CARD-XYZ", StudentId: "002", Issued: 1}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddUnknownScan(&UnknownScan{Barcode: "LOST-999", Posted: 5, Device: "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CloseTerm(&Term{Name: "T1", Closed: time.Now().Unix()}, true); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// encrypting it leaves nothing readable, even in the write-ahead log
+	coords.Passphrase = []byte("secret")
+	s, err = OpenStore(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if found := readable(t, dir, "Alice", "张三丰", "CARD-XYZ", "LOST-999"); found != "" {
+		t.Fatalf("found %s in the encrypted db", found)
+	}
+	if encrypted, err := IsEncryptedStore(s); err != nil || !encrypted {
+		t.Fatalf("got %v %v", encrypted, err)
+	}
+
+	if st, err := FindStudentByCard(s, "CARD-XYZ"); err != nil || st.Name != "Alice Wonder" {
+		t.Fatalf("got %v %v", st, err)
+	}
+	if found, err := SearchStudents(s, "zsf", 10); err != nil || len(found) != 1 || found[0].Id != "001" {
+		t.Fatalf("got %v %v", found, err)
+	}
+	if unknown, err := s.GetUnknownScans(); err != nil || len(unknown) != 1 || unknown[0].Barcode != "LOST-999" {
+		t.Fatalf("got %v %v", unknown, err)
+	}
+
+	// the cards made from the stuids before still work, but are reported
+	if st, err := FindStudentByCard(s, "001"); err != nil || st.Id != "001" {
+		t.Fatalf("got %v %v", st, err)
+	}
+	cards, err := GetStuidCards(s)
+	if err != nil || len(cards) != 2 {
+		t.Fatalf("got %v %v", cards, err)
+	}
+
+	// and no more are made: neither cards from stuids, nor stuids from cards
+	addStudents(t, s, map[string]string{"003": "王五"})
+	if _, err := FindStudentByCard(s, "003"); err != NOT_FOUND {
+		t.Fatalf("got %v, want NOT_FOUND", err)
+	}
+	if err := s.IssueCard(&Card{Barcode: "003", StudentId: "003"}, false); err != STUID_IS_BARCODE {
+		t.Fatalf("got %v, want STUID_IS_BARCODE", err)
+	}
+	if _, err := CreateFromUnknownBarcode(s, "LOST-999", "", "李四"); err != STUID_IS_BARCODE {
+		t.Fatalf("got %v, want STUID_IS_BARCODE", err)
+	}
+	if _, err := CreateFromUnknownBarcode(s, "LOST-999", "004", "李四"); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := FindStudentByCard(s, "LOST-999"); err != nil || st.Id != "004" {
+		t.Fatalf("got %v %v", st, err)
+	}
+	if cards, err := s.GetCards("004"); err != nil || len(cards) != 1 {
+		t.Fatalf("got %v %v", cards, err)
+	}
+	s.Close()
+
+	coords.Passphrase = nil
+	if _, err := OpenStore(coords); err != ENCRYPTED_DB {
+		t.Fatalf("got %v, want ENCRYPTED_DB", err)
+	}
+	coords.Passphrase = []byte("wrong")
+	if _, err := OpenStore(coords); err != WRONG_KEY {
+		t.Fatalf("got %v, want WRONG_KEY", err)
+	}
+
+	coords.Passphrase = []byte("secret")
+	if s, err = OpenStore(coords); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.RemoveEncryption(); err != nil || n == 0 {
+		t.Fatal(n, err)
+	}
+	if found, err := s.MatchStudents("alice", 10); err != nil || len(found) != 1 {
+		t.Fatalf("got %v %v", found, err)
+	}
+	if st, err := FindStudentByCard(s, "CARD-XYZ"); err != nil || st.Id != "002" {
+		t.Fatalf("got %v %v", st, err)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"time"
+)
+
+const (
+	// The kinds of live events
+	LIVE_SCAN       = "scan"
+	LIVE_SUBMISSION = "submission"
+	LIVE_SCANNER    = "scanner"
+
+	// The changes to a submission (logged by the live_submission triggers)
+	LIVE_SUBMITTED   = "submitted"
+	LIVE_UNSUBMITTED = "unsubmitted"
+	LIVE_GRADED      = "graded"
+
+	// The outcomes of a scan
+	SCAN_SUBMITTED         = "submitted"
+	SCAN_ALREADY_SUBMITTED = "already submitted"
+	SCAN_CHECKED_IN        = "checked in"
+	SCAN_CHECKED_OUT       = "checked out"
+	SCAN_UNKNOWN           = "unknown card"
+	SCAN_REVOKED           = "revoked card"
+	SCAN_TRASHED           = "student in the trash"
+	SCAN_ARCHIVED          = "student archived"
+	SCAN_FAILED            = "failed"
+
+	// The scanner status
+	SCANNER_CONNECTED    = "connected"
+	SCANNER_DISCONNECTED = "disconnected"
+
+	// How many events the WebApp reads at a time, and how long they are
+	// kept: they only matter to the pages open when they happen
+	LIVE_BATCH     = 100
+	LIVE_RETENTION = 24 * time.Hour
+)
+
+// RecordScan adds the live event of the outcome of a scan by the
+// student (if known), against the assignment (if any)
+func RecordScan(s Store, outcome, stuid string, assignmentId int64, detail string, now time.Time) error {
+	_, err := s.AddLiveEvent(&LiveEvent{Kind: LIVE_SCAN, Outcome: outcome, StudentId: stuid, Assignment: assignmentId, Detail: detail, Created: now.Unix()})
+	return err
+}
+
+// RecordScannerStatus adds the live event of the scanner device being
+// connected or disconnected
+func RecordScannerStatus(s Store, status, device string, now time.Time) error {
+	_, err := s.AddLiveEvent(&LiveEvent{Kind: LIVE_SCANNER, Outcome: status, Detail: device, Created: now.Unix()})
+	return err
+}
+
+// HasSubmitted reports whether the student has submitted the assignment
+// (and it is not in the trash)
+func HasSubmitted(s Store, stuid string, assignmentId int64) (bool, error) {
+	submissions, err := s.GetSubmissions(assignmentId)
+	if err != nil {
+		return false, err
+	}
+	for _, sub := range submissions {
+		if sub.StudentId == stuid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,205 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	// Gradebook cell values
+	GRADEBOOK_SUBMITTED   = "已交"
+	GRADEBOOK_MISSING     = "未交"
+	GRADEBOOK_LATE        = "迟交"
+	GRADEBOOK_TIME_FORMAT = "2006-01-02 15:04"
+	GRADEBOOK_SHEET       = "Gradebook"
+)
+
+var (
+	// The fixed leading columns, and the ones repeated for each assignment
+	GRADEBOOK_STUDENT_COLUMNS    = []string{"学号", "姓名"}
+	GRADEBOOK_ASSIGNMENT_COLUMNS = []string{"状态", "提交时间", "迟交", "成绩", "评语"}
+)
+
+// GradebookCell is the submission of one student for one assignment
+type GradebookCell struct {
+	Submitted bool
+	Posted    int64
+	Late      bool
+	Grade     string
+	Comment   string
+}
+
+// Gradebook is the students x assignments submission matrix; the
+// assignments are in the order they were posted (oldest first), so new
+// ones are always added as columns on the right
+type Gradebook struct {
+	Students    []*Student
+	Assignments []*Assignment
+	Cells       [][]*GradebookCell // [student][assignment]
+}
+
+// GetGradebook builds the Gradebook for all the students and either the
+// given assignments, or all of them (in the active term) if none are given
+func GetGradebook(s Store, assignmentIds ...int64) (*Gradebook, error) {
+	students, err := s.GetStudents()
+	if err != nil {
+		return nil, err
+	}
+
+	var assignments []*Assignment
+	if len(assignmentIds) == 0 {
+		assignments, err = s.GetAssignments(ACTIVE_TERM)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, id := range assignmentIds {
+			a, err := s.GetAssignment(id)
+			if err != nil {
+				return nil, err
+			}
+			assignments = append(assignments, a)
+		}
+	}
+	return buildGradebook(s, students, assignments)
+}
+
+// GetTermGradebook builds the Gradebook of a closed term, for its roster
+// and assignments as they were archived
+func GetTermGradebook(s Store, termId int64) (*Gradebook, error) {
+	if _, err := s.GetTerm(termId); err != nil {
+		return nil, err
+	}
+	students, err := s.GetTermRoster(termId)
+	if err != nil {
+		return nil, err
+	}
+	assignments, err := s.GetAssignments(termId)
+	if err != nil {
+		return nil, err
+	}
+	return buildGradebook(s, students, assignments)
+}
+
+// buildGradebook fills in the submissions of the students for the
+// assignments
+func buildGradebook(s Store, students []*Student, assignments []*Assignment) (*Gradebook, error) {
+	g := &Gradebook{Students: students, Assignments: assignments}
+	sort.SliceStable(g.Assignments, func(i, j int) bool {
+		if g.Assignments[i].Posted == g.Assignments[j].Posted {
+			return g.Assignments[i].Id < g.Assignments[j].Id
+		}
+		return g.Assignments[i].Posted < g.Assignments[j].Posted
+	})
+
+	index := make(map[string]int)
+	g.Cells = make([][]*GradebookCell, len(g.Students))
+	for i, student := range g.Students {
+		index[student.Id] = i
+		g.Cells[i] = make([]*GradebookCell, len(g.Assignments))
+		for j := range g.Assignments {
+			g.Cells[i][j] = new(GradebookCell)
+		}
+	}
+
+	for j, a := range g.Assignments {
+		submissions, err := s.GetSubmissions(a.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, sub := range submissions {
+			if i, ok := index[sub.StudentId]; ok {
+				cell := g.Cells[i][j]
+				cell.Submitted = true
+				cell.Posted = sub.Posted
+				cell.Late = a.Due > 0 && sub.Posted > a.Due
+				cell.Grade = sub.Grade
+				cell.Comment = sub.Comment
+			}
+		}
+	}
+
+	return g, nil
+}
+
+// Rows returns the Gradebook as a header row followed by one row per
+// student: the stuid and name, then the status, submission time, late
+// flag, grade (a number, if in points) and comment for each assignment
+func (g *Gradebook) Rows() [][]interface{} {
+	header := make([]interface{}, 0)
+	for _, label := range GRADEBOOK_STUDENT_COLUMNS {
+		header = append(header, label)
+	}
+	for _, a := range g.Assignments {
+		for _, label := range GRADEBOOK_ASSIGNMENT_COLUMNS {
+			header = append(header, a.Title+" "+label)
+		}
+	}
+
+	rows := [][]interface{}{header}
+	for i, student := range g.Students {
+		row := []interface{}{student.Id, student.Name}
+		for j, cell := range g.Cells[i] {
+			status, posted, late := GRADEBOOK_MISSING, "", ""
+			var grade interface{}
+			if cell.Submitted {
+				status = GRADEBOOK_SUBMITTED
+				posted = time.Unix(cell.Posted, 0).Format(GRADEBOOK_TIME_FORMAT)
+				if cell.Late {
+					late = GRADEBOOK_LATE
+				}
+				if cell.Grade != "" {
+					grade = cell.Grade
+					sub := &Submission{Grade: cell.Grade}
+					if points, ok := sub.Points(); ok && g.Assignments[j].Scale == "" {
+						grade = points
+					}
+				}
+			}
+			row = append(row, status, posted, late, grade, cell.Comment)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// WriteCSV writes the Gradebook as UTF-8 CSV (see WriteCSV)
+func (g *Gradebook) WriteCSV(w io.Writer) error {
+	return WriteCSV(w, g.Rows())
+}
+
+// WriteXLSX writes the Gradebook as a native Excel workbook
+func (g *Gradebook) WriteXLSX(w io.Writer) error {
+	return WriteXLSX(w, GRADEBOOK_SHEET, g.Rows())
+}
+
+// WriteCSV writes the rows as UTF-8 CSV, with the byte order mark Excel
+// needs to recognize the encoding
+func WriteCSV(w io.Writer, rows [][]interface{}) error {
+	if _, err := io.WriteString(w, "\xef\xbb\xbf"); err != nil {
+		return err
+	}
+
+	c := csv.NewWriter(w)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			if value != nil {
+				record[i] = fmt.Sprint(value)
+			}
+		}
+		if err := c.Write(record); err != nil {
+			return err
+		}
+	}
+	c.Flush()
+	return c.Error()
+}
@@ -0,0 +1,245 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The letter scale suggested for new assignments
+	LETTER_SCALE = "A,B,C,D,F"
+
+	// Points are grouped into bands of this percentage of the maximum (or
+	// of this many points, if there is none), for the distribution
+	GRADE_BAND = 10
+)
+
+var (
+	INVALID_GRADE = errors.New("That grade is not on the scale of the assignment")
+)
+
+// Letters returns the letter grades of the scale, best first, or nil if
+// the Assignment is graded in points
+func (a *Assignment) Letters() []string {
+	if a.Scale == "" {
+		return nil
+	}
+	letters := make([]string, 0)
+	for _, letter := range strings.Split(a.Scale, ",") {
+		if letter = strings.TrimSpace(letter); letter != "" {
+			letters = append(letters, letter)
+		}
+	}
+	return letters
+}
+
+// letterRank returns the position of the grade on the letter scale (0
+// for the best), or -1 if it is not on it
+func (a *Assignment) letterRank(grade string) int {
+	for i, letter := range a.Letters() {
+		if strings.EqualFold(letter, grade) {
+			return i
+		}
+	}
+	return -1
+}
+
+// NormalizeScale cleans up a letter scale as entered, e.g. 'a, b ,c'
+// becomes 'A,B,C'
+func NormalizeScale(scale string) string {
+	a := &Assignment{Scale: strings.ToUpper(scale)}
+	return strings.Join(a.Letters(), ",")
+}
+
+// NormalizeGrade checks the grade as entered against the scale of the
+// Assignment, and returns it as stored: points as a plain number, or the
+// letter as written in the scale; an empty grade (ungraded) is always valid
+func NormalizeGrade(a *Assignment, grade string) (string, error) {
+	grade = strings.TrimSpace(grade)
+	if grade == "" {
+		return "", nil
+	}
+	if letters := a.Letters(); letters != nil {
+		rank := a.letterRank(grade)
+		if rank < 0 {
+			return "", INVALID_GRADE
+		}
+		return letters[rank], nil
+	}
+
+	points, err := strconv.ParseFloat(grade, 64)
+	if err != nil || points < 0 || math.IsNaN(points) || math.IsInf(points, 0) || (a.MaxPoints > 0 && points > a.MaxPoints) {
+		return "", INVALID_GRADE
+	}
+	return strconv.FormatFloat(points, 'f', -1, 64), nil
+}
+
+// Points returns the grade of the Submission as a number, if it was graded
+// in points
+func (s *Submission) Points() (float64, bool) {
+	if s.Grade == "" {
+		return 0, false
+	}
+	points, err := strconv.ParseFloat(s.Grade, 64)
+	return points, err == nil
+}
+
+// GradeSubmission saves the grade (checked against the scale of the
+// assignment) and comment of the submission; an assignment of a closed
+// term cannot be graded
+func GradeSubmission(s Store, stuid string, assignmentId int64, grade, comment string) error {
+	a, err := s.GetAssignment(assignmentId)
+	if err != nil {
+		return err
+	}
+	if a.Term != ACTIVE_TERM {
+		return ARCHIVED
+	}
+	grade, err = NormalizeGrade(a, grade)
+	if err != nil {
+		return err
+	}
+	return s.GradeSubmission(&Submission{StudentId: stuid, AssignmentId: assignmentId, Grade: grade, Comment: strings.TrimSpace(comment)})
+}
+
+// GradeBucket is one bar of the grade distribution: a letter, or a band
+// of points
+type GradeBucket struct {
+	Label string
+	Count int
+}
+
+// GradeStats summarizes the grades of an Assignment
+type GradeStats struct {
+	Submitted int
+	Graded    int
+	// for points
+	Mean   float64
+	Median float64
+	// for letters, the grade of the mean and the median rank
+	MeanGrade    string
+	MedianGrade  string
+	Distribution []*GradeBucket // best first
+}
+
+// MeanPercent returns the mean as a percentage of the maximum points, if
+// there is one
+func (g *GradeStats) MeanPercent(a *Assignment) string {
+	if a.MaxPoints <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.0f%%", 100*g.Mean/a.MaxPoints)
+}
+
+// median returns the middle value of the sorted values (or the mean of
+// the two middle ones)
+func median(values []float64) float64 {
+	n := len(values)
+	if n == 0 {
+		return 0
+	}
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// GetGradeStats returns the summary statistics of the grades of the
+// Assignment
+func GetGradeStats(s Store, assignmentId int64) (*GradeStats, error) {
+	a, err := s.GetAssignment(assignmentId)
+	if err != nil {
+		return nil, err
+	}
+	submissions, err := s.GetSubmissions(assignmentId)
+	if err != nil {
+		return nil, err
+	}
+	return computeGradeStats(a, submissions), nil
+}
+
+// computeGradeStats summarizes the grades of the submissions of a
+func computeGradeStats(a *Assignment, submissions []*Submission) *GradeStats {
+	stats := &GradeStats{Submitted: len(submissions), Distribution: make([]*GradeBucket, 0)}
+
+	if letters := a.Letters(); letters != nil {
+		counts := make([]int, len(letters))
+		ranks := make([]float64, 0)
+		for _, sub := range submissions {
+			if rank := a.letterRank(sub.Grade); rank >= 0 {
+				counts[rank]++
+				ranks = append(ranks, float64(rank))
+			}
+		}
+		for i, letter := range letters {
+			stats.Distribution = append(stats.Distribution, &GradeBucket{Label: letter, Count: counts[i]})
+		}
+		stats.Graded = len(ranks)
+		if stats.Graded > 0 {
+			sort.Float64s(ranks)
+			total := 0.0
+			for _, rank := range ranks {
+				total += rank
+			}
+			stats.MeanGrade = letters[int(math.Round(total/float64(len(ranks))))]
+			stats.MedianGrade = letters[int(math.Round(median(ranks)))]
+		}
+		return stats
+	}
+
+	points := make([]float64, 0)
+	for _, sub := range submissions {
+		if p, ok := sub.Points(); ok {
+			points = append(points, p)
+		}
+	}
+	stats.Graded = len(points)
+	if stats.Graded == 0 {
+		return stats
+	}
+	sort.Float64s(points)
+	total := 0.0
+	for _, p := range points {
+		total += p
+	}
+	stats.Mean = total / float64(len(points))
+	stats.Median = median(points)
+
+	// bands of GRADE_BAND percent of the maximum, or of GRADE_BAND points,
+	// from the best one down to the lowest one with any grades
+	band := func(p float64) int {
+		if a.MaxPoints > 0 {
+			p = 100 * p / a.MaxPoints
+		}
+		b := int(p) / GRADE_BAND
+		if a.MaxPoints > 0 && b > 100/GRADE_BAND-1 {
+			b = 100/GRADE_BAND - 1 // full marks are in the top band
+		}
+		return b
+	}
+	counts := make(map[int]int)
+	for _, p := range points {
+		counts[band(p)]++
+	}
+	for b := band(points[len(points)-1]); b >= band(points[0]); b-- {
+		low, high := b*GRADE_BAND, (b+1)*GRADE_BAND-1
+		label := fmt.Sprintf("%d-%d", low, high)
+		if a.MaxPoints > 0 {
+			if b == 100/GRADE_BAND-1 {
+				high = 100
+			}
+			label = fmt.Sprintf("%d-%d%%", low, high)
+		}
+		stats.Distribution = append(stats.Distribution, &GradeBucket{Label: label, Count: counts[b]})
+	}
+	return stats
+}
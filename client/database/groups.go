@@ -0,0 +1,87 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	INVALID_GROUP = errors.New("A group needs a name")
+)
+
+// activeAssignment returns the Assignment, or ARCHIVED if it belongs to
+// a closed term, whose groups are kept as they were
+func activeAssignment(s Store, assignmentId int64) (*Assignment, error) {
+	a, err := s.GetAssignment(assignmentId)
+	if err != nil {
+		return nil, err
+	}
+	if a.Term != ACTIVE_TERM {
+		return nil, ARCHIVED
+	}
+	return a, nil
+}
+
+// activeGroup returns the Group, or ARCHIVED if its assignment belongs
+// to a closed term
+func activeGroup(s Store, groupId int64) (*Group, error) {
+	g, err := s.GetGroup(groupId)
+	if err != nil {
+		return nil, err
+	}
+	_, err = activeAssignment(s, g.AssignmentId)
+	return g, err
+}
+
+// AddGroup adds the named group of students (who must be on the roster)
+// to an assignment of the active term
+func AddGroup(s Store, assignmentId int64, name string, members []string) (int64, error) {
+	g := &Group{AssignmentId: assignmentId, Name: strings.TrimSpace(name), Members: members}
+	if g.Name == "" {
+		return BAD_PK, INVALID_GROUP
+	}
+	if _, err := activeAssignment(s, assignmentId); err != nil {
+		return BAD_PK, err
+	}
+	for _, stuid := range members {
+		if _, err := s.GetStudent(stuid); err != nil {
+			return BAD_PK, err
+		}
+	}
+	return s.AddGroup(g)
+}
+
+// AddGroupMember adds the student (who must be on the roster) to the
+// group, unless it is for an assignment of a closed term
+func AddGroupMember(s Store, groupId int64, stuid string) error {
+	if _, err := activeGroup(s, groupId); err != nil {
+		return err
+	}
+	if _, err := s.GetStudent(stuid); err != nil {
+		return err
+	}
+	return s.AddGroupMember(groupId, stuid)
+}
+
+// RemoveGroupMember takes the student out of the group, unless it is for
+// an assignment of a closed term; their submission, if any, is kept
+func RemoveGroupMember(s Store, groupId int64, stuid string) error {
+	if _, err := activeGroup(s, groupId); err != nil {
+		return err
+	}
+	return s.RemoveGroupMember(groupId, stuid)
+}
+
+// DeleteGroup deletes the group, unless it is for an assignment of a
+// closed term; the submissions of its members are kept
+func DeleteGroup(s Store, groupId int64) error {
+	if _, err := activeGroup(s, groupId); err != nil {
+		return err
+	}
+	return s.DeleteGroup(groupId)
+}
@@ -0,0 +1,1608 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-memory Store, for tests and for running the
+// WebApp without a sqlite db file
+type MemoryStore struct {
+	mu          sync.Mutex
+	students    map[string]*Student
+	cards       map[string]*Card
+	assignments map[int64]*Assignment
+	submissions map[int64]map[string]*Submission
+	settings    map[string]string
+	unknown     []*UnknownScan
+	terms       map[int64]*Term
+	termRosters map[int64]map[string]string // stuid: name, as of the close
+	periods     map[int64]*Period
+	attendance  map[attendanceKey]*Attendance
+	groups      map[int64]*Group           // without their Members
+	members     map[int64]map[string]int64 // assignment: stuid: group
+	outbox      []*OutboxMessage           // in the order queued
+	teachers    map[int64]*Teacher
+	apiTokens   map[int64]*APIToken
+	classRoles  map[int64]map[int64]string // teacher: term: role
+	liveEvents  []*LiveEvent               // in the order added
+	lastId      int64
+	lastScanId  int64
+	lastTermId  int64
+	lastPeriod  int64
+	lastGroup   int64
+	lastAnon    int64
+	lastMessage int64
+	lastTeacher int64
+	lastToken   int64
+	lastEvent   int64
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// attendanceKey mirrors the primary key of the sqlite attendance table
+type attendanceKey struct {
+	stuid  string
+	day    string
+	period int64
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		students:    make(map[string]*Student),
+		cards:       make(map[string]*Card),
+		assignments: make(map[int64]*Assignment),
+		submissions: make(map[int64]map[string]*Submission),
+		settings:    make(map[string]string),
+		terms:       make(map[int64]*Term),
+		termRosters: make(map[int64]map[string]string),
+		periods:     make(map[int64]*Period),
+		attendance:  make(map[attendanceKey]*Attendance),
+		groups:      make(map[int64]*Group),
+		members:     make(map[int64]map[string]int64),
+		teachers:    make(map[int64]*Teacher),
+		apiTokens:   make(map[int64]*APIToken),
+		classRoles:  make(map[int64]map[int64]string)}
+}
+
+// onRoster reports whether the Student is on the active roster, i.e.,
+// neither in the trash nor left in a closed term
+func onRoster(s *Student) bool {
+	return s.Deleted == 0 && s.Term == ACTIVE_TERM
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+/* Students */
+
+func (m *MemoryStore) GetStudents() ([]*Student, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*Student, 0, len(m.students))
+	for _, s := range m.students {
+		if onRoster(s) {
+			c := *s
+			results = append(results, &c)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Name == results[j].Name {
+			return results[i].Id < results[j].Id
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) GetStudent(stuid string) (*Student, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.students[stuid]
+	if !ok || !onRoster(s) {
+		return nil, NOT_FOUND
+	}
+	c := *s
+	return &c, nil
+}
+
+func (m *MemoryStore) AddStudent(s *Student) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.canAddStudent(s); err != nil {
+		return err
+	}
+	m.addStudent(s)
+	return nil
+}
+
+// canAddStudent checks the stuid of the new Student is not in use (unless
+// it is in the trash, or a closed term), nor the barcode of their first
+// card; the caller must hold the lock
+func (m *MemoryStore) canAddStudent(s *Student) error {
+	if existing, exists := m.students[s.Id]; exists {
+		if onRoster(existing) {
+			return DUPLICATE_STUDENT
+		}
+		return nil
+	}
+	if _, exists := m.cards[s.Id]; exists {
+		return DUPLICATE_CARD
+	}
+	return nil
+}
+
+// addStudent saves the new Student, and issues their first card, as the
+// sqlite student_first_card trigger does, or returns the one with that
+// stuid to the roster; the caller must hold the lock
+func (m *MemoryStore) addStudent(s *Student) {
+	if existing, exists := m.students[s.Id]; exists {
+		existing.Name = s.Name
+		existing.Deleted = 0
+		existing.Term = ACTIVE_TERM
+		return
+	}
+	c := *s
+	c.Deleted = 0
+	c.Term = ACTIVE_TERM
+	m.students[s.Id] = &c
+	m.cards[s.Id] = &Card{Barcode: s.Id, StudentId: s.Id, Issued: time.Now().Unix()}
+}
+
+func (m *MemoryStore) UpdateStudent(originalId string, s *Student) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if original, ok := m.students[originalId]; !ok || !onRoster(original) {
+		return NOT_FOUND
+	}
+	if _, exists := m.students[s.Id]; exists && s.Id != originalId {
+		return DUPLICATE_STUDENT
+	}
+	m.replaceStudent(originalId, s)
+	return nil
+}
+
+// replaceStudent saves the Student in place of the one with originalId,
+// cascading any id change to the cards and submissions, as sqlite does;
+// the caller must hold the lock
+func (m *MemoryStore) replaceStudent(originalId string, s *Student) {
+	delete(m.students, originalId)
+	c := *s
+	m.students[s.Id] = &c
+
+	if originalId == s.Id {
+		return
+	}
+	for _, card := range m.cards {
+		if card.StudentId == originalId {
+			card.StudentId = s.Id
+		}
+	}
+	for _, subs := range m.submissions {
+		if sub, ok := subs[originalId]; ok {
+			delete(subs, originalId)
+			sub.StudentId = s.Id
+			subs[s.Id] = sub
+		}
+		for _, sub := range subs {
+			if sub.ScannedBy == originalId {
+				sub.ScannedBy = s.Id
+			}
+		}
+	}
+	for _, members := range m.members {
+		if group, ok := members[originalId]; ok {
+			delete(members, originalId)
+			members[s.Id] = group
+		}
+	}
+	for _, roster := range m.termRosters {
+		if name, ok := roster[originalId]; ok {
+			delete(roster, originalId)
+			roster[s.Id] = name
+		}
+	}
+	for key, a := range m.attendance {
+		if key.stuid == originalId {
+			delete(m.attendance, key)
+			a.StudentId = s.Id
+			m.attendance[attendanceKey{s.Id, key.day, key.period}] = a
+		}
+	}
+}
+
+func (m *MemoryStore) DeleteStudent(stuid string, when time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.students[stuid]
+	if !ok || !onRoster(s) {
+		return NOT_FOUND
+	}
+	s.Deleted = when.Unix()
+	return nil
+}
+
+// purgeStudent removes the Student for good, cascading to their cards,
+// submissions and attendance, as sqlite does; the caller must hold the lock
+func (m *MemoryStore) purgeStudent(stuid string) {
+	delete(m.students, stuid)
+	for barcode, card := range m.cards {
+		if card.StudentId == stuid {
+			delete(m.cards, barcode)
+		}
+	}
+	for _, subs := range m.submissions {
+		delete(subs, stuid)
+		for _, sub := range subs {
+			if sub.ScannedBy == stuid {
+				sub.ScannedBy = "" // as with 'on delete set null'
+			}
+		}
+	}
+	for _, roster := range m.termRosters {
+		delete(roster, stuid)
+	}
+	for _, members := range m.members {
+		delete(members, stuid)
+	}
+	for key := range m.attendance {
+		if key.stuid == stuid {
+			delete(m.attendance, key)
+		}
+	}
+}
+
+func (m *MemoryStore) MatchStudents(query string, limit int) ([]*Student, error) {
+	students, err := m.GetStudents()
+	if err != nil {
+		return nil, err
+	}
+	return matchStudents(students, query, limit), nil
+}
+
+func (m *MemoryStore) ImportStudents(add, update []*Student) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// check everything first, so nothing is applied on failure
+	adding := make(map[string]bool)
+	for _, s := range add {
+		if adding[s.Id] {
+			return DUPLICATE_STUDENT
+		}
+		if err := m.canAddStudent(s); err != nil {
+			return err
+		}
+		adding[s.Id] = true
+	}
+	for _, s := range update {
+		if existing, ok := m.students[s.Id]; !ok || !onRoster(existing) {
+			return NOT_FOUND
+		}
+	}
+
+	for _, s := range add {
+		m.addStudent(s)
+	}
+	for _, s := range update {
+		m.students[s.Id].Name = s.Name
+	}
+	return nil
+}
+
+/* Cards */
+
+func (m *MemoryStore) GetCards(stuid string) ([]*Card, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*Card, 0)
+	for _, card := range m.cards {
+		if card.StudentId == stuid {
+			c := *card
+			results = append(results, &c)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Issued == results[j].Issued {
+			return results[i].Barcode < results[j].Barcode
+		}
+		return results[i].Issued < results[j].Issued
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) GetCard(barcode string) (*Card, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	card, ok := m.cards[barcode]
+	if !ok {
+		return nil, NOT_FOUND
+	}
+	c := *card
+	return &c, nil
+}
+
+func (m *MemoryStore) IssueCard(card *Card, replace bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.students[card.StudentId]; !ok {
+		return NOT_FOUND
+	}
+	if _, exists := m.cards[card.Barcode]; exists {
+		return DUPLICATE_CARD
+	}
+	if replace {
+		for _, other := range m.cards {
+			if other.StudentId == card.StudentId && other.Revoked == 0 {
+				other.Revoked = card.Issued
+			}
+		}
+	}
+	c := *card
+	m.cards[card.Barcode] = &c
+	return nil
+}
+
+func (m *MemoryStore) RevokeCard(barcode string, when time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	card, ok := m.cards[barcode]
+	if !ok || card.Revoked != 0 {
+		return NOT_FOUND
+	}
+	card.Revoked = when.Unix()
+	return nil
+}
+
+/* Assignments */
+
+func (m *MemoryStore) GetAssignments(termId int64) ([]*Assignment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*Assignment, 0, len(m.assignments))
+	for _, a := range m.assignments {
+		if a.Term == termId {
+			c := *a
+			results = append(results, &c)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Posted == results[j].Posted {
+			return results[i].Id > results[j].Id
+		}
+		return results[i].Posted > results[j].Posted
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) GetAssignment(id int64) (*Assignment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.assignments[id]
+	if !ok {
+		return nil, NOT_FOUND
+	}
+	c := *a
+	return &c, nil
+}
+
+func (m *MemoryStore) AddAssignment(a *Assignment) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastId++
+	c := *a
+	c.Id = m.lastId
+	c.Term = ACTIVE_TERM
+	m.assignments[c.Id] = &c
+	return c.Id, nil
+}
+
+func (m *MemoryStore) UpdateAssignment(a *Assignment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.assignments[a.Id]
+	if !ok || existing.Term != ACTIVE_TERM {
+		return NOT_FOUND
+	}
+	existing.Title = a.Title
+	existing.Due = a.Due
+	existing.Scale = a.Scale
+	existing.MaxPoints = a.MaxPoints
+	return nil
+}
+
+func (m *MemoryStore) DeleteAssignment(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if a, ok := m.assignments[id]; !ok || a.Term != ACTIVE_TERM {
+		return NOT_FOUND
+	}
+	delete(m.assignments, id)
+	delete(m.submissions, id)
+	delete(m.members, id)
+	for groupId, g := range m.groups {
+		if g.AssignmentId == id {
+			delete(m.groups, groupId)
+		}
+	}
+	for _, u := range m.unknown {
+		if u.AssignmentId == id {
+			u.AssignmentId = 0 // as with 'on delete set null'
+		}
+	}
+	return nil
+}
+
+/* Terms */
+
+func (m *MemoryStore) GetTerms() ([]*Term, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*Term, 0, len(m.terms))
+	for _, t := range m.terms {
+		c := *t
+		results = append(results, &c)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Closed == results[j].Closed {
+			return results[i].Id > results[j].Id
+		}
+		return results[i].Closed > results[j].Closed
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) GetTerm(id int64) (*Term, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.terms[id]
+	if !ok {
+		return nil, NOT_FOUND
+	}
+	c := *t
+	return &c, nil
+}
+
+func (m *MemoryStore) GetTermRoster(termId int64) ([]*Student, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*Student, 0)
+	for stuid, name := range m.termRosters[termId] {
+		results = append(results, &Student{Id: stuid, Name: name})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Name == results[j].Name {
+			return results[i].Id < results[j].Id
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) CloseTerm(t *Term, carryRoster bool) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// the term started when the last one closed, or with its first assignment
+	var started int64
+	for _, closed := range m.terms {
+		if closed.Closed > started {
+			started = closed.Closed
+		}
+	}
+	if started == 0 {
+		for _, a := range m.assignments {
+			if a.Term == ACTIVE_TERM && (started == 0 || a.Posted < started) {
+				started = a.Posted
+			}
+		}
+	}
+
+	m.lastTermId++
+	c := *t
+	c.Id = m.lastTermId
+	c.Started = started
+	m.terms[c.Id] = &c
+
+	roster := make(map[string]string)
+	for _, s := range m.students {
+		if onRoster(s) {
+			roster[s.Id] = s.Name
+			if !carryRoster {
+				s.Term = c.Id
+			}
+		}
+	}
+	m.termRosters[c.Id] = roster
+	for _, a := range m.assignments {
+		if a.Term == ACTIVE_TERM {
+			a.Term = c.Id
+		}
+	}
+	for _, roles := range m.classRoles {
+		if role, ok := roles[ACTIVE_TERM]; ok {
+			delete(roles, ACTIVE_TERM)
+			roles[c.Id] = role
+		}
+	}
+	delete(m.settings, CURRENT_ASSIGNMENT)
+	return c.Id, nil
+}
+
+func (m *MemoryStore) DeleteTerm(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.terms[id]; !ok {
+		return NOT_FOUND
+	}
+	for assignmentId, a := range m.assignments {
+		if a.Term == id {
+			delete(m.assignments, assignmentId)
+			delete(m.submissions, assignmentId)
+			delete(m.members, assignmentId)
+			for groupId, g := range m.groups {
+				if g.AssignmentId == assignmentId {
+					delete(m.groups, groupId)
+				}
+			}
+			for _, u := range m.unknown {
+				if u.AssignmentId == assignmentId {
+					u.AssignmentId = 0 // as with 'on delete set null'
+				}
+			}
+		}
+	}
+	delete(m.terms, id)
+	delete(m.termRosters, id)
+	for _, roles := range m.classRoles {
+		delete(roles, id)
+	}
+
+	for stuid, s := range m.students {
+		if s.Term != id {
+			continue
+		}
+		s.Term = ACTIVE_TERM
+		for termId, roster := range m.termRosters {
+			if _, ok := roster[stuid]; ok && termId > s.Term {
+				s.Term = termId
+			}
+		}
+		if s.Term == ACTIVE_TERM {
+			m.purgeStudent(stuid)
+		}
+	}
+	return nil
+}
+
+/* Submissions */
+
+func (m *MemoryStore) GetSubmissions(assignmentId int64) ([]*Submission, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*Submission, 0)
+	for _, sub := range m.submissions[assignmentId] {
+		// as with the sqlite join, a student in the trash has none
+		if s, ok := m.students[sub.StudentId]; ok && s.Deleted == 0 && sub.Deleted == 0 {
+			c := *sub
+			results = append(results, &c)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Posted < results[j].Posted
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) Submit(stuid string, assignmentId int64, when time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// enforce the same references as the sqlite foreign keys
+	if _, ok := m.students[stuid]; !ok {
+		return NOT_FOUND
+	}
+	if _, ok := m.assignments[assignmentId]; !ok {
+		return NOT_FOUND
+	}
+	m.submit(stuid, assignmentId, when.Unix())
+	return nil
+}
+
+// submit records the Submission, unless there is one already (other
+// than in the trash); the caller must hold the lock
+func (m *MemoryStore) submit(stuid string, assignmentId int64, posted int64) {
+	subs, ok := m.submissions[assignmentId]
+	if !ok {
+		subs = make(map[string]*Submission)
+		m.submissions[assignmentId] = subs
+	}
+	if sub, exists := subs[stuid]; !exists || sub.Deleted != 0 {
+		// the first scan counts, as with the sqlite upsert
+		subs[stuid] = &Submission{StudentId: stuid, AssignmentId: assignmentId, Posted: posted}
+		m.logSubmission(LIVE_SUBMITTED, stuid, assignmentId)
+	}
+}
+
+// logSubmission adds the live event of a change to a submission, as the
+// sqlite live_submission triggers do; the caller must hold the lock
+func (m *MemoryStore) logSubmission(outcome, stuid string, assignmentId int64) {
+	m.addLiveEvent(&LiveEvent{Kind: LIVE_SUBMISSION, Outcome: outcome, StudentId: stuid, Assignment: assignmentId, Created: time.Now().Unix()})
+}
+
+/* Groups */
+
+// groupMembers returns the members of the group not in the trash, in
+// roster order; the caller must hold the lock
+func (m *MemoryStore) groupMembers(g *Group) []string {
+	students := make([]*Student, 0)
+	for stuid, groupId := range m.members[g.AssignmentId] {
+		if s := m.students[stuid]; groupId == g.Id && s.Deleted == 0 {
+			students = append(students, s)
+		}
+	}
+	sort.Slice(students, func(i, j int) bool {
+		if students[i].Name == students[j].Name {
+			return students[i].Id < students[j].Id
+		}
+		return students[i].Name < students[j].Name
+	})
+	results := make([]string, len(students))
+	for i, s := range students {
+		results[i] = s.Id
+	}
+	return results
+}
+
+func (m *MemoryStore) GetGroups(assignmentId int64) ([]*Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*Group, 0)
+	for _, g := range m.groups {
+		if g.AssignmentId == assignmentId {
+			c := *g
+			c.Members = m.groupMembers(g)
+			results = append(results, &c)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Name == results[j].Name {
+			return results[i].Id < results[j].Id
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) GetGroup(id int64) (*Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.groups[id]
+	if !ok {
+		return nil, NOT_FOUND
+	}
+	c := *g
+	c.Members = m.groupMembers(g)
+	return &c, nil
+}
+
+// canAddGroupMember enforces the student reference and that they are in
+// one group per assignment; the caller must hold the lock
+func (m *MemoryStore) canAddGroupMember(assignmentId int64, stuid string) error {
+	if _, ok := m.students[stuid]; !ok {
+		return NOT_FOUND
+	}
+	if _, grouped := m.members[assignmentId][stuid]; grouped {
+		return GROUPED
+	}
+	return nil
+}
+
+// addGroupMember adds the student to the group; the caller must hold the
+// lock
+func (m *MemoryStore) addGroupMember(g *Group, stuid string) {
+	members, ok := m.members[g.AssignmentId]
+	if !ok {
+		members = make(map[string]int64)
+		m.members[g.AssignmentId] = members
+	}
+	members[stuid] = g.Id
+}
+
+func (m *MemoryStore) AddGroup(g *Group) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.assignments[g.AssignmentId]; !ok {
+		return BAD_PK, NOT_FOUND
+	}
+	// check all the members first, for all or nothing
+	seen := make(map[string]bool)
+	for _, stuid := range g.Members {
+		if err := m.canAddGroupMember(g.AssignmentId, stuid); err != nil {
+			return BAD_PK, err
+		}
+		if seen[stuid] {
+			return BAD_PK, GROUPED
+		}
+		seen[stuid] = true
+	}
+
+	m.lastGroup++
+	c := &Group{Id: m.lastGroup, AssignmentId: g.AssignmentId, Name: g.Name}
+	m.groups[c.Id] = c
+	for _, stuid := range g.Members {
+		m.addGroupMember(c, stuid)
+	}
+	return c.Id, nil
+}
+
+func (m *MemoryStore) AddGroupMember(groupId int64, stuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.groups[groupId]
+	if !ok {
+		return NOT_FOUND
+	}
+	if err := m.canAddGroupMember(g.AssignmentId, stuid); err != nil {
+		return err
+	}
+	m.addGroupMember(g, stuid)
+	return nil
+}
+
+func (m *MemoryStore) RemoveGroupMember(groupId int64, stuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.groups[groupId]
+	if !ok || m.members[g.AssignmentId][stuid] != groupId {
+		return NOT_FOUND
+	}
+	delete(m.members[g.AssignmentId], stuid)
+	return nil
+}
+
+func (m *MemoryStore) DeleteGroup(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.groups[id]
+	if !ok {
+		return NOT_FOUND
+	}
+	delete(m.groups, id)
+	for stuid, groupId := range m.members[g.AssignmentId] {
+		if groupId == id {
+			delete(m.members[g.AssignmentId], stuid)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) SubmitGroup(stuid string, assignmentId int64, when time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.students[stuid]; !ok {
+		return 0, NOT_FOUND
+	}
+	if _, ok := m.assignments[assignmentId]; !ok {
+		return 0, NOT_FOUND
+	}
+	m.submit(stuid, assignmentId, when.Unix())
+
+	groupId, grouped := m.members[assignmentId][stuid]
+	if !grouped {
+		return 0, nil
+	}
+	n := 0
+	subs := m.submissions[assignmentId]
+	for teammate, id := range m.members[assignmentId] {
+		if id != groupId || teammate == stuid || !onRoster(m.students[teammate]) {
+			continue
+		}
+		// as with 'insert or ignore', a removed submission stays removed
+		if _, exists := subs[teammate]; !exists {
+			subs[teammate] = &Submission{StudentId: teammate, AssignmentId: assignmentId, Posted: when.Unix(), ScannedBy: stuid}
+			m.logSubmission(LIVE_SUBMITTED, teammate, assignmentId)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemoryStore) Unsubmit(stuid string, assignmentId int64, when time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sub, ok := m.submissions[assignmentId][stuid]; ok && sub.Deleted == 0 {
+		sub.Deleted = when.Unix()
+		m.logSubmission(LIVE_UNSUBMITTED, stuid, assignmentId)
+	}
+	return nil
+}
+
+func (m *MemoryStore) GradeSubmission(sub *Submission) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.submissions[sub.AssignmentId][sub.StudentId]
+	if !ok || existing.Deleted != 0 {
+		return NOT_FOUND
+	}
+	if existing.Grade != sub.Grade || existing.Comment != sub.Comment {
+		m.logSubmission(LIVE_GRADED, sub.StudentId, sub.AssignmentId)
+	}
+	existing.Grade = sub.Grade
+	existing.Comment = sub.Comment
+	return nil
+}
+
+/* Trash */
+
+func (m *MemoryStore) GetDeletedStudents() ([]*Student, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*Student, 0)
+	for _, s := range m.students {
+		if s.Deleted != 0 {
+			c := *s
+			results = append(results, &c)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Deleted != results[j].Deleted {
+			return results[i].Deleted > results[j].Deleted
+		}
+		if results[i].Name == results[j].Name {
+			return results[i].Id < results[j].Id
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) GetDeletedSubmissions() ([]*Submission, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*Submission, 0)
+	for _, subs := range m.submissions {
+		for _, sub := range subs {
+			if sub.Deleted != 0 {
+				c := *sub
+				results = append(results, &c)
+			}
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Deleted != results[j].Deleted {
+			return results[i].Deleted > results[j].Deleted
+		}
+		return results[i].Posted < results[j].Posted
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) RestoreStudent(stuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.students[stuid]
+	if !ok || s.Deleted == 0 {
+		return NOT_FOUND
+	}
+	s.Deleted = 0
+	return nil
+}
+
+func (m *MemoryStore) RestoreSubmission(stuid string, assignmentId int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, ok := m.submissions[assignmentId][stuid]
+	if !ok || sub.Deleted == 0 {
+		return NOT_FOUND
+	}
+	sub.Deleted = 0
+	m.logSubmission(LIVE_SUBMITTED, stuid, assignmentId)
+	return nil
+}
+
+func (m *MemoryStore) RestoreDeleted(when time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	restored := 0
+	for _, s := range m.students {
+		if s.Deleted != 0 && s.Deleted == when.Unix() {
+			s.Deleted = 0
+			restored++
+		}
+	}
+	return restored + m.restoreDeletedSubmissions(when), nil
+}
+
+func (m *MemoryStore) RestoreDeletedSubmissions(when time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.restoreDeletedSubmissions(when), nil
+}
+
+// restoreDeletedSubmissions restores the submissions deleted at the
+// given time; the caller must hold the lock
+func (m *MemoryStore) restoreDeletedSubmissions(when time.Time) int {
+	restored := 0
+	for _, subs := range m.submissions {
+		for _, sub := range subs {
+			if sub.Deleted != 0 && sub.Deleted == when.Unix() {
+				sub.Deleted = 0
+				m.logSubmission(LIVE_SUBMITTED, sub.StudentId, sub.AssignmentId)
+				restored++
+			}
+		}
+	}
+	return restored
+}
+
+func (m *MemoryStore) PurgeDeleted(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := 0
+	for _, subs := range m.submissions {
+		for stuid, sub := range subs {
+			if sub.Deleted != 0 && sub.Deleted < before.Unix() {
+				delete(subs, stuid)
+				purged++
+			}
+		}
+	}
+	for stuid, s := range m.students {
+		if s.Deleted != 0 && s.Deleted < before.Unix() {
+			m.purgeStudent(stuid)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+/* Retention */
+
+func (m *MemoryStore) GetFormerStudents() ([]*FormerStudent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*FormerStudent, 0)
+	for _, s := range m.students {
+		if onRoster(s) || s.Anonymized != 0 {
+			continue
+		}
+		var closed int64
+		if t, ok := m.terms[s.Term]; ok {
+			closed = t.Closed
+		}
+		c := *s
+		f := &FormerStudent{Student: &c, Left: formerLeft(s, closed)}
+		for _, card := range m.cards {
+			if card.StudentId == s.Id {
+				f.Cards++
+			}
+		}
+		results = append(results, f)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Student.Id < results[j].Student.Id
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) AnonymizeStudent(stuid string, when time.Time) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.students[stuid]
+	if !ok || s.Anonymized != 0 {
+		return "", NOT_FOUND
+	}
+	m.lastAnon++
+	anonymous := &Student{Id: fmt.Sprintf(ANONYMOUS_ID_FORMAT, m.lastAnon), Name: ANONYMOUS_NAME,
+		Deleted: s.Deleted, Term: s.Term, Anonymized: when.Unix()}
+	m.replaceStudent(stuid, anonymous)
+	for barcode, card := range m.cards {
+		if card.StudentId == anonymous.Id {
+			delete(m.cards, barcode)
+		}
+	}
+	for _, roster := range m.termRosters {
+		if _, ok := roster[anonymous.Id]; ok {
+			roster[anonymous.Id] = ANONYMOUS_NAME
+		}
+	}
+	return anonymous.Id, nil
+}
+
+/* Attendance */
+
+func (m *MemoryStore) GetPeriods() ([]*Period, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*Period, 0, len(m.periods))
+	for _, p := range m.periods {
+		c := *p
+		results = append(results, &c)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Starts == results[j].Starts {
+			return results[i].Id < results[j].Id
+		}
+		return results[i].Starts < results[j].Starts
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) AddPeriod(p *Period) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastPeriod++
+	c := *p
+	c.Id = m.lastPeriod
+	m.periods[c.Id] = &c
+	return c.Id, nil
+}
+
+func (m *MemoryStore) DeletePeriod(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.periods[id]; !ok {
+		return NOT_FOUND
+	}
+	delete(m.periods, id)
+	for key := range m.attendance {
+		if key.period == id {
+			delete(m.attendance, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetAttendance(day string) ([]*Attendance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*Attendance, 0)
+	for key, a := range m.attendance {
+		if key.day == day && m.students[key.stuid].Deleted == 0 {
+			c := *a
+			results = append(results, &c)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CheckedIn < results[j].CheckedIn
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) CheckIn(a *Attendance) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.students[a.StudentId]; !ok {
+		return NOT_FOUND
+	}
+	if _, ok := m.periods[a.PeriodId]; !ok {
+		return NOT_FOUND
+	}
+	key := attendanceKey{a.StudentId, a.Day, a.PeriodId}
+	if _, exists := m.attendance[key]; exists {
+		return DUPLICATE_ATTENDANCE
+	}
+	c := *a
+	c.CheckedOut = 0
+	m.attendance[key] = &c
+	return nil
+}
+
+func (m *MemoryStore) CheckOut(stuid, day string, periodId int64, when time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.attendance[attendanceKey{stuid, day, periodId}]
+	if !ok || a.CheckedOut != 0 {
+		return NOT_FOUND
+	}
+	a.CheckedOut = when.Unix()
+	return nil
+}
+
+/* Unknown scans */
+
+func (m *MemoryStore) GetUnknownScans() ([]*UnknownScan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*UnknownScan, 0, len(m.unknown))
+	for _, u := range m.unknown {
+		c := *u
+		results = append(results, &c)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Posted < results[j].Posted
+	})
+	return results, nil
+}
+
+func (m *MemoryStore) AddUnknownScan(u *UnknownScan) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.assignments[u.AssignmentId]; u.AssignmentId != 0 && !ok {
+		return BAD_PK, NOT_FOUND
+	}
+	m.lastScanId++
+	c := *u
+	c.Id = m.lastScanId
+	m.unknown = append(m.unknown, &c)
+	return c.Id, nil
+}
+
+// removeUnknownScans drops the queued scans of the barcode, returning
+// them; the caller must hold the lock
+func (m *MemoryStore) removeUnknownScans(barcode string) []*UnknownScan {
+	removed := make([]*UnknownScan, 0)
+	kept := make([]*UnknownScan, 0, len(m.unknown))
+	for _, u := range m.unknown {
+		if u.Barcode == barcode {
+			removed = append(removed, u)
+		} else {
+			kept = append(kept, u)
+		}
+	}
+	m.unknown = kept
+	return removed
+}
+
+func (m *MemoryStore) DismissUnknownScans(barcode string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.removeUnknownScans(barcode)) == 0 {
+		return NOT_FOUND
+	}
+	return nil
+}
+
+func (m *MemoryStore) ResolveUnknownScans(barcode string, s *Student, create bool) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// check everything first, so nothing is applied on failure
+	if _, exists := m.cards[barcode]; exists {
+		return 0, DUPLICATE_CARD
+	}
+	if create {
+		if err := m.canAddStudent(s); err != nil {
+			return 0, err
+		}
+	} else if existing, ok := m.students[s.Id]; !ok || !onRoster(existing) {
+		return 0, NOT_FOUND
+	}
+	found := false
+	for _, u := range m.unknown {
+		if u.Barcode == barcode {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, NOT_FOUND
+	}
+
+	if create {
+		m.addStudent(s)
+	}
+	if !create || s.Id != barcode {
+		m.cards[barcode] = &Card{Barcode: barcode, StudentId: s.Id, Issued: time.Now().Unix()}
+	}
+
+	submitted := 0
+	for _, u := range m.removeUnknownScans(barcode) {
+		if u.AssignmentId != 0 {
+			m.submit(s.Id, u.AssignmentId, u.Posted)
+			submitted++
+		}
+	}
+	return submitted, nil
+}
+
+/* Outbox */
+
+func (m *MemoryStore) AddOutboxMessage(msg *OutboxMessage) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastMessage++
+	copied := *msg
+	copied.Id = m.lastMessage
+	copied.Status = OUTBOX_PENDING
+	m.outbox = append(m.outbox, &copied)
+	return copied.Id, nil
+}
+
+func (m *MemoryStore) GetOutboxMessages() ([]*OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*OutboxMessage, 0, len(m.outbox))
+	for i := len(m.outbox) - 1; i >= 0; i-- {
+		copied := *m.outbox[i]
+		results = append(results, &copied)
+	}
+	return results, nil
+}
+
+func (m *MemoryStore) GetPendingMessages() ([]*OutboxMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*OutboxMessage, 0)
+	for _, msg := range m.outbox {
+		if msg.Status == OUTBOX_PENDING {
+			copied := *msg
+			results = append(results, &copied)
+		}
+	}
+	return results, nil
+}
+
+func (m *MemoryStore) UpdateOutboxMessage(msg *OutboxMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.outbox {
+		if existing.Id == msg.Id {
+			existing.Attempts = msg.Attempts
+			existing.NextAttempt = msg.NextAttempt
+			existing.Status = msg.Status
+			existing.Error = msg.Error
+			existing.Sent = msg.Sent
+			return nil
+		}
+	}
+	return NOT_FOUND
+}
+
+func (m *MemoryStore) RetryOutboxMessage(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.outbox {
+		if existing.Id == id && existing.Status == OUTBOX_FAILED {
+			existing.Status = OUTBOX_PENDING
+			existing.NextAttempt = 0
+			return nil
+		}
+	}
+	return NOT_FOUND
+}
+
+func (m *MemoryStore) PurgeOutbox(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := make([]*OutboxMessage, 0, len(m.outbox))
+	for _, msg := range m.outbox {
+		if msg.Status == OUTBOX_PENDING || msg.Created >= before.Unix() {
+			kept = append(kept, msg)
+		}
+	}
+	purged := len(m.outbox) - len(kept)
+	m.outbox = kept
+	return purged, nil
+}
+
+/* Teachers */
+
+func (m *MemoryStore) GetTeachers() ([]*Teacher, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*Teacher, 0, len(m.teachers))
+	for _, t := range m.teachers {
+		copied := *t
+		results = append(results, &copied)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Username < results[j].Username })
+	return results, nil
+}
+
+func (m *MemoryStore) GetTeacher(id int64) (*Teacher, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.teachers[id]
+	if !ok {
+		return nil, NOT_FOUND
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (m *MemoryStore) GetTeacherByUsername(username string) (*Teacher, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.teachers {
+		if t.Username == username {
+			copied := *t
+			return &copied, nil
+		}
+	}
+	return nil, NOT_FOUND
+}
+
+func (m *MemoryStore) AddTeacher(t *Teacher) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.teachers {
+		if existing.Username == t.Username {
+			return BAD_PK, DUPLICATE_TEACHER
+		}
+	}
+	m.lastTeacher++
+	copied := *t
+	copied.Id = m.lastTeacher
+	copied.LastLogin = 0
+	m.teachers[copied.Id] = &copied
+	return copied.Id, nil
+}
+
+func (m *MemoryStore) UpdateTeacher(t *Teacher) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.teachers[t.Id]
+	if !ok {
+		return NOT_FOUND
+	}
+	existing.Name = t.Name
+	existing.Hash = t.Hash
+	existing.Role = t.Role
+	existing.LastLogin = t.LastLogin
+	return nil
+}
+
+func (m *MemoryStore) DeleteTeacher(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.teachers[id]; !ok {
+		return NOT_FOUND
+	}
+	delete(m.teachers, id)
+	for tokenId, t := range m.apiTokens {
+		if t.TeacherId == id {
+			delete(m.apiTokens, tokenId)
+		}
+	}
+	delete(m.classRoles, id)
+	return nil
+}
+
+/* Class roles */
+
+func (m *MemoryStore) GetClassRoles(teacherId int64) (map[int64]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make(map[int64]string)
+	for term, role := range m.classRoles[teacherId] {
+		results[term] = role
+	}
+	return results, nil
+}
+
+func (m *MemoryStore) SetClassRole(teacherId, term int64, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if role == "" {
+		delete(m.classRoles[teacherId], term)
+		return nil
+	}
+	if _, ok := m.teachers[teacherId]; !ok {
+		return NOT_FOUND
+	}
+	if m.classRoles[teacherId] == nil {
+		m.classRoles[teacherId] = make(map[int64]string)
+	}
+	m.classRoles[teacherId][term] = role
+	return nil
+}
+
+/* API tokens */
+
+func (m *MemoryStore) GetAPITokens() ([]*APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*APIToken, 0, len(m.apiTokens))
+	for _, t := range m.apiTokens {
+		copied := *t
+		results = append(results, &copied)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Id < results[j].Id })
+	return results, nil
+}
+
+func (m *MemoryStore) GetAPITokenByHash(hash string) (*APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, t := range m.apiTokens {
+		if t.Hash == hash {
+			copied := *t
+			return &copied, nil
+		}
+	}
+	return nil, NOT_FOUND
+}
+
+func (m *MemoryStore) AddAPIToken(t *APIToken) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// enforce the same reference as the sqlite foreign key
+	if _, ok := m.teachers[t.TeacherId]; !ok {
+		return BAD_PK, NOT_FOUND
+	}
+	m.lastToken++
+	copied := *t
+	copied.Id = m.lastToken
+	copied.LastUsed = 0
+	m.apiTokens[copied.Id] = &copied
+	return copied.Id, nil
+}
+
+func (m *MemoryStore) TouchAPIToken(id int64, when time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.apiTokens[id]
+	if !ok {
+		return NOT_FOUND
+	}
+	t.LastUsed = when.Unix()
+	return nil
+}
+
+func (m *MemoryStore) DeleteAPIToken(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.apiTokens[id]; !ok {
+		return NOT_FOUND
+	}
+	delete(m.apiTokens, id)
+	return nil
+}
+
+/* Live events */
+
+func (m *MemoryStore) GetLiveEvents(since int64, limit int) ([]*LiveEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]*LiveEvent, 0)
+	for _, e := range m.liveEvents {
+		if e.Id > since && len(results) < limit {
+			copied := *e
+			results = append(results, &copied)
+		}
+	}
+	return results, nil
+}
+
+func (m *MemoryStore) GetLatestLiveEvent(kind string) (*LiveEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.liveEvents) - 1; i >= 0; i-- {
+		if e := m.liveEvents[i]; kind == "" || e.Kind == kind {
+			copied := *e
+			return &copied, nil
+		}
+	}
+	return nil, NOT_FOUND
+}
+
+func (m *MemoryStore) AddLiveEvent(e *LiveEvent) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.addLiveEvent(e), nil
+}
+
+// addLiveEvent adds a copy of the event, returning its id; the caller
+// must hold the lock
+func (m *MemoryStore) addLiveEvent(e *LiveEvent) int64 {
+	m.lastEvent++
+	copied := *e
+	copied.Id = m.lastEvent
+	m.liveEvents = append(m.liveEvents, &copied)
+	return copied.Id
+}
+
+func (m *MemoryStore) PurgeLiveEvents(before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := make([]*LiveEvent, 0, len(m.liveEvents))
+	for _, e := range m.liveEvents {
+		if e.Created >= before.Unix() {
+			kept = append(kept, e)
+		}
+	}
+	purged := len(m.liveEvents) - len(kept)
+	m.liveEvents = kept
+	return purged, nil
+}
+
+/* Settings */
+
+func (m *MemoryStore) GetSetting(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.settings[key]
+	if !ok {
+		return "", NOT_FOUND
+	}
+	return value, nil
+}
+
+func (m *MemoryStore) SetSetting(key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.settings[key] = value
+	return nil
+}
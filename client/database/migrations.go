@@ -0,0 +1,325 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	// Migration statements
+	HAS_TABLES         = "select count(*) from sqlite_master where type = 'table' and name = 'student'"
+	GET_SCHEMA_VERSION = "pragma user_version"
+	SET_SCHEMA_VERSION = "pragma user_version = %d"
+)
+
+// MIGRATIONS are the changes to the tables since their definitions in
+// tables.sql, in order. The db file records how many it has had applied
+// (as its user_version), so each runs exactly once, on new and existing
+// db files alike.
+var MIGRATIONS = []string{
+	// 1: the trash, for soft deletes
+	`ALTER TABLE student ADD COLUMN deleted_at integer NOT NULL DEFAULT 0;
+	 ALTER TABLE submission ADD COLUMN deleted_at integer NOT NULL DEFAULT 0;`,
+
+	// 2: terms, each archiving the assignments (with their submissions)
+	// and the roster as they were when it was closed; the active term is 0
+	`CREATE TABLE term (
+	   id integer PRIMARY KEY AUTOINCREMENT,
+	   name text NOT NULL,
+	   started integer NOT NULL DEFAULT 0, -- unix time
+	   closed integer NOT NULL -- unix time
+	 );
+	 CREATE TABLE term_student (
+	   term integer NOT NULL REFERENCES term(id) ON DELETE CASCADE,
+	   stuid text NOT NULL REFERENCES student(stuid) ON UPDATE CASCADE ON DELETE CASCADE,
+	   name text NOT NULL, -- as of the close
+	   PRIMARY KEY (term, stuid)
+	 );
+	 ALTER TABLE assignment ADD COLUMN term integer NOT NULL DEFAULT 0;
+	 CREATE INDEX assignment_term ON assignment (term);
+	 -- the term a student was left behind in, if not carried forward
+	 ALTER TABLE student ADD COLUMN term integer NOT NULL DEFAULT 0;`,
+
+	// 3: grades, on a scale of points (up to max_points, if not 0), or of
+	// letters (e.g., 'A,B,C,D,F', best first), and teacher comments
+	`ALTER TABLE assignment ADD COLUMN scale text NOT NULL DEFAULT '';
+	 ALTER TABLE assignment ADD COLUMN max_points real NOT NULL DEFAULT 0;
+	 ALTER TABLE submission ADD COLUMN grade text NOT NULL DEFAULT ''; -- '' until graded
+	 ALTER TABLE submission ADD COLUMN comment text NOT NULL DEFAULT '';`,
+
+	// 4: attendance, recorded by the same card scans as submissions, against
+	// a daily schedule of periods (in minutes after midnight)
+	`CREATE TABLE period (
+	   id integer PRIMARY KEY AUTOINCREMENT,
+	   name text NOT NULL,
+	   starts integer NOT NULL, -- minutes after midnight
+	   ends integer NOT NULL,
+	   grace integer NOT NULL DEFAULT 0 -- minutes after the start a check-in is still on time
+	 );
+	 CREATE TABLE attendance (
+	   stuid text NOT NULL REFERENCES student(stuid) ON UPDATE CASCADE ON DELETE CASCADE,
+	   day text NOT NULL, -- local, as YYYY-MM-DD
+	   period integer NOT NULL REFERENCES period(id) ON DELETE CASCADE,
+	   checked_in integer NOT NULL, -- unix time
+	   checked_out integer NOT NULL DEFAULT 0, -- unix time, 0 unless checked out
+	   status text NOT NULL, -- 'present' or 'late'
+	   PRIMARY KEY (stuid, day, period)
+	 );
+	 CREATE INDEX attendance_day ON attendance (day);`,
+
+	// 5: groups of students who hand in an assignment together (table
+	// team, as group is an sql keyword), and who scanned for each member
+	`CREATE TABLE team (
+	   id integer PRIMARY KEY AUTOINCREMENT,
+	   assignment integer NOT NULL REFERENCES assignment(id) ON DELETE CASCADE,
+	   name text NOT NULL
+	 );
+	 CREATE TABLE team_member (
+	   team integer NOT NULL REFERENCES team(id) ON DELETE CASCADE,
+	   assignment integer NOT NULL REFERENCES assignment(id) ON DELETE CASCADE, -- the team's
+	   stuid text NOT NULL REFERENCES student(stuid) ON UPDATE CASCADE ON DELETE CASCADE,
+	   PRIMARY KEY (assignment, stuid) -- one team per student per assignment
+	 );
+	 CREATE INDEX team_member_team ON team_member (team);
+	 ALTER TABLE submission ADD COLUMN scanned_by text REFERENCES student(stuid) ON UPDATE CASCADE ON DELETE SET NULL; -- a teammate, or null`,
+
+	// 6: former students whose names and cards were removed, once past
+	// the retention period
+	`ALTER TABLE student ADD COLUMN anonymized_at integer NOT NULL DEFAULT 0;`,
+
+	// 7: multi-device sync (see sync.go): the log of the changes to the
+	// roster, the assignments and the submissions, each change identified
+	// on every device by the node which made it and its hybrid logical
+	// clock (from sync_clock(), which is given the latest one logged)
+	`ALTER TABLE assignment ADD COLUMN uid text NOT NULL DEFAULT ''; -- the same on every device
+	 -- the existing assignments of the term are matched across devices by title
+	 UPDATE assignment SET uid = CASE
+	   WHEN term = 0 AND id = (SELECT min(id) FROM assignment AS a WHERE a.title = assignment.title AND a.term = 0)
+	   THEN 'title-' || lower(hex(title))
+	   ELSE lower(hex(randomblob(16))) END;
+	 CREATE UNIQUE INDEX assignment_uid ON assignment (uid);
+	 INSERT OR IGNORE INTO setting (key, value) VALUES ('sync_node', lower(hex(randomblob(8))));
+	 CREATE TABLE sync_event (
+	   seq integer PRIMARY KEY AUTOINCREMENT, -- the order it was logged in on this device
+	   hlc integer NOT NULL,
+	   node text NOT NULL, -- with the hlc, identifies it on every device
+	   kind text NOT NULL, -- 'student', 'assignment', 'submit' or 'unsubmit'
+	   stuid text NOT NULL DEFAULT '',
+	   assignment text NOT NULL DEFAULT '', -- uid
+	   name text NOT NULL DEFAULT '', -- of the student, or title of the assignment
+	   posted integer NOT NULL DEFAULT 0, -- unix time
+	   due integer NOT NULL DEFAULT 0, -- unix time
+	   removed integer NOT NULL DEFAULT 0, -- off the roster, or assignment deleted
+	   ref text NOT NULL DEFAULT '', -- the ids (node-hlc) of the submits an unsubmit overrides
+	   UNIQUE (node, hlc)
+	 );
+	 CREATE INDEX sync_event_hlc ON sync_event (hlc);
+	 CREATE INDEX sync_event_submission ON sync_event (stuid, assignment);
+	 CREATE INDEX sync_event_assignment ON sync_event (assignment);
+
+	 -- what is there already is logged as having happened before any change
+	 INSERT INTO sync_event (hlc, node, kind, stuid, assignment, name, posted, due)
+	   SELECT n, node, kind, stuid, assignment, name, posted, due
+	   FROM (SELECT row_number() OVER (ORDER BY k, stuid, assignment) AS n, * FROM (
+	     SELECT 1 AS k, 'student' AS kind, stuid, '' AS assignment, name, 0 AS posted, 0 AS due
+	       FROM student WHERE deleted_at = 0 AND term = 0
+	     UNION ALL SELECT 2, 'assignment', '', uid, title, posted, due FROM assignment WHERE term = 0
+	     UNION ALL SELECT 3, 'submit', submission.stuid, assignment.uid, '', submission.posted, 0
+	       FROM submission JOIN assignment ON assignment.id = submission.assignment
+	       WHERE submission.deleted_at = 0 AND assignment.term = 0)),
+	   (SELECT value AS node FROM setting WHERE key = 'sync_node');
+
+	 -- and every change from now on, except those being synced (or
+	 -- encrypted) while the sync_muted setting is there
+	 CREATE TRIGGER sync_student_insert AFTER INSERT ON student
+	 WHEN NOT EXISTS (SELECT 1 FROM setting WHERE key = 'sync_muted')
+	 BEGIN
+	   INSERT INTO sync_event (hlc, node, kind, stuid, name, removed)
+	     SELECT hlc, value, 'student', new.stuid, new.name, new.deleted_at != 0 OR new.term != 0
+	     FROM (SELECT value, sync_clock((SELECT coalesce(max(hlc), 0) FROM sync_event)) AS hlc FROM setting WHERE key = 'sync_node');
+	 END;
+	 CREATE TRIGGER sync_student_update AFTER UPDATE OF stuid, name, deleted_at, term ON student
+	 WHEN NOT EXISTS (SELECT 1 FROM setting WHERE key = 'sync_muted')
+	   AND (old.stuid != new.stuid OR old.name != new.name OR (old.deleted_at = 0) != (new.deleted_at = 0) OR (old.term != 0 AND new.term = 0))
+	 BEGIN
+	   -- a new stuid takes the old one off the roster
+	   INSERT INTO sync_event (hlc, node, kind, stuid, removed)
+	     SELECT hlc, value, 'student', old.stuid, 1
+	     FROM (SELECT value, sync_clock((SELECT coalesce(max(hlc), 0) FROM sync_event)) AS hlc FROM setting WHERE key = 'sync_node')
+	     WHERE old.stuid != new.stuid;
+	   INSERT INTO sync_event (hlc, node, kind, stuid, name, removed)
+	     SELECT hlc, value, 'student', new.stuid, new.name, new.deleted_at != 0 OR new.term != 0
+	     FROM (SELECT value, sync_clock((SELECT coalesce(max(hlc), 0) FROM sync_event)) AS hlc FROM setting WHERE key = 'sync_node');
+	 END;
+	 CREATE TRIGGER sync_assignment_insert AFTER INSERT ON assignment
+	 WHEN NOT EXISTS (SELECT 1 FROM setting WHERE key = 'sync_muted')
+	 BEGIN
+	   INSERT INTO sync_event (hlc, node, kind, assignment, name, posted, due)
+	     SELECT hlc, value, 'assignment', new.uid, new.title, new.posted, new.due
+	     FROM (SELECT value, sync_clock((SELECT coalesce(max(hlc), 0) FROM sync_event)) AS hlc FROM setting WHERE key = 'sync_node');
+	 END;
+	 CREATE TRIGGER sync_assignment_update AFTER UPDATE OF title, posted, due ON assignment
+	 WHEN NOT EXISTS (SELECT 1 FROM setting WHERE key = 'sync_muted')
+	   AND new.term = 0 AND (old.title != new.title OR old.posted != new.posted OR old.due != new.due)
+	 BEGIN
+	   INSERT INTO sync_event (hlc, node, kind, assignment, name, posted, due)
+	     SELECT hlc, value, 'assignment', new.uid, new.title, new.posted, new.due
+	     FROM (SELECT value, sync_clock((SELECT coalesce(max(hlc), 0) FROM sync_event)) AS hlc FROM setting WHERE key = 'sync_node');
+	 END;
+	 CREATE TRIGGER sync_assignment_delete AFTER DELETE ON assignment
+	 WHEN NOT EXISTS (SELECT 1 FROM setting WHERE key = 'sync_muted') AND old.term = 0
+	 BEGIN
+	   INSERT INTO sync_event (hlc, node, kind, assignment, removed)
+	     SELECT hlc, value, 'assignment', old.uid, 1
+	     FROM (SELECT value, sync_clock((SELECT coalesce(max(hlc), 0) FROM sync_event)) AS hlc FROM setting WHERE key = 'sync_node');
+	 END;
+	 CREATE TRIGGER sync_submission_insert AFTER INSERT ON submission
+	 WHEN NOT EXISTS (SELECT 1 FROM setting WHERE key = 'sync_muted') AND new.deleted_at = 0
+	 BEGIN
+	   INSERT INTO sync_event (hlc, node, kind, stuid, assignment, posted)
+	     SELECT hlc, value, 'submit', new.stuid, (SELECT uid FROM assignment WHERE id = new.assignment), new.posted
+	     FROM (SELECT value, sync_clock((SELECT coalesce(max(hlc), 0) FROM sync_event)) AS hlc FROM setting WHERE key = 'sync_node');
+	 END;
+	 CREATE TRIGGER sync_submission_update AFTER UPDATE OF stuid, posted, deleted_at ON submission
+	 WHEN NOT EXISTS (SELECT 1 FROM setting WHERE key = 'sync_muted')
+	   AND new.deleted_at = 0 AND (old.deleted_at != 0 OR old.posted != new.posted OR old.stuid != new.stuid)
+	 BEGIN
+	   INSERT INTO sync_event (hlc, node, kind, stuid, assignment, posted)
+	     SELECT hlc, value, 'submit', new.stuid, (SELECT uid FROM assignment WHERE id = new.assignment), new.posted
+	     FROM (SELECT value, sync_clock((SELECT coalesce(max(hlc), 0) FROM sync_event)) AS hlc FROM setting WHERE key = 'sync_node');
+	 END;
+	 -- an unsubmit overrides every submit logged so far, but not those
+	 -- made elsewhere at the same time, which are logged later
+	 CREATE TRIGGER sync_submission_unsubmit AFTER UPDATE OF deleted_at ON submission
+	 WHEN NOT EXISTS (SELECT 1 FROM setting WHERE key = 'sync_muted')
+	   AND old.deleted_at = 0 AND new.deleted_at != 0
+	 BEGIN
+	   INSERT INTO sync_event (hlc, node, kind, stuid, assignment, posted, ref)
+	     SELECT hlc, value, 'unsubmit', new.stuid, uid, new.deleted_at,
+	       coalesce((SELECT group_concat(node || '-' || printf('%x', hlc)) FROM sync_event WHERE kind = 'submit' AND stuid = new.stuid AND assignment = uid), '')
+	     FROM (SELECT value, sync_clock((SELECT coalesce(max(hlc), 0) FROM sync_event)) AS hlc,
+	       (SELECT uid FROM assignment WHERE id = new.assignment) AS uid FROM setting WHERE key = 'sync_node');
+	 END;`,
+
+	// 8: the outbox of requests to the API server (see outbox.go), kept
+	// until they are sent, in order
+	`CREATE TABLE outbox (
+	   id integer PRIMARY KEY AUTOINCREMENT, -- the order to send them in
+	   idempotency_key text NOT NULL UNIQUE,
+	   method text NOT NULL,
+	   path text NOT NULL,
+	   params text NOT NULL, -- url encoded, with the digest (encrypted, if the db is)
+	   created integer NOT NULL, -- unix time
+	   attempts integer NOT NULL DEFAULT 0,
+	   next_attempt integer NOT NULL DEFAULT 0, -- unix time
+	   status text NOT NULL DEFAULT 'pending', -- 'pending', 'sent' or 'failed'
+	   error text NOT NULL DEFAULT '', -- of the last attempt
+	   sent integer NOT NULL DEFAULT 0 -- unix time
+	 );
+	 CREATE INDEX outbox_status ON outbox (status, id);`,
+
+	// 9: the teachers who log in to the WebApp (see teachers.go)
+	`CREATE TABLE teacher (
+	   id integer PRIMARY KEY AUTOINCREMENT,
+	   username text NOT NULL UNIQUE,
+	   name text NOT NULL DEFAULT '',
+	   hash text NOT NULL, -- bcrypt
+	   created integer NOT NULL, -- unix time
+	   last_login integer NOT NULL DEFAULT 0 -- unix time
+	 );`,
+
+	// 10: the role of each teacher (see ROLE_PERMISSIONS); those added
+	// before keep every permission
+	`ALTER TABLE teacher ADD COLUMN role text NOT NULL DEFAULT 'teacher';`,
+
+	// 11: the tokens which let scripts use the REST API as a teacher
+	`CREATE TABLE api_token (
+	   id integer PRIMARY KEY AUTOINCREMENT,
+	   teacher integer NOT NULL REFERENCES teacher (id),
+	   name text NOT NULL DEFAULT '',
+	   hash text NOT NULL UNIQUE, -- sha256, hex
+	   created integer NOT NULL, -- unix time
+	   last_used integer NOT NULL DEFAULT 0 -- unix time
+	 );`,
+
+	// 12: the live events the WebApp pushes to the open pages (see
+	// events.go): scan outcomes and scanner status, added by the
+	// PiScanner, and every change to a submission, logged by triggers
+	`CREATE TABLE live_event (
+	   id integer PRIMARY KEY AUTOINCREMENT,
+	   kind text NOT NULL, -- 'scan', 'submission' or 'scanner'
+	   outcome text NOT NULL,
+	   stuid text NOT NULL DEFAULT '',
+	   assignment integer NOT NULL DEFAULT 0,
+	   detail text NOT NULL DEFAULT '',
+	   created integer NOT NULL -- unix time
+	 );
+	 CREATE INDEX live_event_created ON live_event (created);
+	 CREATE TRIGGER live_submission_insert AFTER INSERT ON submission
+	 WHEN new.deleted_at = 0
+	 BEGIN
+	   INSERT INTO live_event (kind, outcome, stuid, assignment, created)
+	     VALUES ('submission', 'submitted', new.stuid, new.assignment, strftime('%s', 'now'));
+	 END;
+	 CREATE TRIGGER live_submission_update AFTER UPDATE OF deleted_at, grade, comment ON submission
+	 WHEN (old.deleted_at = 0) != (new.deleted_at = 0) OR old.grade != new.grade OR old.comment != new.comment
+	 BEGIN
+	   INSERT INTO live_event (kind, outcome, stuid, assignment, created)
+	     VALUES ('submission', CASE
+	       WHEN old.deleted_at != 0 AND new.deleted_at = 0 THEN 'submitted'
+	       WHEN old.deleted_at = 0 AND new.deleted_at != 0 THEN 'unsubmitted'
+	       ELSE 'graded' END, new.stuid, new.assignment, strftime('%s', 'now'));
+	 END;
+	 CREATE TRIGGER live_submission_delete AFTER DELETE ON submission
+	 WHEN old.deleted_at = 0
+	 BEGIN
+	   INSERT INTO live_event (kind, outcome, stuid, assignment, created)
+	     VALUES ('submission', 'unsubmitted', old.stuid, old.assignment, strftime('%s', 'now'));
+	 END;`,
+
+	// 13: the roles of teachers in particular classes, instead of their
+	// own (see ClassRole)
+	`CREATE TABLE class_role (
+	   teacher integer NOT NULL REFERENCES teacher (id) ON DELETE CASCADE,
+	   term integer NOT NULL, -- 0 for the current class
+	   role text NOT NULL,
+	   PRIMARY KEY (teacher, term)
+	 );`,
+}
+
+// migrate applies the MIGRATIONS the db does not have yet, in a single
+// transaction, so the PiScanner and the WebApp starting at the same time
+// cannot both apply them. A db without tables is left as it is.
+func migrate(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var tables, version int
+	if err := tx.QueryRow(HAS_TABLES).Scan(&tables); err != nil || tables == 0 {
+		return err
+	}
+	if err := tx.QueryRow(GET_SCHEMA_VERSION).Scan(&version); err != nil {
+		return err
+	}
+	if version >= len(MIGRATIONS) {
+		return nil
+	}
+
+	for i, migration := range MIGRATIONS[version:] {
+		if _, err := tx.Exec(migration); err != nil {
+			return fmt.Errorf("migration %d: %s", version+i+1, err)
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf(SET_SCHEMA_VERSION, len(MIGRATIONS))); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,120 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	// OutboxMessage statuses
+	OUTBOX_PENDING = "pending"
+	OUTBOX_SENT    = "sent"
+	OUTBOX_FAILED  = "failed"
+
+	// The wait before retrying a message, doubled after each failed
+	// attempt, up to the maximum
+	OUTBOX_BACKOFF     = 15 * time.Second
+	OUTBOX_MAX_BACKOFF = time.Hour
+
+	// How often the WebApp tries to send the pending messages (besides
+	// as soon as one is queued), and how long the others are kept
+	OUTBOX_INTERVAL  = 15 * time.Second
+	OUTBOX_RETENTION = 7 * 24 * time.Hour
+
+	// Random bytes in each idempotency key
+	OUTBOX_KEY_BYTES = 16
+)
+
+// RejectedError is the error of a message the API server refused, which
+// sending again would not change
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return e.Reason
+}
+
+// NewOutboxKey returns a new (random) idempotency key
+func NewOutboxKey() (string, error) {
+	b := make([]byte, OUTBOX_KEY_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// outboxBackoff returns how long to wait before the next attempt, after
+// the given number of failed ones
+func outboxBackoff(attempts int) time.Duration {
+	wait := OUTBOX_BACKOFF
+	for i := 1; i < attempts && wait < OUTBOX_MAX_BACKOFF; i++ {
+		wait *= 2
+	}
+	if wait > OUTBOX_MAX_BACKOFF {
+		wait = OUTBOX_MAX_BACKOFF
+	}
+	return wait
+}
+
+// DrainOutbox sends the pending messages with the send function, in the
+// order they were queued, stopping at the first one which is not due for
+// a retry yet, or which could not be sent (e.g., while offline), so none
+// is ever sent before those queued ahead of it; a message the server
+// rejects (see RejectedError) fails for good instead. It also purges the
+// messages past the OUTBOX_RETENTION, and returns how many it sent.
+func DrainOutbox(s Store, now time.Time, send func(*OutboxMessage) error) (int, error) {
+	if _, err := s.PurgeOutbox(now.Add(-OUTBOX_RETENTION)); err != nil {
+		return 0, err
+	}
+	pending, err := s.GetPendingMessages()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, m := range pending {
+		if m.NextAttempt > now.Unix() {
+			break
+		}
+
+		sendErr := send(m)
+		m.Attempts++
+		if sendErr == nil {
+			m.Status = OUTBOX_SENT
+			m.Sent = now.Unix()
+			m.Error = ""
+		} else if rejected, ok := sendErr.(*RejectedError); ok {
+			m.Status = OUTBOX_FAILED
+			m.Error = rejected.Reason
+		} else {
+			m.Error = sendErr.Error()
+			m.NextAttempt = now.Add(outboxBackoff(m.Attempts)).Unix()
+		}
+		if err := s.UpdateOutboxMessage(m); err != nil {
+			return sent, err
+		}
+
+		if sendErr == nil {
+			sent++
+		} else if m.Status == OUTBOX_PENDING {
+			return sent, sendErr
+		}
+	}
+	return sent, nil
+}
+
+// OutboxCounts tallies the messages in the outbox by status
+func OutboxCounts(messages []*OutboxMessage) map[string]int {
+	counts := map[string]int{OUTBOX_PENDING: 0, OUTBOX_SENT: 0, OUTBOX_FAILED: 0}
+	for _, m := range messages {
+		counts[m.Status]++
+	}
+	return counts
+}
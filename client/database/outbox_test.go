@@ -0,0 +1,128 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var OFFLINE = errors.New("offline")
+
+func TestOutboxBackoff(t *testing.T) {
+	for _, tt := range []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, OUTBOX_BACKOFF},
+		{1, OUTBOX_BACKOFF},
+		{2, 2 * OUTBOX_BACKOFF},
+		{3, 4 * OUTBOX_BACKOFF},
+		{8, 128 * OUTBOX_BACKOFF},
+		{9, OUTBOX_MAX_BACKOFF},
+		{1000, OUTBOX_MAX_BACKOFF},
+	} {
+		if got := outboxBackoff(tt.attempts); got != tt.want {
+			t.Fatalf("after %d attempts: got %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// outboxStatus returns the message of the path, as it is in the outbox
+func outboxStatus(t *testing.T, s Store, path string) *OutboxMessage {
+	messages, err := s.GetOutboxMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range messages {
+		if m.Path == path {
+			return m
+		}
+	}
+	t.Fatalf("no message to %s", path)
+	return nil
+}
+
+func TestDrainOutbox(t *testing.T) {
+	for kind, s := range stores(t) {
+		t.Run(kind, func(t *testing.T) {
+			now := time.Now()
+			for _, path := range []string{"/rejected", "/flaky", "/ok"} {
+				key, err := NewOutboxKey()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := s.AddOutboxMessage(&OutboxMessage{Key: key, Method: "POST", Path: path, Created: now.Unix()}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the server rejects one, and the next cannot be sent yet
+			var sent []string
+			flaky := 2
+			send := func(m *OutboxMessage) error {
+				sent = append(sent, m.Path)
+				switch {
+				case m.Path == "/rejected":
+					return &RejectedError{Reason: "unknown account"}
+				case m.Path == "/flaky" && flaky > 0:
+					flaky--
+					return OFFLINE
+				}
+				return nil
+			}
+			drain := func(at time.Time, want int, wantErr error, wantSent string) {
+				sent = nil
+				n, err := DrainOutbox(s, at, send)
+				if n != want || err != wantErr || strings.Join(sent, " ") != wantSent {
+					t.Fatalf("sent %d (%s), %v; want %d (%s), %v", n, strings.Join(sent, " "), err, want, wantSent, wantErr)
+				}
+			}
+
+			drain(now, 0, OFFLINE, "/rejected /flaky")
+			if m := outboxStatus(t, s, "/rejected"); m.Status != OUTBOX_FAILED || m.Error != "unknown account" {
+				t.Fatalf("got %+v", m)
+			}
+			if m := outboxStatus(t, s, "/flaky"); m.Status != OUTBOX_PENDING || m.Attempts != 1 || m.Error != "offline" ||
+				m.NextAttempt != now.Add(OUTBOX_BACKOFF).Unix() {
+				t.Fatalf("got %+v", m)
+			}
+
+			// nothing is sent before the retry is due, not even the message
+			// queued behind it, and the wait doubles after each failure
+			drain(now.Add(OUTBOX_BACKOFF-time.Second), 0, nil, "")
+			drain(now.Add(OUTBOX_BACKOFF), 0, OFFLINE, "/flaky")
+			if m := outboxStatus(t, s, "/flaky"); m.Attempts != 2 || m.NextAttempt != now.Add(3*OUTBOX_BACKOFF).Unix() {
+				t.Fatalf("got %+v", m)
+			}
+			drain(now.Add(3*OUTBOX_BACKOFF), 2, nil, "/flaky /ok")
+			for _, path := range []string{"/flaky", "/ok"} {
+				if m := outboxStatus(t, s, path); m.Status != OUTBOX_SENT || m.Error != "" {
+					t.Fatalf("got %+v", m)
+				}
+			}
+
+			// the rejected one is only sent again when retried by hand
+			drain(now.Add(4*OUTBOX_BACKOFF), 0, nil, "")
+			if err := s.RetryOutboxMessage(outboxStatus(t, s, "/rejected").Id); err != nil {
+				t.Fatal(err)
+			}
+			drain(now.Add(4*OUTBOX_BACKOFF), 0, nil, "/rejected")
+			if counts := OutboxCounts(mustMessages(t, s)); counts[OUTBOX_FAILED] != 1 || counts[OUTBOX_SENT] != 2 || counts[OUTBOX_PENDING] != 0 {
+				t.Fatalf("got %v", counts)
+			}
+		})
+	}
+}
+
+// mustMessages returns every message in the outbox
+func mustMessages(t *testing.T, s Store) []*OutboxMessage {
+	messages, err := s.GetOutboxMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
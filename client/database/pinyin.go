@@ -0,0 +1,135 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	// PINYIN_SURNAMES are the characters read differently as a family name
+	// (i.e., as the first character of a name) than in PINYIN_TABLE
+	PINYIN_SURNAMES = map[rune]string{'曾': "zeng", '单': "shan", '解': "xie", '仇': "qiu", '朴': "piao",
+		'区': "ou", '查': "zha", '盖': "ge", '乐': "yue", '缪': "miao", '覃': "qin", '召': "shao",
+		'种': "chong", '繁': "po", '隗': "wei", '翟': "zhai", '薄': "bo", '重': "chong", '都': "du",
+		'藏': "zang", '角': "jue", '尉': "yu"}
+
+	// pinyinIndex is PINYIN_TABLE, by character
+	pinyinIndex = func() map[rune]string {
+		index := make(map[rune]string)
+		for syllable, chars := range PINYIN_TABLE {
+			for _, c := range chars {
+				index[c] = syllable
+			}
+		}
+		return index
+	}()
+)
+
+// isHan reports whether the rune is a Chinese character
+func isHan(r rune) bool {
+	return unicode.Is(unicode.Han, r)
+}
+
+// searchTokens splits the (lowercased) text into words of letters and
+// digits, with each Chinese character a word of its own, as the sqlite
+// fts5 unicode61 tokenizer would see it once the characters are spaced
+func searchTokens(text string) []string {
+	tokens := make([]string, 0)
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isHan(r):
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// nameReadings returns the ways the name can be spelled as a sequence of
+// syllables: the pinyin of each Chinese character, and each other word
+// as it is. There are two readings if the first character is read
+// differently as a family name.
+func nameReadings(name string) [][]string {
+	tokens := searchTokens(name)
+	common := make([]string, len(tokens))
+	for i, token := range tokens {
+		common[i] = token
+		if r, _ := utf8.DecodeRuneInString(token); isHan(r) {
+			if syllable, ok := pinyinIndex[r]; ok {
+				common[i] = syllable
+			}
+		}
+	}
+	readings := [][]string{common}
+
+	if len(tokens) > 0 {
+		first, _ := utf8.DecodeRuneInString(tokens[0])
+		if surname, ok := PINYIN_SURNAMES[first]; ok && surname != common[0] {
+			alt := append([]string{surname}, common[1:]...)
+			readings = append(readings, alt)
+		}
+	}
+	return readings
+}
+
+// searchKeys returns the words a student name is found by: each of its
+// characters (or other words), and for each reading, the full pinyin
+// spelling and the initials, from every syllable onward (so the given
+// name alone matches too), e.g., "张三丰" has "张", "三", "丰",
+// "zhangsanfeng", "sanfeng", "feng", "zsf", "sf" and "f"
+func searchKeys(name string) []string {
+	keys := searchTokens(name)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		seen[key] = true
+	}
+	add := func(key string) {
+		if key != "" && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for _, syllables := range nameReadings(name) {
+		for i := range syllables {
+			var full, initials strings.Builder
+			for _, syllable := range syllables[i:] {
+				full.WriteString(syllable)
+				r, _ := utf8.DecodeRuneInString(syllable)
+				initials.WriteRune(r)
+			}
+			add(full.String())
+			add(initials.String())
+		}
+	}
+	return keys
+}
+
+// SearchTerms returns the searchKeys of the name as a single text, which
+// is what the student_search fts5 table indexes (via the search_terms
+// sql function); an encrypted name has none, so nothing of it leaks
+// into the index
+func SearchTerms(name string) string {
+	if IsEncrypted(name) {
+		return ""
+	}
+	return strings.Join(searchKeys(name), " ")
+}
@@ -0,0 +1,111 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// What a former student's name and stuid become
+	ANONYMOUS_NAME      = "已匿名"
+	ANONYMOUS_ID_FORMAT = "anon-%d"
+
+	// How many days former students are kept as they were, by default,
+	// and how often the WebApp anonymizes the ones past that
+	RETENTION_DAYS     = 365
+	RETENTION_INTERVAL = 24 * time.Hour
+)
+
+// formerLeft returns when the Student left the roster: when they were
+// deleted, or when the term they were left in closed, whichever was first
+func formerLeft(s *Student, closed int64) int64 {
+	if s.Deleted != 0 && (s.Term == ACTIVE_TERM || s.Deleted < closed) {
+		return s.Deleted
+	}
+	return closed
+}
+
+// Anonymized is one former student past the retention period
+type Anonymized struct {
+	Id    string // the anonymous stuid, or (in a preview) the current one
+	Left  int64  // unix time
+	Cards int    // how many cards were removed
+}
+
+// LeftDate returns the (local) day the student left the roster
+func (a *Anonymized) LeftDate() string {
+	return time.Unix(a.Left, 0).Format(DAY_FORMAT)
+}
+
+// RetentionReport is what anonymizing the former students past the
+// retention period removed (or, unless Applied, would remove); it never
+// names them, so it can be kept
+type RetentionReport struct {
+	Cutoff   int64 // unix time: those who left before this are anonymized
+	Applied  bool
+	Students []*Anonymized
+	Cards    int
+	Retained int // former students still within the retention period
+}
+
+// Lines returns the report as text, one line per student after a summary
+func (r *RetentionReport) Lines() []string {
+	verb := "would be anonymized"
+	if r.Applied {
+		verb = "anonymized"
+	}
+	lines := []string{fmt.Sprintf("%d former students who left before %s %s (%d cards removed), %d retained",
+		len(r.Students), time.Unix(r.Cutoff, 0).Format(DAY_FORMAT), verb, r.Cards, r.Retained)}
+	for _, a := range r.Students {
+		lines = append(lines, fmt.Sprintf("  %s: left %s, %d cards", a.Id, a.LeftDate(), a.Cards))
+	}
+	return lines
+}
+
+// Anonymize replaces the names and stuids, and removes the cards, of the
+// students who left the roster more than days ago, keeping their
+// submissions (and so the statistics of the assignments and terms) under
+// an anonymous stuid; unless apply is set, it only reports who would be
+func Anonymize(s Store, days int, now time.Time, apply bool) (*RetentionReport, error) {
+	former, err := s.GetFormerStudents()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &RetentionReport{Cutoff: now.AddDate(0, 0, -days).Unix(), Applied: apply, Students: make([]*Anonymized, 0)}
+	for _, f := range former {
+		if f.Left >= r.Cutoff {
+			r.Retained++
+			continue
+		}
+		a := &Anonymized{Id: f.Student.Id, Left: f.Left, Cards: f.Cards}
+		if apply {
+			if a.Id, err = s.AnonymizeStudent(f.Student.Id, now); err != nil {
+				return r, err
+			}
+		}
+		r.Students = append(r.Students, a)
+		r.Cards += a.Cards
+	}
+	return r, nil
+}
+
+// AnonymizeForever anonymizes the students who left more than days ago,
+// at every interval, passing each report which anonymized anyone to
+// reportFn, and invoking errorFn on any failure
+func AnonymizeForever(s Store, days int, interval time.Duration, reportFn func(*RetentionReport), errorFn func(error)) {
+	for now := range time.Tick(interval) {
+		r, err := Anonymize(s, days, now, true)
+		if err != nil {
+			errorFn(err)
+		}
+		if r != nil && len(r.Students) > 0 {
+			reportFn(r)
+		}
+	}
+}
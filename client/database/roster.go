@@ -0,0 +1,297 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Roster file encodings
+	ENCODING_UTF8 = "UTF-8"
+	ENCODING_GBK  = "GBK"
+
+	// Roster row outcomes
+	ROW_NEW       = "new"
+	ROW_UPDATED   = "updated"
+	ROW_UNCHANGED = "unchanged"
+	ROW_CONFLICT  = "conflict"
+)
+
+var (
+	// Recognized header labels (lowercase) for the stuid and name columns
+	ROSTER_ID_HEADERS   = []string{"stuid", "id", "student id", "barcode", "card", "学号", "卡号", "条码", "编号"}
+	ROSTER_NAME_HEADERS = []string{"name", "student", "student name", "姓名", "名字", "学生", "学生姓名"}
+
+	EMPTY_ROSTER = errors.New("The roster file has no rows")
+	BAD_COLUMN   = errors.New("The roster file has no such column")
+)
+
+// RosterMapping names the stuid and name columns, either by header label
+// or by (1-based) column number; blank means detect from the header row
+type RosterMapping struct {
+	IdColumn   string
+	NameColumn string
+}
+
+// RosterRow is one line of a roster file, and what applying it would do
+type RosterRow struct {
+	Line         int
+	Student      *Student
+	Status       string
+	Reason       string
+	PreviousName string // for updates
+}
+
+// RosterPreview is the result of reading a roster file against the
+// existing students, before anything is changed
+type RosterPreview struct {
+	Encoding   string
+	Header     []string // nil if the file has no header row
+	IdColumn   int      // 0-based
+	NameColumn int      // 0-based
+	Rows       []*RosterRow
+
+	New, Updated, Unchanged, Conflicts int
+}
+
+// DecodeRoster returns the roster file content as UTF-8 text, converting
+// it from GBK (as exported by Chinese versions of Excel and WPS) if it is
+// not valid UTF-8, along with the name of the encoding found
+func DecodeRoster(content []byte) (string, string, error) {
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf")) // the Excel UTF-8 BOM
+	if utf8.Valid(content) {
+		return string(content), ENCODING_UTF8, nil
+	}
+
+	decoded, err := simplifiedchinese.GB18030.NewDecoder().Bytes(content)
+	if err != nil {
+		return "", ENCODING_GBK, err
+	}
+	return string(decoded), ENCODING_GBK, nil
+}
+
+// readRecords splits the text into rows, using tabs (TSV) if the first
+// line has them, and commas (CSV) otherwise
+func readRecords(text string) ([][]string, error) {
+	r := csv.NewReader(strings.NewReader(text))
+	firstLine := text
+	if i := strings.IndexAny(text, "\r\n"); i >= 0 {
+		firstLine = text[:i]
+	}
+	if strings.Contains(firstLine, "\t") {
+		r.Comma = '\t'
+	}
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.TrimLeadingSpace = true
+
+	records := make([][]string, 0)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return records, err
+		}
+		// skip blank lines
+		blank := true
+		for _, field := range record {
+			if strings.TrimSpace(field) != "" {
+				blank = false
+				break
+			}
+		}
+		if !blank {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// matchHeader finds the column whose label is one of the given labels
+func matchHeader(header []string, labels []string) int {
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(h))
+		for _, label := range labels {
+			if h == label {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// findColumn resolves a RosterMapping column (label or 1-based number)
+func findColumn(header []string, column string) int {
+	if n, err := strconv.Atoi(column); err == nil {
+		return n - 1
+	}
+	return matchHeader(header, []string{strings.ToLower(strings.TrimSpace(column))})
+}
+
+// ParseRoster reads the roster file content, resolving the columns from
+// the mapping or the header row; by default, without a recognizable
+// header, the first column is the stuid and the second the name
+func ParseRoster(content []byte, mapping RosterMapping) (*RosterPreview, error) {
+	text, encoding, err := DecodeRoster(content)
+	if err != nil {
+		return nil, err
+	}
+	records, err := readRecords(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, EMPTY_ROSTER
+	}
+
+	p := &RosterPreview{Encoding: encoding, IdColumn: 0, NameColumn: 1}
+
+	first := records[0]
+	idCol := matchHeader(first, ROSTER_ID_HEADERS)
+	nameCol := matchHeader(first, ROSTER_NAME_HEADERS)
+	hasHeader := idCol >= 0 || nameCol >= 0
+	if hasHeader {
+		p.Header = first
+		if idCol >= 0 {
+			p.IdColumn = idCol
+		}
+		if nameCol >= 0 {
+			p.NameColumn = nameCol
+		}
+	}
+
+	// an explicit mapping overrides what was detected
+	if mapping.IdColumn != "" {
+		p.IdColumn = findColumn(p.Header, mapping.IdColumn)
+	}
+	if mapping.NameColumn != "" {
+		p.NameColumn = findColumn(p.Header, mapping.NameColumn)
+	}
+	if p.IdColumn < 0 || p.NameColumn < 0 || p.IdColumn == p.NameColumn {
+		return nil, BAD_COLUMN
+	}
+
+	p.Rows = make([]*RosterRow, 0, len(records))
+	for i, record := range records {
+		if hasHeader && i == 0 {
+			continue
+		}
+		row := &RosterRow{Line: i + 1, Student: new(Student)}
+		if p.IdColumn < len(record) {
+			row.Student.Id = strings.TrimSpace(record[p.IdColumn])
+		}
+		if p.NameColumn < len(record) {
+			row.Student.Name = strings.TrimSpace(record[p.NameColumn])
+		}
+		p.Rows = append(p.Rows, row)
+	}
+	if len(p.Rows) == 0 {
+		return nil, EMPTY_ROSTER
+	}
+	return p, nil
+}
+
+// PreviewRoster parses the roster file, and classifies each row as new,
+// an update of an existing student's name, unchanged, or a conflict that
+// will not be applied (missing values, a stuid repeated in the file with
+// different names, or a name that already belongs to a different stuid,
+// in the file or the db)
+func PreviewRoster(s Store, content []byte, mapping RosterMapping) (*RosterPreview, error) {
+	p, err := ParseRoster(content, mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	students, err := s.GetStudents()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*Student)
+	byName := make(map[string]*Student)
+	for _, student := range students {
+		existing[student.Id] = student
+		byName[student.Name] = student
+	}
+
+	seen := make(map[string]*RosterRow)
+	seenNames := make(map[string]*RosterRow)
+	for _, row := range p.Rows {
+		id, name := row.Student.Id, row.Student.Name
+		prev, inFile := seen[id]
+		current, inDB := existing[id]
+		other, nameTaken := byName[name]
+		namesake, nameInFile := seenNames[name]
+
+		switch {
+		case id == "" || name == "":
+			row.Status, row.Reason = ROW_CONFLICT, "缺少学号或姓名"
+		case inFile && prev.Student.Name != name:
+			row.Status, row.Reason = ROW_CONFLICT, fmt.Sprintf("学号与第 %d 行重复", prev.Line)
+		case inFile:
+			row.Status, row.Reason = ROW_UNCHANGED, fmt.Sprintf("与第 %d 行相同", prev.Line)
+		case nameInFile && namesake.Student.Id != id:
+			row.Status, row.Reason = ROW_CONFLICT, fmt.Sprintf("姓名与第 %d 行重复", namesake.Line)
+		case nameTaken && other.Id != id:
+			row.Status, row.Reason = ROW_CONFLICT, fmt.Sprintf("姓名已属于学号 %s", other.Id)
+		case !inDB:
+			row.Status = ROW_NEW
+		case current.Name != name:
+			row.Status, row.PreviousName = ROW_UPDATED, current.Name
+		default:
+			row.Status = ROW_UNCHANGED
+		}
+		if row.Status != ROW_CONFLICT && !inFile {
+			seen[id] = row
+			seenNames[name] = row
+		}
+
+		switch row.Status {
+		case ROW_NEW:
+			p.New++
+		case ROW_UPDATED:
+			p.Updated++
+		case ROW_UNCHANGED:
+			p.Unchanged++
+		case ROW_CONFLICT:
+			p.Conflicts++
+		}
+	}
+	return p, nil
+}
+
+// ApplyRoster adds the new, and updates the changed, students from the
+// preview in a single transaction, skipping conflicts; it returns the
+// number of students changed
+func ApplyRoster(s Store, p *RosterPreview) (int, error) {
+	add := make([]*Student, 0, p.New)
+	update := make([]*Student, 0, p.Updated)
+	for _, row := range p.Rows {
+		switch row.Status {
+		case ROW_NEW:
+			add = append(add, row.Student)
+		case ROW_UPDATED:
+			update = append(update, row.Student)
+		}
+	}
+	if len(add)+len(update) == 0 {
+		return 0, nil
+	}
+	if err := s.ImportStudents(add, update); err != nil {
+		return 0, err
+	}
+	return len(add) + len(update), nil
+}
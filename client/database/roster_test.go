@@ -0,0 +1,91 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"testing"
+)
+
+// gbk returns the text as exported by a Chinese version of Excel
+func gbk(t *testing.T, text string) []byte {
+	content, err := simplifiedchinese.GBK.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+var ROSTER_TESTS = []struct {
+	name     string
+	content  func(t *testing.T) []byte
+	mapping  RosterMapping
+	encoding string
+	header   bool
+	idColumn int
+	rows     [][2]string // stuid, name
+	err      error
+}{
+	{"utf-8 csv with a header",
+		func(t *testing.T) []byte { return []byte("学号,姓名\n001,张三\n002,李四\n") },
+		RosterMapping{}, ENCODING_UTF8, true, 0, [][2]string{{"001", "张三"}, {"002", "李四"}}, nil},
+	{"the Excel BOM is stripped before the header",
+		func(t *testing.T) []byte { return []byte("\xef\xbb\xbfName,Student ID\n张三,001\n") },
+		RosterMapping{}, ENCODING_UTF8, true, 1, [][2]string{{"001", "张三"}}, nil},
+	{"gbk",
+		func(t *testing.T) []byte { return gbk(t, "姓名,学号\r\n张三,001\r\n李四,002\r\n") },
+		RosterMapping{}, ENCODING_GBK, true, 1, [][2]string{{"001", "张三"}, {"002", "李四"}}, nil},
+	{"tsv, with a comma in a name",
+		func(t *testing.T) []byte { return []byte("卡号\t学生姓名\n001\t张, 三\n") },
+		RosterMapping{}, ENCODING_UTF8, true, 0, [][2]string{{"001", "张, 三"}}, nil},
+	{"no header, and a blank line",
+		func(t *testing.T) []byte { return []byte("001,张三\n\n 002 , 李四 \n") },
+		RosterMapping{}, ENCODING_UTF8, false, 0, [][2]string{{"001", "张三"}, {"002", "李四"}}, nil},
+	{"mapped by column number",
+		func(t *testing.T) []byte { return []byte("一班,001,张三\n一班,002,李四\n") },
+		RosterMapping{IdColumn: "2", NameColumn: "3"}, ENCODING_UTF8, false, 1, [][2]string{{"001", "张三"}, {"002", "李四"}}, nil},
+	{"mapped by header label",
+		func(t *testing.T) []byte { return []byte("学号,昵称,姓名\n001,小张,张三\n") },
+		RosterMapping{NameColumn: "昵称"}, ENCODING_UTF8, true, 0, [][2]string{{"001", "小张"}}, nil},
+	{"a short row",
+		func(t *testing.T) []byte { return []byte("学号,姓名\n001\n") },
+		RosterMapping{}, ENCODING_UTF8, true, 0, [][2]string{{"001", ""}}, nil},
+	{"empty",
+		func(t *testing.T) []byte { return nil },
+		RosterMapping{}, "", false, 0, nil, EMPTY_ROSTER},
+	{"only a header",
+		func(t *testing.T) []byte { return []byte("学号,姓名\n") },
+		RosterMapping{}, "", false, 0, nil, EMPTY_ROSTER},
+	{"no such label",
+		func(t *testing.T) []byte { return []byte("学号,姓名\n001,张三\n") },
+		RosterMapping{NameColumn: "班级"}, "", false, 0, nil, BAD_COLUMN},
+	{"both mapped to one column",
+		func(t *testing.T) []byte { return []byte("001,张三\n") },
+		RosterMapping{IdColumn: "1", NameColumn: "1"}, "", false, 0, nil, BAD_COLUMN},
+}
+
+func TestParseRoster(t *testing.T) {
+	for _, tt := range ROSTER_TESTS {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseRoster(tt.content(t), tt.mapping)
+			if err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if p.Encoding != tt.encoding || (p.Header != nil) != tt.header || p.IdColumn != tt.idColumn {
+				t.Fatalf("got %s, header %v, stuid in column %d", p.Encoding, p.Header, p.IdColumn)
+			}
+			if len(p.Rows) != len(tt.rows) {
+				t.Fatalf("got %d rows, want %d", len(p.Rows), len(tt.rows))
+			}
+			for i, row := range p.Rows {
+				if row.Student.Id != tt.rows[i][0] || row.Student.Name != tt.rows[i][1] {
+					t.Fatalf("row %d: got %q %q, want %q", i, row.Student.Id, row.Student.Name, tt.rows[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"strconv"
+	"time"
+)
+
+// ScanResult is what a card scan did, as recorded for the live events
+type ScanResult struct {
+	Outcome    string   // one of the SCAN_ outcomes
+	Student    *Student // nil unless the card is known
+	Assignment int64    // the one submitted, or 0
+	Teammates  int      // how many in their group it also submitted for
+	Detail     string   // e.g., the attendance status, or the error
+}
+
+// ProcessScan records the scan of a card by the PiScanner: an attendance
+// in attendance mode, or else a submission of the current assignment by
+// the student and their group; an unknown card is queued for the teacher
+// to link, but not the card of a student in the trash, or left in a
+// closed term (with its id as the detail). Whatever happens, the outcome
+// is added as a live event, so a scan never fails silently: any error is
+// recorded as SCAN_FAILED, and returned.
+func ProcessScan(s Store, barcode, device string, now time.Time) (*ScanResult, error) {
+	result := new(ScanResult)
+	err := processScan(s, barcode, device, now, result)
+	if err != nil {
+		result.Outcome, result.Detail = SCAN_FAILED, err.Error()
+	}
+	stuid := ""
+	if result.Student != nil {
+		stuid = result.Student.Id
+	}
+	if recordErr := RecordScan(s, result.Outcome, stuid, result.Assignment, result.Detail, now); err == nil {
+		err = recordErr
+	}
+	return result, err
+}
+
+// processScan sets the outcome of the scan, unless it fails
+func processScan(s Store, barcode, device string, now time.Time, result *ScanResult) error {
+	student, err := FindStudentByCard(s, barcode)
+	if err == NOT_FOUND {
+		// a new card, or a student not in the roster yet
+		result.Outcome = SCAN_UNKNOWN
+		return RecordUnknownScan(s, barcode, device, now)
+	} else if revoked, ok := err.(*RevokedCardError); ok {
+		result.Outcome, result.Student, result.Detail = SCAN_REVOKED, revoked.Student, revoked.Card.RevokedDate()
+		return nil
+	} else if inactive, ok := err.(*InactiveStudentError); ok {
+		result.Outcome, result.Student = SCAN_TRASHED, inactive.Student
+		if !inactive.Trashed() {
+			result.Outcome, result.Detail = SCAN_ARCHIVED, strconv.FormatInt(inactive.Student.Term, 10)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	result.Student = student
+
+	mode, _, err := GetScanMode(s)
+	if err != nil {
+		return err
+	}
+	if mode == MODE_ATTENDANCE {
+		a, err := RecordAttendance(s, student.Id, now)
+		if err != nil {
+			return err
+		}
+		result.Outcome, result.Detail = SCAN_CHECKED_IN, a.Status
+		if a.CheckedOut != 0 {
+			result.Outcome = SCAN_CHECKED_OUT
+		}
+		return nil
+	}
+
+	assignment, err := EnsureCurrentAssignment(s, now)
+	if err != nil {
+		return err
+	}
+	result.Assignment = assignment.Id
+	already, err := HasSubmitted(s, student.Id, assignment.Id)
+	if err != nil {
+		return err
+	}
+	// a scan by any member of a group submits for all of them
+	if result.Teammates, err = s.SubmitGroup(student.Id, assignment.Id, now); err != nil {
+		return err
+	}
+	result.Outcome = SCAN_SUBMITTED
+	if already {
+		result.Outcome = SCAN_ALREADY_SUBMITTED
+	}
+	return nil
+}
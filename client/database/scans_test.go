@@ -0,0 +1,108 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var BROKEN = errors.New("broken")
+
+// brokenStore fails every submission
+type brokenStore struct {
+	Store
+}
+
+func (b *brokenStore) SubmitGroup(stuid string, assignmentId int64, when time.Time) (int, error) {
+	return 0, BROKEN
+}
+
+// lastScan returns the latest live event, which should be of a scan
+func lastScan(t *testing.T, s Store) *LiveEvent {
+	e, err := s.GetLatestLiveEvent(LIVE_SCAN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestProcessScan(t *testing.T) {
+	for kind, s := range stores(t) {
+		t.Run(kind, func(t *testing.T) {
+			now := time.Now()
+			addStudents(t, s, map[string]string{"001": "张三", "002": "李四", "003": "王五"})
+			for _, c := range []*Card{{Barcode: "A1", StudentId: "001"}, {Barcode: "B1", StudentId: "002"}, {Barcode: "D1", StudentId: "003"}} {
+				if err := s.IssueCard(c, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.RevokeCard("B1", now); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.DeleteStudent("003", now); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, c := range []struct {
+				barcode, outcome string
+			}{
+				{"A1", SCAN_SUBMITTED},
+				{"A1", SCAN_ALREADY_SUBMITTED},
+				{"B1", SCAN_REVOKED},
+				{"C1", SCAN_UNKNOWN},
+				{"D1", SCAN_TRASHED},
+			} {
+				result, err := ProcessScan(s, c.barcode, "dev", now)
+				if err != nil || result.Outcome != c.outcome {
+					t.Fatalf("%s: got %+v %v, want %s", c.barcode, result, err, c.outcome)
+				}
+				if e := lastScan(t, s); e.Outcome != c.outcome {
+					t.Fatalf("%s: recorded %s, want %s", c.barcode, e.Outcome, c.outcome)
+				}
+			}
+			// the card of a student in the trash is not unknown
+			if scans, _ := s.GetUnknownScans(); len(scans) != 1 || scans[0].Barcode != "C1" {
+				t.Fatalf("got %v queued", scans)
+			}
+
+			// every error is recorded as a failure, with its cause
+			result, err := ProcessScan(&brokenStore{s}, "A1", "dev", now)
+			if err != BROKEN || result.Outcome != SCAN_FAILED {
+				t.Fatalf("got %+v %v, want a failure", result, err)
+			}
+			if e := lastScan(t, s); e.Outcome != SCAN_FAILED || e.StudentId != "001" || e.Detail != BROKEN.Error() {
+				t.Fatalf("recorded %+v", e)
+			}
+
+			if err := SetScanMode(s, MODE_ATTENDANCE, false); err != nil {
+				t.Fatal(err)
+			}
+			if result, err := ProcessScan(s, "A1", "dev", now); err != NO_PERIOD || result.Outcome != SCAN_FAILED {
+				t.Fatalf("got %+v %v, want NO_PERIOD", result, err)
+			}
+			if e := lastScan(t, s); e.Outcome != SCAN_FAILED || e.Detail != NO_PERIOD.Error() {
+				t.Fatalf("recorded %+v", e)
+			}
+
+			// nor is the card of a student left in a closed term
+			termId, err := CloseTerm(s, "上学期", "", false, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err = ProcessScan(s, "A1", "dev", now)
+			if err != nil || result.Outcome != SCAN_ARCHIVED || result.Student.Id != "001" {
+				t.Fatalf("got %+v %v, want an archived student", result, err)
+			}
+			if e := lastScan(t, s); e.Outcome != SCAN_ARCHIVED || e.Detail != strconv.FormatInt(termId, 10) {
+				t.Fatalf("recorded %+v", e)
+			}
+			if scans, _ := s.GetUnknownScans(); len(scans) != 1 {
+				t.Fatalf("got %d queued", len(scans))
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	// Largest number of results from a student search
+	SEARCH_LIMIT = 20
+)
+
+// matchQuery converts the search text into an fts5 query, matching every
+// word of it as a prefix, e.g., `张 zhang` is `"张"* "zhang"*`
+func matchQuery(query string) string {
+	terms := make([]string, 0)
+	for _, token := range searchTokens(query) {
+		terms = append(terms, `"`+token+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// matchesStudent reports whether every word of the query is a prefix of
+// one of the student's searchKeys or stuid words, as the fts5 query does
+func matchesStudent(s *Student, queryTokens []string) bool {
+	keys := append(searchKeys(s.Name), searchTokens(s.Id)...)
+	for _, token := range queryTokens {
+		found := false
+		for _, key := range keys {
+			if strings.HasPrefix(key, token) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return len(queryTokens) > 0
+}
+
+// matchStudents returns up to limit of the students matching every word
+// of the query, in order, i.e., MatchStudents done without the fts index
+func matchStudents(students []*Student, query string, limit int) []*Student {
+	tokens := searchTokens(query)
+	results := make([]*Student, 0)
+	for _, s := range students {
+		if len(results) == limit {
+			break
+		}
+		if matchesStudent(s, tokens) {
+			results = append(results, s)
+		}
+	}
+	return results
+}
+
+// prefixDistance is the edit distance between the query and the closest
+// prefix of the key, i.e., how many typos the query has as the start of it
+func prefixDistance(query, key []rune) int {
+	prev := make([]int, len(key)+1)
+	cur := make([]int, len(key)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(query); i++ {
+		cur[0] = i
+		for j := 1; j <= len(key); j++ {
+			cost := 1
+			if query[i-1] == key[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+
+	best := prev[0]
+	for _, d := range prev {
+		if d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+// fuzzyStudents ranks the students whose name, pinyin, initials or stuid
+// the query matches with a small number of typos: one for up to four
+// letters, two for longer queries
+func fuzzyStudents(s Store, query string, limit int) ([]*Student, error) {
+	q := []rune(strings.Join(searchTokens(query), ""))
+	if len(q) < 2 {
+		return []*Student{}, nil
+	}
+	maxTypos := 1
+	if len(q) > 4 {
+		maxTypos = 2
+	}
+
+	students, err := s.GetStudents()
+	if err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		student  *Student
+		distance int
+	}
+	candidates := make([]*candidate, 0)
+	for _, student := range students {
+		keys := append(searchKeys(student.Name), strings.ToLower(student.Id), strings.ToLower(student.Name))
+		best := maxTypos + 1
+		for _, key := range keys {
+			if d := prefixDistance(q, []rune(key)); d < best {
+				best = d
+			}
+		}
+		if best <= maxTypos {
+			candidates = append(candidates, &candidate{student, best})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	results := make([]*Student, 0, len(candidates))
+	for _, c := range candidates {
+		if len(results) == limit {
+			break
+		}
+		results = append(results, c.student)
+	}
+	return results, nil
+}
+
+// SearchStudents finds the students matching the query by name, stuid,
+// pinyin spelling or initials (each word of the query as a prefix),
+// falling back to tolerating typos if nothing matches exactly
+func SearchStudents(s Store, query string, limit int) ([]*Student, error) {
+	if strings.TrimSpace(query) == "" {
+		return []*Student{}, nil
+	}
+	matches, err := s.MatchStudents(query, limit)
+	if err != nil || len(matches) > 0 {
+		return matches, err
+	}
+	return fuzzyStudents(s, query, limit)
+}
@@ -0,0 +1,1186 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How many times to retry a statement which finds the db file locked
+	// (i.e., SQLITE_BUSY) by the other binary, beyond the busy timeout,
+	// and the delay before the first retry (doubled on each one after)
+	BUSY_RETRIES = 5
+	BUSY_BACKOFF = 50 * time.Millisecond
+)
+
+// StoreMetrics counts the statements run against the sqlite db file, and
+// how often they found it locked
+type StoreMetrics struct {
+	Statements   int64 `json:"statements"`
+	BusyRetries  int64 `json:"busyRetries"`
+	BusyFailures int64 `json:"busyFailures"`
+}
+
+// SQLiteStore is the Store backed by the sqlite db file on the Pi client.
+// It is safe for concurrent use, and meant to be opened once per process.
+type SQLiteStore struct {
+	db      *sql.DB
+	metrics StoreMetrics
+	cipher  *Cipher // nil unless the db is encrypted (see Unlock)
+}
+
+var _ Store = (*SQLiteStore)(nil)
+
+// NewSQLiteStore wraps an open sqlite db (see InitializeDB) as a Store
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: db}
+}
+
+// DB returns the underlying database handle
+func (s *SQLiteStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// Metrics returns a snapshot of the statement and busy retry counts
+func (s *SQLiteStore) Metrics() StoreMetrics {
+	return StoreMetrics{Statements: atomic.LoadInt64(&s.metrics.Statements),
+		BusyRetries:  atomic.LoadInt64(&s.metrics.BusyRetries),
+		BusyFailures: atomic.LoadInt64(&s.metrics.BusyFailures)}
+}
+
+// isBusy reports whether the error means the db file was locked by
+// another connection (or process)
+func isBusy(err error) bool {
+	if e, ok := err.(sqlite3.Error); ok {
+		return e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// retry runs fn, running it again with exponential backoff for as long as
+// it fails with SQLITE_BUSY, up to BUSY_RETRIES times
+func (s *SQLiteStore) retry(fn func() error) error {
+	atomic.AddInt64(&s.metrics.Statements, 1)
+
+	backoff := BUSY_BACKOFF
+	err := fn()
+	for attempt := 0; isBusy(err) && attempt < BUSY_RETRIES; attempt++ {
+		atomic.AddInt64(&s.metrics.BusyRetries, 1)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+	if isBusy(err) {
+		atomic.AddInt64(&s.metrics.BusyFailures, 1)
+	}
+	return err
+}
+
+// notFound translates the database/sql "no rows" error into NOT_FOUND
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return NOT_FOUND
+	}
+	return err
+}
+
+// execute runs the statement, retrying while the db file is busy
+func (s *SQLiteStore) execute(query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := s.retry(func() error {
+		var err error
+		res, err = s.db.Exec(query, args...)
+		return err
+	})
+	return res, err
+}
+
+// exec runs the statement, and reports NOT_FOUND if it affected no rows
+func (s *SQLiteStore) exec(query string, args ...interface{}) error {
+	res, err := s.execute(query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return NOT_FOUND
+	}
+	return err
+}
+
+// queryRow scans the single row result of the query into dest, or
+// returns NOT_FOUND
+func (s *SQLiteStore) queryRow(query string, args []interface{}, dest ...interface{}) error {
+	return notFound(s.retry(func() error {
+		return s.db.QueryRow(query, args...).Scan(dest...)
+	}))
+}
+
+// queryRows invokes scan on each row of the query result; reset is called
+// before each attempt, so a retry does not duplicate results
+func (s *SQLiteStore) queryRows(query string, args []interface{}, reset func(), scan func(*sql.Rows) error) error {
+	return s.retry(func() error {
+		reset()
+		rows, err := s.db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			if err := scan(rows); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+// transaction runs fn inside a single transaction, committing only if it
+// succeeds, and retrying the whole transaction while the db file is busy
+func (s *SQLiteStore) transaction(fn func(*sql.Tx) error) error {
+	return s.retry(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// byName orders students as the db does, by name then stuid
+func byName(a, b *Student) bool {
+	if a.Name == b.Name {
+		return a.Id < b.Id
+	}
+	return a.Name < b.Name
+}
+
+// decrypted decrypts the names of the students as read from the db and,
+// since the db can only order them by their encrypted names, sorts them
+// again with less
+func (s *SQLiteStore) decrypted(students []*Student, less func(a, b *Student) bool) error {
+	if s.cipher == nil {
+		return nil
+	}
+	for _, student := range students {
+		var err error
+		if student.Name, err = s.cipher.Decrypt(student.Name); err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(students, func(i, j int) bool {
+		return less(students[i], students[j])
+	})
+	return nil
+}
+
+/* Students */
+
+func (s *SQLiteStore) GetStudents() ([]*Student, error) {
+	var results []*Student
+	err := s.queryRows(GET_STUDENTS, nil,
+		func() { results = make([]*Student, 0) },
+		func(rows *sql.Rows) error {
+			student := new(Student)
+			if err := rows.Scan(&student.Id, &student.Name); err != nil {
+				return err
+			}
+			results = append(results, student)
+			return nil
+		})
+	if err != nil {
+		return results, err
+	}
+	return results, s.decrypted(results, byName)
+}
+
+func (s *SQLiteStore) GetStudent(stuid string) (*Student, error) {
+	student := new(Student)
+	if err := s.queryRow(GET_STUDENT, []interface{}{stuid}, &student.Id, &student.Name); err != nil {
+		return nil, err
+	}
+	if err := s.decrypted([]*Student{student}, byName); err != nil {
+		return nil, err
+	}
+	return student, nil
+}
+
+// addStudent runs ADD_STUDENT, which does nothing if the stuid is in use
+// (and not in the trash), encrypting the name with the Cipher (if any)
+func addStudent(exec func(string, ...interface{}) (sql.Result, error), c *Cipher, student *Student) error {
+	res, err := exec(ADD_STUDENT, student.Id, c.Encrypt(student.Name))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return DUPLICATE_STUDENT
+	} else if err != nil {
+		return err
+	}
+	if c != nil {
+		// the student_first_card trigger knows nothing of encryption: the
+		// plain stuid would give away the barcode, so there is no such card
+		_, err = exec(DELETE_FIRST_CARD, student.Id, student.Id)
+	}
+	return err
+}
+
+func (s *SQLiteStore) AddStudent(student *Student) error {
+	return addStudent(s.execute, s.cipher, student)
+}
+
+func (s *SQLiteStore) UpdateStudent(originalId string, student *Student) error {
+	return s.exec(UPDATE_STUDENT, student.Id, s.cipher.Encrypt(student.Name), originalId)
+}
+
+func (s *SQLiteStore) DeleteStudent(stuid string, when time.Time) error {
+	return s.exec(DELETE_STUDENT, when.Unix(), stuid)
+}
+
+func (s *SQLiteStore) MatchStudents(query string, limit int) ([]*Student, error) {
+	if s.cipher != nil {
+		// the fts index has no search terms for encrypted names
+		students, err := s.GetStudents()
+		if err != nil {
+			return nil, err
+		}
+		return matchStudents(students, query, limit), nil
+	}
+
+	var results []*Student
+	match := matchQuery(query)
+	if match == "" {
+		return []*Student{}, nil
+	}
+	err := s.queryRows(MATCH_STUDENTS, []interface{}{match, limit},
+		func() { results = make([]*Student, 0) },
+		func(rows *sql.Rows) error {
+			student := new(Student)
+			if err := rows.Scan(&student.Id, &student.Name); err != nil {
+				return err
+			}
+			results = append(results, student)
+			return nil
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) ImportStudents(add, update []*Student) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		for _, student := range add {
+			if err := addStudent(tx.Exec, s.cipher, student); err != nil {
+				return err
+			}
+		}
+		for _, student := range update {
+			res, err := tx.Exec(UPDATE_STUDENT, student.Id, s.cipher.Encrypt(student.Name), student.Id)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err == nil && n == 0 {
+				return NOT_FOUND
+			}
+		}
+		return nil
+	})
+}
+
+/* Cards */
+
+func (s *SQLiteStore) GetCards(stuid string) ([]*Card, error) {
+	var results []*Card
+	err := s.queryRows(GET_CARDS, []interface{}{stuid},
+		func() { results = make([]*Card, 0) },
+		func(rows *sql.Rows) error {
+			c := new(Card)
+			if err := rows.Scan(&c.Barcode, &c.StudentId, &c.Issued, &c.Revoked); err != nil {
+				return err
+			}
+			var err error
+			c.Barcode, err = s.cipher.Decrypt(c.Barcode)
+			results = append(results, c)
+			return err
+		})
+	if err == nil && s.cipher != nil {
+		sort.SliceStable(results, func(i, j int) bool {
+			if results[i].Issued == results[j].Issued {
+				return results[i].Barcode < results[j].Barcode
+			}
+			return results[i].Issued < results[j].Issued
+		})
+	}
+	return results, err
+}
+
+func (s *SQLiteStore) GetCard(barcode string) (*Card, error) {
+	c := new(Card)
+	if err := s.queryRow(GET_CARD, []interface{}{s.cipher.EncryptKey(barcode)}, &c.Barcode, &c.StudentId, &c.Issued, &c.Revoked); err != nil {
+		return nil, err
+	}
+	var err error
+	c.Barcode, err = s.cipher.Decrypt(c.Barcode)
+	return c, err
+}
+
+func (s *SQLiteStore) IssueCard(c *Card, replace bool) error {
+	if s.cipher != nil && c.Barcode == c.StudentId {
+		return STUID_IS_BARCODE
+	}
+	return s.transaction(func(tx *sql.Tx) error {
+		if replace {
+			if _, err := tx.Exec(REVOKE_STUDENT_CARDS, c.Issued, c.StudentId); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ADD_CARD, s.cipher.EncryptKey(c.Barcode), c.StudentId, c.Issued)
+		return err
+	})
+}
+
+func (s *SQLiteStore) RevokeCard(barcode string, when time.Time) error {
+	return s.exec(REVOKE_CARD, when.Unix(), s.cipher.EncryptKey(barcode))
+}
+
+/* Assignments */
+
+func (s *SQLiteStore) GetAssignments(termId int64) ([]*Assignment, error) {
+	var results []*Assignment
+	err := s.queryRows(GET_ASSIGNMENTS, []interface{}{termId},
+		func() { results = make([]*Assignment, 0) },
+		func(rows *sql.Rows) error {
+			a := new(Assignment)
+			if err := rows.Scan(&a.Id, &a.Title, &a.Posted, &a.Due, &a.Term, &a.Scale, &a.MaxPoints); err != nil {
+				return err
+			}
+			results = append(results, a)
+			return nil
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) GetAssignment(id int64) (*Assignment, error) {
+	a := new(Assignment)
+	if err := s.queryRow(GET_ASSIGNMENT, []interface{}{id}, &a.Id, &a.Title, &a.Posted, &a.Due, &a.Term, &a.Scale, &a.MaxPoints); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (s *SQLiteStore) AddAssignment(a *Assignment) (int64, error) {
+	res, err := s.execute(ADD_ASSIGNMENT, a.Title, a.Posted, a.Due, a.Scale, a.MaxPoints)
+	if err != nil {
+		return BAD_PK, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *SQLiteStore) UpdateAssignment(a *Assignment) error {
+	return s.exec(UPDATE_ASSIGNMENT, a.Title, a.Due, a.Scale, a.MaxPoints, a.Id)
+}
+
+func (s *SQLiteStore) DeleteAssignment(id int64) error {
+	return s.exec(DELETE_ASSIGNMENT, id)
+}
+
+/* Terms */
+
+func (s *SQLiteStore) GetTerms() ([]*Term, error) {
+	var results []*Term
+	err := s.queryRows(GET_TERMS, nil,
+		func() { results = make([]*Term, 0) },
+		func(rows *sql.Rows) error {
+			t := new(Term)
+			if err := rows.Scan(&t.Id, &t.Name, &t.Started, &t.Closed); err != nil {
+				return err
+			}
+			results = append(results, t)
+			return nil
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) GetTerm(id int64) (*Term, error) {
+	t := new(Term)
+	if err := s.queryRow(GET_TERM, []interface{}{id}, &t.Id, &t.Name, &t.Started, &t.Closed); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *SQLiteStore) GetTermRoster(termId int64) ([]*Student, error) {
+	var results []*Student
+	err := s.queryRows(GET_TERM_ROSTER, []interface{}{termId},
+		func() { results = make([]*Student, 0) },
+		func(rows *sql.Rows) error {
+			student := new(Student)
+			if err := rows.Scan(&student.Id, &student.Name); err != nil {
+				return err
+			}
+			results = append(results, student)
+			return nil
+		})
+	if err != nil {
+		return results, err
+	}
+	return results, s.decrypted(results, byName)
+}
+
+func (s *SQLiteStore) CloseTerm(t *Term, carryRoster bool) (int64, error) {
+	var id int64
+	err := s.transaction(func(tx *sql.Tx) error {
+		var started int64
+		if err := tx.QueryRow(TERM_STARTED).Scan(&started); err != nil {
+			return err
+		}
+		res, err := tx.Exec(ADD_TERM, t.Name, started, t.Closed)
+		if err != nil {
+			return err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+
+		statements := []string{ARCHIVE_ROSTER, ARCHIVE_ASSIGNMENTS, ARCHIVE_CLASS_ROLES}
+		if !carryRoster {
+			statements = append(statements, ARCHIVE_STUDENTS)
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement, id); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(CLEAR_SETTING, CURRENT_ASSIGNMENT)
+		return err
+	})
+	return id, err
+}
+
+func (s *SQLiteStore) DeleteTerm(id int64) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(DELETE_TERM_ASSIGNMENTS, id); err != nil {
+			return err
+		}
+		res, err := tx.Exec(DELETE_TERM, id)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return NOT_FOUND
+		}
+		for _, statement := range []string{DELETE_TERM_STUDENTS, MOVE_TERM_STUDENTS, DELETE_TERM_CLASS_ROLES} {
+			if _, err := tx.Exec(statement, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/* Submissions */
+
+func (s *SQLiteStore) GetSubmissions(assignmentId int64) ([]*Submission, error) {
+	var results []*Submission
+	err := s.queryRows(GET_SUBMISSIONS, []interface{}{assignmentId},
+		func() { results = make([]*Submission, 0) },
+		func(rows *sql.Rows) error {
+			sub := new(Submission)
+			if err := rows.Scan(&sub.StudentId, &sub.AssignmentId, &sub.Posted, &sub.Grade, &sub.Comment, &sub.ScannedBy); err != nil {
+				return err
+			}
+			results = append(results, sub)
+			return nil
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) Submit(stuid string, assignmentId int64, when time.Time) error {
+	_, err := s.execute(SUBMIT, stuid, assignmentId, when.Unix())
+	return err
+}
+
+func (s *SQLiteStore) Unsubmit(stuid string, assignmentId int64, when time.Time) error {
+	_, err := s.execute(UNSUBMIT, when.Unix(), stuid, assignmentId)
+	return err
+}
+
+func (s *SQLiteStore) GradeSubmission(sub *Submission) error {
+	return s.exec(GRADE, sub.Grade, sub.Comment, sub.StudentId, sub.AssignmentId)
+}
+
+/* Groups */
+
+// getGroupMembers returns the members of each group of the assignment,
+// by group id
+func (s *SQLiteStore) getGroupMembers(assignmentId int64) (map[int64][]string, error) {
+	var (
+		groups   []int64
+		students []*Student
+	)
+	err := s.queryRows(GET_GROUP_MEMBERS, []interface{}{assignmentId},
+		func() { groups, students = make([]int64, 0), make([]*Student, 0) },
+		func(rows *sql.Rows) error {
+			var groupId int64
+			student := new(Student)
+			if err := rows.Scan(&groupId, &student.Id, &student.Name); err != nil {
+				return err
+			}
+			groups = append(groups, groupId)
+			students = append(students, student)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	group := make(map[string]int64)
+	for i, student := range students {
+		group[student.Id] = groups[i]
+	}
+	if err := s.decrypted(students, byName); err != nil {
+		return nil, err
+	}
+	members := make(map[int64][]string)
+	for _, student := range students {
+		members[group[student.Id]] = append(members[group[student.Id]], student.Id)
+	}
+	return members, nil
+}
+
+func (s *SQLiteStore) GetGroups(assignmentId int64) ([]*Group, error) {
+	var results []*Group
+	err := s.queryRows(GET_GROUPS, []interface{}{assignmentId},
+		func() { results = make([]*Group, 0) },
+		func(rows *sql.Rows) error {
+			g := new(Group)
+			if err := rows.Scan(&g.Id, &g.AssignmentId, &g.Name); err != nil {
+				return err
+			}
+			results = append(results, g)
+			return nil
+		})
+	if err != nil {
+		return results, err
+	}
+	members, err := s.getGroupMembers(assignmentId)
+	for _, g := range results {
+		g.Members = members[g.Id]
+	}
+	return results, err
+}
+
+func (s *SQLiteStore) GetGroup(id int64) (*Group, error) {
+	g := new(Group)
+	if err := s.queryRow(GET_GROUP, []interface{}{id}, &g.Id, &g.AssignmentId, &g.Name); err != nil {
+		return nil, err
+	}
+	members, err := s.getGroupMembers(g.AssignmentId)
+	g.Members = members[g.Id]
+	return g, err
+}
+
+// addGroupMember adds the student to the group, unless they are in
+// another group for the same assignment
+func addGroupMember(tx *sql.Tx, groupId, assignmentId int64, stuid string) error {
+	var existing int64
+	err := tx.QueryRow(GET_MEMBER_GROUP, assignmentId, stuid).Scan(&existing)
+	if err == nil {
+		return GROUPED
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = tx.Exec(ADD_GROUP_MEMBER, groupId, assignmentId, stuid)
+	return err
+}
+
+func (s *SQLiteStore) AddGroup(g *Group) (int64, error) {
+	var id int64
+	err := s.transaction(func(tx *sql.Tx) error {
+		res, err := tx.Exec(ADD_GROUP, g.AssignmentId, g.Name)
+		if err != nil {
+			return err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+		for _, stuid := range g.Members {
+			if err := addGroupMember(tx, id, g.AssignmentId, stuid); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return BAD_PK, err
+	}
+	return id, nil
+}
+
+func (s *SQLiteStore) AddGroupMember(groupId int64, stuid string) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		var id, assignmentId int64
+		var name string
+		if err := tx.QueryRow(GET_GROUP, groupId).Scan(&id, &assignmentId, &name); err != nil {
+			return notFound(err)
+		}
+		return addGroupMember(tx, groupId, assignmentId, stuid)
+	})
+}
+
+func (s *SQLiteStore) RemoveGroupMember(groupId int64, stuid string) error {
+	return s.exec(REMOVE_GROUP_MEMBER, groupId, stuid)
+}
+
+func (s *SQLiteStore) DeleteGroup(id int64) error {
+	return s.exec(DELETE_GROUP, id)
+}
+
+func (s *SQLiteStore) SubmitGroup(stuid string, assignmentId int64, when time.Time) (int, error) {
+	var n int64
+	err := s.transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(SUBMIT, stuid, assignmentId, when.Unix()); err != nil {
+			return err
+		}
+		res, err := tx.Exec(SUBMIT_FOR_GROUP, when.Unix(), stuid, assignmentId)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return int(n), err
+}
+
+/* Retention */
+
+func (s *SQLiteStore) GetFormerStudents() ([]*FormerStudent, error) {
+	var results []*FormerStudent
+	err := s.queryRows(GET_FORMER_STUDENTS, nil,
+		func() { results = make([]*FormerStudent, 0) },
+		func(rows *sql.Rows) error {
+			f := &FormerStudent{Student: new(Student)}
+			var closed int64
+			if err := rows.Scan(&f.Student.Id, &f.Student.Name, &f.Student.Deleted, &f.Student.Term, &closed, &f.Cards); err != nil {
+				return err
+			}
+			f.Left = formerLeft(f.Student, closed)
+			var err error
+			f.Student.Name, err = s.cipher.Decrypt(f.Student.Name)
+			results = append(results, f)
+			return err
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) AnonymizeStudent(stuid string, when time.Time) (string, error) {
+	var anonymousId string
+	err := s.transaction(func(tx *sql.Tx) error {
+		var rowid int64
+		if err := tx.QueryRow(GET_STUDENT_ROWID, stuid).Scan(&rowid); err != nil {
+			return notFound(err)
+		}
+		anonymousId = fmt.Sprintf(ANONYMOUS_ID_FORMAT, rowid)
+		if _, err := tx.Exec(DELETE_STUDENT_CARDS, stuid); err != nil {
+			return err
+		}
+		// and from the changes logged for sync; the new stuid is not a
+		// change to sync, as it would log the old one again
+		if _, err := tx.Exec(SCRUB_SYNC_EVENTS, anonymousId, ANONYMOUS_NAME, stuid); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ADD_SETTING_ONCE, SYNC_MUTED, "1"); err != nil {
+			return err
+		}
+		// the new stuid cascades to the submissions, attendance and rosters
+		if _, err := tx.Exec(ANONYMIZE_STUDENT, anonymousId, ANONYMOUS_NAME, when.Unix(), stuid); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ANONYMIZE_TERM_ROSTER, ANONYMOUS_NAME, anonymousId); err != nil {
+			return err
+		}
+		_, err := tx.Exec(CLEAR_SETTING, SYNC_MUTED)
+		return err
+	})
+	return anonymousId, err
+}
+
+/* Trash */
+
+func (s *SQLiteStore) GetDeletedStudents() ([]*Student, error) {
+	var results []*Student
+	err := s.queryRows(GET_DELETED_STUDENTS, nil,
+		func() { results = make([]*Student, 0) },
+		func(rows *sql.Rows) error {
+			student := new(Student)
+			if err := rows.Scan(&student.Id, &student.Name, &student.Deleted); err != nil {
+				return err
+			}
+			results = append(results, student)
+			return nil
+		})
+	if err != nil {
+		return results, err
+	}
+	return results, s.decrypted(results, func(a, b *Student) bool {
+		if a.Deleted != b.Deleted {
+			return a.Deleted > b.Deleted
+		}
+		return byName(a, b)
+	})
+}
+
+func (s *SQLiteStore) GetDeletedSubmissions() ([]*Submission, error) {
+	var results []*Submission
+	err := s.queryRows(GET_DELETED_SUBMISSIONS, nil,
+		func() { results = make([]*Submission, 0) },
+		func(rows *sql.Rows) error {
+			sub := new(Submission)
+			if err := rows.Scan(&sub.StudentId, &sub.AssignmentId, &sub.Posted, &sub.Deleted); err != nil {
+				return err
+			}
+			results = append(results, sub)
+			return nil
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) RestoreStudent(stuid string) error {
+	return s.exec(RESTORE_STUDENT, stuid)
+}
+
+func (s *SQLiteStore) RestoreSubmission(stuid string, assignmentId int64) error {
+	return s.exec(RESTORE_SUBMISSION, stuid, assignmentId)
+}
+
+// changeAll runs each of the statements with the same args, in a single
+// transaction, returning the total number of rows they affected
+func (s *SQLiteStore) changeAll(statements []string, args ...interface{}) (int, error) {
+	var total int
+	err := s.transaction(func(tx *sql.Tx) error {
+		total = 0
+		for _, statement := range statements {
+			res, err := tx.Exec(statement, args...)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			total += int(n)
+		}
+		return nil
+	})
+	return total, err
+}
+
+func (s *SQLiteStore) RestoreDeleted(when time.Time) (int, error) {
+	return s.changeAll([]string{RESTORE_DELETED_STUDENTS, RESTORE_DELETED_SUBMISSIONS}, when.Unix())
+}
+
+func (s *SQLiteStore) RestoreDeletedSubmissions(when time.Time) (int, error) {
+	return s.changeAll([]string{RESTORE_DELETED_SUBMISSIONS}, when.Unix())
+}
+
+func (s *SQLiteStore) PurgeDeleted(before time.Time) (int, error) {
+	return s.changeAll([]string{PURGE_SUBMISSIONS, PURGE_STUDENTS}, before.Unix())
+}
+
+/* Attendance */
+
+func (s *SQLiteStore) GetPeriods() ([]*Period, error) {
+	var results []*Period
+	err := s.queryRows(GET_PERIODS, nil,
+		func() { results = make([]*Period, 0) },
+		func(rows *sql.Rows) error {
+			p := new(Period)
+			if err := rows.Scan(&p.Id, &p.Name, &p.Starts, &p.Ends, &p.Grace); err != nil {
+				return err
+			}
+			results = append(results, p)
+			return nil
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) AddPeriod(p *Period) (int64, error) {
+	res, err := s.execute(ADD_PERIOD, p.Name, p.Starts, p.Ends, p.Grace)
+	if err != nil {
+		return BAD_PK, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *SQLiteStore) DeletePeriod(id int64) error {
+	return s.exec(DELETE_PERIOD, id)
+}
+
+func (s *SQLiteStore) GetAttendance(day string) ([]*Attendance, error) {
+	var results []*Attendance
+	err := s.queryRows(GET_ATTENDANCE, []interface{}{day},
+		func() { results = make([]*Attendance, 0) },
+		func(rows *sql.Rows) error {
+			a := new(Attendance)
+			if err := rows.Scan(&a.StudentId, &a.Day, &a.PeriodId, &a.CheckedIn, &a.CheckedOut, &a.Status); err != nil {
+				return err
+			}
+			results = append(results, a)
+			return nil
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) CheckIn(a *Attendance) error {
+	err := s.exec(CHECK_IN, a.StudentId, a.Day, a.PeriodId, a.CheckedIn, a.Status)
+	if err == NOT_FOUND {
+		return DUPLICATE_ATTENDANCE
+	}
+	return err
+}
+
+func (s *SQLiteStore) CheckOut(stuid, day string, periodId int64, when time.Time) error {
+	return s.exec(CHECK_OUT, when.Unix(), stuid, day, periodId)
+}
+
+/* Unknown scans */
+
+// scanUnknownScan reads one row of GET_UNKNOWN_SCANS(_BY)
+func (s *SQLiteStore) scanUnknownScan(rows *sql.Rows) (*UnknownScan, error) {
+	u := new(UnknownScan)
+	if err := rows.Scan(&u.Id, &u.Barcode, &u.Posted, &u.Device, &u.AssignmentId); err != nil {
+		return u, err
+	}
+	var err error
+	u.Barcode, err = s.cipher.Decrypt(u.Barcode)
+	return u, err
+}
+
+func (s *SQLiteStore) GetUnknownScans() ([]*UnknownScan, error) {
+	var results []*UnknownScan
+	err := s.queryRows(GET_UNKNOWN_SCANS, nil,
+		func() { results = make([]*UnknownScan, 0) },
+		func(rows *sql.Rows) error {
+			u, err := s.scanUnknownScan(rows)
+			if err != nil {
+				return err
+			}
+			results = append(results, u)
+			return nil
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) AddUnknownScan(u *UnknownScan) (int64, error) {
+	res, err := s.execute(ADD_UNKNOWN_SCAN, s.cipher.EncryptKey(u.Barcode), u.Posted, u.Device, u.AssignmentId)
+	if err != nil {
+		return BAD_PK, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *SQLiteStore) DismissUnknownScans(barcode string) error {
+	return s.exec(DELETE_UNKNOWN_SCANS, s.cipher.EncryptKey(barcode))
+}
+
+func (s *SQLiteStore) ResolveUnknownScans(barcode string, student *Student, create bool) (int, error) {
+	var submitted int
+	stored := s.cipher.EncryptKey(barcode)
+	err := s.transaction(func(tx *sql.Tx) error {
+		submitted = 0
+		if create {
+			if err := addStudent(tx.Exec, s.cipher, student); err != nil {
+				return err
+			}
+		}
+		// a new student whose stuid is the barcode has it as their
+		// first card already (via the student_first_card trigger), unless
+		// the db is encrypted (see CreateFromUnknownBarcode)
+		if !create || student.Id != barcode || s.cipher != nil {
+			if _, err := tx.Exec(ADD_CARD, stored, student.Id, time.Now().Unix()); err != nil {
+				return err
+			}
+		}
+
+		rows, err := tx.Query(GET_UNKNOWN_SCANS_BY, stored)
+		if err != nil {
+			return err
+		}
+		scans := make([]*UnknownScan, 0)
+		for rows.Next() {
+			u, err := s.scanUnknownScan(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			scans = append(scans, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(scans) == 0 {
+			return NOT_FOUND
+		}
+
+		for _, u := range scans {
+			if u.AssignmentId == 0 {
+				continue
+			}
+			if _, err := tx.Exec(SUBMIT, student.Id, u.AssignmentId, u.Posted); err != nil {
+				return err
+			}
+			submitted++
+		}
+		_, err = tx.Exec(DELETE_UNKNOWN_SCANS, stored)
+		return err
+	})
+	return submitted, err
+}
+
+/* Outbox */
+
+// getOutboxMessages reads the result of GET_OUTBOX_MESSAGES or
+// GET_PENDING_MESSAGES
+func (s *SQLiteStore) getOutboxMessages(query string) ([]*OutboxMessage, error) {
+	var results []*OutboxMessage
+	err := s.queryRows(query, nil,
+		func() { results = make([]*OutboxMessage, 0) },
+		func(rows *sql.Rows) error {
+			m := new(OutboxMessage)
+			if err := rows.Scan(&m.Id, &m.Key, &m.Method, &m.Path, &m.Params, &m.Created, &m.Attempts, &m.NextAttempt, &m.Status, &m.Error, &m.Sent); err != nil {
+				return err
+			}
+			var err error
+			if m.Params, err = s.cipher.Decrypt(m.Params); err != nil {
+				return err
+			}
+			results = append(results, m)
+			return nil
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) AddOutboxMessage(m *OutboxMessage) (int64, error) {
+	res, err := s.execute(ADD_OUTBOX_MESSAGE, m.Key, m.Method, m.Path, s.cipher.Encrypt(m.Params), m.Created, m.NextAttempt)
+	if err != nil {
+		return BAD_PK, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *SQLiteStore) GetOutboxMessages() ([]*OutboxMessage, error) {
+	return s.getOutboxMessages(GET_OUTBOX_MESSAGES)
+}
+
+func (s *SQLiteStore) GetPendingMessages() ([]*OutboxMessage, error) {
+	return s.getOutboxMessages(GET_PENDING_MESSAGES)
+}
+
+func (s *SQLiteStore) UpdateOutboxMessage(m *OutboxMessage) error {
+	return s.exec(UPDATE_OUTBOX_MESSAGE, m.Attempts, m.NextAttempt, m.Status, m.Error, m.Sent, m.Id)
+}
+
+func (s *SQLiteStore) RetryOutboxMessage(id int64) error {
+	return s.exec(RETRY_OUTBOX_MESSAGE, id)
+}
+
+func (s *SQLiteStore) PurgeOutbox(before time.Time) (int, error) {
+	return s.changeAll([]string{PURGE_OUTBOX}, before.Unix())
+}
+
+/* Teachers */
+
+func (s *SQLiteStore) GetTeachers() ([]*Teacher, error) {
+	var results []*Teacher
+	err := s.queryRows(GET_TEACHERS, nil,
+		func() { results = make([]*Teacher, 0) },
+		func(rows *sql.Rows) error {
+			t := new(Teacher)
+			if err := rows.Scan(&t.Id, &t.Username, &t.Name, &t.Hash, &t.Role, &t.Created, &t.LastLogin); err != nil {
+				return err
+			}
+			results = append(results, t)
+			return nil
+		})
+	return results, err
+}
+
+// getTeacher runs the single row lookup of a Teacher
+func (s *SQLiteStore) getTeacher(query string, arg interface{}) (*Teacher, error) {
+	t := new(Teacher)
+	if err := s.queryRow(query, []interface{}{arg}, &t.Id, &t.Username, &t.Name, &t.Hash, &t.Role, &t.Created, &t.LastLogin); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *SQLiteStore) GetTeacher(id int64) (*Teacher, error) {
+	return s.getTeacher(GET_TEACHER, id)
+}
+
+func (s *SQLiteStore) GetTeacherByUsername(username string) (*Teacher, error) {
+	return s.getTeacher(GET_TEACHER_BY_USERNAME, username)
+}
+
+func (s *SQLiteStore) AddTeacher(t *Teacher) (int64, error) {
+	res, err := s.execute(ADD_TEACHER, t.Username, t.Name, t.Hash, t.Role, t.Created)
+	if err != nil {
+		return BAD_PK, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return BAD_PK, DUPLICATE_TEACHER
+	} else if err != nil {
+		return BAD_PK, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *SQLiteStore) UpdateTeacher(t *Teacher) error {
+	return s.exec(UPDATE_TEACHER, t.Name, t.Hash, t.Role, t.LastLogin, t.Id)
+}
+
+func (s *SQLiteStore) DeleteTeacher(id int64) error {
+	n, err := s.changeAll([]string{DELETE_TEACHER_TOKENS, DELETE_TEACHER}, id)
+	if err == nil && n == 0 {
+		return NOT_FOUND
+	}
+	return err
+}
+
+/* Class roles */
+
+func (s *SQLiteStore) GetClassRoles(teacherId int64) (map[int64]string, error) {
+	var results map[int64]string
+	err := s.queryRows(GET_CLASS_ROLES, []interface{}{teacherId},
+		func() { results = make(map[int64]string) },
+		func(rows *sql.Rows) error {
+			var term int64
+			var role string
+			if err := rows.Scan(&term, &role); err != nil {
+				return err
+			}
+			results[term] = role
+			return nil
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) SetClassRole(teacherId, term int64, role string) error {
+	if role == "" {
+		_, err := s.execute(CLEAR_CLASS_ROLE, teacherId, term)
+		return err
+	}
+	_, err := s.execute(SET_CLASS_ROLE, teacherId, term, role)
+	return err
+}
+
+/* API tokens */
+
+func (s *SQLiteStore) GetAPITokens() ([]*APIToken, error) {
+	var results []*APIToken
+	err := s.queryRows(GET_API_TOKENS, nil,
+		func() { results = make([]*APIToken, 0) },
+		func(rows *sql.Rows) error {
+			t := new(APIToken)
+			if err := rows.Scan(&t.Id, &t.TeacherId, &t.Name, &t.Hash, &t.Created, &t.LastUsed); err != nil {
+				return err
+			}
+			results = append(results, t)
+			return nil
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) GetAPITokenByHash(hash string) (*APIToken, error) {
+	t := new(APIToken)
+	if err := s.queryRow(GET_API_TOKEN_BY_HASH, []interface{}{hash}, &t.Id, &t.TeacherId, &t.Name, &t.Hash, &t.Created, &t.LastUsed); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *SQLiteStore) AddAPIToken(t *APIToken) (int64, error) {
+	res, err := s.execute(ADD_API_TOKEN, t.TeacherId, t.Name, t.Hash, t.Created)
+	if err != nil {
+		return BAD_PK, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *SQLiteStore) TouchAPIToken(id int64, when time.Time) error {
+	return s.exec(TOUCH_API_TOKEN, when.Unix(), id)
+}
+
+func (s *SQLiteStore) DeleteAPIToken(id int64) error {
+	return s.exec(DELETE_API_TOKEN, id)
+}
+
+/* Live events */
+
+func (s *SQLiteStore) GetLiveEvents(since int64, limit int) ([]*LiveEvent, error) {
+	var results []*LiveEvent
+	err := s.queryRows(GET_LIVE_EVENTS, []interface{}{since, limit},
+		func() { results = make([]*LiveEvent, 0) },
+		func(rows *sql.Rows) error {
+			e := new(LiveEvent)
+			if err := rows.Scan(&e.Id, &e.Kind, &e.Outcome, &e.StudentId, &e.Assignment, &e.Detail, &e.Created); err != nil {
+				return err
+			}
+			results = append(results, e)
+			return nil
+		})
+	return results, err
+}
+
+func (s *SQLiteStore) GetLatestLiveEvent(kind string) (*LiveEvent, error) {
+	e := new(LiveEvent)
+	if err := s.queryRow(GET_LATEST_LIVE_EVENT, []interface{}{kind}, &e.Id, &e.Kind, &e.Outcome, &e.StudentId, &e.Assignment, &e.Detail, &e.Created); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (s *SQLiteStore) AddLiveEvent(e *LiveEvent) (int64, error) {
+	res, err := s.execute(ADD_LIVE_EVENT, e.Kind, e.Outcome, e.StudentId, e.Assignment, e.Detail, e.Created)
+	if err != nil {
+		return BAD_PK, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *SQLiteStore) PurgeLiveEvents(before time.Time) (int, error) {
+	return s.changeAll([]string{PURGE_LIVE_EVENTS}, before.Unix())
+}
+
+/* Settings */
+
+func (s *SQLiteStore) GetSetting(key string) (string, error) {
+	var value string
+	err := s.queryRow(GET_SETTING, []interface{}{key}, &value)
+	return value, err
+}
+
+func (s *SQLiteStore) SetSetting(key, value string) error {
+	_, err := s.execute(SET_SETTING, key, value)
+	return err
+}
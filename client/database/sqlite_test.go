@@ -0,0 +1,146 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	STRESS_WORKERS = 4  // per handle
+	STRESS_ROUNDS  = 50 // per worker
+)
+
+// TestConcurrentHandles opens the db file twice, as the PiScanner and the
+// WebApp do, and has one handle record scans while the other makes the
+// changes a teacher would, none of which should find the file locked
+func TestConcurrentHandles(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coords := ConnCoordinates{DBPath: t.TempDir(), DBFile: "test.sqlite", DBTablesPath: wd}
+	scanner, err := OpenStore(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer scanner.Close()
+	webapp, err := OpenStore(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webapp.Close()
+
+	now := time.Now()
+	a, err := EnsureCurrentAssignment(webapp, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for w := 0; w < STRESS_WORKERS; w++ {
+		for i := 0; i < STRESS_ROUNDS; i++ {
+			id := fmt.Sprintf("s%d-%d", w, i)
+			if err := webapp.AddStudent(&Student{Id: id, Name: id}); err != nil {
+				t.Fatal(err)
+			}
+			if err := webapp.IssueCard(&Card{Barcode: "card-" + id, StudentId: id, Issued: now.Unix()}, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*STRESS_WORKERS*STRESS_ROUNDS)
+	work := func(fn func(w, i int) error) {
+		for w := 0; w < STRESS_WORKERS; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < STRESS_ROUNDS; i++ {
+					if err := fn(w, i); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(w)
+		}
+	}
+
+	// the PiScanner: each card scanned in
+	work(func(w, i int) error {
+		result, err := ProcessScan(scanner, fmt.Sprintf("card-s%d-%d", w, i), "dev", time.Now())
+		if err == nil && result.Outcome != SCAN_SUBMITTED {
+			err = fmt.Errorf("the scan was %s", result.Outcome)
+		}
+		return err
+	})
+
+	// the WebApp: new students, grades and settings, as they are scanned
+	work(func(w, i int) error {
+		id := fmt.Sprintf("w%d-%d", w, i)
+		if err := webapp.AddStudent(&Student{Id: id, Name: id}); err != nil {
+			return err
+		}
+		if err := webapp.Submit(id, a.Id, time.Now()); err != nil {
+			return err
+		}
+		if err := webapp.GradeSubmission(&Submission{StudentId: id, AssignmentId: a.Id, Grade: "A"}); err != nil {
+			return err
+		}
+		if _, err := webapp.GetStudents(); err != nil {
+			return err
+		}
+		return webapp.SetSetting(CLASS_NAME, id)
+	})
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if strings.Contains(err.Error(), "database is locked") {
+			t.Errorf("found the db file locked: %v", err)
+		} else {
+			t.Error(err)
+		}
+	}
+
+	subs, err := webapp.GetSubmissions(a.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 2 * STRESS_WORKERS * STRESS_ROUNDS; len(subs) != want {
+		t.Errorf("got %d submissions, want %d", len(subs), want)
+	}
+	events, err := webapp.GetLiveEvents(0, 10*LIVE_BATCH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scans := 0
+	for _, e := range events {
+		if e.Kind == LIVE_SCAN {
+			scans++
+		}
+	}
+	if want := STRESS_WORKERS * STRESS_ROUNDS; scans != want {
+		t.Errorf("got %d scans, want %d", scans, want)
+	}
+
+	// every statement went through retry, and none ran out of retries
+	for name, s := range map[string]*SQLiteStore{"scanner": scanner, "webapp": webapp} {
+		m := s.Metrics()
+		t.Logf("%s: %+v", name, m)
+		if m.Statements < STRESS_WORKERS*STRESS_ROUNDS {
+			t.Errorf("%s counted %d statements", name, m.Statements)
+		}
+		if m.BusyFailures != 0 {
+			t.Errorf("%s ran out of retries %d times", name, m.BusyFailures)
+		}
+		if m.BusyRetries > m.Statements*BUSY_RETRIES {
+			t.Errorf("%s retried %d times, for %d statements", name, m.BusyRetries, m.Statements)
+		}
+	}
+}
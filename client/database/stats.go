@@ -0,0 +1,162 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// A student is falling behind once they have missed this many
+	// assignments in a row
+	BEHIND_STREAK = 2
+
+	HOURS_PER_DAY = 24
+)
+
+// AssignmentStats summarizes the submissions of one Assignment
+type AssignmentStats struct {
+	Id             int64              `json:"id"`
+	Title          string             `json:"title"`
+	Posted         int64              `json:"posted"`
+	Due            int64              `json:"due"`
+	Students       int                `json:"students"`
+	Submitted      int                `json:"submitted"`
+	OnTime         int                `json:"onTime"`
+	CompletionRate float64            `json:"completionRate"` // submitted, of the students
+	OnTimeRate     float64            `json:"onTimeRate"`     // on time, of the submissions
+	Hours          [HOURS_PER_DAY]int `json:"hours"`          // scans by (local) hour of day
+}
+
+// StudentStats summarizes the submissions of one Student; only assignments
+// which are settled, i.e., past due or (without a deadline) followed by a
+// newer one, count as missed
+type StudentStats struct {
+	Id            string  `json:"id"`
+	Name          string  `json:"name"`
+	Expected      int     `json:"expected"` // settled assignments
+	Completed     int     `json:"completed"`
+	Completion    float64 `json:"completion"`    // completed, of those expected
+	Streak        int     `json:"streak"`        // missed in a row, up to the latest
+	LongestStreak int     `json:"longestStreak"` // missed in a row, ever
+	Behind        bool    `json:"behind"`
+}
+
+// percent returns the fraction as a whole percentage
+func percent(f float64) int {
+	return int(math.Round(f * 100))
+}
+
+// CompletionPercent returns the completion rate as a whole percentage
+func (a *AssignmentStats) CompletionPercent() int {
+	return percent(a.CompletionRate)
+}
+
+// OnTimePercent returns the on-time rate as a whole percentage
+func (a *AssignmentStats) OnTimePercent() int {
+	return percent(a.OnTimeRate)
+}
+
+// CompletionPercent returns the completion of the Student as a whole
+// percentage (0 if no assignment is expected of them yet)
+func (s *StudentStats) CompletionPercent() int {
+	return percent(s.Completion)
+}
+
+// SubmissionStats are the statistics of the assignments of the active
+// term, as of the given time
+type SubmissionStats struct {
+	Generated   int64              `json:"generated"`
+	Assignments []*AssignmentStats `json:"assignments"` // oldest first
+	Students    []*StudentStats    `json:"students"`    // furthest behind first
+	Hours       [HOURS_PER_DAY]int `json:"hours"`       // all the scans
+}
+
+// rate returns n of total as a fraction, or 0 if there are none
+func rate(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// settled reports whether the assignment at index j of the gradebook
+// counts as missed by those who have not submitted it, as of now
+func (g *Gradebook) settled(j int, now time.Time) bool {
+	a := g.Assignments[j]
+	if a.Due > 0 {
+		return now.Unix() > a.Due
+	}
+	return j < len(g.Assignments)-1
+}
+
+// GetSubmissionStats computes the completion and on-time rates and the
+// time-of-day histogram of each assignment of the active term, and the
+// completion and missed streaks of each student
+func GetSubmissionStats(s Store, now time.Time) (*SubmissionStats, error) {
+	g, err := GetGradebook(s)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &SubmissionStats{Generated: now.Unix(),
+		Assignments: make([]*AssignmentStats, len(g.Assignments)),
+		Students:    make([]*StudentStats, len(g.Students))}
+	for j, a := range g.Assignments {
+		stats.Assignments[j] = &AssignmentStats{Id: a.Id, Title: a.Title, Posted: a.Posted, Due: a.Due, Students: len(g.Students)}
+	}
+
+	for i, student := range g.Students {
+		st := &StudentStats{Id: student.Id, Name: student.Name}
+		for j, cell := range g.Cells[i] {
+			as := stats.Assignments[j]
+			if cell.Submitted {
+				as.Submitted++
+				if !cell.Late {
+					as.OnTime++
+				}
+				hour := time.Unix(cell.Posted, 0).Hour()
+				as.Hours[hour]++
+				stats.Hours[hour]++
+			}
+
+			if !g.settled(j, now) {
+				continue
+			}
+			st.Expected++
+			if cell.Submitted {
+				st.Completed++
+				st.Streak = 0
+			} else {
+				st.Streak++
+				if st.Streak > st.LongestStreak {
+					st.LongestStreak = st.Streak
+				}
+			}
+		}
+		st.Completion = rate(st.Completed, st.Expected)
+		st.Behind = st.Streak >= BEHIND_STREAK
+		stats.Students[i] = st
+	}
+
+	for _, as := range stats.Assignments {
+		as.CompletionRate = rate(as.Submitted, as.Students)
+		as.OnTimeRate = rate(as.OnTime, as.Submitted)
+	}
+	sort.SliceStable(stats.Students, func(i, j int) bool {
+		a, b := stats.Students[i], stats.Students[j]
+		if a.Streak != b.Streak {
+			return a.Streak > b.Streak
+		}
+		if (a.Expected == 0) != (b.Expected == 0) {
+			return b.Expected == 0 // nothing expected of them yet: last
+		}
+		return a.Completion < b.Completion
+	})
+	return stats, nil
+}
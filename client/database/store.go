@@ -0,0 +1,701 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// Setting keys
+	CURRENT_ASSIGNMENT   = "current_assignment"
+	ACCOUNT_EMAIL        = "account_email"
+	ACCOUNT_API_CODE     = "account_api_code"
+	SCAN_MODE            = "scan_mode"
+	ATTENDANCE_CHECK_OUT = "attendance_check_out"
+	SESSION_KEY          = "session_key"
+	CLASS_NAME           = "class_name"
+
+	// The term of the assignments not archived yet
+	ACTIVE_TERM = 0
+
+	// The (unregistered) default for the designated account
+	ANONYMOUS_EMAIL = "anonymous"
+
+	// There is only ever one account per client device
+	DESIGNATED_ACCOUNT = 1
+)
+
+var (
+	// NOT_FOUND is returned by Store lookups which match nothing
+	NOT_FOUND = errors.New("No such record")
+	// DUPLICATE_STUDENT is returned on adding a stuid already in use
+	DUPLICATE_STUDENT = errors.New("A student with that id already exists")
+	// DUPLICATE_CARD mirrors the sqlite primary key constraint on barcode
+	DUPLICATE_CARD = errors.New("A card with that barcode already exists")
+	// ARCHIVED is returned on choosing an assignment of a closed term
+	ARCHIVED = errors.New("That assignment belongs to a closed term")
+	// DUPLICATE_ATTENDANCE is returned on a second check-in for a period
+	DUPLICATE_ATTENDANCE = errors.New("That student has already checked in for that period")
+	// GROUPED is returned on adding a student to a second group for the
+	// same assignment
+	GROUPED = errors.New("That student is already in a group for that assignment")
+	// DUPLICATE_TEACHER is returned on adding a username already in use
+	DUPLICATE_TEACHER = errors.New("A teacher with that username already exists")
+)
+
+// Student is a single roster entry, identified by the (scanned) barcode
+// on their card
+type Student struct {
+	Id      string
+	Name    string
+	Deleted int64 // unix time, or 0 unless it is in the trash
+	Term    int64 // the closed term they were left in, or 0 while on the roster
+	// Anonymized is the unix time their name and cards were removed, or 0
+	Anonymized int64
+}
+
+// DeletedSince returns a human readable version of the time the Student
+// was deleted
+func (s *Student) DeletedSince() string {
+	return calculateTimeSince(s.Deleted)
+}
+
+// Card is a scannable barcode issued to a Student; every Student starts
+// with one whose barcode is their stuid
+type Card struct {
+	Barcode   string
+	StudentId string
+	Issued    int64 // unix time
+	Revoked   int64 // unix time, or 0 while the card is valid
+}
+
+// IssuedDate returns the (local) day the Card was issued, if known
+func (c *Card) IssuedDate() string {
+	if c.Issued == 0 {
+		return ""
+	}
+	return time.Unix(c.Issued, 0).Format("2006-01-02")
+}
+
+// RevokedDate returns the (local) day the Card was revoked, if it was
+func (c *Card) RevokedDate() string {
+	if c.Revoked == 0 {
+		return ""
+	}
+	return time.Unix(c.Revoked, 0).Format("2006-01-02")
+}
+
+// RevokedCardError is returned by FindStudentByCard for a scan of a card
+// which is no longer valid
+type RevokedCardError struct {
+	Card    *Card
+	Student *Student
+}
+
+func (e *RevokedCardError) Error() string {
+	return fmt.Sprintf("卡 %s 已于 %s 注销 (%s, %s)", e.Card.Barcode, e.Card.RevokedDate(), e.Student.Name, e.Student.Id)
+}
+
+// InactiveStudentError is returned by FindStudentByCard for a scan of the
+// card of a student who is no longer on the roster: in the trash, or left
+// in a closed term
+type InactiveStudentError struct {
+	Card    *Card
+	Student *Student
+}
+
+func (e *InactiveStudentError) Error() string {
+	if e.Trashed() {
+		return fmt.Sprintf("卡 %s 的学生在回收站中 (%s, %s)", e.Card.Barcode, e.Student.Name, e.Student.Id)
+	}
+	return fmt.Sprintf("卡 %s 的学生已随往期学期归档 (%s, %s)", e.Card.Barcode, e.Student.Name, e.Student.Id)
+}
+
+// Trashed reports whether the student is in the trash (rather than left
+// in a closed term)
+func (e *InactiveStudentError) Trashed() bool {
+	return e.Student.Deleted != 0 && e.Student.Term == ACTIVE_TERM
+}
+
+// Assignment is a single piece of homework, against which students submit
+type Assignment struct {
+	Id     int64
+	Title  string
+	Posted int64 // unix time
+	Due    int64 // unix time, or 0 if there is no deadline
+	Term   int64 // the closed term it is archived in, or ACTIVE_TERM
+	// Scale is the letter grades, best first (e.g., 'A,B,C,D,F'), or ''
+	// for points, out of MaxPoints (if not 0)
+	Scale     string
+	MaxPoints float64
+}
+
+// DueDate returns the (local) day the Assignment is due, if it has a deadline
+func (a *Assignment) DueDate() string {
+	if a.Due == 0 {
+		return ""
+	}
+	return time.Unix(a.Due, 0).Format("2006-01-02")
+}
+
+// Term is a closed (and archived) school term or semester
+type Term struct {
+	Id      int64
+	Name    string
+	Started int64 // unix time
+	Closed  int64 // unix time
+}
+
+// StartedDate returns the (local) day the Term started, if known
+func (t *Term) StartedDate() string {
+	if t.Started == 0 {
+		return ""
+	}
+	return time.Unix(t.Started, 0).Format("2006-01-02")
+}
+
+// ClosedDate returns the (local) day the Term was closed
+func (t *Term) ClosedDate() string {
+	return time.Unix(t.Closed, 0).Format("2006-01-02")
+}
+
+// Submission records that a Student handed in an Assignment, and when
+type Submission struct {
+	StudentId    string
+	AssignmentId int64
+	Posted       int64  // unix time of the scan
+	Deleted      int64  // unix time, or 0 unless it is in the trash
+	Grade        string // points, or a letter of the scale, or '' until graded
+	Comment      string
+	ScannedBy    string // the stuid of the teammate who scanned for them, or ''
+}
+
+// Since returns a human readable version of the time of the Submission
+func (s *Submission) Since() string {
+	return calculateTimeSince(s.Posted)
+}
+
+// DeletedSince returns a human readable version of the time the
+// Submission was deleted
+func (s *Submission) DeletedSince() string {
+	return calculateTimeSince(s.Deleted)
+}
+
+// Group is a team of students who hand in an Assignment together, so a
+// scan of any one of their cards submits it for all of them
+type Group struct {
+	Id           int64
+	AssignmentId int64
+	Name         string
+	Members      []string // stuids, by name
+}
+
+// FormerStudent is a Student who is no longer on the roster
+type FormerStudent struct {
+	Student *Student
+	Left    int64 // unix time they were deleted or their term closed, whichever was first
+	Cards   int
+}
+
+// Period is a class period of the daily schedule, which attendance is
+// recorded against
+type Period struct {
+	Id     int64
+	Name   string
+	Starts int // minutes after midnight
+	Ends   int // minutes after midnight
+	Grace  int // minutes after the start a check-in is still on time
+}
+
+// Attendance records that a Student checked in for a Period on a given
+// day, and when they checked out, if they did
+type Attendance struct {
+	StudentId  string
+	Day        string // local, as 2006-01-02
+	PeriodId   int64
+	CheckedIn  int64  // unix time of the scan
+	CheckedOut int64  // unix time, or 0 unless checked out
+	Status     string // ATTENDANCE_PRESENT or ATTENDANCE_LATE
+}
+
+// UnknownScan is a scan of a barcode which matched no Student, kept until
+// the barcode is linked to one, or dismissed
+type UnknownScan struct {
+	Id           int64
+	Barcode      string
+	Posted       int64  // unix time of the scan
+	Device       string // the scanner input device
+	AssignmentId int64  // current when scanned, or 0 if since deleted
+}
+
+// Since returns a human readable version of the time of the UnknownScan
+func (u *UnknownScan) Since() string {
+	return calculateTimeSince(u.Posted)
+}
+
+// OutboxMessage is a request to the API server, kept in the outbox until
+// it is sent, so nothing is lost while the device is offline
+type OutboxMessage struct {
+	Id          int64  // the order the outbox sends them in
+	Key         string // idempotency key, so the server applies a retry once
+	Method      string // "GET" or "POST"
+	Path        string // on the API server, e.g. "/register"
+	Params      string // url encoded, including the key and the digest
+	Created     int64  // unix time
+	Attempts    int
+	NextAttempt int64  // unix time, while pending
+	Status      string // OUTBOX_PENDING, OUTBOX_SENT or OUTBOX_FAILED
+	Error       string // why the last attempt failed, if it did
+	Sent        int64  // unix time, or 0 until sent
+}
+
+// Since returns a human readable version of the time the OutboxMessage
+// was queued
+func (m *OutboxMessage) Since() string {
+	return calculateTimeSince(m.Created)
+}
+
+// SentSince returns a human readable version of the time the
+// OutboxMessage was sent
+func (m *OutboxMessage) SentSince() string {
+	return calculateTimeSince(m.Sent)
+}
+
+// Teacher is a login to the WebApp, with the bcrypt hash of its password
+// and the role which decides what it may do (see ROLE_PERMISSIONS), in
+// every class but those it has another role in (see ClassRole)
+type Teacher struct {
+	Id        int64
+	Username  string
+	Name      string
+	Hash      string
+	Role      string
+	Created   int64 // unix time
+	LastLogin int64 // unix time, or 0 until the first login
+}
+
+// LastLoginSince returns a human readable version of the time the
+// Teacher last logged in
+func (t *Teacher) LastLoginSince() string {
+	if t.LastLogin == 0 {
+		return "never"
+	}
+	return calculateTimeSince(t.LastLogin)
+}
+
+// APIToken lets a script use the REST API as the Teacher it was made
+// for; only the sha256 hash of the token itself is kept
+type APIToken struct {
+	Id        int64
+	TeacherId int64
+	Name      string // what it is for, e.g. 'gradebook sync'
+	Hash      string
+	Created   int64 // unix time
+	LastUsed  int64 // unix time, or 0 until it is first used
+}
+
+// LastUsedSince returns a human readable version of the time the
+// APIToken was last used
+func (t *APIToken) LastUsedSince() string {
+	if t.LastUsed == 0 {
+		return "never"
+	}
+	return calculateTimeSince(t.LastUsed)
+}
+
+// LiveEvent is something that just happened, for the WebApp to push to
+// the pages open on it (see events.go)
+type LiveEvent struct {
+	Id         int64
+	Kind       string // LIVE_SCAN, LIVE_SUBMISSION or LIVE_SCANNER
+	Outcome    string // of the scan, the change to the submission, or the scanner status
+	StudentId  string // '' if not known
+	Assignment int64  // 0 if none
+	Detail     string // e.g., why a scan failed, or the scanner device
+	Created    int64  // unix time
+}
+
+// Store is everything the WebApp and PiScanner need from the client
+// datastore; the ui handlers and the scanner depend only on this interface.
+// Deleting a student or a submission moves it to the trash, where every
+// lookup but the Trash ones ignores it, until it is restored or purged.
+type Store interface {
+	// Students
+	GetStudents() ([]*Student, error)
+	GetStudent(stuid string) (*Student, error)
+	// AddStudent restores the student, if their stuid is in the trash
+	AddStudent(s *Student) error
+	UpdateStudent(originalId string, s *Student) error
+	DeleteStudent(stuid string, when time.Time) error
+	ImportStudents(add, update []*Student) error // all or nothing
+	// MatchStudents finds the students whose stuid, name, pinyin spelling
+	// or initials start with each word of the query (see SearchStudents)
+	MatchStudents(query string, limit int) ([]*Student, error)
+
+	// Cards
+	GetCards(stuid string) ([]*Card, error)
+	GetCard(barcode string) (*Card, error)
+	// IssueCard adds the card, first revoking the student's other valid
+	// cards if it replaces them, all or nothing
+	IssueCard(c *Card, replace bool) error
+	RevokeCard(barcode string, when time.Time) error
+
+	// Assignments
+	// GetAssignments returns those of the given term (e.g., ACTIVE_TERM)
+	GetAssignments(termId int64) ([]*Assignment, error)
+	GetAssignment(id int64) (*Assignment, error)
+	AddAssignment(a *Assignment) (int64, error)
+	// UpdateAssignment saves the title, due date and grading scale of an
+	// assignment of the active term
+	UpdateAssignment(a *Assignment) error
+	DeleteAssignment(id int64) error
+
+	// Submissions
+	GetSubmissions(assignmentId int64) ([]*Submission, error)
+	Submit(stuid string, assignmentId int64, when time.Time) error
+	Unsubmit(stuid string, assignmentId int64, when time.Time) error
+	// GradeSubmission saves the grade and comment (see GradeSubmission)
+	GradeSubmission(sub *Submission) error
+
+	// Groups
+	// GetGroups returns the groups of the assignment, with their members
+	// (but not those in the trash)
+	GetGroups(assignmentId int64) ([]*Group, error)
+	GetGroup(id int64) (*Group, error)
+	// AddGroup adds the group with its members, all or nothing, or returns
+	// GROUPED if one of them is in another group for the assignment
+	AddGroup(g *Group) (int64, error)
+	AddGroupMember(groupId int64, stuid string) error // or GROUPED
+	RemoveGroupMember(groupId int64, stuid string) error
+	DeleteGroup(id int64) error
+	// SubmitGroup submits the assignment for the student, and, as scanned
+	// by them, for the rest of their group (if any), except those who have
+	// submitted already or whose submission was removed, all or nothing;
+	// it returns how many teammates it submitted for
+	SubmitGroup(stuid string, assignmentId int64, when time.Time) (int, error)
+
+	// Terms
+	GetTerms() ([]*Term, error) // the closed ones, most recent first
+	GetTerm(id int64) (*Term, error)
+	// GetTermRoster returns the roster of the closed term, as it was then
+	GetTermRoster(termId int64) ([]*Student, error)
+	// CloseTerm archives the assignments of the active term (with their
+	// submissions) and its roster as a new Term, and starts a new active
+	// term, with the same roster if carryRoster is set, or an empty one,
+	// all or nothing; it returns the id of the new Term, which the class
+	// roles of the active term are moved to
+	CloseTerm(t *Term, carryRoster bool) (int64, error)
+	// DeleteTerm removes the closed term for good, with its assignments
+	// (and their submissions), its roster and class roles, and the
+	// students left in it who were on no other term; those who were are
+	// left in the latest of them instead
+	DeleteTerm(id int64) error
+
+	// Trash
+	GetDeletedStudents() ([]*Student, error)
+	GetDeletedSubmissions() ([]*Submission, error)
+	RestoreStudent(stuid string) error
+	RestoreSubmission(stuid string, assignmentId int64) error
+	// RestoreDeleted restores everything deleted at the given time (i.e.,
+	// by a single bulk action), returning how many were
+	RestoreDeleted(when time.Time) (int, error)
+	// RestoreDeletedSubmissions does the same for the submissions only
+	RestoreDeletedSubmissions(when time.Time) (int, error)
+	// PurgeDeleted removes for good everything deleted before the given
+	// time, returning how many were
+	PurgeDeleted(before time.Time) (int, error)
+
+	// Retention
+	// GetFormerStudents returns the students no longer on the roster (in
+	// the trash, or left in a closed term) who have not been anonymized
+	GetFormerStudents() ([]*FormerStudent, error)
+	// AnonymizeStudent replaces the stuid and name of a former student
+	// (everywhere, including the rosters of closed terms) and removes
+	// their cards, keeping their submissions and attendance under the new
+	// stuid, which it returns
+	AnonymizeStudent(stuid string, when time.Time) (string, error)
+
+	// Attendance
+	GetPeriods() ([]*Period, error) // in the order they start
+	AddPeriod(p *Period) (int64, error)
+	DeletePeriod(id int64) error // with all the attendance recorded for it
+	GetAttendance(day string) ([]*Attendance, error)
+	// CheckIn records the attendance, or returns DUPLICATE_ATTENDANCE if
+	// the student has already checked in for that period, that day
+	CheckIn(a *Attendance) error
+	// CheckOut records the time the student left, or returns NOT_FOUND if
+	// they have not checked in for that period that day, or already left
+	CheckOut(stuid, day string, periodId int64, when time.Time) error
+
+	// Unknown scans
+	GetUnknownScans() ([]*UnknownScan, error)
+	AddUnknownScan(u *UnknownScan) (int64, error)
+	DismissUnknownScans(barcode string) error
+	// ResolveUnknownScans makes the barcode a card of the student (adding
+	// the student first, if create is set), submits each queued scan of
+	// the barcode for them, and clears them from the queue, all or
+	// nothing; it returns the number of scans submitted
+	ResolveUnknownScans(barcode string, s *Student, create bool) (int, error)
+
+	// Outbox
+	AddOutboxMessage(m *OutboxMessage) (int64, error)
+	GetOutboxMessages() ([]*OutboxMessage, error)  // the most recent first
+	GetPendingMessages() ([]*OutboxMessage, error) // in the order to send them
+	// UpdateOutboxMessage saves the attempts, next attempt, status, error
+	// and sent time of the message
+	UpdateOutboxMessage(m *OutboxMessage) error
+	// RetryOutboxMessage makes a failed message pending again, or returns
+	// NOT_FOUND
+	RetryOutboxMessage(id int64) error
+	// PurgeOutbox removes the messages queued before the given time which
+	// are no longer pending, returning how many were
+	PurgeOutbox(before time.Time) (int, error)
+
+	// Teachers
+	GetTeachers() ([]*Teacher, error) // by username
+	GetTeacher(id int64) (*Teacher, error)
+	GetTeacherByUsername(username string) (*Teacher, error)
+	// AddTeacher returns DUPLICATE_TEACHER if the username is in use
+	AddTeacher(t *Teacher) (int64, error)
+	// UpdateTeacher saves the name, password hash, role and last login time
+	UpdateTeacher(t *Teacher) error
+	// DeleteTeacher removes the teacher, with their API tokens and class
+	// roles
+	DeleteTeacher(id int64) error
+
+	// Class roles
+	// GetClassRoles returns the roles the teacher was given in particular
+	// classes, by term (ACTIVE_TERM for the current class)
+	GetClassRoles(teacherId int64) (map[int64]string, error)
+	// SetClassRole gives the teacher the role in the class of the term,
+	// instead of their own, or takes it back if the role is ""
+	SetClassRole(teacherId, term int64, role string) error
+
+	// API tokens
+	GetAPITokens() ([]*APIToken, error) // in the order they were made
+	GetAPITokenByHash(hash string) (*APIToken, error)
+	AddAPIToken(t *APIToken) (int64, error)
+	// TouchAPIToken records the time the token was last used
+	TouchAPIToken(id int64, when time.Time) error
+	DeleteAPIToken(id int64) error
+
+	// Live events
+	// GetLiveEvents returns up to limit events added after the one with
+	// the id, oldest first
+	GetLiveEvents(since int64, limit int) ([]*LiveEvent, error)
+	// GetLatestLiveEvent returns the most recent event of the kind (or of
+	// any kind, if it is ''), or NOT_FOUND
+	GetLatestLiveEvent(kind string) (*LiveEvent, error)
+	AddLiveEvent(e *LiveEvent) (int64, error)
+	// PurgeLiveEvents removes the events added before the given time,
+	// returning how many were
+	PurgeLiveEvents(before time.Time) (int, error)
+
+	// Settings
+	GetSetting(key string) (string, error)
+	SetSetting(key, value string) error
+
+	Close() error
+}
+
+// FindStudentByCard returns the Student the scanned barcode was issued
+// to, NOT_FOUND if it is not a known card, a RevokedCardError if it is no
+// longer valid, or an InactiveStudentError if the student is no longer on
+// the roster
+func FindStudentByCard(s Store, barcode string) (*Student, error) {
+	c, err := s.GetCard(barcode)
+	if err != nil {
+		return nil, err
+	}
+	student, err := s.GetStudent(c.StudentId)
+	if err == NOT_FOUND {
+		return nil, findFormerStudent(s, c)
+	} else if err != nil {
+		return nil, err
+	}
+	if c.Revoked != 0 {
+		return nil, &RevokedCardError{Card: c, Student: student}
+	}
+	return student, nil
+}
+
+// findFormerStudent returns the error of a scan of the card of a student
+// no longer on the roster (or NOT_FOUND, if there is no such student)
+func findFormerStudent(s Store, c *Card) error {
+	former, err := s.GetFormerStudents()
+	if err != nil {
+		return err
+	}
+	for _, f := range former {
+		if f.Student.Id == c.StudentId {
+			if c.Revoked != 0 {
+				return &RevokedCardError{Card: c, Student: f.Student}
+			}
+			return &InactiveStudentError{Card: c, Student: f.Student}
+		}
+	}
+	return NOT_FOUND
+}
+
+// StudentStatus pairs a Student with their Submission for a given
+// Assignment, where Submission is nil if they have not (yet) handed it in
+type StudentStatus struct {
+	Student    *Student
+	Submission *Submission
+	Group      *Group   // nil unless they are in a group for the Assignment
+	ScannedBy  *Student // the teammate who scanned for them, if any
+}
+
+// GetRoster returns the status of every Student against the given
+// Assignment, optionally limited to those who have submitted
+func GetRoster(s Store, assignmentId int64, submittedOnly bool) ([]*StudentStatus, error) {
+	results := make([]*StudentStatus, 0)
+
+	students, err := s.GetStudents()
+	if err != nil {
+		return results, err
+	}
+	submissions, err := s.GetSubmissions(assignmentId)
+	if err != nil {
+		return results, err
+	}
+
+	groups, err := s.GetGroups(assignmentId)
+	if err != nil {
+		return results, err
+	}
+
+	submitted := make(map[string]*Submission)
+	for _, sub := range submissions {
+		submitted[sub.StudentId] = sub
+	}
+	grouped := make(map[string]*Group)
+	for _, g := range groups {
+		for _, stuid := range g.Members {
+			grouped[stuid] = g
+		}
+	}
+	roster := make(map[string]*Student)
+	for _, student := range students {
+		roster[student.Id] = student
+	}
+
+	for _, student := range students {
+		sub, ok := submitted[student.Id]
+		if submittedOnly && !ok {
+			continue
+		}
+		status := &StudentStatus{Student: student, Submission: sub, Group: grouped[student.Id]}
+		if ok && sub.ScannedBy != "" {
+			if status.ScannedBy, ok = roster[sub.ScannedBy]; !ok {
+				// no longer on the roster: just the stuid
+				status.ScannedBy = &Student{Id: sub.ScannedBy}
+			}
+		}
+		results = append(results, status)
+	}
+	return results, nil
+}
+
+// CurrentAssignment returns the Assignment that scans are recorded
+// against, or NOT_FOUND if none has been chosen (in the active term)
+func CurrentAssignment(s Store) (*Assignment, error) {
+	val, err := s.GetSetting(CURRENT_ASSIGNMENT)
+	if err != nil {
+		return nil, err
+	}
+	var id int64
+	if _, scanErr := fmt.Sscan(val, &id); scanErr != nil {
+		return nil, NOT_FOUND
+	}
+	a, err := s.GetAssignment(id)
+	if err == nil && a.Term != ACTIVE_TERM {
+		return nil, NOT_FOUND
+	}
+	return a, err
+}
+
+// SetCurrentAssignment makes the given Assignment the one scans are
+// recorded against; it must be in the active term
+func SetCurrentAssignment(s Store, id int64) error {
+	a, err := s.GetAssignment(id)
+	if err != nil {
+		return err
+	}
+	if a.Term != ACTIVE_TERM {
+		return ARCHIVED
+	}
+	return s.SetSetting(CURRENT_ASSIGNMENT, fmt.Sprintf("%d", id))
+}
+
+// EnsureCurrentAssignment returns the current Assignment, creating (and
+// selecting) one named for the given day if none has been chosen yet
+func EnsureCurrentAssignment(s Store, now time.Time) (*Assignment, error) {
+	a, err := CurrentAssignment(s)
+	if err != NOT_FOUND {
+		return a, err
+	}
+
+	a = &Assignment{Title: now.Format("2006-01-02"), Posted: now.Unix()}
+	id, err := s.AddAssignment(a)
+	if err != nil {
+		return nil, err
+	}
+	a.Id = id
+	return a, s.SetSetting(CURRENT_ASSIGNMENT, fmt.Sprintf("%d", id))
+}
+
+// Account is the end-user registration with the API server, kept in the
+// settings of the client datastore
+type Account struct {
+	Id      int64
+	Email   string
+	APICode string
+}
+
+// GetDesignatedAccount returns the one Account for this client device,
+// generating its api code the first time it is requested
+func GetDesignatedAccount(s Store) (*Account, error) {
+	acc := &Account{Id: DESIGNATED_ACCOUNT, Email: ANONYMOUS_EMAIL}
+
+	email, err := s.GetSetting(ACCOUNT_EMAIL)
+	if err == nil {
+		acc.Email = email
+	} else if err != NOT_FOUND {
+		return acc, err
+	}
+
+	code, err := s.GetSetting(ACCOUNT_API_CODE)
+	if err == NOT_FOUND {
+		b := make([]byte, 16)
+		if _, err = rand.Read(b); err != nil {
+			return acc, err
+		}
+		code = hex.EncodeToString(b)
+		err = s.SetSetting(ACCOUNT_API_CODE, code)
+	}
+	acc.APICode = code
+
+	return acc, err
+}
+
+// Update saves the email address and api code of the Account
+func (a *Account) Update(s Store, email, apiCode string) error {
+	if err := s.SetSetting(ACCOUNT_EMAIL, email); err != nil {
+		return err
+	}
+	if err := s.SetSetting(ACCOUNT_API_CODE, apiCode); err != nil {
+		return err
+	}
+	a.Email = email
+	a.APICode = apiCode
+	return nil
+}
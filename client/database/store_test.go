@@ -0,0 +1,455 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openSQLiteStore returns a SQLiteStore on a new db file in a temp dir
+func openSQLiteStore(t *testing.T) *SQLiteStore {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenStore(ConnCoordinates{DBPath: t.TempDir(), DBFile: "test.sqlite", DBTablesPath: wd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// stores returns an empty Store of each kind, so a test can run against
+// both, and catch where the MemoryStore drifts from the sqlite one
+func stores(t *testing.T) map[string]Store {
+	return map[string]Store{"sqlite": openSQLiteStore(t), "memory": NewMemoryStore()}
+}
+
+// addStudents adds the students, by stuid: name
+func addStudents(t *testing.T, s Store, students map[string]string) {
+	for id, name := range students {
+		if err := s.AddStudent(&Student{Id: id, Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+var STORE_TESTS = []struct {
+	name string
+	test func(t *testing.T, s Store)
+}{
+	{"students", func(t *testing.T, s Store) {
+		if _, err := s.GetStudent("001"); err != NOT_FOUND {
+			t.Fatalf("got %v, want NOT_FOUND", err)
+		}
+		addStudents(t, s, map[string]string{"001": "张三", "002": "李四"})
+		if err := s.AddStudent(&Student{Id: "002", Name: "李四"}); err == nil {
+			t.Fatal("added a duplicate stuid")
+		}
+		if err := s.UpdateStudent("001", &Student{Id: "003", Name: "张三丰"}); err != nil {
+			t.Fatal(err)
+		}
+		if st, err := s.GetStudent("003"); err != nil || st.Name != "张三丰" {
+			t.Fatalf("got %v %v", st, err)
+		}
+		if _, err := s.GetStudent("001"); err != NOT_FOUND {
+			t.Fatalf("got %v, want NOT_FOUND", err)
+		}
+		students, err := s.GetStudents()
+		if err != nil || len(students) != 2 {
+			t.Fatalf("got %d students, %v", len(students), err)
+		}
+	}},
+	{"submissions follow the stuid and the trash", func(t *testing.T, s Store) {
+		addStudents(t, s, map[string]string{"001": "张三", "002": "李四"})
+		now := time.Now()
+		a, err := EnsureCurrentAssignment(s, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Submit("001", a.Id, now); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateStudent("001", &Student{Id: "003", Name: "张三"}); err != nil {
+			t.Fatal(err)
+		}
+		roster, err := GetRoster(s, a.Id, true)
+		if err != nil || len(roster) != 1 || roster[0].Student.Id != "003" {
+			t.Fatalf("got %v %v", roster, err)
+		}
+		if err := s.DeleteStudent("003", now); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteStudent("003", now); err != NOT_FOUND {
+			t.Fatalf("got %v, want NOT_FOUND", err)
+		}
+		if subs, _ := s.GetSubmissions(a.Id); len(subs) != 0 {
+			t.Fatalf("got %d submissions of a student in the trash", len(subs))
+		}
+		if err := s.RestoreStudent("003"); err != nil {
+			t.Fatal(err)
+		}
+		if subs, _ := s.GetSubmissions(a.Id); len(subs) != 1 {
+			t.Fatalf("got %d submissions after the restore, want 1", len(subs))
+		}
+	}},
+	{"undo a bulk delete", func(t *testing.T, s Store) {
+		addStudents(t, s, map[string]string{"001": "张三", "002": "李四"})
+		now := time.Now()
+		a, err := EnsureCurrentAssignment(s, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Submit("002", a.Id, now); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteStudent("001", now); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Unsubmit("002", a.Id, now); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := s.RestoreDeletedSubmissions(now); err != nil || n != 1 {
+			t.Fatalf("restored %d, %v; want only the submission", n, err)
+		}
+		if _, err := s.GetStudent("001"); err != NOT_FOUND {
+			t.Fatalf("got %v, want the student left in the trash", err)
+		}
+		if n, err := s.RestoreDeleted(now); err != nil || n != 1 {
+			t.Fatalf("restored %d, %v; want the student", n, err)
+		}
+	}},
+	{"cards", func(t *testing.T, s Store) {
+		addStudents(t, s, map[string]string{"001": "张三"})
+		now := time.Now()
+		if _, err := FindStudentByCard(s, "A1"); err != NOT_FOUND {
+			t.Fatalf("got %v, want NOT_FOUND", err)
+		}
+		if err := s.IssueCard(&Card{Barcode: "A1", StudentId: "001", Issued: now.Unix()}, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.IssueCard(&Card{Barcode: "A2", StudentId: "001", Issued: now.Unix()}, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := FindStudentByCard(s, "A1"); err == nil {
+			t.Fatal("found the student by a replaced card")
+		} else if _, ok := err.(*RevokedCardError); !ok {
+			t.Fatalf("got %v, want a RevokedCardError", err)
+		}
+		if st, err := FindStudentByCard(s, "A2"); err != nil || st.Id != "001" {
+			t.Fatalf("got %v %v", st, err)
+		}
+	}},
+	{"unknown scans", func(t *testing.T, s Store) {
+		now := time.Now()
+		a, err := EnsureCurrentAssignment(s, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := s.AddUnknownScan(&UnknownScan{Barcode: "B1", Posted: now.Unix(), AssignmentId: a.Id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n, err := s.ResolveUnknownScans("B1", &Student{Id: "001", Name: "张三"}, true)
+		if err != nil || n != 2 {
+			t.Fatalf("submitted %d, %v; want 2", n, err)
+		}
+		if subs, _ := s.GetSubmissions(a.Id); len(subs) != 1 {
+			t.Fatalf("got %d submissions, want 1", len(subs))
+		}
+		if scans, _ := s.GetUnknownScans(); len(scans) != 0 {
+			t.Fatalf("got %d scans left in the queue", len(scans))
+		}
+		if st, err := FindStudentByCard(s, "B1"); err != nil || st.Id != "001" {
+			t.Fatalf("got %v %v", st, err)
+		}
+	}},
+	{"settings and the account", func(t *testing.T, s Store) {
+		if _, err := s.GetSetting("x"); err != NOT_FOUND {
+			t.Fatalf("got %v, want NOT_FOUND", err)
+		}
+		acc, err := GetDesignatedAccount(s)
+		if err != nil || acc.APICode == "" {
+			t.Fatal(err)
+		}
+		if again, _ := GetDesignatedAccount(s); again.APICode != acc.APICode {
+			t.Fatal("the account changed")
+		}
+	}},
+	{"roster preview and apply", func(t *testing.T, s Store) {
+		addStudents(t, s, map[string]string{"001": "张三", "002": "李四", "007": "赵六"})
+		content := []byte("学号,姓名\n001,张三\n002,李四四\n003,王五\n003,王五\n003,王六\n004,王五\n005,赵六\n006,\n")
+		p, err := PreviewRoster(s, content, RosterMapping{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range []struct{ status, reason, previous string }{
+			{ROW_UNCHANGED, "", ""},
+			{ROW_UPDATED, "", "李四"},
+			{ROW_NEW, "", ""},
+			{ROW_UNCHANGED, "与第 4 行相同", ""},
+			{ROW_CONFLICT, "学号与第 4 行重复", ""},
+			{ROW_CONFLICT, "姓名与第 4 行重复", ""},
+			{ROW_CONFLICT, "姓名已属于学号 007", ""},
+			{ROW_CONFLICT, "缺少学号或姓名", ""},
+		} {
+			row := p.Rows[i]
+			if row.Status != want.status || row.Reason != want.reason || row.PreviousName != want.previous {
+				t.Fatalf("line %d: got %s %q %q, want %v", row.Line, row.Status, row.Reason, row.PreviousName, want)
+			}
+		}
+		if p.New != 1 || p.Updated != 1 || p.Unchanged != 2 || p.Conflicts != 4 {
+			t.Fatalf("got %d new, %d updated, %d unchanged, %d conflicts", p.New, p.Updated, p.Unchanged, p.Conflicts)
+		}
+
+		if n, err := ApplyRoster(s, p); err != nil || n != 2 {
+			t.Fatalf("changed %d, %v; want 2", n, err)
+		}
+		if st, err := s.GetStudent("002"); err != nil || st.Name != "李四四" {
+			t.Fatalf("got %v %v", st, err)
+		}
+		if st, err := s.GetStudent("003"); err != nil || st.Name != "王五" {
+			t.Fatalf("got %v %v", st, err)
+		}
+		for _, stuid := range []string{"004", "005", "006"} {
+			if _, err := s.GetStudent(stuid); err != NOT_FOUND {
+				t.Fatalf("%s: got %v, want the conflict skipped", stuid, err)
+			}
+		}
+		if again, err := PreviewRoster(s, content, RosterMapping{}); err != nil || again.New != 0 || again.Updated != 0 {
+			t.Fatalf("got %+v %v, want nothing left to apply", again, err)
+		}
+	}},
+	{"anonymize former students", func(t *testing.T, s Store) {
+		now := time.Now()
+		addStudents(t, s, map[string]string{"001": "张三", "002": "李四"})
+		a, err := EnsureCurrentAssignment(s, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stuid := range []string{"001", "002"} {
+			if err := s.Submit(stuid, a.Id, now); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.IssueCard(&Card{Barcode: "A1", StudentId: "001", Issued: now.Unix()}, false); err != nil {
+			t.Fatal(err)
+		}
+		// each student has a card of their stuid, and 001 one more; both
+		// left with a term closed 400 days ago, one left 10 days ago
+		// and one is still on the roster
+		termId, err := s.CloseTerm(&Term{Name: "2023", Closed: now.AddDate(0, 0, -400).Unix()}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addStudents(t, s, map[string]string{"003": "王五", "004": "赵六"})
+		if err := s.DeleteStudent("003", now.AddDate(0, 0, -10)); err != nil {
+			t.Fatal(err)
+		}
+
+		preview, err := Anonymize(s, 365, now, false)
+		if err != nil || preview.Applied || len(preview.Students) != 2 || preview.Cards != 3 || preview.Retained != 1 ||
+			preview.Cutoff != now.AddDate(0, 0, -365).Unix() {
+			t.Fatalf("got %+v %v", preview, err)
+		}
+		if preview.Students[0].Id != "001" || preview.Students[1].Id != "002" {
+			t.Fatalf("got %v %v", preview.Students[0], preview.Students[1])
+		}
+		if _, err := s.GetCard("A1"); err != nil {
+			t.Fatalf("the preview removed the card: %v", err)
+		}
+
+		r, err := Anonymize(s, 365, now, true)
+		if err != nil || !r.Applied || len(r.Students) != 2 || r.Cards != 3 || r.Retained != 1 {
+			t.Fatalf("got %+v %v", r, err)
+		}
+		anonymous := map[string]bool{r.Students[0].Id: true, r.Students[1].Id: true}
+		for id := range anonymous {
+			if !strings.HasPrefix(id, "anon-") {
+				t.Fatalf("got the stuid %s", id)
+			}
+		}
+		if len(anonymous) != 2 {
+			t.Fatalf("got %v", r.Students)
+		}
+		for _, barcode := range []string{"A1", "001", "002"} {
+			if _, err := s.GetCard(barcode); err != NOT_FOUND {
+				t.Fatalf("%s: got %v, want the card removed", barcode, err)
+			}
+		}
+		roster, err := s.GetTermRoster(termId)
+		if err != nil || len(roster) != 2 {
+			t.Fatalf("got %v %v", roster, err)
+		}
+		for _, st := range roster {
+			if !anonymous[st.Id] || st.Name != ANONYMOUS_NAME {
+				t.Fatalf("the term roster keeps %v", st)
+			}
+		}
+		// the submissions, and so the statistics, are kept
+		subs, err := s.GetSubmissions(a.Id)
+		if err != nil || len(subs) != 2 {
+			t.Fatalf("got %d submissions, %v", len(subs), err)
+		}
+		for _, sub := range subs {
+			if !anonymous[sub.StudentId] {
+				t.Fatalf("got a submission of %s", sub.StudentId)
+			}
+		}
+		if again, err := Anonymize(s, 365, now, true); err != nil || len(again.Students) != 0 || again.Retained != 1 {
+			t.Fatalf("got %+v %v", again, err)
+		}
+		if st, err := s.GetStudent("004"); err != nil || st.Name != "赵六" {
+			t.Fatalf("got %v %v", st, err)
+		}
+	}},
+	{"delete a closed term", func(t *testing.T, s Store) {
+		now := time.Now()
+		submit := func(title string, stuids ...string) int64 {
+			id, err := s.AddAssignment(&Assignment{Title: title, Posted: now.Unix(), Due: now.Unix()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stuid := range stuids {
+				if err := s.Submit(stuid, id, now); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return id
+		}
+		closeTerm := func(name string, carryRoster bool) int64 {
+			id, err := s.CloseTerm(&Term{Name: name, Closed: now.Unix()}, carryRoster)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return id
+		}
+		// 001 is in both terms, 002 only in the second, 003 in neither
+		addStudents(t, s, map[string]string{"001": "张三"})
+		first := submit("first", "001")
+		firstTerm := closeTerm("2023", true)
+		addStudents(t, s, map[string]string{"002": "李四"})
+		second := submit("second", "001", "002")
+		secondTerm := closeTerm("2024", false)
+		addStudents(t, s, map[string]string{"003": "王五"})
+		current := submit("current", "003")
+
+		if err := s.DeleteTerm(secondTerm); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetTerm(secondTerm); err != NOT_FOUND {
+			t.Fatalf("got %v, want the term removed", err)
+		}
+		if _, err := s.GetAssignment(second); err != NOT_FOUND {
+			t.Fatalf("got %v, want its assignment removed", err)
+		}
+		former, err := s.GetFormerStudents()
+		if err != nil || len(former) != 1 || former[0].Student.Id != "001" || former[0].Student.Term != firstTerm {
+			t.Fatalf("got %v %v, want only 001, left in the first term", former, err)
+		}
+		if _, err := s.GetCard("002"); err != NOT_FOUND {
+			t.Fatalf("got %v, want the card of 002 removed", err)
+		}
+		if roster, err := s.GetTermRoster(firstTerm); err != nil || len(roster) != 1 {
+			t.Fatalf("got %v %v", roster, err)
+		}
+		for _, id := range []int64{first, current} {
+			if subs, err := s.GetSubmissions(id); err != nil || len(subs) != 1 {
+				t.Fatalf("got %v %v, want the other terms untouched", subs, err)
+			}
+		}
+		if terms, err := s.GetTerms(); err != nil || len(terms) != 1 {
+			t.Fatalf("got %v %v", terms, err)
+		}
+
+		for _, id := range []int64{secondTerm, ACTIVE_TERM} {
+			if err := s.DeleteTerm(id); err != NOT_FOUND {
+				t.Fatalf("%d: got %v, want NOT_FOUND", id, err)
+			}
+		}
+		if _, err := s.GetAssignment(current); err != nil {
+			t.Fatal(err)
+		}
+	}},
+	{"class roles", func(t *testing.T, s Store) {
+		now := time.Now()
+		for _, username := range []string{"teacher", "ta"} {
+			if _, _, err := SetTeacherPassword(s, username, "", "password", now); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ta, err := s.GetTeacherByUsername("ta")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ta, err = SetTeacherRole(s, ta.Id, ROLE_KIOSK); err != nil {
+			t.Fatal(err)
+		}
+		roleIn := func(term int64) string {
+			role, err := ClassRole(s, ta, term)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return role
+		}
+
+		if err := SetClassRole(s, ta.Id, ACTIVE_TERM, ROLE_TA); err != nil {
+			t.Fatal(err)
+		}
+		if err := SetClassRole(s, ta.Id, ACTIVE_TERM, "owner"); err != BAD_ROLE {
+			t.Fatalf("got %v, want BAD_ROLE", err)
+		}
+		if err := SetClassRole(s, ta.Id, 99, ROLE_TA); err != NOT_FOUND {
+			t.Fatalf("got %v, want NOT_FOUND for no such term", err)
+		}
+		if can, err := ClassCan(s, ta, ACTIVE_TERM, PERM_MARK); err != nil || !can || ta.Can(PERM_MARK) {
+			t.Fatalf("got %v %v, want mark in the class only", can, err)
+		}
+
+		// closing the term keeps the role to it
+		closed, err := s.CloseTerm(&Term{Name: "2024", Closed: now.Unix()}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if roleIn(closed) != ROLE_TA || roleIn(ACTIVE_TERM) != ROLE_KIOSK {
+			t.Fatalf("got %s in the closed term, %s in the new one", roleIn(closed), roleIn(ACTIVE_TERM))
+		}
+
+		// cleared, or removed with the term or the teacher
+		if err := SetClassRole(s, ta.Id, ACTIVE_TERM, ROLE_TEACHER); err != nil {
+			t.Fatal(err)
+		}
+		if err := SetClassRole(s, ta.Id, ACTIVE_TERM, ""); err != nil || roleIn(ACTIVE_TERM) != ROLE_KIOSK {
+			t.Fatalf("got %v %s", err, roleIn(ACTIVE_TERM))
+		}
+		if err := s.DeleteTerm(closed); err != nil {
+			t.Fatal(err)
+		}
+		if roles, err := s.GetClassRoles(ta.Id); err != nil || len(roles) != 0 {
+			t.Fatalf("got %v %v, want the role removed with the term", roles, err)
+		}
+		if err := SetClassRole(s, ta.Id, ACTIVE_TERM, ROLE_TA); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteTeacher(ta.Id); err != nil {
+			t.Fatal(err)
+		}
+		if roles, err := s.GetClassRoles(ta.Id); err != nil || len(roles) != 0 {
+			t.Fatalf("got %v %v, want the role removed with the teacher", roles, err)
+		}
+	}},
+}
+
+func TestStores(t *testing.T) {
+	for _, tt := range STORE_TESTS {
+		for kind, s := range stores(t) {
+			t.Run(kind+"/"+tt.name, func(t *testing.T) { tt.test(t, s) })
+		}
+	}
+}
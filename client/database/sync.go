@@ -0,0 +1,469 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// The settings of sync: this device's node id, the switch which stops
+	// the triggers logging changes, and how far each peer has been pulled
+	SYNC_NODE          = "sync_node"
+	SYNC_MUTED         = "sync_muted"
+	SYNC_CURSOR_PREFIX = "sync_cursor "
+
+	// A hybrid logical clock is the unix time in ms, shifted left by this
+	// many bits, plus a counter for the changes made in the same ms, or
+	// while the local clock is behind one already seen
+	HLC_COUNTER_BITS = 16
+
+	// The kinds of sync events
+	SYNC_STUDENT    = "student"
+	SYNC_ASSIGNMENT = "assignment"
+	SYNC_SUBMIT     = "submit"
+	SYNC_UNSUBMIT   = "unsubmit"
+
+	// How many events a peer is sent at a time, and how often the WebApp
+	// pulls them from its peers, by default
+	SYNC_BATCH    = 500
+	SYNC_INTERVAL = time.Minute
+
+	// Prepared Statements
+	GET_SYNC_EVENTS        = "select seq, hlc, node, kind, stuid, assignment, name, posted, due, removed, ref from sync_event where seq > ? order by seq limit ?"
+	ADD_SYNC_EVENT         = "insert or ignore into sync_event (hlc, node, kind, stuid, assignment, name, posted, due, removed, ref) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	GET_LATEST_SYNC_EVENT  = "select hlc, node from sync_event where kind = ? and stuid = ? and assignment = ? order by hlc desc, node desc limit 1"
+	GET_SUBMISSION_EVENTS  = "select hlc, node, kind, posted, ref from sync_event where stuid = ? and assignment = ? and kind in ('submit', 'unsubmit')"
+	GET_STUDENT_SUBMITS    = "select distinct stuid, assignment from sync_event where kind = 'submit' and stuid = ?"
+	GET_ASSIGNMENT_SUBMITS = "select distinct stuid, assignment from sync_event where kind = 'submit' and assignment = ?"
+	GET_SYNC_STUDENT       = "select deleted_at, term from student where stuid = ?"
+	SYNC_STUDENT_NAME      = "update student set name = ? where stuid = ? and deleted_at = 0 and term = 0"
+	GET_SYNC_ASSIGNMENT    = "select id, term from assignment where uid = ?"
+	ADD_SYNC_ASSIGNMENT    = "insert into assignment (title, posted, due, uid) values (?, ?, ?, ?)"
+	UPDATE_SYNC_ASSIGNMENT = "update assignment set title = ?, posted = ?, due = ? where uid = ? and term = 0"
+	DELETE_SYNC_ASSIGNMENT = "delete from assignment where uid = ? and term = 0"
+	GET_SYNC_SUBMISSION    = "select deleted_at from submission where stuid = ? and assignment = ?"
+	SCRUB_SYNC_EVENTS      = "update sync_event set stuid = ?, name = case when kind = 'student' then ? else name end where stuid = ?"
+	GET_SYNC_EVENT_NAMES   = "select seq, name from sync_event where kind = 'student'"
+	SET_SYNC_EVENT_NAME    = "update sync_event set name = ? where seq = ?"
+)
+
+var (
+	BAD_SYNC_EVENT = errors.New("The peer sent a change which is not valid")
+	SYNC_SELF      = errors.New("That peer is this device")
+)
+
+// SyncClock returns the hybrid logical clock of a new change, given the
+// latest one logged (as the sync_clock() sql function of the triggers):
+// the current time, unless that is not after the latest
+func SyncClock(latest int64) int64 {
+	now := time.Now().UnixNano() / int64(time.Millisecond) << HLC_COUNTER_BITS
+	if now > latest {
+		return now
+	}
+	return latest + 1
+}
+
+// SyncEvent is one change to the roster, an assignment or a submission,
+// as logged by the device (node) which made it, and sent to the others.
+// Students are identified by stuid and assignments by their uid, which
+// are the same on every device.
+type SyncEvent struct {
+	Id         string `json:"id"`  // node-hlc (in hex)
+	HLC        int64  `json:"hlc"` // hybrid logical clock
+	Node       string `json:"node"`
+	Kind       string `json:"kind"`
+	StudentId  string `json:"stuid,omitempty"`
+	Assignment string `json:"assignment,omitempty"` // uid
+	Name       string `json:"name,omitempty"`       // of the student, or title of the assignment
+	Posted     int64  `json:"posted,omitempty"`
+	Due        int64  `json:"due,omitempty"`
+	Removed    bool   `json:"removed,omitempty"` // off the roster, or the assignment deleted
+	Ref        string `json:"ref,omitempty"`     // the ids of the submits an unsubmit overrides
+}
+
+// after reports whether the event supersedes the other, i.e., whether it
+// has the later clock, or, on a tie, the greater node
+func (e *SyncEvent) after(other *SyncEvent) bool {
+	if e.HLC == other.HLC {
+		return e.Node > other.Node
+	}
+	return e.HLC > other.HLC
+}
+
+// syncEventId is the id of the event the node logged at the hlc
+func syncEventId(node string, hlc int64) string {
+	return fmt.Sprintf("%s-%x", node, hlc)
+}
+
+// valid reports whether the event is one a device could have logged
+func (e *SyncEvent) valid() bool {
+	if e.Id != syncEventId(e.Node, e.HLC) || e.Node == "" {
+		return false
+	}
+	switch e.Kind {
+	case SYNC_STUDENT:
+		return e.StudentId != "" && e.Assignment == ""
+	case SYNC_ASSIGNMENT:
+		return e.StudentId == "" && e.Assignment != ""
+	case SYNC_SUBMIT, SYNC_UNSUBMIT:
+		return e.StudentId != "" && e.Assignment != ""
+	}
+	return false
+}
+
+// SyncChanges are the events of a device's log after a cursor, in the
+// order it logged them
+type SyncChanges struct {
+	Node   string       `json:"node"`
+	Events []*SyncEvent `json:"events"`
+	Next   int64        `json:"next"` // the cursor of the changes after these
+	More   bool         `json:"more"` // if there are any
+}
+
+// Syncer is a Store which logs its changes, to pull them from its peers
+// (only the SQLiteStore does: the log is kept by the triggers)
+type Syncer interface {
+	Store
+	// GetChanges returns up to limit events of the log after the cursor
+	GetChanges(since int64, limit int) (*SyncChanges, error)
+	// ApplyChanges adds the events of a peer to the log, and makes the
+	// changes they decide, returning how many were new
+	ApplyChanges(events []*SyncEvent) (int, error)
+	// Pull applies the changes of the peer fetched after its cursor
+	Pull(peer string, fetch func(since int64) (*SyncChanges, error)) (int, error)
+}
+
+var _ Syncer = (*SQLiteStore)(nil)
+
+// GetChanges returns up to limit events of the log after the cursor
+func (s *SQLiteStore) GetChanges(since int64, limit int) (*SyncChanges, error) {
+	node, err := s.GetSetting(SYNC_NODE)
+	if err != nil {
+		return nil, err
+	}
+	changes := &SyncChanges{Node: node, Next: since}
+	err = s.queryRows(GET_SYNC_EVENTS, []interface{}{since, limit},
+		func() { changes.Events, changes.Next = make([]*SyncEvent, 0), since },
+		func(rows *sql.Rows) error {
+			e := new(SyncEvent)
+			if err := rows.Scan(&changes.Next, &e.HLC, &e.Node, &e.Kind, &e.StudentId, &e.Assignment, &e.Name, &e.Posted, &e.Due, &e.Removed, &e.Ref); err != nil {
+				return err
+			}
+			e.Id = syncEventId(e.Node, e.HLC)
+			var err error
+			e.Name, err = s.cipher.Decrypt(e.Name)
+			changes.Events = append(changes.Events, e)
+			return err
+		})
+	changes.More = len(changes.Events) == limit
+	return changes, err
+}
+
+// latestEvent reports whether the event is the latest of its student or
+// assignment in the log
+func latestEvent(tx *sql.Tx, e *SyncEvent) (bool, error) {
+	var (
+		hlc  int64
+		node string
+	)
+	if err := tx.QueryRow(GET_LATEST_SYNC_EVENT, e.Kind, e.StudentId, e.Assignment).Scan(&hlc, &node); err != nil {
+		return false, err
+	}
+	return hlc == e.HLC && node == e.Node, nil
+}
+
+// syncKey identifies a student (by stuid), an assignment (by uid) or a
+// submission (by both) across devices
+type syncKey struct {
+	stuid, assignment string
+}
+
+// addSubmissionKeys adds the submissions in the result of the query (of
+// GET_STUDENT_SUBMITS or GET_ASSIGNMENT_SUBMITS) to keys
+func addSubmissionKeys(tx *sql.Tx, keys map[syncKey]bool, query, arg string) error {
+	rows, err := tx.Query(query, arg)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key syncKey
+		if err := rows.Scan(&key.stuid, &key.assignment); err != nil {
+			return err
+		}
+		keys[key] = true
+	}
+	return rows.Err()
+}
+
+// applyLatest applies the student or assignment event, if it is still the
+// latest of its student or assignment once logged, and adds the
+// submissions which may now be made to keys
+func (s *SQLiteStore) applyLatest(tx *sql.Tx, e *SyncEvent, keys map[syncKey]bool, now int64) error {
+	if ok, err := latestEvent(tx, e); err != nil || !ok {
+		return err
+	}
+	if e.Kind == SYNC_STUDENT {
+		created, err := s.applyStudent(tx, e, now)
+		if err != nil || !created {
+			return err
+		}
+		return addSubmissionKeys(tx, keys, GET_STUDENT_SUBMITS, e.StudentId)
+	}
+	created, err := applyAssignment(tx, e)
+	if err != nil || !created {
+		return err
+	}
+	return addSubmissionKeys(tx, keys, GET_ASSIGNMENT_SUBMITS, e.Assignment)
+}
+
+// applyStudent makes the student on the roster (or not) as in the event,
+// reporting whether they were added to it
+func (s *SQLiteStore) applyStudent(tx *sql.Tx, e *SyncEvent, now int64) (bool, error) {
+	var deleted, term int64
+	err := tx.QueryRow(GET_SYNC_STUDENT, e.StudentId).Scan(&deleted, &term)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	onRoster := err == nil && deleted == 0 && term == ACTIVE_TERM
+
+	switch {
+	case e.Removed:
+		if onRoster {
+			_, err = tx.Exec(DELETE_STUDENT, now, e.StudentId)
+		}
+		return false, err
+	case onRoster:
+		_, err = tx.Exec(SYNC_STUDENT_NAME, s.cipher.Encrypt(e.Name), e.StudentId)
+		return false, err
+	}
+	return true, addStudent(tx.Exec, s.cipher, &Student{Id: e.StudentId, Name: e.Name})
+}
+
+// applyAssignment adds, updates or deletes the assignment as in the
+// event, reporting whether it was added; those of closed terms are left
+// as they are
+func applyAssignment(tx *sql.Tx, e *SyncEvent) (bool, error) {
+	var id, term int64
+	err := tx.QueryRow(GET_SYNC_ASSIGNMENT, e.Assignment).Scan(&id, &term)
+	switch {
+	case err == sql.ErrNoRows:
+		if e.Removed {
+			return false, nil
+		}
+		_, err = tx.Exec(ADD_SYNC_ASSIGNMENT, e.Name, e.Posted, e.Due, e.Assignment)
+		return true, err
+	case err != nil || term != ACTIVE_TERM:
+		return false, err
+	case e.Removed:
+		_, err = tx.Exec(DELETE_SYNC_ASSIGNMENT, e.Assignment)
+	default:
+		_, err = tx.Exec(UPDATE_SYNC_ASSIGNMENT, e.Name, e.Posted, e.Due, e.Assignment)
+	}
+	return false, err
+}
+
+// resolveSubmission submits (or unsubmits) the assignment for the student
+// as all the events logged for them decide: it is submitted if any of
+// the submits is not overridden by an unsubmit, i.e., a submit made at
+// the same time as an unsubmit elsewhere beats it, and the earliest of
+// those submits is the time it was
+func resolveSubmission(tx *sql.Tx, key syncKey, now int64) error {
+	rows, err := tx.Query(GET_SUBMISSION_EVENTS, key.stuid, key.assignment)
+	if err != nil {
+		return err
+	}
+	submits := make(map[string]int64)
+	overridden := make(map[string]bool)
+	var unsubmitted int64
+	for rows.Next() {
+		var node, kind, ref string
+		var hlc, posted int64
+		if err := rows.Scan(&hlc, &node, &kind, &posted, &ref); err != nil {
+			rows.Close()
+			return err
+		}
+		if kind == SYNC_SUBMIT {
+			submits[syncEventId(node, hlc)] = posted
+			continue
+		}
+		for _, submit := range strings.Split(ref, ",") {
+			overridden[submit] = true
+		}
+		if posted > unsubmitted {
+			unsubmitted = posted
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var submitted bool
+	var posted int64
+	for id, when := range submits {
+		if !overridden[id] && (!submitted || when < posted) {
+			submitted, posted = true, when
+		}
+	}
+
+	// only the assignments of the term, and students this device has
+	var id, term, deleted int64
+	if err := tx.QueryRow(GET_SYNC_ASSIGNMENT, key.assignment).Scan(&id, &term); err != nil || term != ACTIVE_TERM {
+		return notFoundOk(err)
+	}
+	if err := tx.QueryRow(GET_SYNC_STUDENT, key.stuid).Scan(&deleted, &term); err != nil {
+		return notFoundOk(err)
+	}
+	err = tx.QueryRow(GET_SYNC_SUBMISSION, key.stuid, id).Scan(&deleted)
+	exists := err == nil
+	if err := notFoundOk(err); err != nil {
+		return err
+	}
+
+	switch {
+	case submitted && (!exists || deleted != 0):
+		_, err = tx.Exec(SUBMIT, key.stuid, id, posted)
+		return err
+	case !submitted && exists && deleted == 0:
+		if unsubmitted == 0 {
+			unsubmitted = now
+		}
+		_, err = tx.Exec(UNSUBMIT, unsubmitted, key.stuid, id)
+		return err
+	}
+	return nil
+}
+
+// notFoundOk returns the error, unless it is that there was no row
+func notFoundOk(err error) error {
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
+// ApplyChanges adds the events a peer sent to the log, and makes the
+// changes of those which win their conflicts, without logging them again;
+// it returns how many of the events were new
+func (s *SQLiteStore) ApplyChanges(events []*SyncEvent) (int, error) {
+	for _, e := range events {
+		if !e.valid() {
+			return 0, BAD_SYNC_EVENT
+		}
+	}
+
+	var added int
+	err := s.transaction(func(tx *sql.Tx) error {
+		added = 0
+		now := time.Now().Unix()
+		if _, err := tx.Exec(ADD_SETTING_ONCE, SYNC_MUTED, "1"); err != nil {
+			return err
+		}
+
+		// log them all first, so each student and assignment is given
+		// only the latest of its changes
+		latest := make(map[syncKey]*SyncEvent)
+		submissions := make(map[syncKey]bool)
+		for _, e := range events {
+			name := e.Name
+			if e.Kind == SYNC_STUDENT {
+				name = s.cipher.Encrypt(name)
+			}
+			res, err := tx.Exec(ADD_SYNC_EVENT, e.HLC, e.Node, e.Kind, e.StudentId, e.Assignment, name, e.Posted, e.Due, e.Removed, e.Ref)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil || n == 0 {
+				continue // already logged
+			}
+			added++
+			key := syncKey{e.StudentId, e.Assignment}
+			switch e.Kind {
+			case SYNC_STUDENT, SYNC_ASSIGNMENT:
+				if latest[key] == nil || e.after(latest[key]) {
+					latest[key] = e
+				}
+			default:
+				submissions[key] = true
+			}
+		}
+
+		// the roster and assignments first, as the submissions need them
+		for _, kind := range []string{SYNC_STUDENT, SYNC_ASSIGNMENT} {
+			for _, e := range latest {
+				if e.Kind != kind {
+					continue
+				}
+				if err := s.applyLatest(tx, e, submissions, now); err != nil {
+					return err
+				}
+			}
+		}
+		for key := range submissions {
+			if err := resolveSubmission(tx, key, now); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(CLEAR_SETTING, SYNC_MUTED)
+		return err
+	})
+	return added, err
+}
+
+// Pull applies the changes in the log of the peer at the given address
+// which this device does not have yet, as fetched after the cursor kept
+// for it; it returns how many were new
+func (s *SQLiteStore) Pull(peer string, fetch func(since int64) (*SyncChanges, error)) (int, error) {
+	node, err := s.GetSetting(SYNC_NODE)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		peerNode string
+		since    int64
+		total    int
+	)
+	key := SYNC_CURSOR_PREFIX + peer
+	if cursor, err := s.GetSetting(key); err == nil {
+		fmt.Sscan(cursor, &peerNode, &since)
+	}
+
+	for {
+		changes, err := fetch(since)
+		if err != nil {
+			return total, err
+		}
+		if changes.Node == node {
+			return total, SYNC_SELF
+		}
+		if changes.Node != peerNode && since > 0 {
+			// another device answers at that address now
+			peerNode, since = changes.Node, 0
+			continue
+		}
+		peerNode = changes.Node
+
+		n, err := s.ApplyChanges(changes.Events)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		since = changes.Next
+		if err := s.SetSetting(key, fmt.Sprintf("%s %d", peerNode, since)); err != nil {
+			return total, err
+		}
+		if !changes.More {
+			return total, nil
+		}
+	}
+}
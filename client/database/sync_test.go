@@ -0,0 +1,241 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package database
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// a small batch, so a pull takes several
+const TEST_SYNC_BATCH = 3
+
+// openNode returns a SQLiteStore on a new db file, encrypted if there is a
+// passphrase, as one of the devices
+func openNode(t *testing.T, passphrase string) *SQLiteStore {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coords := ConnCoordinates{DBPath: t.TempDir(), DBFile: "test.sqlite", DBTablesPath: wd}
+	if passphrase != "" {
+		coords.Passphrase = []byte(passphrase)
+	}
+	s, err := OpenStore(coords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// pullFrom returns the fetch function of a pull from the peer, in process
+func pullFrom(peer *SQLiteStore, limit int) func(since int64) (*SyncChanges, error) {
+	return func(since int64) (*SyncChanges, error) { return peer.GetChanges(since, limit) }
+}
+
+// syncNodes has every node pull from every other, twice, so the changes
+// one pulled from another reach the third
+func syncNodes(t *testing.T, nodes map[string]*SQLiteStore) {
+	for i := 0; i < 2; i++ {
+		for name, s := range nodes {
+			for peer, p := range nodes {
+				if peer == name {
+					continue
+				}
+				if _, err := s.Pull(peer, pullFrom(p, TEST_SYNC_BATCH)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+// findAssignment returns the assignment by its title
+func findAssignment(t *testing.T, s Store, title string) *Assignment {
+	assignments, err := s.GetAssignments(ACTIVE_TERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range assignments {
+		if a.Title == title {
+			return a
+		}
+	}
+	t.Fatalf("no assignment %s", title)
+	return nil
+}
+
+// submitters returns the stuids of the submissions of the assignment
+func submitters(t *testing.T, s Store, title string) map[string]bool {
+	subs, err := s.GetSubmissions(findAssignment(t, s, title).Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stuids := make(map[string]bool)
+	for _, sub := range subs {
+		stuids[sub.StudentId] = true
+	}
+	return stuids
+}
+
+func TestSync(t *testing.T) {
+	a, b, c := openNode(t, ""), openNode(t, ""), openNode(t, "passphrase")
+	nodes := map[string]*SQLiteStore{"a": a, "b": b, "c": c}
+
+	// the roster and the assignments converge
+	addStudents(t, a, map[string]string{"001": "张三", "002": "李四"})
+	if _, err := a.AddAssignment(&Assignment{Title: "X", Posted: 100}); err != nil {
+		t.Fatal(err)
+	}
+	syncNodes(t, nodes)
+	for name, s := range nodes {
+		if st, err := s.GetStudent("002"); err != nil || st.Name != "李四" {
+			t.Fatalf("%s: got %v %v", name, st, err)
+		}
+		findAssignment(t, s, "X")
+	}
+
+	if err := b.Submit("001", findAssignment(t, b, "X").Id, time.Unix(200, 0)); err != nil {
+		t.Fatal(err)
+	}
+	syncNodes(t, nodes)
+	for name, s := range nodes {
+		if m := submitters(t, s, "X"); !m["001"] || m["002"] {
+			t.Fatalf("%s: got %v, want 001", name, m)
+		}
+	}
+
+	// a submission beats an unsubmit made at the same time on another device
+	xa := findAssignment(t, a, "X")
+	if err := a.Submit("002", xa.Id, time.Unix(300, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Unsubmit("002", xa.Id, time.Unix(301, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Submit("002", findAssignment(t, b, "X").Id, time.Unix(302, 0)); err != nil {
+		t.Fatal(err)
+	}
+	syncNodes(t, nodes)
+	for name, s := range nodes {
+		if m := submitters(t, s, "X"); !m["002"] {
+			t.Fatalf("%s: got %v, want the submission to win", name, m)
+		}
+	}
+
+	// unless the unsubmit is made later, having seen it
+	if err := c.Unsubmit("002", findAssignment(t, c, "X").Id, time.Unix(400, 0)); err != nil {
+		t.Fatal(err)
+	}
+	syncNodes(t, nodes)
+	for name, s := range nodes {
+		if m := submitters(t, s, "X"); m["002"] || !m["001"] {
+			t.Fatalf("%s: got %v, want the override to win", name, m)
+		}
+	}
+
+	// the last rename wins, and the trash and the new students converge
+	if err := a.UpdateStudent("001", &Student{Id: "001", Name: "甲"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := c.UpdateStudent("001", &Student{Id: "001", Name: "乙"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteStudent("002", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	addStudents(t, a, map[string]string{"003": "Carol"})
+	syncNodes(t, nodes)
+	for name, s := range nodes {
+		if students, err := s.GetStudents(); err != nil || len(students) != 2 {
+			t.Fatalf("%s: got %d students, %v", name, len(students), err)
+		}
+		if st, err := s.GetStudent("001"); err != nil || st.Name != "乙" {
+			t.Fatalf("%s: got %v %v, want the last rename", name, st, err)
+		}
+		if found, err := SearchStudents(s, "carol", 5); err != nil || len(found) != 1 {
+			t.Fatalf("%s: found %v %v", name, found, err)
+		}
+	}
+
+	// so do the assignments renamed and deleted
+	x := findAssignment(t, c, "X")
+	x.Title = "Y"
+	if err := c.UpdateAssignment(x); err != nil {
+		t.Fatal(err)
+	}
+	syncNodes(t, nodes)
+	if err := a.DeleteAssignment(findAssignment(t, a, "Y").Id); err != nil {
+		t.Fatal(err)
+	}
+	syncNodes(t, nodes)
+	for name, s := range nodes {
+		if assignments, err := s.GetAssignments(ACTIVE_TERM); err != nil || len(assignments) != 0 {
+			t.Fatalf("%s: got %v %v", name, assignments, err)
+		}
+	}
+
+	// pulling the whole log again applies nothing
+	for name, s := range nodes {
+		for peer, p := range nodes {
+			if peer == name {
+				continue
+			}
+			if n, err := s.Pull(peer, func(since int64) (*SyncChanges, error) { return p.GetChanges(0, 1000) }); err != nil || n != 0 {
+				t.Fatalf("%s from %s: applied %d again, %v", name, peer, n, err)
+			}
+		}
+	}
+
+	if _, err := a.Pull("a", pullFrom(a, TEST_SYNC_BATCH)); err != SYNC_SELF {
+		t.Fatalf("got %v, want SYNC_SELF", err)
+	}
+	if _, err := a.ApplyChanges([]*SyncEvent{{Id: "x", Node: "n", HLC: 1, Kind: SYNC_STUDENT, StudentId: "9"}}); err != BAD_SYNC_EVENT {
+		t.Fatalf("got %v, want BAD_SYNC_EVENT", err)
+	}
+
+	// the log of the encrypted node keeps the names encrypted, and gives
+	// them to the peers decrypted (the WebApp seals them for the network)
+	var stored string
+	if err := c.DB().QueryRow("select name from sync_event where kind = ? and name != '' limit 1", SYNC_STUDENT).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(stored) {
+		t.Fatalf("the log keeps %q", stored)
+	}
+	changes, err := c.GetChanges(0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := false
+	for _, e := range changes.Events {
+		plain = plain || e.Name == "乙"
+	}
+	if !plain {
+		t.Fatal("the changes do not have the names")
+	}
+
+	// anonymizing a former student leaves no change in the log with their
+	// stuid, nor any for the peers to pull
+	anonymousId, err := b.AnonymizeStudent("002", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := b.DB().QueryRow("select count(*) from sync_event where stuid = ?", "002").Scan(&n); err != nil || n != 0 {
+		t.Fatalf("the log keeps %d changes of the old stuid, %v", n, err)
+	}
+	changes, err = b.GetChanges(0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range changes.Events {
+		if e.StudentId == "002" || (e.StudentId == anonymousId && e.Name != "" && e.Name != ANONYMOUS_NAME) {
+			t.Fatalf("the changes have %+v", e)
+		}
+	}
+}
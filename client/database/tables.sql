@@ -1,16 +1,110 @@
-
 -- These tables comprise the local datastore on the Raspberry Pi client
 -- device, using SQLite for the database. SQLite has a limited set of
 -- datatypes (https://www.sqlite.org/datatype3.html), so the analogous
 -- server database columns have been adjusted accordingly.
+--
+-- These are the tables as first defined; later changes to them (e.g.,
+-- the deleted_at columns of the trash) are the MIGRATIONS in
+-- migrations.go, which the client binaries apply when they open the db.
 
--- `account` defines basic end-user information, corresponding to the
--- account table in the server database
+-- `student` is the class roster, keyed by the barcode on each card
 
 CREATE TABLE IF NOT EXISTS student (
-  name text NOT NULL,
-  stuid integer PRIMARY KEY,
-  submission_status boolean DEFAULT 0,
-  submission_time integer DEFAULT 0,
-  UNIQUE(name, stuid)
+  stuid text PRIMARY KEY,
+  name text NOT NULL
+);
+
+-- `assignment` is each piece of homework students hand in
+
+CREATE TABLE IF NOT EXISTS assignment (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  title text NOT NULL,
+  posted integer DEFAULT 0, -- unix time
+  due integer DEFAULT 0 -- unix time, 0 means no deadline
 );
+
+-- `submission` records each scan of a student card against an assignment
+
+CREATE TABLE IF NOT EXISTS submission (
+  stuid text NOT NULL REFERENCES student(stuid) ON UPDATE CASCADE ON DELETE CASCADE,
+  assignment integer NOT NULL REFERENCES assignment(id) ON DELETE CASCADE,
+  posted integer NOT NULL, -- unix time of the scan
+  PRIMARY KEY (stuid, assignment)
+);
+
+-- `setting` holds the client configuration, including the designated
+-- account registration and the current assignment
+
+CREATE TABLE IF NOT EXISTS setting (
+  key text PRIMARY KEY,
+  value text NOT NULL
+);
+
+-- `unknown_scan` queues the scans of barcodes which match no student
+-- (e.g., a new card, or a student not in the roster yet), until they are
+-- linked to a student, or dismissed
+
+CREATE TABLE IF NOT EXISTS unknown_scan (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  barcode text NOT NULL,
+  posted integer NOT NULL, -- unix time of the scan
+  device text NOT NULL DEFAULT '', -- the scanner input device
+  assignment integer REFERENCES assignment(id) ON DELETE SET NULL -- current when scanned
+);
+
+CREATE INDEX IF NOT EXISTS unknown_scan_barcode ON unknown_scan (barcode);
+
+-- `card` maps each scannable barcode to a student, so a student may have
+-- several cards (e.g., a replacement for a lost one), and a lost card can
+-- be revoked without changing the student's stuid or their history
+
+CREATE TABLE IF NOT EXISTS card (
+  barcode text PRIMARY KEY,
+  stuid text NOT NULL REFERENCES student(stuid) ON UPDATE CASCADE ON DELETE CASCADE,
+  issued integer NOT NULL DEFAULT 0, -- unix time
+  revoked integer NOT NULL DEFAULT 0 -- unix time, 0 while the card is valid
+);
+
+CREATE INDEX IF NOT EXISTS card_student ON card (stuid);
+
+-- each new student starts with a card whose barcode is their stuid
+
+CREATE TRIGGER IF NOT EXISTS student_first_card AFTER INSERT ON student
+BEGIN
+  INSERT INTO card (barcode, stuid, issued) VALUES (new.stuid, new.stuid, CAST(strftime('%s', 'now') AS integer));
+END;
+
+-- and so do existing students, from before cards were kept
+
+INSERT OR IGNORE INTO card (barcode, stuid)
+  SELECT stuid, stuid FROM student WHERE stuid NOT IN (SELECT stuid FROM card);
+
+-- `student_search` is the full text index of the roster, by stuid and by
+-- name, pinyin spelling and initials (the search_terms() function is
+-- registered by the client binaries, which must be built with the
+-- 'sqlite_fts5' tag); the triggers keep it in step with `student`
+
+CREATE VIRTUAL TABLE IF NOT EXISTS student_search USING fts5 (
+  stuid,
+  terms,
+  tokenize = 'unicode61'
+);
+
+CREATE TRIGGER IF NOT EXISTS student_search_insert AFTER INSERT ON student
+BEGIN
+  INSERT INTO student_search (stuid, terms) VALUES (new.stuid, search_terms(new.name));
+END;
+
+CREATE TRIGGER IF NOT EXISTS student_search_update AFTER UPDATE ON student
+BEGIN
+  DELETE FROM student_search WHERE stuid = old.stuid;
+  INSERT INTO student_search (stuid, terms) VALUES (new.stuid, search_terms(new.name));
+END;
+
+CREATE TRIGGER IF NOT EXISTS student_search_delete AFTER DELETE ON student
+BEGIN
+  DELETE FROM student_search WHERE stuid = old.stuid;
+END;
+
+INSERT INTO student_search (stuid, terms)
+  SELECT stuid, search_terms(name) FROM student WHERE stuid NOT IN (SELECT stuid FROM student_search);
@@ -0,0 +1,260 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The shortest password a teacher may choose
+	MIN_PASSWORD_LENGTH = 8
+
+	// The bcrypt work factor of the password hashes
+	PASSWORD_COST = bcrypt.DefaultCost
+
+	// Random bytes in the key which signs the WebApp sessions
+	SESSION_KEY_BYTES = 32
+
+	// Teacher roles
+	ROLE_TEACHER = "teacher" // everything, including managing the others
+	ROLE_TA      = "ta"      // marks submissions and grades
+	ROLE_KIOSK   = "kiosk"   // a read-only display, e.g. in the hallway
+
+	// Permissions, which the WebApp checks for each route
+	PERM_VIEW     = "view"     // the student lists, assignments and stats
+	PERM_MARK     = "mark"     // submissions, grades and groups
+	PERM_ROSTER   = "roster"   // students, cards, unknown scans and the trash
+	PERM_EXPORT   = "export"   // gradebooks, attendance sheets and emails
+	PERM_MANAGE   = "manage"   // assignments, terms, attendance setup, the account and outbox
+	PERM_SHUTDOWN = "shutdown" // the device
+	PERM_ADMIN    = "admin"    // the teachers and their roles
+)
+
+var (
+	// BAD_LOGIN is returned by Login for an unknown username and for a
+	// wrong password alike
+	BAD_LOGIN = errors.New("Wrong username or password")
+	// SHORT_PASSWORD is returned on choosing a password which is too short
+	SHORT_PASSWORD = fmt.Errorf("The password needs at least %d characters", MIN_PASSWORD_LENGTH)
+	// NO_USERNAME is returned on adding a teacher without a username
+	NO_USERNAME = errors.New("The username is required")
+
+	// BAD_ROLE is returned on giving a teacher a role not in ROLES
+	BAD_ROLE = errors.New("No such role")
+	// LAST_ADMIN is returned on removing, or taking the admin permission
+	// from, the last teacher who has it
+	LAST_ADMIN = errors.New("At least one teacher must keep the admin permission")
+
+	// ROLES in the order to offer them, and the permissions of each
+	ROLES            = []string{ROLE_TEACHER, ROLE_TA, ROLE_KIOSK}
+	PERMISSIONS      = []string{PERM_VIEW, PERM_MARK, PERM_ROSTER, PERM_EXPORT, PERM_MANAGE, PERM_SHUTDOWN, PERM_ADMIN}
+	ROLE_PERMISSIONS = map[string][]string{
+		ROLE_TEACHER: PERMISSIONS,
+		ROLE_TA:      {PERM_VIEW, PERM_MARK},
+		ROLE_KIOSK:   {PERM_VIEW}}
+
+	// what a login with an unknown username is checked against, so it
+	// takes as long as one with a wrong password
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// HashPassword returns the bcrypt hash of the password, or SHORT_PASSWORD
+func HashPassword(password string) (string, error) {
+	if len([]rune(password)) < MIN_PASSWORD_LENGTH {
+		return "", SHORT_PASSWORD
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PASSWORD_COST)
+	return string(hash), err
+}
+
+// CheckPassword reports whether the password is the Teacher's
+func (t *Teacher) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(t.Hash), []byte(password)) == nil
+}
+
+// RoleCan reports whether the role has the permission
+func RoleCan(role, perm string) bool {
+	for _, p := range ROLE_PERMISSIONS[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the Teacher's own role has the permission, i.e.,
+// on the device as a whole (see ClassCan for a class)
+func (t *Teacher) Can(perm string) bool {
+	return RoleCan(t.Role, perm)
+}
+
+// ClassRole returns the role of the teacher in the class of the term
+// (ACTIVE_TERM for the current one): the one they were given in it, if
+// any, or else their own
+func ClassRole(s Store, t *Teacher, term int64) (string, error) {
+	roles, err := s.GetClassRoles(t.Id)
+	if err != nil {
+		return "", err
+	}
+	if role, ok := roles[term]; ok {
+		return role, nil
+	}
+	return t.Role, nil
+}
+
+// ClassCan reports whether the role of the teacher in the class of the
+// term has the permission
+func ClassCan(s Store, t *Teacher, term int64, perm string) (bool, error) {
+	role, err := ClassRole(s, t, term)
+	return err == nil && RoleCan(role, perm), err
+}
+
+// SetClassRole gives the teacher with the id the role in the class of the
+// term, instead of their own, or takes it back if the role is ""
+func SetClassRole(s Store, id, term int64, role string) error {
+	if _, ok := ROLE_PERMISSIONS[role]; !ok && role != "" {
+		return BAD_ROLE
+	}
+	if _, err := s.GetTeacher(id); err != nil {
+		return err
+	}
+	if term != ACTIVE_TERM {
+		if _, err := s.GetTerm(term); err != nil {
+			return err
+		}
+	}
+	return s.SetClassRole(id, term, role)
+}
+
+// SetTeacherPassword sets the password (and the name, unless it is
+// empty) of the teacher with the username, adding them if there is no
+// such teacher yet; it reports whether it did
+func SetTeacherPassword(s Store, username, name, password string, now time.Time) (*Teacher, bool, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, false, NO_USERNAME
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, false, err
+	}
+
+	t, err := s.GetTeacherByUsername(username)
+	if err == NOT_FOUND {
+		t = &Teacher{Username: username, Name: name, Hash: hash, Role: ROLE_TEACHER, Created: now.Unix()}
+		t.Id, err = s.AddTeacher(t)
+		return t, err == nil, err
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if name != "" {
+		t.Name = name
+	}
+	t.Hash = hash
+	return t, false, s.UpdateTeacher(t)
+}
+
+// otherAdmins reports whether any teacher but the one with the id has
+// the admin permission
+func otherAdmins(s Store, id int64) (bool, error) {
+	teachers, err := s.GetTeachers()
+	if err != nil {
+		return false, err
+	}
+	for _, t := range teachers {
+		if t.Id != id && t.Can(PERM_ADMIN) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SetTeacherRole gives the teacher with the id the role, unless that
+// would leave no teacher with the admin permission
+func SetTeacherRole(s Store, id int64, role string) (*Teacher, error) {
+	if _, ok := ROLE_PERMISSIONS[role]; !ok {
+		return nil, BAD_ROLE
+	}
+	t, err := s.GetTeacher(id)
+	if err != nil {
+		return nil, err
+	}
+	if t.Can(PERM_ADMIN) && !RoleCan(role, PERM_ADMIN) {
+		if others, err := otherAdmins(s, id); err != nil {
+			return nil, err
+		} else if !others {
+			return nil, LAST_ADMIN
+		}
+	}
+	t.Role = role
+	return t, s.UpdateTeacher(t)
+}
+
+// RemoveTeacher removes the teacher with the id, unless they are the
+// last one with the admin permission
+func RemoveTeacher(s Store, id int64) error {
+	t, err := s.GetTeacher(id)
+	if err != nil {
+		return err
+	}
+	if t.Can(PERM_ADMIN) {
+		if others, err := otherAdmins(s, id); err != nil {
+			return err
+		} else if !others {
+			return LAST_ADMIN
+		}
+	}
+	return s.DeleteTeacher(id)
+}
+
+// Login returns the Teacher with the username and password, recording
+// the time they logged in, or BAD_LOGIN
+func Login(s Store, username, password string, now time.Time) (*Teacher, error) {
+	t, err := s.GetTeacherByUsername(strings.TrimSpace(username))
+	if err == NOT_FOUND {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), PASSWORD_COST)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, BAD_LOGIN
+	} else if err != nil {
+		return nil, err
+	}
+	if !t.CheckPassword(password) {
+		return nil, BAD_LOGIN
+	}
+
+	t.LastLogin = now.Unix()
+	return t, s.UpdateTeacher(t)
+}
+
+// GetSessionKey returns the key which signs the WebApp sessions,
+// generating it the first time it is requested
+func GetSessionKey(s Store) ([]byte, error) {
+	key, err := s.GetSetting(SESSION_KEY)
+	if err == NOT_FOUND {
+		b := make([]byte, SESSION_KEY_BYTES)
+		if _, err = rand.Read(b); err != nil {
+			return nil, err
+		}
+		key = hex.EncodeToString(b)
+		err = s.SetSetting(SESSION_KEY, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(key)
+}
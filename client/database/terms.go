@@ -0,0 +1,84 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"strings"
+	"time"
+)
+
+// AssignmentTally is an Assignment, with how many students submitted it
+type AssignmentTally struct {
+	Assignment *Assignment
+	Submitted  int
+}
+
+// TermArchive is a closed Term, with its roster and assignments (most
+// recent first) as they were archived
+type TermArchive struct {
+	Term        *Term
+	Roster      []*Student
+	Assignments []*AssignmentTally
+}
+
+// GetTermArchive returns the closed Term with everything archived in it
+func GetTermArchive(s Store, termId int64) (*TermArchive, error) {
+	t, err := s.GetTerm(termId)
+	if err != nil {
+		return nil, err
+	}
+	roster, err := s.GetTermRoster(termId)
+	if err != nil {
+		return nil, err
+	}
+	assignments, err := s.GetAssignments(termId)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &TermArchive{Term: t, Roster: roster, Assignments: make([]*AssignmentTally, 0, len(assignments))}
+	for _, a := range assignments {
+		submissions, err := s.GetSubmissions(a.Id)
+		if err != nil {
+			return nil, err
+		}
+		archive.Assignments = append(archive.Assignments, &AssignmentTally{Assignment: a, Submitted: len(submissions)})
+	}
+	return archive, nil
+}
+
+// GetClassName returns the name of the class of the active term, if it
+// was given one (see CloseTerm)
+func GetClassName(s Store) (string, error) {
+	name, err := s.GetSetting(CLASS_NAME)
+	if err == NOT_FOUND {
+		return "", nil
+	}
+	return name, err
+}
+
+// CloseTerm archives the active term under the name (or, if it is empty,
+// the class name, or else the day), and starts a new one, with the same
+// roster if carryRoster is set, whose class is called next; it returns
+// the id of the archived Term
+func CloseTerm(s Store, name, next string, carryRoster bool, now time.Time) (int64, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		current, err := GetClassName(s)
+		if err != nil {
+			return BAD_PK, err
+		}
+		name = current
+	}
+	if name == "" {
+		name = now.Format("2006-01-02")
+	}
+	id, err := s.CloseTerm(&Term{Name: name, Closed: now.Unix()}, carryRoster)
+	if err != nil {
+		return BAD_PK, err
+	}
+	return id, s.SetSetting(CLASS_NAME, strings.TrimSpace(next))
+}
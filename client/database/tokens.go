@@ -0,0 +1,82 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	// Random bytes in an API token
+	API_TOKEN_BYTES = 32
+
+	// what every API token starts with, so one is easy to tell apart
+	// (e.g., when it leaks into a log or a commit)
+	API_TOKEN_PREFIX = "piscan_"
+
+	// how often the last use of a token is recorded, to spare the SD card
+	// a write on every request
+	API_TOKEN_TOUCH = time.Minute
+)
+
+var (
+	// BAD_TOKEN is returned for an unknown API token, or one whose
+	// teacher has been removed
+	BAD_TOKEN = errors.New("No such API token")
+)
+
+// hashAPIToken returns the hash of the token, which is what is kept
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIToken makes a token for the teacher with the username, returning
+// it (which is shown only this once) with its record
+func NewAPIToken(s Store, username, name string, now time.Time) (string, *APIToken, error) {
+	t, err := s.GetTeacherByUsername(strings.TrimSpace(username))
+	if err != nil {
+		return "", nil, err
+	}
+	b := make([]byte, API_TOKEN_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := API_TOKEN_PREFIX + hex.EncodeToString(b)
+
+	record := &APIToken{TeacherId: t.Id, Name: strings.TrimSpace(name), Hash: hashAPIToken(token), Created: now.Unix()}
+	record.Id, err = s.AddAPIToken(record)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, record, nil
+}
+
+// APITokenTeacher returns the Teacher the token was made for, recording
+// the time it was used, or BAD_TOKEN
+func APITokenTeacher(s Store, token string, now time.Time) (*Teacher, error) {
+	record, err := s.GetAPITokenByHash(hashAPIToken(token))
+	if err == NOT_FOUND {
+		return nil, BAD_TOKEN
+	} else if err != nil {
+		return nil, err
+	}
+	t, err := s.GetTeacher(record.TeacherId)
+	if err == NOT_FOUND {
+		return nil, BAD_TOKEN
+	} else if err != nil {
+		return nil, err
+	}
+	if now.Sub(time.Unix(record.LastUsed, 0)) < API_TOKEN_TOUCH {
+		return t, nil
+	}
+	return t, s.TouchAPIToken(record.Id, now)
+}
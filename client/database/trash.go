@@ -0,0 +1,89 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"time"
+)
+
+const (
+	// How long deleted students and submissions stay in the trash, by
+	// default, and how often the WebApp purges the older ones
+	PURGE_AFTER    = 30 * 24 * time.Hour
+	PURGE_INTERVAL = 24 * time.Hour
+)
+
+// DeletedSubmission is a Submission in the trash, with the Student and
+// Assignment it was for
+type DeletedSubmission struct {
+	Submission *Submission
+	Student    *Student // possibly in the trash too
+	Assignment *Assignment
+}
+
+// Trash is everything deleted and not yet purged, most recent first
+type Trash struct {
+	Students    []*Student
+	Submissions []*DeletedSubmission
+}
+
+// GetTrash returns the deleted students and submissions
+func GetTrash(s Store) (*Trash, error) {
+	deleted, err := s.GetDeletedStudents()
+	if err != nil {
+		return nil, err
+	}
+	subs, err := s.GetDeletedSubmissions()
+	if err != nil {
+		return nil, err
+	}
+	students, err := s.GetStudents()
+	if err != nil {
+		return nil, err
+	}
+	assignments, err := s.GetAssignments(ACTIVE_TERM)
+	if err != nil {
+		return nil, err
+	}
+
+	roster := make(map[string]*Student)
+	for _, student := range append(students, deleted...) {
+		roster[student.Id] = student
+	}
+	titles := make(map[int64]*Assignment)
+	for _, a := range assignments {
+		titles[a.Id] = a
+	}
+
+	trash := &Trash{Students: deleted, Submissions: make([]*DeletedSubmission, 0, len(subs))}
+	for _, sub := range subs {
+		d := &DeletedSubmission{Submission: sub, Student: roster[sub.StudentId], Assignment: titles[sub.AssignmentId]}
+		if d.Student == nil {
+			d.Student = &Student{Id: sub.StudentId}
+		}
+		if d.Assignment == nil {
+			// archived in a closed term
+			a, err := s.GetAssignment(sub.AssignmentId)
+			if err != nil {
+				return nil, err
+			}
+			titles[a.Id] = a
+			d.Assignment = a
+		}
+		trash.Submissions = append(trash.Submissions, d)
+	}
+	return trash, nil
+}
+
+// PurgeForever empties the trash of everything deleted more than age
+// ago, at every interval, invoking errorFn on any failure
+func PurgeForever(s Store, age, interval time.Duration, errorFn func(error)) {
+	for now := range time.Tick(interval) {
+		if _, err := s.PurgeDeleted(now.Add(-age)); err != nil {
+			errorFn(err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// PendingBarcode is an unknown barcode with all its queued scans, oldest
+// first
+type PendingBarcode struct {
+	Barcode string
+	Scans   []*UnknownScan
+}
+
+// LastScan returns the most recent scan of the barcode
+func (p *PendingBarcode) LastScan() *UnknownScan {
+	return p.Scans[len(p.Scans)-1]
+}
+
+// RecordUnknownScan queues the scan of a barcode which matched no Student,
+// against the current Assignment, so it can be submitted once the barcode
+// is linked to a Student; in attendance mode, there is nothing to submit
+func RecordUnknownScan(s Store, barcode, device string, now time.Time) error {
+	u := &UnknownScan{Barcode: barcode, Posted: now.Unix(), Device: device}
+	mode, _, err := GetScanMode(s)
+	if err != nil {
+		return err
+	}
+	if mode == MODE_HOMEWORK {
+		a, err := EnsureCurrentAssignment(s, now)
+		if err != nil {
+			return err
+		}
+		u.AssignmentId = a.Id
+	}
+	_, err = s.AddUnknownScan(u)
+	return err
+}
+
+// GetPendingBarcodes groups the queued unknown scans by barcode, the most
+// recently scanned barcode first
+func GetPendingBarcodes(s Store) ([]*PendingBarcode, error) {
+	scans, err := s.GetUnknownScans()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*PendingBarcode, 0)
+	index := make(map[string]*PendingBarcode)
+	for _, u := range scans {
+		p, ok := index[u.Barcode]
+		if !ok {
+			p = &PendingBarcode{Barcode: u.Barcode}
+			index[u.Barcode] = p
+			results = append(results, p)
+		}
+		p.Scans = append(p.Scans, u)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].LastScan().Posted > results[j].LastScan().Posted
+	})
+	return results, nil
+}
+
+// LinkUnknownBarcode issues the barcode as another card of an existing
+// Student, and submits its queued scans for them
+func LinkUnknownBarcode(s Store, barcode, stuid string) (int, error) {
+	student, err := s.GetStudent(stuid)
+	if err != nil {
+		return 0, err
+	}
+	return s.ResolveUnknownScans(barcode, student, false)
+}
+
+// CreateFromUnknownBarcode adds a new Student with the barcode as their
+// first card, and submits its queued scans for them; their stuid is the
+// barcode, unless one is given, which it must be in an encrypted db
+func CreateFromUnknownBarcode(s Store, barcode, stuid, name string) (int, error) {
+	if stuid == "" {
+		stuid = barcode
+	}
+	if stuid == barcode {
+		encrypted, err := IsEncryptedStore(s)
+		if err != nil {
+			return 0, err
+		}
+		if encrypted {
+			return 0, STUID_IS_BARCODE
+		}
+	}
+	return s.ResolveUnknownScans(barcode, &Student{Id: stuid, Name: name}, true)
+}
@@ -0,0 +1,62 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the sqlite database on the Pi client
+
+package database
+
+import (
+	"database/sql"
+)
+
+const (
+	// the setting with the seq (see sync_event) of the last submission
+	// queued for upload to the API server
+	UPLOAD_CURSOR = "upload_cursor"
+
+	// every submission logged, whether scanned here or pulled from a peer,
+	// with the name of the student and the title of the assignment
+	GET_UPLOADS = `select e.seq, e.stuid, coalesce(s.name, ''), e.assignment, coalesce(a.title, ''), e.posted
+	  from sync_event e left join student s on s.stuid = e.stuid left join assignment a on a.uid = e.assignment
+	  where e.seq > ? and e.kind = 'submit' order by e.seq limit ?`
+)
+
+// Upload is a submission as sent to the API server, where the assignment
+// is known by its uid, the same on every synced device
+type Upload struct {
+	StudentId   string
+	StudentName string
+	Assignment  string // uid
+	Title       string
+	Posted      int64 // unix time of the scan
+}
+
+// Uploader is a Store which keeps the log of the submissions to upload
+type Uploader interface {
+	Store
+	// GetUploads returns the submissions logged after the cursor, at most
+	// limit of them, and the cursor of those after them
+	GetUploads(since int64, limit int) ([]*Upload, int64, error)
+}
+
+var _ Uploader = (*SQLiteStore)(nil)
+
+func (s *SQLiteStore) GetUploads(since int64, limit int) ([]*Upload, int64, error) {
+	var (
+		uploads []*Upload
+		next    int64
+	)
+	err := s.queryRows(GET_UPLOADS, []interface{}{since, limit},
+		func() { uploads, next = make([]*Upload, 0), since },
+		func(rows *sql.Rows) error {
+			u := new(Upload)
+			if err := rows.Scan(&next, &u.StudentId, &u.StudentName, &u.Assignment, &u.Title, &u.Posted); err != nil {
+				return err
+			}
+			var err error
+			u.StudentName, err = s.cipher.Decrypt(u.StudentName)
+			uploads = append(uploads, u)
+			return err
+		})
+	return uploads, next, err
+}
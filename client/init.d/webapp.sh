@@ -18,8 +18,13 @@ case "$1" in
     echo "Stopping WebApp"
     killall WebApp
     ;;
+  restart)
+    echo "Restarting WebApp"
+    # in the background, so the WebApp can answer before it is stopped
+    ( sleep 2; $0 stop; $0 start ) > /dev/null 2>&1 &
+    ;;
   *)
-    echo "Usage: /etc/init.d/webapp.sh {start|stop}"
+    echo "Usage: /etc/init.d/webapp.sh {start|stop|restart}"
     exit 1
     ;;
 esac
@@ -0,0 +1,454 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package rest provides the JSON REST API of the Pi client WebApp, for
+// scripts, under /api/v1
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	API_URL      = "/api/v1/"
+	OPENAPI_PATH = "/openapi.json"
+
+	// list pagination
+	DEFAULT_LIMIT = 50
+	MAX_LIMIT     = 500
+
+	// the largest request body accepted
+	MAX_BODY = 1 << 20
+
+	// query parameter types
+	STRING  = "string"
+	INTEGER = "integer"
+	BOOLEAN = "boolean"
+
+	// Errors
+	NO_TOKEN      = "An API token is required (as 'Authorization: Bearer <token>')"
+	NOT_PERMITTED = "The teacher of this API token is not allowed to do that"
+	NO_ROUTE      = "No such API path"
+	NO_METHOD     = "Method not allowed"
+)
+
+// Param is a path variable or query parameter of a Route
+type Param struct {
+	Name        string
+	Type        string // STRING, INTEGER or BOOLEAN
+	Description string
+}
+
+// Route is an endpoint of the API; the ROUTES are both what the Handler
+// serves and what the OpenAPI document describes
+type Route struct {
+	Method      string
+	Path        string // under API_URL, e.g. "/students/{id}"
+	Summary     string
+	Permission  string  // what the teacher of the token needs (see database.ROLE_PERMISSIONS)
+	Vars        []Param // in the path
+	Query       []Param // the filters of a list
+	List        bool    // paginated, with the limit and offset parameters
+	Sort        []string
+	Body        interface{} // a zero value of the request body, or nil
+	Reply       interface{} // a zero value of the reply (or of each item of a List)
+	Status      int         // on success
+	Destructive string      // what it does which cannot be undone, if anything
+	Refused     string      // why the method is not allowed on the path (a 405), if it is not
+	// Class returns the class (term) the request is about, in which the
+	// teacher's role is checked, if it may be another than the current one
+	Class  func(c *Context) int64
+	Handle func(c *Context) (interface{}, error)
+}
+
+// Context is a request to a Route
+type Context struct {
+	Request  *http.Request
+	Store    database.Store
+	Teacher  *database.Teacher
+	Route    *Route
+	Vars     map[string]string
+	Now      time.Time
+	Location string // of a created resource
+	Created  bool   // false if a POST found it already there
+	w        http.ResponseWriter
+}
+
+// Error is an error reply, with its http status
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorReply is the body of every error reply
+type ErrorReply struct {
+	Error string `json:"error"`
+}
+
+// List is a page of a list reply
+type List struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total" doc:"how many match, on every page"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+// badRequest returns a 400 Error
+func badRequest(format string, args ...interface{}) error {
+	return &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+// statusOf returns the http status of the error
+func statusOf(err error) int {
+	switch err {
+	case database.NOT_FOUND:
+		return http.StatusNotFound
+	case database.DUPLICATE_STUDENT, database.DUPLICATE_CARD, database.ARCHIVED, database.GROUPED:
+		return http.StatusConflict
+	case database.INVALID_GRADE:
+		return http.StatusBadRequest
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// reply writes the value as json, with the status
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		status, body = http.StatusInternalServerError, []byte(fmt.Sprintf(`{"error":%q}`, err.Error()))
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// replyError writes the error reply
+func replyError(w http.ResponseWriter, status int, message string) {
+	reply(w, status, ErrorReply{Error: message})
+}
+
+// match returns the path variables of the route in the path, or false
+func match(route, path string) (map[string]string, bool) {
+	routeParts := strings.Split(strings.Trim(route, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(routeParts) != len(pathParts) {
+		return nil, false
+	}
+	vars := make(map[string]string)
+	for i, part := range routeParts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") && pathParts[i] != "" {
+			vars[part[1:len(part)-1]] = pathParts[i]
+		} else if part != pathParts[i] {
+			return nil, false
+		}
+	}
+	return vars, true
+}
+
+// checkType reports whether the value is of the Param's type
+func checkType(p Param, value string) bool {
+	switch p.Type {
+	case INTEGER:
+		_, err := strconv.ParseInt(value, 10, 64)
+		return err == nil
+	case BOOLEAN:
+		_, err := strconv.ParseBool(value)
+		return err == nil
+	}
+	return true
+}
+
+// pageParams are the query parameters of every List route
+func pageParams(route *Route) []Param {
+	params := []Param{
+		{Name: "limit", Type: INTEGER, Description: fmt.Sprintf("How many to return, up to %d (defaults to %d)", MAX_LIMIT, DEFAULT_LIMIT)},
+		{Name: "offset", Type: INTEGER, Description: "How many to skip"}}
+	if len(route.Sort) > 0 {
+		params = append(params, Param{Name: "sort", Type: STRING,
+			Description: fmt.Sprintf("One of %s, or the same with a leading '-' for descending order (defaults to %s)", strings.Join(route.Sort, ", "), route.Sort[0])})
+	}
+	return params
+}
+
+// checkParams rejects the path variables and query parameters which are
+// not of the route, or not of their type
+func (c *Context) checkParams() error {
+	for _, p := range c.Route.Vars {
+		if !checkType(p, c.Vars[p.Name]) {
+			return &Error{Status: http.StatusNotFound, Message: database.NOT_FOUND.Error()}
+		}
+	}
+	params := c.Route.Query
+	if c.Route.List {
+		params = append(pageParams(c.Route), params...)
+	}
+	query := c.Request.URL.Query()
+	for name, values := range query {
+		known := false
+		for _, p := range params {
+			if p.Name == name {
+				known = true
+				if !checkType(p, values[0]) {
+					return badRequest("The '%s' parameter must be of type %s", name, p.Type)
+				}
+			}
+		}
+		if !known {
+			return badRequest("Unknown query parameter '%s'", name)
+		}
+	}
+	return nil
+}
+
+// String returns the query parameter, or ""
+func (c *Context) String(name string) string {
+	return strings.TrimSpace(c.Request.URL.Query().Get(name))
+}
+
+// Int returns the (already checked) integer query parameter, and whether
+// it was given
+func (c *Context) Int(name string) (int64, bool) {
+	n, err := strconv.ParseInt(c.Request.URL.Query().Get(name), 10, 64)
+	return n, err == nil
+}
+
+// Bool returns the (already checked) boolean query parameter, and whether
+// it was given
+func (c *Context) Bool(name string) (bool, bool) {
+	b, err := strconv.ParseBool(c.Request.URL.Query().Get(name))
+	return b, err == nil
+}
+
+// IntVar returns the (already checked) integer path variable
+func (c *Context) IntVar(name string) int64 {
+	n, _ := strconv.ParseInt(c.Vars[name], 10, 64)
+	return n
+}
+
+// decode reads the json request body into v, which must match it exactly
+func (c *Context) decode(v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(c.w, c.Request.Body, MAX_BODY))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return badRequest("The request body is not valid: %s", err.Error())
+	}
+	return nil
+}
+
+// sortLess returns the order the list was asked for, of the fields of
+// the route's Sort, with the less functions given for each
+func (c *Context) sortLess(less map[string]func(i, j int) bool) (func(i, j int) bool, error) {
+	field := c.String("sort")
+	if field == "" {
+		field = c.Route.Sort[0]
+	}
+	descending := strings.HasPrefix(field, "-")
+	field = strings.TrimPrefix(field, "-")
+	for _, known := range c.Route.Sort {
+		if known == field {
+			fn := less[field]
+			if descending {
+				return func(i, j int) bool { return fn(j, i) }, nil
+			}
+			return fn, nil
+		}
+	}
+	return nil, badRequest("The list cannot be sorted by '%s'", field)
+}
+
+// sortBy sorts the items (a slice) as the list was asked for
+func (c *Context) sortBy(items interface{}, less map[string]func(i, j int) bool) error {
+	fn, err := c.sortLess(less)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(items, fn)
+	return nil
+}
+
+// page returns the bounds of the page asked for of n items, and the List
+// to return it in
+func (c *Context) page(n int) (int, int, *List, error) {
+	limit, ok := c.Int("limit")
+	if !ok {
+		limit = DEFAULT_LIMIT
+	}
+	if limit < 1 || limit > MAX_LIMIT {
+		return 0, 0, nil, badRequest("The limit must be between 1 and %d", MAX_LIMIT)
+	}
+	offset, _ := c.Int("offset")
+	if offset < 0 {
+		return 0, 0, nil, badRequest("The offset cannot be negative")
+	}
+	start, end := int(offset), int(offset+limit)
+	if start > n {
+		start = n
+	}
+	if end > n {
+		end = n
+	}
+	return start, end, &List{Total: n, Limit: int(limit), Offset: int(offset)}, nil
+}
+
+// authenticate returns the teacher of the API token of the request
+func authenticate(r *http.Request, store database.Store, now time.Time) (*database.Teacher, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, database.BAD_TOKEN
+	}
+	return database.APITokenTeacher(store, strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")), now)
+}
+
+// serve invokes the route for the request, replying with the value it
+// returns, or the error
+func serve(w http.ResponseWriter, r *http.Request, store database.Store, route *Route, vars map[string]string) {
+	c := &Context{Request: r, Store: store, Route: route, Vars: vars, Now: time.Now(), Created: true, w: w}
+
+	if route.Permission != "" {
+		t, err := authenticate(r, store, c.Now)
+		if err == database.BAD_TOKEN {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="PiScan"`)
+			replyError(w, http.StatusUnauthorized, NO_TOKEN)
+			return
+		} else if err != nil {
+			replyError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		var class int64 = database.ACTIVE_TERM
+		if route.Class != nil {
+			class = route.Class(c)
+		}
+		role, err := database.ClassRole(store, t, class)
+		if err != nil {
+			replyError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !database.RoleCan(role, route.Permission) {
+			log.Println(fmt.Sprintf("Denied %s %s to the API token of %s (%s in class %d): it needs the '%s' permission", r.Method, r.URL.Path, t.Username, role, class, route.Permission))
+			replyError(w, http.StatusForbidden, NOT_PERMITTED)
+			return
+		}
+		c.Teacher = t
+	}
+
+	if err := c.checkParams(); err != nil {
+		replyError(w, statusOf(err), err.Error())
+		return
+	}
+	v, err := route.Handle(c)
+	if err != nil {
+		replyError(w, statusOf(err), err.Error())
+		return
+	}
+
+	status := route.Status
+	if status == http.StatusCreated && !c.Created {
+		status = http.StatusOK
+	}
+	if c.Location != "" {
+		w.Header().Set("Location", c.Location)
+	}
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	reply(w, status, v)
+}
+
+// Handler serves the ROUTES (and the OpenAPI document describing them)
+// from the store, for the teachers with an API token (see
+// database.NewAPIToken) whose role has the permission of each
+func Handler(store database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(API_URL, "/"))
+		if path == OPENAPI_PATH && r.Method == "GET" {
+			reply(w, http.StatusOK, OpenAPI())
+			return
+		}
+
+		allowed, refused := make([]string, 0), NO_METHOD
+		for _, route := range ROUTES {
+			vars, ok := match(route.Path, path)
+			if !ok {
+				continue
+			}
+			switch {
+			case route.Refused != "":
+				if route.Method == r.Method {
+					refused = route.Refused
+				}
+			case route.Method == r.Method:
+				serve(w, r, store, route, vars)
+				return
+			default:
+				allowed = append(allowed, route.Method)
+			}
+		}
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			replyError(w, http.StatusMethodNotAllowed, refused)
+			return
+		}
+		replyError(w, http.StatusNotFound, NO_ROUTE)
+	}
+}
+
+// classVar is the class of a request with its id in the path
+func classVar(c *Context) int64 {
+	return c.IntVar("id")
+}
+
+// classQuery is the class of a request with the 'class' parameter, if any
+func classQuery(c *Context) int64 {
+	class, _ := c.Int("class")
+	return class
+}
+
+// assignmentClass returns the class of the assignment with the id, or
+// the current one if there is no such assignment (which the route then
+// replies is not found)
+func assignmentClass(c *Context, id int64) int64 {
+	a, err := c.Store.GetAssignment(id)
+	if err != nil {
+		return database.ACTIVE_TERM
+	}
+	return a.Term
+}
+
+// assignmentVar returns the class of a request with an assignment id as
+// the path variable
+func assignmentVar(name string) func(c *Context) int64 {
+	return func(c *Context) int64 {
+		return assignmentClass(c, c.IntVar(name))
+	}
+}
+
+// assignmentQuery is the class of a request with the 'assignment'
+// parameter, or else the 'class' one
+func assignmentQuery(c *Context) int64 {
+	if id, given := c.Int("assignment"); given {
+		return assignmentClass(c, id)
+	}
+	return classQuery(c)
+}
+
+// location returns the url of the resource at the path under API_URL
+func location(format string, args ...interface{}) string {
+	return strings.TrimSuffix(API_URL, "/") + fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,199 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package rest provides the JSON REST API of the Pi client WebApp, for
+// scripts, under /api/v1
+
+package rest
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"strings"
+)
+
+// Assignment is a piece of homework of a class
+type Assignment struct {
+	Id        int64   `json:"id"`
+	Title     string  `json:"title"`
+	Posted    int64   `json:"posted" doc:"unix time"`
+	Due       int64   `json:"due" doc:"unix time, or 0 if there is no deadline"`
+	Class     int64   `json:"class" doc:"the id of its class: 0 for the current one"`
+	Scale     string  `json:"scale" doc:"the letter grades, best first (e.g., 'A,B,C,D,F'), or '' for points"`
+	MaxPoints float64 `json:"maxPoints" doc:"out of which the points are given, or 0"`
+	Current   bool    `json:"current" doc:"whether scans are recorded against it"`
+}
+
+// AssignmentInput is the body which adds or changes an Assignment
+type AssignmentInput struct {
+	Title     string  `json:"title"`
+	Due       int64   `json:"due" doc:"unix time, or 0 if there is no deadline"`
+	Scale     string  `json:"scale" doc:"the letter grades, best first (e.g., 'A,B,C,D,F'), or '' for points"`
+	MaxPoints float64 `json:"maxPoints" doc:"out of which the points are given, or 0"`
+	Current   bool    `json:"current" doc:"make it the one scans are recorded against"`
+}
+
+// currentId returns the id of the current assignment, or 0
+func currentId(c *Context) (int64, error) {
+	a, err := database.CurrentAssignment(c.Store)
+	if err == database.NOT_FOUND {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return a.Id, nil
+}
+
+func assignmentJSON(a *database.Assignment, current int64) *Assignment {
+	return &Assignment{Id: a.Id,
+		Title:     a.Title,
+		Posted:    a.Posted,
+		Due:       a.Due,
+		Class:     a.Term,
+		Scale:     a.Scale,
+		MaxPoints: a.MaxPoints,
+		Current:   a.Id == current}
+}
+
+// apply copies the input to the assignment, checking it
+func (in *AssignmentInput) apply(a *database.Assignment) error {
+	a.Title = strings.TrimSpace(in.Title)
+	if a.Title == "" {
+		return badRequest("An assignment needs a title")
+	}
+	if in.Due < 0 || in.MaxPoints < 0 {
+		return badRequest("The due date and the points cannot be negative")
+	}
+	a.Due, a.Scale, a.MaxPoints = in.Due, "", in.MaxPoints
+	if strings.TrimSpace(in.Scale) != "" {
+		a.Scale = database.NormalizeScale(in.Scale)
+		if a.Scale == "" {
+			return badRequest("The scale is not a list of letter grades")
+		}
+		a.MaxPoints = 0
+	}
+	return nil
+}
+
+// ListAssignments returns the assignments of the class (the current one,
+// unless another is given), optionally only those whose title has the
+// query
+func ListAssignments(c *Context) (interface{}, error) {
+	class, _ := c.Int("class")
+	assignments, err := c.Store.GetAssignments(class)
+	if err != nil {
+		return nil, err
+	}
+	if q := strings.ToLower(c.String("q")); q != "" {
+		matching := make([]*database.Assignment, 0)
+		for _, a := range assignments {
+			if strings.Contains(strings.ToLower(a.Title), q) {
+				matching = append(matching, a)
+			}
+		}
+		assignments = matching
+	}
+	err = c.sortBy(assignments, map[string]func(i, j int) bool{
+		"posted": func(i, j int) bool { return assignments[i].Posted < assignments[j].Posted },
+		"due":    func(i, j int) bool { return assignments[i].Due < assignments[j].Due },
+		"title":  func(i, j int) bool { return assignments[i].Title < assignments[j].Title }})
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := currentId(c)
+	if err != nil {
+		return nil, err
+	}
+	start, end, list, err := c.page(len(assignments))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Assignment, 0, end-start)
+	for _, a := range assignments[start:end] {
+		items = append(items, assignmentJSON(a, current))
+	}
+	list.Items = items
+	return list, nil
+}
+
+// GetAssignment returns the assignment with the id in the path
+func GetAssignment(c *Context) (interface{}, error) {
+	a, err := c.Store.GetAssignment(c.IntVar("id"))
+	if err != nil {
+		return nil, err
+	}
+	current, err := currentId(c)
+	if err != nil {
+		return nil, err
+	}
+	return assignmentJSON(a, current), nil
+}
+
+// AddAssignment adds the posted assignment to the current class
+func AddAssignment(c *Context) (interface{}, error) {
+	in := new(AssignmentInput)
+	if err := c.decode(in); err != nil {
+		return nil, err
+	}
+	a := &database.Assignment{Posted: c.Now.Unix()}
+	if err := in.apply(a); err != nil {
+		return nil, err
+	}
+	id, err := c.Store.AddAssignment(a)
+	if err != nil {
+		return nil, err
+	}
+	a.Id = id
+	if in.Current {
+		if err := database.SetCurrentAssignment(c.Store, id); err != nil {
+			return nil, err
+		}
+	}
+	current, err := currentId(c)
+	if err != nil {
+		return nil, err
+	}
+	c.Location = location("/assignments/%d", id)
+	return assignmentJSON(a, current), nil
+}
+
+// UpdateAssignment changes the assignment with the id in the path, which
+// must be of the current class
+func UpdateAssignment(c *Context) (interface{}, error) {
+	a, err := c.Store.GetAssignment(c.IntVar("id"))
+	if err != nil {
+		return nil, err
+	}
+	if a.Term != database.ACTIVE_TERM {
+		return nil, database.ARCHIVED
+	}
+	in := new(AssignmentInput)
+	if err := c.decode(in); err != nil {
+		return nil, err
+	}
+	if err := in.apply(a); err != nil {
+		return nil, err
+	}
+	if err := c.Store.UpdateAssignment(a); err != nil {
+		return nil, err
+	}
+	if in.Current {
+		if err := database.SetCurrentAssignment(c.Store, a.Id); err != nil {
+			return nil, err
+		}
+	}
+	return GetAssignment(c)
+}
+
+// DeleteAssignment deletes the assignment with the id in the path, which
+// must be of the current class
+func DeleteAssignment(c *Context) (interface{}, error) {
+	a, err := c.Store.GetAssignment(c.IntVar("id"))
+	if err != nil {
+		return nil, err
+	}
+	if a.Term != database.ACTIVE_TERM {
+		return nil, database.ARCHIVED
+	}
+	return nil, c.Store.DeleteAssignment(a.Id)
+}
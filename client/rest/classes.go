@@ -0,0 +1,173 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package rest provides the JSON REST API of the Pi client WebApp, for
+// scripts, under /api/v1
+
+package rest
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+	"strings"
+)
+
+// Class is a school term: the current one (whose id is 0), or one
+// closed and archived
+type Class struct {
+	Id          int64  `json:"id" doc:"0 for the current class"`
+	Name        string `json:"name"`
+	Started     int64  `json:"started" doc:"unix time, or 0 if not known"`
+	Closed      int64  `json:"closed" doc:"unix time, or 0 for the current class"`
+	Current     bool   `json:"current"`
+	Students    int    `json:"students" doc:"on its roster"`
+	Assignments int    `json:"assignments"`
+}
+
+// ClassInput is the body which closes the current Class, starting the
+// next one
+type ClassInput struct {
+	Name        string `json:"name" doc:"of the next class"`
+	CarryRoster bool   `json:"carryRoster" doc:"keep the roster of the closed class"`
+}
+
+// ClassNameInput is the body which renames the current Class
+type ClassNameInput struct {
+	Name string `json:"name"`
+}
+
+// currentClass returns the current class
+func currentClass(s database.Store) (*Class, error) {
+	name, err := database.GetClassName(s)
+	if err != nil {
+		return nil, err
+	}
+	class := &Class{Id: database.ACTIVE_TERM, Name: name, Current: true}
+	terms, err := s.GetTerms()
+	if err != nil {
+		return nil, err
+	}
+	if len(terms) > 0 {
+		class.Started = terms[0].Closed
+	}
+	students, err := s.GetStudents()
+	if err != nil {
+		return nil, err
+	}
+	class.Students = len(students)
+	return class, countAssignments(s, class)
+}
+
+// closedClass returns the class of the closed term
+func closedClass(s database.Store, t *database.Term) (*Class, error) {
+	class := &Class{Id: t.Id, Name: t.Name, Started: t.Started, Closed: t.Closed}
+	students, err := s.GetTermRoster(t.Id)
+	if err != nil {
+		return nil, err
+	}
+	class.Students = len(students)
+	return class, countAssignments(s, class)
+}
+
+func countAssignments(s database.Store, class *Class) error {
+	assignments, err := s.GetAssignments(class.Id)
+	class.Assignments = len(assignments)
+	return err
+}
+
+// ListClasses returns the current class, then the closed ones, most
+// recent first
+func ListClasses(c *Context) (interface{}, error) {
+	terms, err := c.Store.GetTerms()
+	if err != nil {
+		return nil, err
+	}
+	start, end, list, err := c.page(len(terms) + 1)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Class, 0, end-start)
+	for i := start; i < end; i++ {
+		var class *Class
+		if i == 0 {
+			class, err = currentClass(c.Store)
+		} else {
+			class, err = closedClass(c.Store, terms[i-1])
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, class)
+	}
+	list.Items = items
+	return list, nil
+}
+
+// GetClass returns the class with the id in the path
+func GetClass(c *Context) (interface{}, error) {
+	id := c.IntVar("id")
+	if id == database.ACTIVE_TERM {
+		return currentClass(c.Store)
+	}
+	t, err := c.Store.GetTerm(id)
+	if err != nil {
+		return nil, err
+	}
+	return closedClass(c.Store, t)
+}
+
+// CloseClass closes the current class (as closing the term on the Terms
+// page does), archiving it, and starts the posted one; it returns the
+// closed class, under its new id
+func CloseClass(c *Context) (interface{}, error) {
+	if _, err := GetClass(c); err != nil {
+		return nil, err
+	}
+	if c.IntVar("id") != database.ACTIVE_TERM {
+		return nil, &Error{Status: http.StatusConflict, Message: "The class is already closed"}
+	}
+	in := new(ClassInput)
+	if err := c.decode(in); err != nil {
+		return nil, err
+	}
+	id, err := database.CloseTerm(c.Store, "", in.Name, in.CarryRoster, c.Now)
+	if err != nil {
+		return nil, err
+	}
+	t, err := c.Store.GetTerm(id)
+	if err != nil {
+		return nil, err
+	}
+	c.Location = location("/classes/%d", id)
+	return closedClass(c.Store, t)
+}
+
+// DeleteClass deletes the closed class with the id in the path; the
+// current one cannot be deleted
+func DeleteClass(c *Context) (interface{}, error) {
+	if _, err := GetClass(c); err != nil {
+		return nil, err
+	}
+	if c.IntVar("id") == database.ACTIVE_TERM {
+		return nil, &Error{Status: http.StatusConflict, Message: "The current class cannot be deleted"}
+	}
+	return nil, c.Store.DeleteTerm(c.IntVar("id"))
+}
+
+// UpdateClass renames the current class; a closed one cannot be changed
+func UpdateClass(c *Context) (interface{}, error) {
+	if _, err := GetClass(c); err != nil {
+		return nil, err
+	}
+	if c.IntVar("id") != database.ACTIVE_TERM {
+		return nil, &Error{Status: http.StatusConflict, Message: "A closed class cannot be changed"}
+	}
+	in := new(ClassNameInput)
+	if err := c.decode(in); err != nil {
+		return nil, err
+	}
+	if err := c.Store.SetSetting(database.CLASS_NAME, strings.TrimSpace(in.Name)); err != nil {
+		return nil, err
+	}
+	return currentClass(c.Store)
+}
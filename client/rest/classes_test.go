@@ -0,0 +1,158 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloseClass(t *testing.T) {
+	store := database.NewMemoryStore()
+	now := time.Now()
+	if _, _, err := database.SetTeacherPassword(store, "teacher", "", "password1", now); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := database.NewAPIToken(store, "teacher", "script", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddStudent(&database.Student{Id: "001", Name: "张三"}); err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(store)
+	do := func(method, path, body string, want int) map[string]interface{} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, API_URL+strings.TrimPrefix(path, "/"), strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		h(w, r)
+		if w.Code != want {
+			t.Fatalf("%s %s: got %d %s, want %d", method, path, w.Code, w.Body.String(), want)
+		}
+		v := make(map[string]interface{})
+		if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// posting a class no longer closes the current one, and says why
+	if e := do("POST", "/classes", `{"name":"下学期","carryRoster":true}`, http.StatusMethodNotAllowed); !strings.Contains(e["error"].(string), "/classes/0/close") {
+		t.Fatalf("got %v", e)
+	}
+	if c := do("GET", "/classes/0", "", http.StatusOK); c["students"].(float64) != 1 {
+		t.Fatalf("got %v", c)
+	}
+
+	do("POST", "/classes/0/close", `{"name":"下学期","unknown":true}`, http.StatusBadRequest)
+	do("POST", "/classes/9/close", `{"name":"下学期"}`, http.StatusNotFound)
+	closed := do("POST", "/classes/0/close", `{"name":"下学期","carryRoster":false}`, http.StatusOK)
+	id := int64(closed["id"].(float64))
+	if id == database.ACTIVE_TERM || closed["current"].(bool) || closed["students"].(float64) != 1 {
+		t.Fatalf("got %v", closed)
+	}
+	if c := do("GET", "/classes/0", "", http.StatusOK); c["name"] != "下学期" || c["students"].(float64) != 0 {
+		t.Fatalf("got %v", c)
+	}
+	do("POST", fmt.Sprintf("/classes/%d/close", id), `{"name":"x"}`, http.StatusConflict)
+
+	// and the OpenAPI document says it cannot be undone, and why a class
+	// cannot be posted
+	doc := do("GET", OPENAPI_PATH, "", http.StatusOK)
+	paths := doc["paths"].(map[string]interface{})
+	op := paths["/classes"].(map[string]interface{})["post"].(map[string]interface{})
+	if _, ok := op["responses"].(map[string]interface{})["405"]; !ok || !strings.HasPrefix(op["description"].(string), "Not allowed") {
+		t.Fatalf("got %v", op)
+	}
+	for _, destructive := range []struct{ path, method string }{{"/classes/{id}/close", "post"}, {"/classes/{id}", "delete"}} {
+		op := paths[destructive.path].(map[string]interface{})[destructive.method].(map[string]interface{})
+		if op["x-destructive"] != true || !strings.HasPrefix(op["description"].(string), "Destructive") {
+			t.Fatalf("%s %s: got %v", destructive.method, destructive.path, op)
+		}
+	}
+}
+
+func TestDeleteClass(t *testing.T) {
+	store := database.NewMemoryStore()
+	now := time.Now()
+	if _, _, err := database.SetTeacherPassword(store, "teacher", "", "password1", now); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := database.NewAPIToken(store, "teacher", "script", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(store)
+	do := func(method, path string, want int) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, API_URL+strings.TrimPrefix(path, "/"), nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		h(w, r)
+		if w.Code != want {
+			t.Fatalf("%s %s: got %d %s, want %d", method, path, w.Code, w.Body.String(), want)
+		}
+	}
+
+	id, err := database.CloseTerm(store, "", "下学期", false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	do("DELETE", "/classes/0", http.StatusConflict)
+	do("DELETE", fmt.Sprintf("/classes/%d", id), http.StatusNoContent)
+	do("GET", fmt.Sprintf("/classes/%d", id), http.StatusNotFound)
+	do("DELETE", fmt.Sprintf("/classes/%d", id), http.StatusNotFound)
+}
+
+func TestClassRoles(t *testing.T) {
+	store := database.NewMemoryStore()
+	now := time.Now()
+	for _, username := range []string{"teacher", "hall"} {
+		if _, _, err := database.SetTeacherPassword(store, username, "", "password1", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hall, err := store.GetTeacherByUsername("hall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.SetTeacherRole(store, hall.Id, database.ROLE_KIOSK); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := database.NewAPIToken(store, "hall", "script", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Handler(store)
+	do := func(method, path string, want int) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, API_URL+strings.TrimPrefix(path, "/"), nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		h(w, r)
+		if w.Code != want {
+			t.Fatalf("%s %s: got %d %s, want %d", method, path, w.Code, w.Body.String(), want)
+		}
+	}
+
+	// the token of a kiosk, who is a teacher of one closed class only
+	first, err := database.CloseTerm(store, "", "下学期", false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := database.CloseTerm(store, "", "", false, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.SetClassRole(store, hall.Id, first, database.ROLE_TEACHER); err != nil {
+		t.Fatal(err)
+	}
+	do("DELETE", fmt.Sprintf("/classes/%d", second), http.StatusForbidden)
+	do("DELETE", fmt.Sprintf("/classes/%d", first), http.StatusNoContent)
+	do("GET", fmt.Sprintf("/classes/%d", second), http.StatusOK)
+}
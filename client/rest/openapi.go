@@ -0,0 +1,183 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package rest provides the JSON REST API of the Pi client WebApp, for
+// scripts, under /api/v1
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const (
+	OPENAPI_VERSION = "3.0.3"
+	API_TITLE       = "PiScan client API"
+	API_VERSION     = "1"
+)
+
+// object is a node of the OpenAPI document
+type object map[string]interface{}
+
+// schemaRef returns the reference to the schema of the struct value,
+// adding it (and the structs it has) to the schemas
+func schemaRef(v interface{}, schemas object) object {
+	t := reflect.TypeOf(v)
+	if _, ok := schemas[t.Name()]; !ok {
+		schemas[t.Name()] = structSchema(t, schemas)
+	}
+	return object{"$ref": "#/components/schemas/" + t.Name()}
+}
+
+// structSchema returns the schema of the struct type, from the json (and
+// doc) tags of its fields
+func structSchema(t reflect.Type, schemas object) object {
+	properties := object{}
+	required := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		property := typeSchema(f.Type, schemas)
+		if doc := f.Tag.Get("doc"); doc != "" {
+			property["description"] = doc
+		}
+		properties[name] = property
+		required = append(required, name)
+	}
+	return object{"type": "object", "properties": properties, "required": required}
+}
+
+// typeSchema returns the schema of a field of the type
+func typeSchema(t reflect.Type, schemas object) object {
+	switch t.Kind() {
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int32:
+		return object{"type": "integer", "format": "int32"}
+	case reflect.Int64:
+		return object{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.Slice:
+		return object{"type": "array", "items": typeSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		return schemaRef(reflect.Zero(t).Interface(), schemas)
+	}
+	return object{}
+}
+
+// listSchema returns the schema of a page of the items
+func listSchema(item interface{}, schemas object) object {
+	list := structSchema(reflect.TypeOf(List{}), schemas)
+	list["properties"].(object)["items"] = object{"type": "array", "items": schemaRef(item, schemas)}
+	return list
+}
+
+// paramsOf returns the parameters of the route
+func paramsOf(route *Route) []object {
+	params := make([]object, 0)
+	for _, p := range route.Vars {
+		params = append(params, object{"name": p.Name, "in": "path", "required": true,
+			"description": p.Description, "schema": object{"type": p.Type}})
+	}
+	query := route.Query
+	if route.List {
+		query = append(pageParams(route), query...)
+	}
+	for _, p := range query {
+		params = append(params, object{"name": p.Name, "in": "query", "required": false,
+			"description": p.Description, "schema": object{"type": p.Type}})
+	}
+	return params
+}
+
+// errorResponse is the response of an error status
+func errorResponse(description string) object {
+	return object{"description": description,
+		"content": object{"application/json": object{"schema": object{"$ref": "#/components/schemas/Error"}}}}
+}
+
+// operationOf returns the OpenAPI operation of the route
+func operationOf(route *Route, schemas object) object {
+	op := object{"summary": route.Summary,
+		"operationId": strings.ToLower(route.Method) + strings.Replace(strings.Title(strings.NewReplacer("{", "", "}", "", "/", " ").Replace(route.Path)), " ", "", -1)}
+	if route.Refused != "" {
+		op["description"] = "Not allowed: " + route.Refused
+		op["security"] = []object{}
+		op["responses"] = object{"405": errorResponse(route.Refused)}
+		return op
+	}
+	if route.Destructive != "" {
+		op["description"] = "Destructive: " + route.Destructive
+		op["x-destructive"] = true
+	}
+	if params := paramsOf(route); len(params) > 0 {
+		op["parameters"] = params
+	}
+	if route.Body != nil {
+		op["requestBody"] = object{"required": true,
+			"content": object{"application/json": object{"schema": schemaRef(route.Body, schemas)}}}
+	}
+
+	responses := object{}
+	success := object{"description": http.StatusText(route.Status)}
+	if route.Reply != nil {
+		schema := schemaRef(route.Reply, schemas)
+		if route.List {
+			schema = listSchema(route.Reply, schemas)
+		}
+		success["content"] = object{"application/json": object{"schema": schema}}
+	}
+	responses[fmt.Sprintf("%d", route.Status)] = success
+	if route.Status == http.StatusCreated {
+		ok := object{"description": "Already there"}
+		ok["content"] = success["content"]
+		responses["200"] = ok
+	}
+	responses["400"] = errorResponse("The parameters or the body are not valid")
+	responses["404"] = errorResponse("Not found")
+	if route.Permission != "" {
+		responses["401"] = errorResponse("No valid API token")
+		responses["403"] = errorResponse("The teacher of the API token does not have the permission")
+		op["x-permission"] = route.Permission
+	} else {
+		op["security"] = []object{}
+	}
+	if route.Method != "GET" {
+		responses["409"] = errorResponse("In conflict with the data (e.g., a duplicate, or a closed class)")
+	}
+	op["responses"] = responses
+	return op
+}
+
+// OpenAPI returns the OpenAPI document of the ROUTES
+func OpenAPI() map[string]interface{} {
+	schemas := object{"Error": structSchema(reflect.TypeOf(ErrorReply{}), nil)}
+	paths := object{}
+	for _, route := range ROUTES {
+		item, ok := paths[route.Path].(object)
+		if !ok {
+			item = object{}
+			paths[route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = operationOf(route, schemas)
+	}
+	return object{
+		"openapi": OPENAPI_VERSION,
+		"info": object{"title": API_TITLE, "version": API_VERSION,
+			"description": "Every route needs an API token (made with 'PiScanner token'), as 'Authorization: Bearer <token>', of a teacher whose role has the x-permission of the route"},
+		"servers":  []object{{"url": strings.TrimSuffix(API_URL, "/")}},
+		"paths":    paths,
+		"security": []object{{"token": []string{}}},
+		"components": object{
+			"schemas":         schemas,
+			"securitySchemes": object{"token": object{"type": "http", "scheme": "bearer"}}}}
+}
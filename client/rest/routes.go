@@ -0,0 +1,103 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package rest provides the JSON REST API of the Pi client WebApp, for
+// scripts, under /api/v1
+
+package rest
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+)
+
+var (
+	STUDENT_ID    = Param{Name: "id", Type: STRING, Description: "The stuid"}
+	ASSIGNMENT_ID = Param{Name: "id", Type: INTEGER, Description: "The assignment id"}
+	CLASS_ID      = Param{Name: "id", Type: INTEGER, Description: "The class id: 0 for the current one"}
+	CLASS_QUERY   = Param{Name: "class", Type: INTEGER, Description: "The class id (defaults to 0, the current one)"}
+
+	SUBMISSION_VARS = []Param{
+		{Name: "assignment", Type: INTEGER, Description: "The assignment id"},
+		{Name: "student", Type: STRING, Description: "The stuid"}}
+
+	// ROUTES are the endpoints of the API
+	ROUTES = []*Route{
+		// students
+		{Method: "GET", Path: "/students", Summary: "List the students on the roster",
+			Permission: database.PERM_VIEW, List: true, Sort: []string{"name", "id"},
+			Query: []Param{{Name: "q", Type: STRING, Description: "Only those whose name (or its pinyin) or stuid matches"}},
+			Reply: Student{}, Status: http.StatusOK, Handle: ListStudents},
+		{Method: "POST", Path: "/students", Summary: "Add a student to the roster",
+			Permission: database.PERM_ROSTER,
+			Body:       StudentInput{}, Reply: Student{}, Status: http.StatusCreated, Handle: AddStudent},
+		{Method: "GET", Path: "/students/{id}", Summary: "Get a student",
+			Permission: database.PERM_VIEW, Vars: []Param{STUDENT_ID},
+			Reply: Student{}, Status: http.StatusOK, Handle: GetStudent},
+		{Method: "PUT", Path: "/students/{id}", Summary: "Rename a student, or change their stuid",
+			Permission: database.PERM_ROSTER, Vars: []Param{STUDENT_ID},
+			Body: StudentInput{}, Reply: Student{}, Status: http.StatusOK, Handle: UpdateStudent},
+		{Method: "DELETE", Path: "/students/{id}", Summary: "Move a student to the trash",
+			Permission: database.PERM_ROSTER, Vars: []Param{STUDENT_ID},
+			Status: http.StatusNoContent, Handle: DeleteStudent},
+
+		// assignments
+		{Method: "GET", Path: "/assignments", Summary: "List the assignments of a class",
+			Permission: database.PERM_VIEW, List: true, Sort: []string{"posted", "due", "title"},
+			Query: []Param{CLASS_QUERY, {Name: "q", Type: STRING, Description: "Only those whose title has this"}},
+			Class: classQuery, Reply: Assignment{}, Status: http.StatusOK, Handle: ListAssignments},
+		{Method: "POST", Path: "/assignments", Summary: "Add an assignment to the current class",
+			Permission: database.PERM_MANAGE,
+			Body:       AssignmentInput{}, Reply: Assignment{}, Status: http.StatusCreated, Handle: AddAssignment},
+		{Method: "GET", Path: "/assignments/{id}", Summary: "Get an assignment",
+			Permission: database.PERM_VIEW, Vars: []Param{ASSIGNMENT_ID}, Class: assignmentVar("id"),
+			Reply: Assignment{}, Status: http.StatusOK, Handle: GetAssignment},
+		{Method: "PUT", Path: "/assignments/{id}", Summary: "Change an assignment of the current class",
+			Permission: database.PERM_MANAGE, Vars: []Param{ASSIGNMENT_ID}, Class: assignmentVar("id"),
+			Body: AssignmentInput{}, Reply: Assignment{}, Status: http.StatusOK, Handle: UpdateAssignment},
+		{Method: "DELETE", Path: "/assignments/{id}", Summary: "Delete an assignment of the current class, with its submissions",
+			Permission: database.PERM_MANAGE, Vars: []Param{ASSIGNMENT_ID}, Class: assignmentVar("id"),
+			Status: http.StatusNoContent, Handle: DeleteAssignment},
+
+		// classes
+		{Method: "GET", Path: "/classes", Summary: "List the current class, then the closed ones, most recent first",
+			Permission: database.PERM_VIEW, List: true,
+			Reply: Class{}, Status: http.StatusOK, Handle: ListClasses},
+		{Method: "POST", Path: "/classes", Summary: "Start a class (not allowed)",
+			Refused: "A class is only started by closing the current one, with POST /classes/0/close, so that a script cannot archive it by mistake"},
+		{Method: "GET", Path: "/classes/{id}", Summary: "Get a class",
+			Permission: database.PERM_VIEW, Vars: []Param{CLASS_ID}, Class: classVar,
+			Reply: Class{}, Status: http.StatusOK, Handle: GetClass},
+		{Method: "PUT", Path: "/classes/{id}", Summary: "Rename the current class",
+			Permission: database.PERM_MANAGE, Vars: []Param{CLASS_ID}, Class: classVar,
+			Body: ClassNameInput{}, Reply: Class{}, Status: http.StatusOK, Handle: UpdateClass},
+		{Method: "DELETE", Path: "/classes/{id}", Summary: "Delete a closed class",
+			Permission: database.PERM_MANAGE, Vars: []Param{CLASS_ID}, Class: classVar,
+			Destructive: "its assignments, submissions and roster are removed for good, with the students left in it who were in no other class",
+			Status:      http.StatusNoContent, Handle: DeleteClass},
+		{Method: "POST", Path: "/classes/{id}/close", Summary: "Close the current class, archiving it, and start the next one",
+			Permission: database.PERM_MANAGE, Vars: []Param{CLASS_ID}, Class: classVar,
+			Destructive: "its assignments, submissions and roster become read-only, and the next class starts without a current assignment (and, unless carryRoster, with an empty roster); a closed class cannot be reopened",
+			Body:        ClassInput{}, Reply: Class{}, Status: http.StatusOK, Handle: CloseClass},
+
+		// submissions
+		{Method: "GET", Path: "/submissions", Summary: "List the submissions of an assignment, or of every assignment of a class",
+			Permission: database.PERM_VIEW, List: true, Sort: []string{"posted", "student", "assignment"},
+			Query: []Param{CLASS_QUERY,
+				{Name: "assignment", Type: INTEGER, Description: "Only those of this assignment"},
+				{Name: "student", Type: STRING, Description: "Only those of this stuid"},
+				{Name: "graded", Type: BOOLEAN, Description: "Only those graded (true) or not (false)"}},
+			Class: assignmentQuery, Reply: Submission{}, Status: http.StatusOK, Handle: ListSubmissions},
+		{Method: "POST", Path: "/submissions", Summary: "Submit an assignment of the current class for a student (200 if it already was)",
+			Permission: database.PERM_MARK,
+			Body:       SubmissionInput{}, Reply: Submission{}, Status: http.StatusCreated, Handle: AddSubmission},
+		{Method: "GET", Path: "/submissions/{assignment}/{student}", Summary: "Get a submission",
+			Permission: database.PERM_VIEW, Vars: SUBMISSION_VARS, Class: assignmentVar("assignment"),
+			Reply: Submission{}, Status: http.StatusOK, Handle: GetSubmission},
+		{Method: "PUT", Path: "/submissions/{assignment}/{student}", Summary: "Grade a submission",
+			Permission: database.PERM_MARK, Vars: SUBMISSION_VARS, Class: assignmentVar("assignment"),
+			Body: GradeInput{}, Reply: Submission{}, Status: http.StatusOK, Handle: GradeSubmission},
+		{Method: "DELETE", Path: "/submissions/{assignment}/{student}", Summary: "Unsubmit an assignment for a student",
+			Permission: database.PERM_MARK, Vars: SUBMISSION_VARS, Class: assignmentVar("assignment"),
+			Status: http.StatusNoContent, Handle: DeleteSubmission}}
+)
@@ -0,0 +1,118 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package rest provides the JSON REST API of the Pi client WebApp, for
+// scripts, under /api/v1
+
+package rest
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"strings"
+)
+
+// Student is a student on the roster of the current class
+type Student struct {
+	Id   string `json:"id" doc:"the stuid, also the barcode of their first card"`
+	Name string `json:"name"`
+}
+
+// StudentInput is the body which adds or changes a Student
+type StudentInput struct {
+	Id   string `json:"id" doc:"a new stuid, to change it (optional on an update)"`
+	Name string `json:"name"`
+}
+
+func studentJSON(s *database.Student) *Student {
+	return &Student{Id: s.Id, Name: s.Name}
+}
+
+// ListStudents returns the students of the roster, optionally only
+// those matching the search
+func ListStudents(c *Context) (interface{}, error) {
+	var students []*database.Student
+	var err error
+	if q := c.String("q"); q != "" {
+		students, err = database.SearchStudents(c.Store, q, MAX_LIMIT)
+	} else {
+		students, err = c.Store.GetStudents()
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = c.sortBy(students, map[string]func(i, j int) bool{
+		"name": func(i, j int) bool { return students[i].Name < students[j].Name },
+		"id":   func(i, j int) bool { return students[i].Id < students[j].Id }})
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, list, err := c.page(len(students))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Student, 0, end-start)
+	for _, s := range students[start:end] {
+		items = append(items, studentJSON(s))
+	}
+	list.Items = items
+	return list, nil
+}
+
+// GetStudent returns the student with the stuid in the path
+func GetStudent(c *Context) (interface{}, error) {
+	s, err := c.Store.GetStudent(c.Vars["id"])
+	if err != nil {
+		return nil, err
+	}
+	return studentJSON(s), nil
+}
+
+// AddStudent adds the posted student to the roster
+func AddStudent(c *Context) (interface{}, error) {
+	in := new(StudentInput)
+	if err := c.decode(in); err != nil {
+		return nil, err
+	}
+	s := &database.Student{Id: strings.TrimSpace(in.Id), Name: strings.TrimSpace(in.Name)}
+	if s.Id == "" || s.Name == "" {
+		return nil, badRequest("A student needs an id and a name")
+	}
+	if err := c.Store.AddStudent(s); err != nil {
+		return nil, err
+	}
+	c.Location = location("/students/%s", s.Id)
+	return studentJSON(s), nil
+}
+
+// UpdateStudent renames the student with the stuid in the path, or gives
+// them a new stuid
+func UpdateStudent(c *Context) (interface{}, error) {
+	s, err := c.Store.GetStudent(c.Vars["id"])
+	if err != nil {
+		return nil, err
+	}
+	in := new(StudentInput)
+	if err := c.decode(in); err != nil {
+		return nil, err
+	}
+	updated := &database.Student{Id: strings.TrimSpace(in.Id), Name: strings.TrimSpace(in.Name)}
+	if updated.Id == "" {
+		updated.Id = s.Id
+	}
+	if updated.Name == "" {
+		return nil, badRequest("A student needs a name")
+	}
+	if err := c.Store.UpdateStudent(s.Id, updated); err != nil {
+		return nil, err
+	}
+	return studentJSON(updated), nil
+}
+
+// DeleteStudent moves the student with the stuid in the path to the trash
+func DeleteStudent(c *Context) (interface{}, error) {
+	if _, err := c.Store.GetStudent(c.Vars["id"]); err != nil {
+		return nil, err
+	}
+	return nil, c.Store.DeleteStudent(c.Vars["id"], c.Now)
+}
@@ -0,0 +1,192 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package rest provides the JSON REST API of the Pi client WebApp, for
+// scripts, under /api/v1
+
+package rest
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"strings"
+)
+
+// Submission records that a student handed in an assignment
+type Submission struct {
+	Assignment int64  `json:"assignment"`
+	Student    string `json:"student" doc:"the stuid"`
+	Posted     int64  `json:"posted" doc:"unix time of the scan"`
+	Grade      string `json:"grade" doc:"points, or a letter of the scale of the assignment, or '' until graded"`
+	Comment    string `json:"comment"`
+	ScannedBy  string `json:"scannedBy" doc:"the stuid of the teammate who scanned for them, or ''"`
+}
+
+// SubmissionInput is the body which submits an assignment for a student
+type SubmissionInput struct {
+	Assignment int64  `json:"assignment"`
+	Student    string `json:"student" doc:"the stuid"`
+}
+
+// GradeInput is the body which grades a Submission
+type GradeInput struct {
+	Grade   string `json:"grade" doc:"points, or a letter of the scale of the assignment, or '' to clear it"`
+	Comment string `json:"comment"`
+}
+
+func submissionJSON(sub *database.Submission) *Submission {
+	return &Submission{Assignment: sub.AssignmentId,
+		Student:   sub.StudentId,
+		Posted:    sub.Posted,
+		Grade:     sub.Grade,
+		Comment:   sub.Comment,
+		ScannedBy: sub.ScannedBy}
+}
+
+// findSubmission returns the submission of the assignment by the student
+func findSubmission(s database.Store, assignmentId int64, stuid string) (*database.Submission, error) {
+	submissions, err := s.GetSubmissions(assignmentId)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range submissions {
+		if sub.StudentId == stuid {
+			return sub, nil
+		}
+	}
+	return nil, database.NOT_FOUND
+}
+
+// ListSubmissions returns the submissions of the assignment, if given,
+// or else of every assignment of the class (the current one, unless
+// another is given), optionally only those of a student, or only those
+// graded (or not)
+func ListSubmissions(c *Context) (interface{}, error) {
+	var assignments []*database.Assignment
+	if id, ok := c.Int("assignment"); ok {
+		a, err := c.Store.GetAssignment(id)
+		if err == database.NOT_FOUND {
+			return nil, badRequest("No such assignment")
+		} else if err != nil {
+			return nil, err
+		}
+		assignments = []*database.Assignment{a}
+	} else {
+		class, _ := c.Int("class")
+		var err error
+		if assignments, err = c.Store.GetAssignments(class); err != nil {
+			return nil, err
+		}
+	}
+
+	stuid := c.String("student")
+	graded, filterGraded := c.Bool("graded")
+	submissions := make([]*database.Submission, 0)
+	for _, a := range assignments {
+		subs, err := c.Store.GetSubmissions(a.Id)
+		if err != nil {
+			return nil, err
+		}
+		for _, sub := range subs {
+			if stuid != "" && sub.StudentId != stuid {
+				continue
+			}
+			if filterGraded && (sub.Grade != "") != graded {
+				continue
+			}
+			submissions = append(submissions, sub)
+		}
+	}
+	err := c.sortBy(submissions, map[string]func(i, j int) bool{
+		"posted":     func(i, j int) bool { return submissions[i].Posted < submissions[j].Posted },
+		"student":    func(i, j int) bool { return submissions[i].StudentId < submissions[j].StudentId },
+		"assignment": func(i, j int) bool { return submissions[i].AssignmentId < submissions[j].AssignmentId }})
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, list, err := c.page(len(submissions))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Submission, 0, end-start)
+	for _, sub := range submissions[start:end] {
+		items = append(items, submissionJSON(sub))
+	}
+	list.Items = items
+	return list, nil
+}
+
+// GetSubmission returns the submission of the assignment by the student
+// in the path
+func GetSubmission(c *Context) (interface{}, error) {
+	sub, err := findSubmission(c.Store, c.IntVar("assignment"), c.Vars["student"])
+	if err != nil {
+		return nil, err
+	}
+	return submissionJSON(sub), nil
+}
+
+// AddSubmission submits the assignment, which must be of the current
+// class, for the student, as a scan of their card would (but not for
+// their group); a second submission keeps the first
+func AddSubmission(c *Context) (interface{}, error) {
+	in := new(SubmissionInput)
+	if err := c.decode(in); err != nil {
+		return nil, err
+	}
+	in.Student = strings.TrimSpace(in.Student)
+	a, err := c.Store.GetAssignment(in.Assignment)
+	if err == database.NOT_FOUND {
+		return nil, badRequest("No such assignment")
+	} else if err != nil {
+		return nil, err
+	}
+	if a.Term != database.ACTIVE_TERM {
+		return nil, database.ARCHIVED
+	}
+	if _, err := c.Store.GetStudent(in.Student); err == database.NOT_FOUND {
+		return nil, badRequest("No such student")
+	} else if err != nil {
+		return nil, err
+	}
+
+	if _, err := findSubmission(c.Store, a.Id, in.Student); err == nil {
+		c.Created = false
+	} else if err != database.NOT_FOUND {
+		return nil, err
+	} else if err := c.Store.Submit(in.Student, a.Id, c.Now); err != nil {
+		return nil, err
+	}
+	sub, err := findSubmission(c.Store, a.Id, in.Student)
+	if err != nil {
+		return nil, err
+	}
+	c.Location = location("/submissions/%d/%s", a.Id, in.Student)
+	return submissionJSON(sub), nil
+}
+
+// GradeSubmission saves the grade and comment of the submission of the
+// assignment by the student in the path
+func GradeSubmission(c *Context) (interface{}, error) {
+	assignmentId, stuid := c.IntVar("assignment"), c.Vars["student"]
+	if _, err := findSubmission(c.Store, assignmentId, stuid); err != nil {
+		return nil, err
+	}
+	in := new(GradeInput)
+	if err := c.decode(in); err != nil {
+		return nil, err
+	}
+	if err := database.GradeSubmission(c.Store, stuid, assignmentId, in.Grade, in.Comment); err != nil {
+		return nil, err
+	}
+	return GetSubmission(c)
+}
+
+// DeleteSubmission unsubmits the assignment for the student in the path
+func DeleteSubmission(c *Context) (interface{}, error) {
+	assignmentId, stuid := c.IntVar("assignment"), c.Vars["student"]
+	if _, err := findSubmission(c.Store, assignmentId, stuid); err != nil {
+		return nil, err
+	}
+	return nil, c.Store.Unsubmit(stuid, assignmentId, c.Now)
+}
@@ -6,32 +6,439 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/RogerZhangHS/PiScan/client/database"
 	"github.com/RogerZhangHS/PiScan/scanner"
 	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
 )
 
+const (
+	// the -at time format of the restore command
+	RESTORE_TIME_FORMAT = "2006-01-02 15:04"
+)
+
+var (
+	NOT_SQLITE        = errors.New("This command needs the sqlite client db")
+	PASSWORD_MISMATCH = errors.New("The passwords do not match: nothing was changed")
+
+	// the folder for database snapshots (from the command line options)
+	backupDir string
+)
+
+// COMMANDS are the maintenance subcommands which run against the client
+// db instead of scanning, e.g. 'PiScanner -sqlitePath /data import roster.csv'
+var COMMANDS = map[string]func(database.Store, []string) error{
+	"import":    importCommand,
+	"backup":    backupCommand,
+	"snapshots": snapshotsCommand,
+	"verify":    verifyCommand,
+	"restore":   restoreCommand,
+	"purge":     purgeCommand,
+	"anonymize": anonymizeCommand,
+	"decrypt":   decryptCommand,
+	"teacher":   teacherCommand,
+	"token":     tokenCommand,
+}
+
+// runCommand invokes the named subcommand with the remaining arguments
+func runCommand(store database.Store, args []string) {
+	cmd, exists := COMMANDS[args[0]]
+	if !exists {
+		fmt.Println("PiScanner commands:")
+		for name := range COMMANDS {
+			fmt.Println("  " + name)
+		}
+		os.Exit(2)
+	}
+	if err := cmd(store, args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// importCommand previews (or, with -apply, applies) a CSV/TSV class roster
+func importCommand(store database.Store, args []string) error {
+	var (
+		idColumn, nameColumn string
+		apply                bool
+	)
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.StringVar(&idColumn, "idColumn", "", "Header label or (1-based) number of the student id column (detected if not given)")
+	fs.StringVar(&nameColumn, "nameColumn", "", "Header label or (1-based) number of the student name column (detected if not given)")
+	fs.BoolVar(&apply, "apply", false, "Apply the new and updated rows (otherwise only show the preview)")
+	fs.Usage = func() {
+		fmt.Println("PiScanner import [options] roster.csv")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	content, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	preview, err := database.PreviewRoster(store, content, database.RosterMapping{IdColumn: idColumn, NameColumn: nameColumn})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s (%s): %d new, %d updated, %d unchanged, %d conflicts\n", fs.Arg(0), preview.Encoding, preview.New, preview.Updated, preview.Unchanged, preview.Conflicts)
+	for _, row := range preview.Rows {
+		switch row.Status {
+		case database.ROW_NEW:
+			fmt.Printf("  line %d: + %s %s\n", row.Line, row.Student.Id, row.Student.Name)
+		case database.ROW_UPDATED:
+			fmt.Printf("  line %d: ~ %s %s (was %s)\n", row.Line, row.Student.Id, row.Student.Name, row.PreviousName)
+		case database.ROW_CONFLICT:
+			fmt.Printf("  line %d: ! %s %s: %s\n", row.Line, row.Student.Id, row.Student.Name, row.Reason)
+		}
+	}
+
+	if apply {
+		n, err := database.ApplyRoster(store, preview)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d students saved\n", n)
+	}
+	return nil
+}
+
+// sqliteStore returns the store as the sqlite client db, which the backup
+// commands work on directly
+func sqliteStore(store database.Store) (*database.SQLiteStore, error) {
+	s, ok := store.(*database.SQLiteStore)
+	if !ok {
+		return nil, NOT_SQLITE
+	}
+	return s, nil
+}
+
+// backupCommand takes a snapshot of the client db now, and rotates the
+// older ones
+func backupCommand(store database.Store, args []string) error {
+	s, err := sqliteStore(store)
+	if err != nil {
+		return err
+	}
+	snap, err := s.Snapshot(backupDir, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s saved\n", snap.Path)
+
+	removed, err := database.RotateSnapshots(backupDir, database.DEFAULT_RETENTION)
+	for _, old := range removed {
+		fmt.Printf("%s removed\n", old.Path)
+	}
+	return err
+}
+
+// snapshotsCommand lists the snapshots of the client db, newest first
+func snapshotsCommand(store database.Store, args []string) error {
+	snapshots, err := database.ListSnapshots(backupDir)
+	if err != nil {
+		return err
+	}
+	for _, snap := range snapshots {
+		fmt.Printf("%s  %s\n", snap.Taken.Format(RESTORE_TIME_FORMAT), snap.Path)
+	}
+	return nil
+}
+
+// verifyCommand runs the sqlite integrity check on the given snapshot
+// files, or the client db itself if none are given
+func verifyCommand(store database.Store, args []string) error {
+	if len(args) == 0 {
+		s, err := sqliteStore(store)
+		if err != nil {
+			return err
+		}
+		if err := s.IntegrityCheck(); err != nil {
+			return err
+		}
+		fmt.Println("the client db is ok")
+		return nil
+	}
+
+	for _, file := range args {
+		if err := database.VerifySnapshot(file); err != nil {
+			return err
+		}
+		fmt.Printf("%s is ok\n", file)
+	}
+	return nil
+}
+
+// restoreCommand replaces the client db with a snapshot: either the given
+// file, or the newest one taken at or before the -at time, after the
+// user confirms it (or with -yes)
+func restoreCommand(store database.Store, args []string) error {
+	var (
+		at  string
+		yes bool
+	)
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.StringVar(&at, "at", "", fmt.Sprintf("Restore the newest snapshot taken at or before this (local) time, as '%s'", RESTORE_TIME_FORMAT))
+	fs.BoolVar(&yes, "yes", false, "Do not ask for confirmation")
+	fs.Usage = func() {
+		fmt.Println("PiScanner restore [options] [snapshot.sqlite]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (fs.NArg() == 1) == (at != "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	s, err := sqliteStore(store)
+	if err != nil {
+		return err
+	}
+
+	file := fs.Arg(0)
+	if at != "" {
+		when, err := time.ParseInLocation(RESTORE_TIME_FORMAT, at, time.Local)
+		if err != nil {
+			return err
+		}
+		snap, err := database.FindSnapshot(backupDir, when)
+		if err != nil {
+			return err
+		}
+		file = snap.Path
+	}
+
+	if !yes {
+		if err := database.ConfirmRestore(os.Stdin, os.Stdout, file); err != nil {
+			return err
+		}
+	}
+
+	saved, err := s.Restore(file, backupDir)
+	if saved != nil {
+		fmt.Printf("the previous contents were saved as %s\n", saved.Path)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s restored\n", file)
+	return nil
+}
+
+// purgeCommand removes for good the students and submissions which have
+// been in the trash for longer than -olderThan
+func purgeCommand(store database.Store, args []string) error {
+	var olderThan time.Duration
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	fs.DurationVar(&olderThan, "olderThan", database.PURGE_AFTER, fmt.Sprintf("Purge what has been in the trash for longer than this (defaults to '%s')", database.PURGE_AFTER))
+	fs.Usage = func() {
+		fmt.Println("PiScanner purge [options]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	n, err := store.PurgeDeleted(time.Now().Add(-olderThan))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d purged from the trash\n", n)
+	return nil
+}
+
+// anonymizeCommand reports (or, with -apply, anonymizes) the former
+// students who left the roster more than -days ago
+func anonymizeCommand(store database.Store, args []string) error {
+	var (
+		days  int
+		apply bool
+	)
+	fs := flag.NewFlagSet("anonymize", flag.ExitOnError)
+	fs.IntVar(&days, "days", database.RETENTION_DAYS, fmt.Sprintf("Anonymize the students who left more than this many days ago (defaults to %d)", database.RETENTION_DAYS))
+	fs.BoolVar(&apply, "apply", false, "Anonymize them (otherwise only report who would be)")
+	fs.Usage = func() {
+		fmt.Println("PiScanner anonymize [options]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if days < 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	report, err := database.Anonymize(store, days, time.Now(), apply)
+	if report != nil {
+		for _, line := range report.Lines() {
+			fmt.Println(line)
+		}
+	}
+	return err
+}
+
+// decryptCommand removes the encryption of the client db for good (it
+// is encrypted by opening it with a key)
+func decryptCommand(store database.Store, args []string) error {
+	s, err := sqliteStore(store)
+	if err != nil {
+		return err
+	}
+	n, err := s.RemoveEncryption()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d names and barcodes decrypted\n", n)
+	return nil
+}
+
+// teacherCommand adds a teacher who logs in to the WebApp, or sets the
+// password (and, with -role, the role) of an existing one, reading it
+// (twice) from stdin; with -list it lists the teachers instead
+func teacherCommand(store database.Store, args []string) error {
+	var (
+		name, role string
+		list       bool
+	)
+	fs := flag.NewFlagSet("teacher", flag.ExitOnError)
+	fs.StringVar(&name, "name", "", "The teacher's full name (defaults to none, or to the current one)")
+	fs.StringVar(&role, "role", "", fmt.Sprintf("One of: %s (defaults to '%s' for a new teacher, or to the current one)", strings.Join(database.ROLES, ", "), database.ROLE_TEACHER))
+	fs.BoolVar(&list, "list", false, "List the teachers instead")
+	fs.Usage = func() {
+		fmt.Println("PiScanner teacher [options] username")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if list {
+		teachers, err := store.GetTeachers()
+		if err != nil {
+			return err
+		}
+		for _, t := range teachers {
+			fmt.Printf("%s\t%s\t%s\tlast login: %s\n", t.Username, t.Role, t.Name, t.LastLoginSince())
+		}
+		return nil
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, ok := database.ROLE_PERMISSIONS[role]; role != "" && !ok {
+		return database.BAD_ROLE
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	fmt.Printf("Password (at least %d characters): ", database.MIN_PASSWORD_LENGTH)
+	password, _ := stdin.ReadString('\n')
+	fmt.Print("Password again: ")
+	again, _ := stdin.ReadString('\n')
+	password = strings.TrimRight(password, "\r\n")
+	if password != strings.TrimRight(again, "\r\n") {
+		return PASSWORD_MISMATCH
+	}
+
+	t, added, err := database.SetTeacherPassword(store, fs.Arg(0), name, password, time.Now())
+	if err != nil {
+		return err
+	}
+	if role != "" {
+		if t, err = database.SetTeacherRole(store, t.Id, role); err != nil {
+			return err
+		}
+	}
+	if added {
+		fmt.Printf("teacher %s added\n", t.Username)
+	} else {
+		fmt.Printf("password of %s changed\n", t.Username)
+	}
+	return nil
+}
+
+// tokenCommand makes an API token for the teacher, for scripts using the
+// REST API of the WebApp; with -list it lists the tokens instead, and
+// with -revoke it deletes one
+func tokenCommand(store database.Store, args []string) error {
+	var (
+		name   string
+		list   bool
+		revoke int64
+	)
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	fs.StringVar(&name, "name", "", "What the token is for (e.g., 'gradebook sync')")
+	fs.BoolVar(&list, "list", false, "List the tokens instead")
+	fs.Int64Var(&revoke, "revoke", 0, "Revoke the token with this id instead")
+	fs.Usage = func() {
+		fmt.Println("PiScanner token [options] username")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if list {
+		tokens, err := store.GetAPITokens()
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			teacher, err := store.GetTeacher(t.TeacherId)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d\t%s\t%s\tlast used: %s\n", t.Id, teacher.Username, t.Name, t.LastUsedSince())
+		}
+		return nil
+	}
+	if revoke > 0 {
+		if err := store.DeleteAPIToken(revoke); err != nil {
+			return err
+		}
+		fmt.Printf("token %d revoked\n", revoke)
+		return nil
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	token, t, err := database.NewAPIToken(store, fs.Arg(0), name, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("token %d for %s (it is not shown again):\n%s\n", t.Id, fs.Arg(0), token)
+	return nil
+}
+
 func main() {
 	var (
-		device, sqlitePath, sqliteFile, sqliteTablesDefinitionPath string
+		device, sqlitePath, sqliteFile, sqliteTablesDefinitionPath, keyFile string
 	)
 
 	flag.StringVar(&device, "device", scanner.SCANNER_DEVICE, fmt.Sprintf("The '/dev/input/event' device associated with your scanner (defaults to '%s')", scanner.SCANNER_DEVICE))
 	flag.StringVar(&sqlitePath, "sqlitePath", database.SQLITE_PATH, fmt.Sprintf("Path to the sqlite file (defaults to '%s')", database.SQLITE_PATH))
 	flag.StringVar(&sqliteFile, "sqliteFile", database.SQLITE_FILE, fmt.Sprintf("The sqlite database file (defaults to '%s')", database.SQLITE_FILE))
 	flag.StringVar(&sqliteTablesDefinitionPath, "sqliteTables", "", fmt.Sprintf("Path to the sqlite database definitions file, %s, (use only if creating the client db for the first time)", database.TABLE_SQL_DEFINITIONS))
+	flag.StringVar(&backupDir, "backupDir", "", fmt.Sprintf("Folder for the database snapshots (defaults to '%s' under sqlitePath)", database.BACKUP_DIR))
+	flag.StringVar(&keyFile, "keyFile", "", fmt.Sprintf("File with the passphrase which encrypts the client db (defaults to the %s environment variable, if set)", database.PASSPHRASE_ENV))
 	flag.Parse()
 
+	if backupDir == "" {
+		backupDir = path.Join(sqlitePath, database.BACKUP_DIR)
+	}
+
 	// 连接到本地sqlite数据库
 	if len(sqliteTablesDefinitionPath) > 0 {
 		// this is a request to create the client db for the first time
-		initDb, initErr := database.InitializeDB(database.ConnCoordinates{sqlitePath, sqliteFile, sqliteTablesDefinitionPath})
+		initDb, initErr := database.InitializeDB(database.ConnCoordinates{DBPath: sqlitePath, DBFile: sqliteFile, DBTablesPath: sqliteTablesDefinitionPath})
 		if initErr != nil {
 			log.Fatal(initErr)
 		}
@@ -43,26 +450,63 @@ func main() {
 
 		// coordinates for connecting to the sqlite database (from the command line options)
 		dbCoordinates := database.ConnCoordinates{DBPath: sqlitePath, DBFile: sqliteFile}
+		passphrase, keyErr := database.ReadPassphrase(keyFile)
+		if keyErr != nil {
+			log.Fatal(keyErr)
+		}
+		dbCoordinates.Passphrase = passphrase
 
 		// attempt to connect to the sqlite db
-		db, dbErr := database.InitializeDB(dbCoordinates)
-		if dbErr != nil {
-			log.Fatal(dbErr)
+		store, storeErr := database.OpenStore(dbCoordinates)
+		if storeErr != nil {
+			log.Fatal(storeErr)
+		}
+		defer store.Close()
+
+		if flag.NArg() > 0 {
+			// a maintenance subcommand, instead of scanning
+			runCommand(store, flag.Args())
+			return
 		}
-		defer db.Close()
 
 		processScanFn := func(barcode string) {
 			// 该函数过程为获取barcode 查询本地数据库中是否存在这些barcode 并且做出相应的反应
-			if database.getExistingItem(db, barcode) != -1 {
-				database.Sign(db, barcode)
+			// (the outcome, even a failure, is also shown live on the WebApp pages)
+			result, err := database.ProcessScan(store, barcode, device, time.Now())
+			who := barcode
+			if result.Student != nil {
+				who = fmt.Sprintf("%s (%s)", result.Student.Name, result.Student.Id)
+			}
+			if err != nil {
+				log.Println(fmt.Sprintf("%s: %s", who, err))
+			} else if result.Teammates > 0 {
+				log.Println(fmt.Sprintf("%s: also submitted for %d teammates", who, result.Teammates))
+			}
+		}
+
+		// the scanner status is shown live on the WebApp pages, until the
+		// PiScanner stops (or the device is unplugged)
+		status := func(s string) {
+			if err := database.RecordScannerStatus(store, s, device, time.Now()); err != nil {
+				log.Println(err)
 			}
 		}
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-stop
+			status(database.SCANNER_DISCONNECTED)
+			log.Println(fmt.Sprintf("Stopping the scanner %s (%s)", device, sig))
+			os.Exit(0)
+		}()
 
 		errorFn := func(e error) {
+			status(database.SCANNER_DISCONNECTED)
 			log.Fatal(e)
 		}
 
 		log.Println(fmt.Sprintf("Starting the scanner %s", device))
+		status(database.SCANNER_CONNECTED)
 		scanner.ScanForever(device, processScanFn, errorFn)
 	}
 }
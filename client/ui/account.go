@@ -7,9 +7,9 @@ package ui
 
 import (
 	"encoding/json"
-	"github.com/Banrai/PiScan/client/database"
-	"github.com/Banrai/PiScan/server/api"
-	"github.com/Banrai/PiScan/server/digest"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"github.com/RogerZhangHS/PiScan/server/api"
+	"github.com/RogerZhangHS/PiScan/server/digest"
 	"html/template"
 	"net/http"
 	"net/url"
@@ -29,42 +29,28 @@ type AccountForm struct {
 	CancelUrl    string
 	FormError    string
 	Unregistered bool
+	Outbox       map[string]int // how many messages to the server, by status
 }
 
 /* HTML Response Functions (via templates) */
 
-func renderAccountEditTemplate(w http.ResponseWriter, a *AccountForm) {
+func renderAccountEditTemplate(w http.ResponseWriter, r *http.Request, a *AccountForm) {
 	if TEMPLATES_INITIALIZED {
-		ACCOUNT_EDIT_TEMPLATES.Execute(w, a)
+		executeTemplate(w, r, ACCOUNT_EDIT_TEMPLATES, a)
 	}
 }
 
 // EditAccount presents the form for editing Account information (in
 // response to a GET request) and handles to add/updates (in response to
 // a POST request)
-func EditAccount(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
-	// attempt to connect to the db
-	db, err := database.InitializeDB(dbCoords)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
+func EditAccount(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
 	// get the Account for this request
-	acc, accErr := database.GetDesignatedAccount(db)
+	acc, accErr := database.GetDesignatedAccount(store)
 	if accErr != nil {
 		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// get the api server + port from the optional parameters
-	apiHost, apiHostOk := opts[0].(string)
-	if !apiHostOk {
-		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
-		return
-	}
-
 	// prepare the html page response
 	regStatus := (acc.Email == database.ANONYMOUS_EMAIL)
 	cancelUrl := HOME_URL
@@ -78,6 +64,13 @@ func EditAccount(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 		CancelUrl:    cancelUrl,
 		Unregistered: regStatus}
 
+	messages, messagesErr := store.GetOutboxMessages()
+	if messagesErr != nil {
+		http.Error(w, messagesErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	form.Outbox = database.OutboxCounts(messages)
+
 	if "POST" == r.Method {
 		form.FormError = BAD_POST // in event of problems
 
@@ -93,28 +86,20 @@ func EditAccount(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 			} else {
 				if acc.Id == accId {
 					// update the account email address in the local client db
-					updateErr := acc.Update(db, emailVal[0], acc.APICode)
+					updateErr := acc.Update(store, emailVal[0], acc.APICode)
+					if updateErr == nil {
+						// queue the registration (see Outbox), for the server to
+						// email the link which verifies the api code
+						v := url.Values{}
+						v.Set("email", emailVal[0])
+						v.Set("api", acc.APICode)
+
+						// use the email address as the digest key
+						updateErr = enqueue(store, "GET", api.REGISTER_URL, emailVal[0], v)
+					}
 					if updateErr != nil {
 						form.FormError = updateErr.Error()
 					} else {
-						// ping the server with the api code and email for verification
-						ping := func() {
-							v := url.Values{}
-							v.Set("email", emailVal[0])
-							v.Set("api", acc.APICode)
-
-							// use the email address as the digest key
-							hmac := digest.GenerateDigest(emailVal[0], v.Encode())
-							v.Set("hmac", hmac)
-
-							res, err := http.Get(strings.Join([]string{apiHost, "/register?", v.Encode()}, ""))
-							if err == nil {
-								res.Body.Close()
-							}
-						}
-
-						go ping() // do not wait for the server to reply
-
 						// return success
 						http.Redirect(w, r, ACCOUNT_URL, http.StatusFound)
 						return
@@ -124,22 +109,15 @@ func EditAccount(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 		}
 	}
 
-	renderAccountEditTemplate(w, form)
+	renderAccountEditTemplate(w, r, form)
 }
 
 // ConfirmServerAccount responds to the ajax request from the client to
 // lookup and return the status of the given account
-func ConfirmServerAccount(r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) string {
+func ConfirmServerAccount(r *http.Request, store database.Store, opts ...interface{}) string {
 	// prepare the ajax reply object
 	ack := AjaxAck{Message: "", Error: ""}
 
-	// attempt to connect to the db
-	db, err := database.InitializeDB(dbCoords)
-	if err != nil {
-		ack.Error = err.Error()
-	}
-	defer db.Close()
-
 	// get the api server + port from the optional parameters
 	apiHost, apiHostOk := opts[0].(string)
 	if !apiHostOk {
@@ -148,7 +126,7 @@ func ConfirmServerAccount(r *http.Request, dbCoords database.ConnCoordinates, op
 
 	if ack.Error == "" {
 		// get the Account for this request
-		acc, accErr := database.GetDesignatedAccount(db)
+		acc, accErr := database.GetDesignatedAccount(store)
 		if accErr != nil {
 			ack.Error = accErr.Error()
 		}
@@ -175,10 +153,11 @@ func ConfirmServerAccount(r *http.Request, dbCoords database.ConnCoordinates, op
 
 							// ping the API Server for the status of this account
 							res, resErr := http.Get(strings.Join([]string{apiHost, "/status?", v.Encode()}, ""))
-							defer res.Body.Close()
 							if resErr != nil {
 								ack.Error = resErr.Error()
 							} else {
+								defer res.Body.Close()
+
 								// read and parse the json message from the API Server
 								m := new(api.SimpleMessage)
 								dec := json.NewDecoder(res.Body)
@@ -204,10 +183,5 @@ func ConfirmServerAccount(r *http.Request, dbCoords database.ConnCoordinates, op
 		}
 	}
 
-	// convert the ajax reply object to json
-	ackObj, ackObjErr := json.Marshal(ack)
-	if ackObjErr != nil {
-		return ackObjErr.Error()
-	}
-	return string(ackObj)
+	return ajaxReply(ack)
 }
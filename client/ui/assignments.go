@@ -0,0 +1,130 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the html date input format
+	DATE_FORMAT = "2006-01-02"
+)
+
+var (
+	ASSIGNMENT_LIST_TEMPLATE_FILES = []string{"assignments.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	ASSIGNMENT_LIST_TEMPLATES      *template.Template
+)
+
+type AssignmentPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Assignments []*database.Assignment
+	Current     *database.Assignment
+	Terms       []*database.Term
+	FormError   string
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderAssignmentListTemplate(w http.ResponseWriter, r *http.Request, p *AssignmentPage) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, ASSIGNMENT_LIST_TEMPLATES, p)
+	}
+}
+
+// Assignments lists all the assignments of the active term, and the closed
+// terms (in response to a GET request), and adds a new one, making it
+// current (in response to a POST request)
+func Assignments(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	p := &AssignmentPage{Title: "作业",
+		ActiveTab: &ActiveTab{Assignments: true, ShowTabs: true}}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+		title := strings.TrimSpace(r.PostForm.Get("title"))
+		if title == "" {
+			p.FormError = BAD_POST
+		} else {
+			a := &database.Assignment{Title: title, Posted: time.Now().Unix()}
+			if due := r.PostForm.Get("due"); due != "" {
+				dueDate, dueErr := time.ParseInLocation(DATE_FORMAT, due, time.Local)
+				if dueErr != nil {
+					p.FormError = dueErr.Error()
+				} else {
+					// due by the end of the given day
+					a.Due = dueDate.AddDate(0, 0, 1).Unix() - 1
+				}
+			}
+			if p.FormError == "" {
+				id, err := store.AddAssignment(a)
+				if err == nil {
+					err = database.SetCurrentAssignment(store, id)
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				http.Redirect(w, r, HOME_URL, http.StatusFound)
+				return
+			}
+		}
+	}
+
+	assignments, err := store.GetAssignments(database.ACTIVE_TERM)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Assignments = assignments
+
+	terms, err := store.GetTerms()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Terms = terms
+
+	current, err := database.CurrentAssignment(store)
+	if err != nil && err != database.NOT_FOUND {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Current = current
+
+	renderAssignmentListTemplate(w, r, p)
+}
+
+// SelectAssignment accepts a form post of a single assignment id, and
+// makes it the one that scans are recorded against
+func SelectAssignment(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	if "POST" != r.Method {
+		http.Error(w, BAD_REQUEST, http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	id, idErr := strconv.ParseInt(r.PostForm.Get("assignment"), 10, 64)
+	if idErr != nil {
+		http.Error(w, BAD_POST, http.StatusBadRequest)
+		return
+	}
+	if err := database.SetCurrentAssignment(store, id); err != nil {
+		if err == database.NOT_FOUND || err == database.ARCHIVED {
+			http.Error(w, BAD_POST, http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	http.Redirect(w, r, HOME_URL, http.StatusFound)
+}
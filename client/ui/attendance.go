@@ -0,0 +1,164 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// attendance page actions
+	ATTENDANCE_MODE = "mode"
+	PERIOD_ADD      = "addPeriod"
+	PERIOD_DELETE   = "deletePeriod"
+)
+
+var (
+	ATTENDANCE_TEMPLATE_FILES = []string{"attendance.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	ATTENDANCE_TEMPLATES      *template.Template
+)
+
+type AttendancePage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Report      *database.AttendanceReport
+	Mode        string
+	CheckOut    bool
+	Previous    string // the day before, as DATE_FORMAT
+	Next        string // the day after, or '' if the report is for today
+	FormError   string
+	FormMessage string
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderAttendanceTemplate(w http.ResponseWriter, r *http.Request, p *AttendancePage) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, ATTENDANCE_TEMPLATES, p)
+	}
+}
+
+// reportDay returns the day given as the 'day' url parameter, or today
+func reportDay(r *http.Request, now time.Time) (time.Time, error) {
+	day := r.URL.Query().Get("day")
+	if day == "" {
+		return now, nil
+	}
+	return time.ParseInLocation(DATE_FORMAT, day, time.Local)
+}
+
+// newPeriod returns the Period posted to the attendance page
+func newPeriod(r *http.Request) (*database.Period, error) {
+	p := &database.Period{Name: strings.TrimSpace(r.PostForm.Get("name"))}
+	var err error
+	if p.Starts, err = database.ParseClock(r.PostForm.Get("starts")); err != nil {
+		return nil, err
+	}
+	if p.Ends, err = database.ParseClock(r.PostForm.Get("ends")); err != nil {
+		return nil, err
+	}
+	if grace := r.PostForm.Get("grace"); grace != "" {
+		if p.Grace, err = strconv.Atoi(grace); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Attendance shows the attendance report of the day given as the 'day'
+// url parameter, or of today (in response to a GET request), or (in
+// response to a POST) chooses what card scans record, or adds or deletes
+// a period of the daily schedule
+func Attendance(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	now := time.Now()
+	day, err := reportDay(r, now)
+	if err != nil {
+		http.Error(w, BAD_REQUEST, http.StatusBadRequest)
+		return
+	}
+
+	p := &AttendancePage{Title: "Attendance",
+		ActiveTab: &ActiveTab{Attendance: true, ShowTabs: true},
+		Previous:  day.AddDate(0, 0, -1).Format(DATE_FORMAT)}
+	if day.Format(DATE_FORMAT) < now.Format(DATE_FORMAT) {
+		p.Next = day.AddDate(0, 0, 1).Format(DATE_FORMAT)
+	}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+		switch r.PostForm.Get("action") {
+		case ATTENDANCE_MODE:
+			err = database.SetScanMode(store, r.PostForm.Get("mode"), r.PostForm.Get("checkOut") != "")
+			if err == nil {
+				p.FormMessage = "扫描模式已保存"
+			}
+
+		case PERIOD_ADD:
+			period, parseErr := newPeriod(r)
+			if parseErr != nil {
+				err = database.INVALID_PERIOD
+			} else if _, err = database.AddPeriod(store, period); err == nil {
+				p.FormMessage = fmt.Sprintf("%s: 已添加", period.Name)
+			}
+
+		case PERIOD_DELETE:
+			id, idErr := strconv.ParseInt(r.PostForm.Get("period"), 10, 64)
+			if idErr != nil {
+				p.FormError = BAD_POST
+			} else if err = store.DeletePeriod(id); err == nil {
+				p.FormMessage = "已删除"
+			}
+
+		default:
+			p.FormError = BAD_POST
+		}
+		switch err {
+		case nil:
+		case database.INVALID_MODE, database.INVALID_PERIOD, database.OVERLAPPING_PERIOD, database.NOT_FOUND:
+			p.FormError = err.Error()
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	p.Mode, p.CheckOut, err = database.GetScanMode(store)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Report, err = database.GetAttendanceReport(store, day, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderAttendanceTemplate(w, r, p)
+}
+
+// ExportAttendance sends the attendance report of the day given as the
+// 'day' url parameter, or of today, as a CSV (the default) or XLSX
+// ('format=xlsx') download
+func ExportAttendance(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	now := time.Now()
+	day, err := reportDay(r, now)
+	if err != nil {
+		http.Error(w, BAD_REQUEST, http.StatusBadRequest)
+		return
+	}
+	report, err := database.GetAttendanceReport(store, day, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendExport(w, r.URL.Query().Get("format"), report, fmt.Sprintf("attendance-%s", report.Day))
+}
@@ -0,0 +1,76 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// card actions
+	CARD_ISSUE  = "issue"
+	CARD_REVOKE = "revoke"
+)
+
+// ManageCards accepts a form post for the cards of a single student:
+// issuing a new one (optionally replacing, i.e., revoking, the others),
+// or revoking one. It returns to the student's edit form.
+func ManageCards(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	if "POST" != r.Method {
+		http.Error(w, BAD_REQUEST, http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	student, err := store.GetStudent(r.PostForm.Get("stuid"))
+	if err != nil {
+		http.Error(w, BAD_POST, http.StatusBadRequest)
+		return
+	}
+
+	form := &StudentForm{Title: "修改学生信息",
+		Item:       student,
+		OriginalId: student.Id,
+		CancelUrl:  HOME_URL}
+
+	barcode := strings.TrimSpace(r.PostForm.Get("barcode"))
+	switch r.PostForm.Get("action") {
+	case CARD_ISSUE:
+		if barcode == "" {
+			form.FormError = BAD_POST
+		} else {
+			card := &database.Card{Barcode: barcode, StudentId: student.Id, Issued: time.Now().Unix()}
+			err = store.IssueCard(card, r.PostForm.Get("replace") != "")
+		}
+	case CARD_REVOKE:
+		card, cardErr := store.GetCard(barcode)
+		if cardErr != nil || card.StudentId != student.Id {
+			form.FormError = BAD_POST
+		} else {
+			err = store.RevokeCard(barcode, time.Now())
+		}
+	default:
+		form.FormError = BAD_POST
+	}
+	if err != nil {
+		form.FormError = err.Error()
+	}
+
+	if form.FormError == "" {
+		http.Redirect(w, r, "/input/"+student.Id, http.StatusFound)
+		return
+	}
+
+	form.Cards, err = store.GetCards(student.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderItemEditTemplate(w, r, form)
+}
@@ -6,136 +6,94 @@
 package ui
 
 import (
-	"github.com/Banrai/PiScan/client/database"
-	"github.com/Banrai/PiScan/server/digest"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"github.com/RogerZhangHS/PiScan/server/api"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
 )
 
-// InputUnknownItem handles the form for user contributions of unknown
-// barcode scans: a GET presents the form, and a POST responds to the
-// user-contributed input
-func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
-	// attempt to connect to the db
-	db, err := database.InitializeDB(dbCoords)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
+// InputUnknownItem handles the form for manual entry of students: a GET
+// presents the form (blank, or for the stuid in the url path), and a POST
+// adds or updates the student from the user input
+func InputUnknownItem(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
 	// get the Account for this request
-	acc, accErr := database.GetDesignatedAccount(db)
+	acc, accErr := database.GetDesignatedAccount(store)
 	if accErr != nil {
 		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// get the api server + port from the optional parameters
-	apiHost, apiHostOk := opts[0].(string)
-	if !apiHostOk {
-		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
-		return
-	}
-
 	// prepare the html page response
-	form := &StudentForm{StuName: "Contribute Product Information",
-		CancelUrl:            HOME_URL,
-		Unregistered:         (acc.Email == database.ANONYMOUS_EMAIL)}
+	form := &StudentForm{Title: "新增学生",
+		CancelUrl: HOME_URL}
 
-	//lookup the item from the request id
+	//lookup the student from the request id
 	// and show the input form (if a GET)
 	// or process it (if a POST)
 	if "GET" == r.Method {
-		// derive the item id from the url path
+		// derive the stuid from the url path
 		urlPaths := strings.Split(r.URL.Path[1:], "/")
-		if len(urlPaths) >= 2 {
-			itemId, itemIdErr := strconv.ParseInt(urlPaths[1], 10, 64)
-			if itemIdErr == nil {
-				item, itemErr := database.GetSingleItem(db, acc, itemId)
-				if itemErr == nil {
-					if item.Id != database.BAD_PK && item.Desc == "" {
-						// requested item has been found and is valid
-						form.Item = item
-					}
-				}
+		if len(urlPaths) >= 2 && len(urlPaths[1]) > 0 {
+			student, studentErr := store.GetStudent(urlPaths[1])
+			if studentErr != nil {
+				// no matching student was found
+				http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
+				return
 			}
-		}
-
-		if form.Item == nil {
-			// no matching item was found
-			http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
-			return
+			cards, cardsErr := store.GetCards(student.Id)
+			if cardsErr != nil {
+				http.Error(w, cardsErr.Error(), http.StatusInternalServerError)
+				return
+			}
+			form.Title = "修改学生信息"
+			form.Item = student
+			form.OriginalId = student.Id
+			form.Cards = cards
 		}
 
 	} else if "POST" == r.Method {
-		// get the item id from the posted data
+		// get the original stuid (if any) from the posted data
 		r.ParseForm()
 		idVal, idExists := r.PostForm["item"]
 		barcodeVal, barcodeExists := r.PostForm["barcode"]
-		prodNameVal, prodNameExists := r.PostForm["prodName"]
-		if idExists && barcodeExists && prodNameExists {
-			itemId, itemIdErr := strconv.ParseInt(idVal[0], 10, 64)
-			if itemIdErr != nil {
-				form.FormError = itemIdErr.Error()
+		nameVal, nameExists := r.PostForm["stuName"]
+		if idExists && barcodeExists && nameExists {
+			student := &database.Student{Id: strings.TrimSpace(barcodeVal[0]), Name: strings.TrimSpace(nameVal[0])}
+			form.Item = student
+			form.OriginalId = idVal[0]
+			if form.OriginalId != "" {
+				form.Title = "修改学生信息"
+			}
+
+			if student.Id == "" || student.Name == "" {
+				form.FormError = BAD_POST
 			} else {
-				item, itemErr := database.GetSingleItem(db, acc, itemId)
-				if itemErr != nil {
-					form.FormError = itemErr.Error()
+				var saveErr error
+				if idVal[0] == "" {
+					saveErr = store.AddStudent(student)
 				} else {
-					// the hidden barcode value must match the retrieved item
-					if item.Barcode == barcodeVal[0] {
-						// update the item in the local client db
-						item.Desc = prodNameVal[0]
-						item.UserContributed = true
-						item.Update(db)
-
-						// also need to mark the contribution to POD in the server
-						if acc.Email != database.ANONYMOUS_EMAIL {
-							// get the form's prodDesc, brandName, brandUrl data
-							prodDesc, prodDescExists := r.PostForm["prodDesc"]
-							brandName, brandNameExists := r.PostForm["brandName"]
-							brandUrl, brandUrlExists := r.PostForm["brandUrl"]
-
-							// ping the server with the contribution data
-							ping := func() {
-								v := url.Values{}
-								v.Set("email", acc.Email)
-								v.Set("barcode", barcodeVal[0])
-								v.Set("prodName", prodNameVal[0])
-								if prodDescExists {
-									v.Set("prodDesc", prodDesc[0])
-								}
-								if brandNameExists {
-									v.Set("brandName", brandName[0])
-								}
-								if brandUrlExists {
-									v.Set("brandUrl", brandUrl[0])
-								}
-
-								// use the account api code as the digest key
-								hmac := digest.GenerateDigest(acc.APICode, v.Encode())
-								v.Set("hmac", hmac)
-
-								res, err := http.PostForm(strings.Join([]string{apiHost, "/contribute/"}, ""), v)
-								if err == nil {
-									res.Body.Close()
-								}
-							}
+					saveErr = store.UpdateStudent(idVal[0], student)
+				}
 
-							go ping() // do not wait for the server to reply
+				// also share the roster entry with the server, queued (see
+				// Outbox) until it can be reached
+				if saveErr == nil && acc.Email != database.ANONYMOUS_EMAIL {
+					v := url.Values{}
+					v.Set("email", acc.Email)
+					v.Set("barcode", student.Id)
+					v.Set("stuName", student.Name)
 
-						}
+					// use the account api code as the digest key
+					saveErr = enqueue(store, "POST", api.CONTRIBUTE_URL, acc.APICode, v)
+				}
 
-						// return success
-						http.Redirect(w, r, HOME_URL, http.StatusFound)
-						return
-					} else {
-						// bad form post: the hidden barcode value does not match the retrieved item
-						form.FormError = BAD_POST
-					}
+				if saveErr != nil {
+					form.FormError = saveErr.Error()
+				} else {
+					// return success
+					http.Redirect(w, r, HOME_URL, http.StatusFound)
+					return
 				}
 			}
 		} else {
@@ -144,5 +102,5 @@ func InputUnknownItem(w http.ResponseWriter, r *http.Request, dbCoords database.
 		}
 	}
 
-	renderItemEditTemplate(w, form)
+	renderItemEditTemplate(w, r, form)
 }
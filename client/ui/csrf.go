@@ -0,0 +1,105 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	// where the forms and the ajax calls carry the token
+	CSRF_FIELD  = "csrf_token"
+	CSRF_HEADER = "X-CSRF-Token"
+)
+
+var (
+	// BAD_CSRF is returned for a post without the token of the session
+	BAD_CSRF = errors.New("Sorry, this form has expired. Please go back, reload the page and try again.")
+
+	// the template functions, bound to each request by executeTemplate
+	CSRF_FUNCS = template.FuncMap{
+		"csrfToken": func() string { return "" },
+		"csrfField": func() template.HTML { return "" }}
+)
+
+// csrfToken returns the token for the session cookie value: it is signed
+// with the session key, so it cannot be guessed by another site, and it
+// changes with each login
+func csrfToken(key []byte, session string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "csrf|%s", session)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// RequestCSRFToken returns the token of the teacher logged in for the
+// request (see RequireLogin), or an empty string
+func RequestCSRFToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfKey).(string)
+	return token
+}
+
+// postedCSRFToken returns the token sent with the request, in the header
+// (by the ajax calls) or the form
+func postedCSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if token := r.Header.Get(CSRF_HEADER); token != "" {
+		return token, nil
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		// the roster upload is the only multipart form
+		r.Body = http.MaxBytesReader(w, r.Body, 2*MAX_ROSTER_SIZE)
+		if err := r.ParseMultipartForm(MAX_ROSTER_SIZE); err != nil {
+			return "", err
+		}
+	}
+	return r.PostFormValue(CSRF_FIELD), nil
+}
+
+// checkCSRF returns BAD_CSRF unless a request which may change something
+// (i.e., anything but a GET) from a logged in teacher carries the token of
+// their session; a request with no teacher is left to RequireLogin
+func checkCSRF(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" || r.Method == "HEAD" || RequestTeacher(r) == nil {
+		return nil
+	}
+	posted, err := postedCSRFToken(w, r)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(posted), []byte(RequestCSRFToken(r))) {
+		return BAD_CSRF
+	}
+	return nil
+}
+
+// parseTemplates parses the files in the folder, the first of which is
+// the one to execute, with the CSRF_FUNCS available to them
+func parseTemplates(folder string, files []string) *template.Template {
+	return template.Must(template.New(files[0]).Funcs(CSRF_FUNCS).ParseFiles(TEMPLATE_LIST(folder, files)...))
+}
+
+// executeTemplate executes a copy of the templates with the CSRF_FUNCS
+// bound to the token of the request, so {{csrfField}} adds it to a form
+func executeTemplate(w io.Writer, r *http.Request, t *template.Template, data interface{}) error {
+	bound, err := t.Clone()
+	if err != nil {
+		return err
+	}
+	token := RequestCSRFToken(r)
+	bound.Funcs(template.FuncMap{
+		"csrfToken": func() string { return token },
+		"csrfField": func() template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, CSRF_FIELD, template.HTMLEscapeString(token)))
+		}})
+	return bound.Execute(w, data)
+}
@@ -6,34 +6,18 @@
 package ui
 
 import (
-	"github.com/Banrai/PiScan/client/database"
-	"github.com/Banrai/PiScan/server/digest"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"github.com/RogerZhangHS/PiScan/server/api"
 	"net/http"
 	"net/url"
 	"strconv"
-	"strings"
 )
 
 // EmailItems handles the client form post, to send a list of the selected
-// items via email to the given user
-func EmailItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
-	// attempt to connect to the db
-	db, err := database.InitializeDB(dbCoords)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
-	// get the api server + port from the optional parameters
-	apiHost, apiHostOk := opts[0].(string)
-	if !apiHostOk {
-		http.Error(w, BAD_REQUEST, http.StatusInternalServerError)
-		return
-	}
-
+// students via email to the given user
+func EmailItems(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
 	// get the Account for this request
-	acc, accErr := database.GetDesignatedAccount(db)
+	acc, accErr := database.GetDesignatedAccount(store)
 	if accErr != nil {
 		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
@@ -61,36 +45,31 @@ func EmailItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCo
 					} else {
 						// proceed with the send only if registered
 						if acc.Email != database.ANONYMOUS_EMAIL {
-							// lookup all the items for this account
-							accountItems, accountItemsErr := database.GetItems(db, acc)
-
-							if accountItemsErr == nil {
-								// ping the server with the selected item data
-								ping := func() {
-									v := url.Values{}
-									v.Set("email", acc.Email)
-
-									// attach the list of descriptions for the selected items
-									for _, accItem := range accountItems {
-										for _, item := range items {
-											if strconv.FormatInt(accItem.Id, 10) == item {
-												v.Add("item", accItem.Desc)
-												break
-											}
-										}
-									}
+							// lookup all the students
+							students, studentsErr := store.GetStudents()
+							if studentsErr != nil {
+								http.Error(w, studentsErr.Error(), http.StatusInternalServerError)
+								return
+							}
 
-									// use the account api code as the digest key
-									hmac := digest.GenerateDigest(acc.APICode, v.Encode())
-									v.Set("hmac", hmac)
+							// queue the selected student data for the server (see Outbox)
+							v := url.Values{}
+							v.Set("email", acc.Email)
 
-									res, err := http.PostForm(strings.Join([]string{apiHost, "/email/"}, ""), v)
-									if err == nil {
-										res.Body.Close()
+							// attach the list of names for the selected students
+							for _, student := range students {
+								for _, item := range items {
+									if student.Id == item {
+										v.Add("item", student.Name)
+										break
 									}
 								}
+							}
 
-								go ping() // do not wait for the server to reply
+							// use the account api code as the digest key
+							if queueErr := enqueue(store, "POST", api.EMAIL_URL, acc.APICode, v); queueErr != nil {
+								http.Error(w, queueErr.Error(), http.StatusInternalServerError)
+								return
 							}
 						}
 					}
@@ -108,7 +87,7 @@ func EmailItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCo
 		return
 	}
 
-	// finally, return home, to the scanned items list with an ack message
+	// finally, return home, to the student list with an ack message
 	http.Redirect(w, r, HOME_URL+"?ack=email", http.StatusFound)
 
 }
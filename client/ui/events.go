@@ -0,0 +1,406 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// where the open pages get the live events, as server-sent events
+	EVENTS_URL = "/events"
+
+	// how often the WebApp reads the live events added to the db (by the
+	// PiScanner, and the triggers), by default
+	EVENTS_INTERVAL = time.Second
+
+	// how often an open stream is sent a comment, so proxies and the
+	// browser keep it open (and its session is checked again), and how
+	// long a page waits to reconnect (ms)
+	EVENTS_KEEPALIVE = 30 * time.Second
+	EVENTS_RETRY     = 3000
+
+	// how many messages a page may fall behind before it misses some
+	EVENTS_BUFFER = 64
+
+	// Errors
+	NO_STREAMING = "Sorry, this server cannot stream events"
+)
+
+var (
+	// what the pages show for each outcome
+	SCAN_MESSAGES = map[string]string{
+		database.SCAN_SUBMITTED:         "%s 已提交",
+		database.SCAN_ALREADY_SUBMITTED: "%s 已经提交过了",
+		database.SCAN_CHECKED_IN:        "%s 已签到",
+		database.SCAN_CHECKED_OUT:       "%s 已签退",
+		database.SCAN_UNKNOWN:           "未知的卡片，请到“未知”页面关联学生",
+		database.SCAN_REVOKED:           "%s 的卡已注销",
+		database.SCAN_TRASHED:           "%s 在回收站中，是否恢复？",
+		database.SCAN_ARCHIVED:          "%s 已随往期学期归档，不在当前名单中",
+		database.SCAN_FAILED:            "%s 扫描失败"}
+	SUBMISSION_MESSAGES = map[string]string{
+		database.LIVE_SUBMITTED:   "%s 已提交",
+		database.LIVE_UNSUBMITTED: "%s 的提交已移除",
+		database.LIVE_GRADED:      "%s 的成绩已更新"}
+	SCANNER_MESSAGES = map[string]string{
+		database.SCANNER_CONNECTED:    "扫描器已连接",
+		database.SCANNER_DISCONNECTED: "扫描器已断开"}
+)
+
+// LiveMessage is the data of a server-sent event: a LiveEvent, with what
+// the page needs to show it
+type LiveMessage struct {
+	Id         int64  `json:"id"`
+	Kind       string `json:"kind"`
+	Outcome    string `json:"outcome"`
+	StudentId  string `json:"stuid,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Assignment int64  `json:"assignment,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+	Time       int64  `json:"time"`
+	Message    string `json:"msg"`
+	Link       string `json:"link,omitempty"` // the page to act on it
+	// for a student, against the current assignment: whether they have
+	// submitted it, and their row of the students page (see item.html)
+	Current   bool   `json:"current"`
+	Submitted bool   `json:"submitted"`
+	Row       string `json:"row,omitempty"`
+}
+
+// EventBroker passes the live events to the streams of the open pages
+type EventBroker struct {
+	mu        sync.Mutex
+	streams   map[chan *LiveMessage]bool
+	last      int64         // the id of the latest event passed on
+	keepalive time.Duration // see EVENTS_KEEPALIVE
+}
+
+// NewEventBroker returns an EventBroker without any streams
+func NewEventBroker() *EventBroker {
+	return &EventBroker{streams: make(map[chan *LiveMessage]bool), keepalive: EVENTS_KEEPALIVE}
+}
+
+// subscribe returns a new stream, and the id of the latest event passed
+// on before it
+func (b *EventBroker) subscribe() (chan *LiveMessage, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stream := make(chan *LiveMessage, EVENTS_BUFFER)
+	b.streams[stream] = true
+	return stream, b.last
+}
+
+func (b *EventBroker) unsubscribe(stream chan *LiveMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.streams, stream)
+}
+
+// listening reports whether any page is open
+func (b *EventBroker) listening() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.streams) > 0
+}
+
+// publish passes the messages on to every stream, skipping those too far
+// behind to take them (they catch up from the db when they reconnect),
+// and records the id of the last event
+func (b *EventBroker) publish(messages []*LiveMessage, last int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, m := range messages {
+		for stream := range b.streams {
+			select {
+			case stream <- m:
+			default:
+			}
+		}
+	}
+	b.last = last
+}
+
+// liveMessages returns the messages of the events, with the names of the
+// students, and their rows against the current assignment
+func liveMessages(store database.Store, events []*database.LiveEvent) ([]*LiveMessage, error) {
+	var currentId int64 = database.BAD_PK
+	current, err := database.CurrentAssignment(store)
+	if err == nil {
+		currentId = current.Id
+	} else if err != database.NOT_FOUND {
+		return nil, err
+	}
+
+	var roster map[string]*database.StudentStatus
+	messages := make([]*LiveMessage, 0, len(events))
+	for _, e := range events {
+		m := &LiveMessage{Id: e.Id,
+			Kind:       e.Kind,
+			Outcome:    e.Outcome,
+			StudentId:  e.StudentId,
+			Assignment: e.Assignment,
+			Detail:     e.Detail,
+			Time:       e.Created,
+			Current:    e.Assignment != 0 && e.Assignment == currentId}
+
+		if e.StudentId != "" {
+			if m.Name, err = studentName(store, e.StudentId); err != nil {
+				return nil, err
+			}
+		}
+		if m.Current {
+			if roster == nil {
+				students, err := database.GetRoster(store, currentId, false)
+				if err != nil {
+					return nil, err
+				}
+				roster = make(map[string]*database.StudentStatus)
+				for _, s := range students {
+					roster[s.Student.Id] = s
+				}
+			}
+			if status, ok := roster[e.StudentId]; ok {
+				m.Submitted = status.Submission != nil
+				m.Row = renderItem(status)
+			}
+		}
+
+		switch e.Kind {
+		case database.LIVE_SCAN:
+			m.Message = phraseOf(SCAN_MESSAGES, e.Outcome, m.Name)
+			if e.Outcome == database.SCAN_TRASHED {
+				m.Link = TRASH_URL
+			} else if e.Outcome == database.SCAN_ARCHIVED {
+				m.Link = fmt.Sprintf("%s%s", TERMS_URL, e.Detail)
+			} else if label, ok := database.ATTENDANCE_LABELS[e.Detail]; ok {
+				m.Message = fmt.Sprintf("%s (%s)", m.Message, label)
+			} else if e.Detail != "" {
+				m.Message = fmt.Sprintf("%s: %s", m.Message, e.Detail)
+			}
+		case database.LIVE_SUBMISSION:
+			m.Message = phraseOf(SUBMISSION_MESSAGES, e.Outcome, m.Name)
+		case database.LIVE_SCANNER:
+			m.Message = fmt.Sprintf("%s (%s)", phraseOf(SCANNER_MESSAGES, e.Outcome), e.Detail)
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+// studentName returns the name of the student, even if they are no longer
+// on the roster, or the stuid, if they cannot be found
+func studentName(store database.Store, stuid string) (string, error) {
+	s, err := store.GetStudent(stuid)
+	if err == nil {
+		return s.Name, nil
+	} else if err != database.NOT_FOUND {
+		return "", err
+	}
+	former, err := store.GetFormerStudents()
+	if err != nil {
+		return "", err
+	}
+	for _, f := range former {
+		if f.Student.Id == stuid {
+			return f.Student.Name, nil
+		}
+	}
+	return stuid, nil
+}
+
+// phraseOf returns the phrase of the outcome, with the name (if it takes
+// one), or the outcome itself if it has none
+func phraseOf(phrases map[string]string, outcome string, args ...interface{}) string {
+	phrase, ok := phrases[outcome]
+	if !ok {
+		return outcome
+	}
+	if strings.Contains(phrase, "%s") {
+		return fmt.Sprintf(phrase, args...)
+	}
+	return phrase
+}
+
+// renderItem returns the html of the student's row of the students page
+func renderItem(status *database.StudentStatus) string {
+	if !TEMPLATES_INITIALIZED {
+		return ""
+	}
+	var row bytes.Buffer
+	if err := ITEM_LIST_TEMPLATES.ExecuteTemplate(&row, "item.html", status); err != nil {
+		return ""
+	}
+	return row.String()
+}
+
+// pollEvents passes on the events added since the last one, returning
+// the id of the latest
+func pollEvents(store database.Store, broker *EventBroker, last int64) (int64, error) {
+	for {
+		events, err := store.GetLiveEvents(last, database.LIVE_BATCH)
+		if err != nil || len(events) == 0 {
+			return last, err
+		}
+		last = events[len(events)-1].Id
+
+		// nobody to tell, so no need to look up the students
+		messages := make([]*LiveMessage, 0)
+		if broker.listening() {
+			if messages, err = liveMessages(store, events); err != nil {
+				return last, err
+			}
+		}
+		broker.publish(messages, last)
+		if len(events) < database.LIVE_BATCH {
+			return last, nil
+		}
+	}
+}
+
+// EventsForever reads the live events added to the db at each interval,
+// and passes them on to the broker, purging those too old to matter
+// every hour; errors are passed to errFn
+func EventsForever(store database.Store, broker *EventBroker, interval time.Duration, errFn func(error)) {
+	var last int64
+	if latest, err := store.GetLatestLiveEvent(""); err == nil {
+		last = latest.Id
+	} else if err != database.NOT_FOUND {
+		errFn(err)
+	}
+	broker.publish(nil, last)
+
+	purged := time.Time{}
+	for {
+		var err error
+		if last, err = pollEvents(store, broker, last); err != nil {
+			errFn(err)
+		}
+		if now := time.Now(); now.Sub(purged) > time.Hour {
+			if _, err := store.PurgeLiveEvents(now.Add(-database.LIVE_RETENTION)); err != nil {
+				errFn(err)
+			}
+			purged = now
+		}
+		time.Sleep(interval)
+	}
+}
+
+// writeEvent sends the message to the page, as a server-sent event
+func writeEvent(w http.ResponseWriter, m *LiveMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if m.Id > 0 {
+		fmt.Fprintf(w, "id: %d\n", m.Id)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.Kind, data)
+	return err
+}
+
+// streamPermitted reports whether the session of the stream's request
+// still lets the teacher read the events of the current class: it may
+// have expired, or the teacher been removed, or had their password or
+// role changed, since the stream opened
+func streamPermitted(r *http.Request, store database.Store) bool {
+	t, err := SessionTeacher(r, store, time.Now())
+	if err != nil {
+		return false
+	}
+	can, err := database.ClassCan(store, t, database.ACTIVE_TERM, ROUTE_PERMISSIONS[EVENTS_URL].Read)
+	return err == nil && can
+}
+
+// Events streams the live events to the page (with an EventSource) as
+// they happen, starting with the status of the scanner, and those it
+// missed while reconnecting (from its Last-Event-ID), until the session
+// of the page ends (see streamPermitted); opts[0] is the EventBroker
+func Events(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	broker, ok := opts[0].(*EventBroker)
+	flusher, canFlush := w.(http.Flusher)
+	if !ok || !canFlush {
+		http.Error(w, NO_STREAMING, http.StatusInternalServerError)
+		return
+	}
+	stream, last := broker.subscribe()
+	defer broker.unsubscribe(stream)
+
+	// the events it missed, up to those the stream has
+	missed := make([]*database.LiveEvent, 0)
+	if since, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil && since < last {
+		events, err := store.GetLiveEvents(since, database.LIVE_BATCH)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, e := range events {
+			if e.Id <= last {
+				missed = append(missed, e)
+			}
+		}
+	}
+	// and the status of the scanner, as of now
+	if status, err := store.GetLatestLiveEvent(database.LIVE_SCANNER); err == nil {
+		status.Id = 0
+		missed = append(missed, status)
+	} else if err != database.NOT_FOUND {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	messages, err := liveMessages(store, missed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", EVENTS_RETRY)
+	for _, m := range messages {
+		if err := writeEvent(w, m); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(broker.keepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case m := <-stream:
+			if m.Id <= last {
+				continue
+			}
+			if err := writeEvent(w, m); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if !streamPermitted(r, store) {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
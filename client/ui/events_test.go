@@ -0,0 +1,247 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"bufio"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventBroker(t *testing.T) {
+	broker := NewEventBroker()
+	if broker.listening() {
+		t.Fatal("listening without any stream")
+	}
+	a, last := broker.subscribe()
+	b, _ := broker.subscribe()
+	if last != 0 || !broker.listening() {
+		t.Fatalf("got %d %v", last, broker.listening())
+	}
+
+	// a stream too far behind misses the messages, without holding up
+	// the others
+	for i := 0; i < EVENTS_BUFFER; i++ {
+		broker.publish([]*LiveMessage{{Id: int64(i + 1)}}, int64(i+1))
+		<-a
+	}
+	broker.publish([]*LiveMessage{{Id: EVENTS_BUFFER + 1}}, EVENTS_BUFFER+1)
+	if m := <-a; m.Id != EVENTS_BUFFER+1 || len(b) != EVENTS_BUFFER {
+		t.Fatalf("got %d, with %d waiting", m.Id, len(b))
+	}
+	if _, last := broker.subscribe(); last != EVENTS_BUFFER+1 {
+		t.Fatalf("got %d", last)
+	}
+
+	broker.unsubscribe(a)
+	broker.publish([]*LiveMessage{{Id: EVENTS_BUFFER + 2}}, EVENTS_BUFFER+2)
+	if len(a) != 0 {
+		t.Fatal("published to a stream no longer subscribed")
+	}
+}
+
+func TestPollEvents(t *testing.T) {
+	store := database.NewMemoryStore()
+	if err := store.AddStudent(&database.Student{Id: "001", Name: "张三"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < database.LIVE_BATCH+1; i++ {
+		if _, err := store.AddLiveEvent(&database.LiveEvent{Kind: database.LIVE_SCAN, Outcome: database.SCAN_SUBMITTED, StudentId: "001", Created: time.Now().Unix()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// with no page open, the events are only counted
+	broker := NewEventBroker()
+	last, err := pollEvents(store, broker, 0)
+	if err != nil || last != database.LIVE_BATCH+1 {
+		t.Fatalf("got %d %v", last, err)
+	}
+
+	stream, _ := broker.subscribe()
+	if _, err := store.AddLiveEvent(&database.LiveEvent{Kind: database.LIVE_SCAN, Outcome: database.SCAN_UNKNOWN, Created: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.AddLiveEvent(&database.LiveEvent{Kind: database.LIVE_SCAN, Outcome: database.SCAN_REVOKED, StudentId: "001", Created: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	if last, err = pollEvents(store, broker, last); err != nil || last != database.LIVE_BATCH+3 || len(stream) != 2 {
+		t.Fatalf("got %d %v, %d messages", last, err, len(stream))
+	}
+	if m := <-stream; m.Id != database.LIVE_BATCH+2 || m.Message != SCAN_MESSAGES[database.SCAN_UNKNOWN] {
+		t.Fatalf("got %+v", m)
+	}
+	if m := <-stream; m.Name != "张三" || m.Message != "张三 的卡已注销" {
+		t.Fatalf("got %+v", m)
+	}
+	if again, err := pollEvents(store, broker, last); err != nil || again != last || len(stream) != 0 {
+		t.Fatalf("got %d %v, %d messages", again, err, len(stream))
+	}
+}
+
+// openStream opens the event stream as the teacher, from the event after
+// since, returning its lines
+func openStream(t *testing.T, server *httptest.Server, store database.Store, teacher *database.Teacher, since string) (*http.Response, chan string) {
+	r, err := http.NewRequest("GET", server.URL+EVENTS_URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range testRequest(t, store, "GET", EVENTS_URL, teacher, nil).Cookies() {
+		r.AddCookie(cookie)
+	}
+	if since != "" {
+		r.Header.Set("Last-Event-ID", since)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	lines := make(chan string, 100)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	return resp, lines
+}
+
+// nextId returns the id of the next event of the stream, or "" if it ends
+func nextId(t *testing.T, lines chan string) string {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, open := <-lines:
+			if !open {
+				return ""
+			}
+			if strings.HasPrefix(line, "id: ") {
+				return strings.TrimPrefix(line, "id: ")
+			}
+		case <-timeout:
+			t.Fatal("no event")
+		}
+	}
+}
+
+// ended reports whether the stream ends before the timeout
+func ended(lines chan string, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, open := <-lines:
+			if !open {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	store := database.NewMemoryStore()
+	teacher := testTeacher(t, store, "teacher", database.ROLE_TEACHER)
+	kiosk := testTeacher(t, store, "hall", database.ROLE_KIOSK)
+	for i := 0; i < 3; i++ {
+		if _, err := store.AddLiveEvent(&database.LiveEvent{Kind: database.LIVE_SCAN, Outcome: database.SCAN_UNKNOWN, Created: time.Now().Unix()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	broker := NewEventBroker()
+	broker.keepalive = 20 * time.Millisecond
+	broker.publish(nil, 3)
+	server := httptest.NewServer(Guard(store, EVENTS_URL, func(w http.ResponseWriter, r *http.Request) { Events(w, r, store, broker) }))
+	t.Cleanup(server.Close) // after the streams are closed (see openStream)
+
+	// it catches up from the Last-Event-ID, then goes on with the new ones
+	resp, lines := openStream(t, server, store, kiosk, "1")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("got %d %v", resp.StatusCode, resp.Header)
+	}
+	for _, want := range []string{"2", "3"} {
+		if id := nextId(t, lines); id != want {
+			t.Fatalf("got the event %q, want %s", id, want)
+		}
+	}
+	for !broker.listening() {
+		time.Sleep(time.Millisecond)
+	}
+	broker.publish([]*LiveMessage{{Id: 3}, {Id: 4, Kind: database.LIVE_SCAN}}, 4)
+	if id := nextId(t, lines); id != "4" {
+		t.Fatalf("got the event %q, want 4 (and not 3 again)", id)
+	}
+
+	// without a Last-Event-ID, only the new ones
+	_, fresh := openStream(t, server, store, teacher, "")
+	if ended(fresh, 100*time.Millisecond) {
+		t.Fatal("the stream of the teacher ended")
+	}
+
+	// it ends once the teacher is removed, or their session is no longer
+	// valid (here, after a new password)
+	if err := store.DeleteTeacher(kiosk.Id); err != nil {
+		t.Fatal(err)
+	}
+	if !ended(lines, time.Second) {
+		t.Fatal("the stream outlived the teacher")
+	}
+	if _, _, err := database.SetTeacherPassword(store, teacher.Username, "", "password2", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !ended(fresh, time.Second) {
+		t.Fatal("the stream outlived the session")
+	}
+
+	// and a logged out page cannot open one
+	if resp, _ := openStream(t, server, store, nil, "1"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+}
+
+func TestEventsExpire(t *testing.T) {
+	store := database.NewMemoryStore()
+	teacher := testTeacher(t, store, "teacher", database.ROLE_TEACHER)
+	broker := NewEventBroker()
+	broker.keepalive = 20 * time.Millisecond
+	h := Guard(store, EVENTS_URL, func(w http.ResponseWriter, r *http.Request) { Events(w, r, store, broker) })
+
+	// a session which expires within two seconds of opening the stream
+	w := httptest.NewRecorder()
+	if err := StartSession(w, store, teacher, time.Now().Add(2*time.Second-SESSION_LIFETIME)); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	r, err := http.NewRequest("GET", server.URL+EVENTS_URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(w.Result().Cookies()[0])
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got %d", resp.StatusCode)
+	}
+	done := make(chan bool)
+	go func() {
+		bufio.NewReader(resp.Body).WriteTo(new(strings.Builder))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream outlived the session")
+	}
+}
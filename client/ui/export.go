@@ -0,0 +1,117 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// export file formats
+	FORMAT_CSV  = "csv"
+	FORMAT_XLSX = "xlsx"
+
+	MIME_CSV = "text/csv"
+)
+
+// sendDownload writes the content back as a file attachment
+func sendDownload(w http.ResponseWriter, content []byte, mediaType, filename string) {
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
+	w.Write(content)
+}
+
+// ExportGradebook sends the students x assignments submission matrix as
+// a CSV (the default) or XLSX ('format=xlsx') download, for all the
+// assignments of the active term, only those of it given as 'assignment'
+// url parameters, or those of the closed term given as the 'term' parameter
+func ExportGradebook(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	r.ParseForm()
+
+	var (
+		gradebook *database.Gradebook
+		err       error
+	)
+	filename := fmt.Sprintf("gradebook-%s", time.Now().Format(DATE_FORMAT))
+
+	assignmentIds := make([]int64, 0)
+	for _, idString := range r.Form["assignment"] {
+		id, idErr := strconv.ParseInt(idString, 10, 64)
+		if idErr != nil {
+			http.Error(w, BAD_REQUEST, http.StatusBadRequest)
+			return
+		}
+		// those of a closed term are only exported with it, by its 'term'
+		// (which is what the permissions are checked against)
+		if a, err := store.GetAssignment(id); err == nil && a.Term != database.ACTIVE_TERM {
+			http.Error(w, BAD_REQUEST, http.StatusBadRequest)
+			return
+		}
+		assignmentIds = append(assignmentIds, id)
+	}
+
+	if termString := r.Form.Get("term"); termString != "" {
+		termId, idErr := strconv.ParseInt(termString, 10, 64)
+		if idErr != nil {
+			http.Error(w, BAD_REQUEST, http.StatusBadRequest)
+			return
+		}
+		gradebook, err = database.GetTermGradebook(store, termId)
+		filename = fmt.Sprintf("gradebook-term%d", termId)
+	} else {
+		gradebook, err = database.GetGradebook(store, assignmentIds...)
+	}
+	if err != nil {
+		if err == database.NOT_FOUND {
+			http.Error(w, BAD_REQUEST, http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	sendExport(w, r.Form.Get("format"), gradebook, filename)
+}
+
+// Exporter is a table which can be downloaded as CSV or XLSX
+type Exporter interface {
+	WriteCSV(w io.Writer) error
+	WriteXLSX(w io.Writer) error
+}
+
+// sendExport sends the table as a download in the given format, CSV if
+// none is given
+func sendExport(w http.ResponseWriter, format string, table Exporter, filename string) {
+	var (
+		b   bytes.Buffer
+		err error
+	)
+	switch format {
+	case FORMAT_XLSX:
+		err = table.WriteXLSX(&b)
+		if err == nil {
+			sendDownload(w, b.Bytes(), database.XLSX_MIME, filename+"."+FORMAT_XLSX)
+		}
+	case FORMAT_CSV, "":
+		err = table.WriteCSV(&b)
+		if err == nil {
+			sendDownload(w, b.Bytes(), MIME_CSV+"; charset=utf-8", filename+"."+FORMAT_CSV)
+		}
+	default:
+		http.Error(w, BAD_REQUEST, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
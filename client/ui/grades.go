@@ -0,0 +1,179 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// grading actions
+	GRADE_SCALE  = "scale"
+	GRADE_SAVE   = "grade"
+	SCALE_POINTS = "points"
+)
+
+var (
+	GRADE_TEMPLATE_FILES = []string{"grades.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	GRADE_TEMPLATES      *template.Template
+)
+
+type GradePage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Assignment  *database.Assignment
+	Submissions []*database.StudentStatus
+	Stats       *database.GradeStats
+	LetterScale string
+	ReadOnly    bool
+	FormError   string
+	FormMessage string
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderGradeTemplate(w http.ResponseWriter, r *http.Request, p *GradePage) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, GRADE_TEMPLATES, p)
+	}
+}
+
+// gradedRoster returns the students of the assignment's term who have
+// submitted it, with their submissions
+func gradedRoster(store database.Store, a *database.Assignment) ([]*database.StudentStatus, error) {
+	if a.Term == database.ACTIVE_TERM {
+		return database.GetRoster(store, a.Id, true)
+	}
+
+	results := make([]*database.StudentStatus, 0)
+	students, err := store.GetTermRoster(a.Term)
+	if err != nil {
+		return results, err
+	}
+	submissions, err := store.GetSubmissions(a.Id)
+	if err != nil {
+		return results, err
+	}
+	submitted := make(map[string]*database.Submission)
+	for _, sub := range submissions {
+		submitted[sub.StudentId] = sub
+	}
+	for _, student := range students {
+		if sub, ok := submitted[student.Id]; ok {
+			results = append(results, &database.StudentStatus{Student: student, Submission: sub})
+		}
+	}
+	return results, nil
+}
+
+// Grades shows the submissions of the assignment in the url path, with
+// their grades and comments, and the summary statistics (in response to a
+// GET request), and saves either its grading scale or the grades (in
+// response to a POST). Assignments of closed terms are read-only.
+func Grades(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	// derive the assignment id from the url path
+	urlPaths := strings.Split(r.URL.Path[1:], "/")
+	if len(urlPaths) < 2 || len(urlPaths[1]) == 0 {
+		http.Redirect(w, r, ASSIGNMENTS_URL, http.StatusFound)
+		return
+	}
+	id, idErr := strconv.ParseInt(urlPaths[1], 10, 64)
+	if idErr != nil {
+		http.Error(w, BAD_REQUEST, http.StatusBadRequest)
+		return
+	}
+	a, err := store.GetAssignment(id)
+	if err != nil {
+		if err == database.NOT_FOUND {
+			http.Error(w, BAD_REQUEST, http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	p := &GradePage{Title: a.Title,
+		ActiveTab:   &ActiveTab{Assignments: true, ShowTabs: true},
+		LetterScale: database.LETTER_SCALE,
+		ReadOnly:    a.Term != database.ACTIVE_TERM}
+
+	if "POST" == r.Method && p.ReadOnly {
+		p.FormError = database.ARCHIVED.Error()
+	} else if "POST" == r.Method {
+		r.ParseForm()
+		switch r.PostForm.Get("action") {
+		case GRADE_SCALE:
+			a.Scale, a.MaxPoints = "", 0
+			if r.PostForm.Get("scale") == SCALE_POINTS {
+				if max := strings.TrimSpace(r.PostForm.Get("maxPoints")); max != "" {
+					a.MaxPoints, err = strconv.ParseFloat(max, 64)
+					if err != nil || a.MaxPoints < 0 {
+						p.FormError = BAD_POST
+					}
+				}
+			} else {
+				a.Scale = database.NormalizeScale(r.PostForm.Get("letters"))
+				if a.Scale == "" {
+					p.FormError = BAD_POST
+				}
+			}
+			if p.FormError == "" {
+				if err := store.UpdateAssignment(a); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				p.FormMessage = "评分方式已保存"
+			}
+
+		case GRADE_SAVE:
+			stuids, grades, comments := r.PostForm["stuid"], r.PostForm["grade"], r.PostForm["comment"]
+			if len(grades) != len(stuids) || len(comments) != len(stuids) {
+				p.FormError = BAD_POST
+				break
+			}
+			saved := 0
+			problems := make([]string, 0)
+			for i, stuid := range stuids {
+				err := database.GradeSubmission(store, stuid, a.Id, grades[i], comments[i])
+				if err == database.INVALID_GRADE || err == database.NOT_FOUND {
+					problems = append(problems, fmt.Sprintf("%s (%s): %s", stuid, grades[i], err.Error()))
+				} else if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				} else {
+					saved++
+				}
+			}
+			p.FormMessage = fmt.Sprintf("已保存 %d 份成绩", saved)
+			p.FormError = strings.Join(problems, "; ")
+
+		default:
+			p.FormError = BAD_POST
+		}
+	}
+	p.Assignment = a
+
+	submissions, err := gradedRoster(store, a)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Submissions = submissions
+
+	stats, err := database.GetGradeStats(store, a.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Stats = stats
+
+	renderGradeTemplate(w, r, p)
+}
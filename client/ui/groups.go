@@ -0,0 +1,180 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// group page actions
+	GROUP_ADD           = "addGroup"
+	GROUP_DELETE        = "deleteGroup"
+	GROUP_ADD_MEMBER    = "addMember"
+	GROUP_REMOVE_MEMBER = "removeMember"
+)
+
+var (
+	GROUP_TEMPLATE_FILES = []string{"groups.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	GROUP_TEMPLATES      *template.Template
+)
+
+// GroupMembers is a Group with its members' roster entries
+type GroupMembers struct {
+	Group   *database.Group
+	Members []*database.Student
+}
+
+type GroupPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Assignment  *database.Assignment
+	Groups      []*GroupMembers
+	Ungrouped   []*database.Student // on the roster, but in no group yet
+	ReadOnly    bool
+	FormError   string
+	FormMessage string
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderGroupTemplate(w http.ResponseWriter, r *http.Request, p *GroupPage) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, GROUP_TEMPLATES, p)
+	}
+}
+
+// groupRoster returns the students of the assignment's term: the active
+// roster, or that of the closed term it belongs to
+func groupRoster(store database.Store, a *database.Assignment) ([]*database.Student, error) {
+	if a.Term == database.ACTIVE_TERM {
+		return store.GetStudents()
+	}
+	return store.GetTermRoster(a.Term)
+}
+
+// Groups shows the groups of the assignment in the url path, with their
+// members (in response to a GET request), or (in response to a POST)
+// adds or deletes a group, or adds or removes one of its members. The
+// groups of an assignment of a closed term are read-only.
+func Groups(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	// derive the assignment id from the url path
+	urlPaths := strings.Split(r.URL.Path[1:], "/")
+	if len(urlPaths) < 2 || len(urlPaths[1]) == 0 {
+		http.Redirect(w, r, ASSIGNMENTS_URL, http.StatusFound)
+		return
+	}
+	id, idErr := strconv.ParseInt(urlPaths[1], 10, 64)
+	if idErr != nil {
+		http.Error(w, BAD_REQUEST, http.StatusBadRequest)
+		return
+	}
+	a, err := store.GetAssignment(id)
+	if err != nil {
+		if err == database.NOT_FOUND {
+			http.Error(w, BAD_REQUEST, http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	p := &GroupPage{Title: a.Title,
+		ActiveTab:  &ActiveTab{Assignments: true, ShowTabs: true},
+		Assignment: a,
+		ReadOnly:   a.Term != database.ACTIVE_TERM}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+		action := r.PostForm.Get("action")
+		var groupId int64
+		if action != GROUP_ADD {
+			groupId, idErr = strconv.ParseInt(r.PostForm.Get("group"), 10, 64)
+			if idErr != nil {
+				action = ""
+			}
+		}
+		stuid := r.PostForm.Get("stuid")
+
+		switch action {
+		case GROUP_ADD:
+			name := r.PostForm.Get("name")
+			if _, err = database.AddGroup(store, a.Id, name, r.PostForm["member"]); err == nil {
+				p.FormMessage = fmt.Sprintf("%s: 已添加", strings.TrimSpace(name))
+			}
+
+		case GROUP_ADD_MEMBER:
+			if err = database.AddGroupMember(store, groupId, stuid); err == nil {
+				p.FormMessage = fmt.Sprintf("%s: 已加入小组", stuid)
+			}
+
+		case GROUP_REMOVE_MEMBER:
+			if err = database.RemoveGroupMember(store, groupId, stuid); err == nil {
+				p.FormMessage = fmt.Sprintf("%s: 已移出小组", stuid)
+			}
+
+		case GROUP_DELETE:
+			if err = database.DeleteGroup(store, groupId); err == nil {
+				p.FormMessage = "已删除"
+			}
+
+		default:
+			p.FormError = BAD_POST
+		}
+		switch err {
+		case nil:
+		case database.INVALID_GROUP, database.GROUPED, database.ARCHIVED, database.NOT_FOUND:
+			p.FormError = err.Error()
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	students, err := groupRoster(store, a)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	groups, err := store.GetGroups(a.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	roster := make(map[string]*database.Student)
+	for _, s := range students {
+		roster[s.Id] = s
+	}
+	grouped := make(map[string]bool)
+	p.Groups = make([]*GroupMembers, 0, len(groups))
+	for _, g := range groups {
+		gm := &GroupMembers{Group: g, Members: make([]*database.Student, 0, len(g.Members))}
+		for _, stuid := range g.Members {
+			s, ok := roster[stuid]
+			if !ok {
+				// no longer on the roster: just the stuid
+				s = &database.Student{Id: stuid}
+			}
+			gm.Members = append(gm.Members, s)
+			grouped[stuid] = true
+		}
+		p.Groups = append(p.Groups, gm)
+	}
+	p.Ungrouped = make([]*database.Student, 0)
+	for _, s := range students {
+		if !grouped[s.Id] {
+			p.Ungrouped = append(p.Ungrouped, s)
+		}
+	}
+
+	renderGroupTemplate(w, r, p)
+}
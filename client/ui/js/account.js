@@ -1,5 +1,4 @@
 $(function(){
-    $('a.shutdown').click(confirmShutdown);
     $('a.update').click(function(event){
         event.preventDefault();
         var toggleId = $(this).attr('href');
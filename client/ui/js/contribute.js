@@ -1,4 +1,35 @@
+
 $(function(){
-    $("#prodName").focus();
+    if( $("#barcode").val() ) {
+	$("#stuName").focus();
+    } else {
+	$("#barcode").focus();
+    }
 });
 
+// list the existing students matching the name being typed, so the same
+// student is not entered twice
+$(function(){
+    var similar = $("#similar");
+    var lookup = null;
+    $("#stuName").on("input", function(){
+	var q = $(this).val();
+	clearTimeout(lookup);
+	lookup = setTimeout(function(){
+	    if( !q ) {
+		similar.empty();
+		return;
+	    }
+	    $.getJSON("/search/", {q: q}, function(students){
+		similar.empty();
+		$.each(students || [], function(i, s){
+		    if( s.id == similar.data("stuid") ) {
+			return;
+		    }
+		    var link = $("<a>").attr("href", "/input/" + encodeURIComponent(s.id)).text(s.name + " (" + s.id + ")");
+		    similar.append($("<li>").append('<i class="fa fa-user"></i> ').append(link));
+		});
+	    });
+	}, 250);
+    });
+});
@@ -46,7 +46,10 @@ $(function(){
     if( ! Modernizr.canvas || ! Modernizr.svg ) {
 	window.location.href = '/browser';
     }
-    $('a.shutdown').click(confirmShutdown);
+    $("#undo").each(function() {
+	var banner = $(this);
+	setTimeout(function() { banner.remove(); }, banner.data("expires") * 1000);
+    });
     $("#id_actions_chk").on("click", function() {
 	var state = $(this).is(':checked');
 	$(".chk_item").each(function() {
@@ -54,15 +57,17 @@ $(function(){
 	});
 	toggleActions();
     });
-    $(".chk_item").on("click", function() {
+    // delegated, as the rows are replaced as they change (see events.js)
+    $(document).on("click", ".chk_item", function() {
 	toggleActions();
     });
-    $('a.trash').on("click", function (event) {
+    $(document).on("click", "a.trash", function (event) {
 	event.preventDefault();
 	var itemId = $(this).attr('href').split('#')[1],
 	  postData = { itemId: itemId };
 	$.ajax({type: "POST",
 		url: "/remove/",
+		headers: csrfHeaders(),
                 data: postData,
                 dataType: "json",
                 success: function (d) {
@@ -0,0 +1,81 @@
+// the students page follows the scans, and the changes to the
+// submissions, as they happen, from the /events stream of the WebApp
+
+function liveRow (stuid) {
+    return $(document.getElementById("Item_" + stuid));
+}
+
+function showScan (m) {
+    var banner = $("#live-scan"),
+	ok = (m.outcome == "submitted" || m.outcome == "checked in" || m.outcome == "checked out"),
+	level = ok ? "alert-success" : (m.outcome == "already submitted" ? "alert-info" : "alert-warning");
+    banner.removeClass("alert-success alert-info alert-warning").addClass(level).text(m.msg).show();
+    if( m.link ) {
+	// e.g., to restore the student from the trash
+	banner.append(" ").append($("<a>").addClass("alert-link").attr("href", m.link).text("前往处理"));
+    }
+    clearTimeout(banner.data("timer"));
+    banner.data("timer", setTimeout(function() { banner.fadeOut(); }, 10000));
+}
+
+function showScanner (m) {
+    var status = $("#scanner-status"),
+	icon = (m.outcome == "connected") ? "fa fa-check-circle text-success" : "fa fa-exclamation-circle text-danger";
+    status.empty().append($("<i>").addClass(icon)).append(document.createTextNode(" " + m.msg));
+}
+
+// updateRow replaces the row of the student, keeping whether it is
+// checked, or adds it (or removes it, on the submitted page) as the
+// submission changes; a search only updates the rows it found
+function updateRow (m) {
+    var list = $("#bulkActions"),
+	submittedPage = (window.location.pathname.indexOf("/submitted/") === 0),
+	row = liveRow(m.stuid);
+    if( !m.current || !m.row ) {
+	return;
+    }
+    if( list.length === 0 ) {
+	// an empty list (or none to compare with): start again
+	if( !submittedPage || m.submitted ) {
+	    window.location.reload();
+	}
+	return;
+    }
+    if( String(list.data("assignment")) !== String(m.assignment) ) {
+	return;
+    }
+    if( submittedPage && !m.submitted ) {
+	row.remove();
+	toggleActions();
+	return;
+    }
+    var updated = $($.parseHTML($.trim(m.row))).filter(".item");
+    if( row.length > 0 ) {
+	updated.find(".chk_item").prop("checked", row.find(".chk_item").is(":checked"));
+	row.replaceWith(updated);
+    } else if( !list.data("query") ) {
+	list.append(updated);
+    }
+}
+
+$(function(){
+    if( !window.EventSource ) {
+	return;
+    }
+    var source = new EventSource("/events");
+    source.addEventListener("scan", function (e) {
+	var m = JSON.parse(e.data);
+	showScan(m);
+	updateRow(m);
+    });
+    source.addEventListener("submission", function (e) {
+	updateRow(JSON.parse(e.data));
+    });
+    source.addEventListener("scanner", function (e) {
+	showScanner(JSON.parse(e.data));
+    });
+    source.onerror = function () {
+	// the browser reconnects by itself, from the last event it had
+	$("#scanner-status").empty().append($("<i>").addClass("fa fa-chain-broken text-muted")).append(document.createTextNode(" 连接中断，正在重连"));
+    };
+});
@@ -5,6 +5,12 @@ function showModal (title, header, message) {
     $('#modalMessage').text(message);
 }
 
+// the ajax calls which change something send the token of the session,
+// from the csrf-token meta tag in head.html
+function csrfHeaders () {
+    return { "X-CSRF-Token": $('meta[name="csrf-token"]').attr('content') };
+}
+
 function checkAccountStatus (accId) {
     var fn = null;
     if( arguments.length > 1 ) {
@@ -12,6 +18,7 @@ function checkAccountStatus (accId) {
     }
     $.ajax({type: "POST",
 	    url: "/status/",
+	    headers: csrfHeaders(),
 	    data: { account: accId },
 	    dataType: "json",
 	    success: function (d) {
@@ -25,32 +32,3 @@ function checkAccountStatus (accId) {
 	    }
 	   });
 }
-
-function showConfirmModal (title, header, message, continueAction) {
-    var continueButton = null,
-	dismissButton  = null;
-    if( arguments.length > 4 ) {
-	continueButton = arguments[4];
-    }
-    if( arguments.length > 5 ) {
-	dismissButton = arguments[5];
-    }
-    
-    $('#modalWindow').modal('show');
-    $('#modalTitle').text(title);
-    $('#modalMessageHeader').text(header);
-    $('#modalMessage').text(message);
-    $('#modalContinue').show();
-    $('#modalContinue').attr('href', continueAction); 
-    if( continueButton !== null ) {
-	$('#modalContinueButton').text(continueButton);
-    }
-    if( dismissButton !== null ) {
-	$('#modalDismissButton').text(dismissButton);
-    }
-}
-
-var confirmShutdown = function(event){
-    event.preventDefault();
-    showConfirmModal('Shutdown', 'Shutdown this scanner', 'Are you sure you want to shutdown?', $(this).attr('href'), 'Yes', 'Cancel');
-};
@@ -0,0 +1,249 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"github.com/RogerZhangHS/PiScan/server/api"
+	"github.com/RogerZhangHS/PiScan/server/digest"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// how long the API server has to answer each message
+	OUTBOX_TIMEOUT = 30 * time.Second
+
+	OUTBOX_URL = "/outbox/"
+
+	// the most submissions queued in a single upload
+	UPLOAD_BATCH = 500
+)
+
+var (
+	OUTBOX_TEMPLATE_FILES = []string{"outbox.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	OUTBOX_TEMPLATES      *template.Template
+
+	// what each message does, by the API server path it goes to
+	OUTBOX_ACTIONS = map[string]string{
+		api.REGISTER_URL:    "Register this device",
+		api.CONTRIBUTE_URL:  "Share a student",
+		api.EMAIL_URL:       "Email students",
+		api.SUBMISSIONS_URL: "Upload submissions"}
+
+	// wakes the sender (see OutboxForever) as soon as a message is queued
+	outboxQueued = make(chan bool, 1)
+)
+
+type OutboxPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Messages    []*database.OutboxMessage
+	Counts      map[string]int
+	Actions     map[string]string
+	FormError   string
+	FormMessage string
+}
+
+// enqueue adds the request to the outbox, signed (see digest) with the
+// key, and with a new idempotency key, so the API server applies it only
+// once, however many times it is sent
+func enqueue(store database.Store, method, path, key string, v url.Values) error {
+	idempotencyKey, err := database.NewOutboxKey()
+	if err != nil {
+		return err
+	}
+	v.Set(api.IDEMPOTENCY_PARAM, idempotencyKey)
+	v.Set(digest.DIGEST_PARAM, digest.GenerateDigest(key, v.Encode()))
+
+	now := time.Now().Unix()
+	m := &database.OutboxMessage{Key: idempotencyKey,
+		Method:  method,
+		Path:    path,
+		Params:  v.Encode(),
+		Created: now,
+		Status:  database.OUTBOX_PENDING}
+	if _, err := store.AddOutboxMessage(m); err != nil {
+		return err
+	}
+	wakeOutbox()
+	return nil
+}
+
+// QueueUploads queues the submissions logged since the last upload (see
+// database.UPLOAD_CURSOR) for the API server, in batches, once this
+// device is registered to an account; the server merges those it already
+// has, so a batch queued twice does no harm. It returns how many it
+// queued, none if the store keeps no log of them.
+func QueueUploads(store database.Store) (int, error) {
+	s, ok := store.(database.Uploader)
+	if !ok {
+		return 0, nil
+	}
+	acc, err := database.GetDesignatedAccount(store)
+	if err != nil || acc.Email == database.ANONYMOUS_EMAIL {
+		return 0, err
+	}
+	var cursor int64
+	if value, err := store.GetSetting(database.UPLOAD_CURSOR); err == nil {
+		cursor, _ = strconv.ParseInt(value, 10, 64)
+	} else if err != database.NOT_FOUND {
+		return 0, err
+	}
+
+	queued := 0
+	for {
+		uploads, next, err := s.GetUploads(cursor, UPLOAD_BATCH)
+		if err != nil || len(uploads) == 0 {
+			return queued, err
+		}
+		submissions := make([]*api.Submission, 0, len(uploads))
+		for _, u := range uploads {
+			submissions = append(submissions, &api.Submission{StudentId: u.StudentId,
+				StudentName: u.StudentName,
+				Assignment:  u.Assignment,
+				Title:       u.Title,
+				Posted:      u.Posted})
+		}
+		encoded, err := json.Marshal(submissions)
+		if err != nil {
+			return queued, err
+		}
+		v := url.Values{}
+		v.Set("email", acc.Email)
+		v.Set("submissions", string(encoded))
+		if err := enqueue(store, "POST", api.SUBMISSIONS_URL, acc.APICode, v); err != nil {
+			return queued, err
+		}
+		if err := store.SetSetting(database.UPLOAD_CURSOR, strconv.FormatInt(next, 10)); err != nil {
+			return queued, err
+		}
+		cursor = next
+		queued += len(uploads)
+	}
+}
+
+// wakeOutbox has the sender try the pending messages now
+func wakeOutbox() {
+	select {
+	case outboxQueued <- true:
+	default: // already awake
+	}
+}
+
+// sendOutboxMessage makes the request of the message to the API server,
+// returning a database.RejectedError if the server refused it for good
+func sendOutboxMessage(client *http.Client, apiHost string, m *database.OutboxMessage) error {
+	var req *http.Request
+	var err error
+	if m.Method == "GET" {
+		req, err = http.NewRequest("GET", strings.Join([]string{apiHost, m.Path, "?", m.Params}, ""), nil)
+	} else {
+		req, err = http.NewRequest(m.Method, strings.Join([]string{apiHost, m.Path}, ""), strings.NewReader(m.Params))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return &database.RejectedError{Reason: err.Error()}
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	reply := new(api.SimpleMessage)
+	decodeErr := json.NewDecoder(res.Body).Decode(reply)
+	if res.StatusCode >= http.StatusInternalServerError || res.Header.Get("Retry-After") != "" {
+		// worth trying again later
+		if reply.Err != nil {
+			return reply.Err
+		}
+		return fmt.Errorf("%s%s: %s", apiHost, m.Path, res.Status)
+	}
+	if reply.Err != nil {
+		return &database.RejectedError{Reason: reply.Err.Error()}
+	}
+	if res.StatusCode != http.StatusOK {
+		return &database.RejectedError{Reason: res.Status}
+	}
+	// e.g., the login page of a wifi hotspot
+	return decodeErr
+}
+
+// OutboxForever sends the pending messages in the outbox to the API
+// server (with its scheme, e.g. 'http://localhost:9001') as soon as they
+// are queued, and retries them at every interval (see
+// database.DrainOutbox), when it also queues the new submissions (see
+// QueueUploads), invoking errorFn on any failure
+func OutboxForever(store database.Store, apiHost string, interval time.Duration, errorFn func(error)) {
+	client := &http.Client{Timeout: OUTBOX_TIMEOUT}
+	send := func(m *database.OutboxMessage) error {
+		return sendOutboxMessage(client, apiHost, m)
+	}
+
+	tick := time.Tick(interval)
+	for {
+		if _, err := QueueUploads(store); err != nil {
+			errorFn(err)
+		}
+		if _, err := database.DrainOutbox(store, time.Now(), send); err != nil {
+			errorFn(err)
+		}
+		select {
+		case <-tick:
+		case <-outboxQueued:
+		}
+	}
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderOutboxTemplate(w http.ResponseWriter, r *http.Request, p *OutboxPage) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, OUTBOX_TEMPLATES, p)
+	}
+}
+
+// Outbox lists the messages to the API server with their status (in
+// response to a GET request), and sends a failed one again (in response
+// to a POST)
+func Outbox(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	p := &OutboxPage{Title: "发件箱",
+		ActiveTab: &ActiveTab{Account: true, ShowTabs: true},
+		Actions:   OUTBOX_ACTIONS}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+		id, err := strconv.ParseInt(r.PostForm.Get("message"), 10, 64)
+		if err != nil {
+			p.FormError = BAD_POST
+		} else if err = store.RetryOutboxMessage(id); err != nil {
+			p.FormError = err.Error()
+		} else {
+			p.FormMessage = "已重新排队发送"
+			wakeOutbox()
+		}
+	}
+
+	messages, err := store.GetOutboxMessages()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Messages = messages
+	p.Counts = database.OutboxCounts(messages)
+
+	renderOutboxTemplate(w, r, p)
+}
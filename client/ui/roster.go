@@ -0,0 +1,104 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	// largest roster file accepted for upload
+	MAX_ROSTER_SIZE = 1 << 20
+)
+
+var (
+	ROSTER_IMPORT_TEMPLATE_FILES = []string{"import.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	ROSTER_IMPORT_TEMPLATES      *template.Template
+)
+
+type RosterImportPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Preview     *database.RosterPreview
+	Content     string // the uploaded file (base64), carried from preview to apply
+	IdColumn    string
+	NameColumn  string
+	FormError   string
+	FormMessage string
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderRosterImportTemplate(w http.ResponseWriter, r *http.Request, p *RosterImportPage) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, ROSTER_IMPORT_TEMPLATES, p)
+	}
+}
+
+// ImportRoster presents the roster upload form (in response to a GET
+// request), previews the uploaded file against the existing students (in
+// response to a POST with a file) and applies it (in response to a POST
+// with apply set, carrying the previewed file)
+func ImportRoster(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	p := &RosterImportPage{Title: "导入名单",
+		ActiveTab: &ActiveTab{Scanned: true, ShowTabs: true}}
+
+	if "POST" == r.Method {
+		r.Body = http.MaxBytesReader(w, r.Body, 2*MAX_ROSTER_SIZE)
+		if err := r.ParseMultipartForm(MAX_ROSTER_SIZE); err != nil {
+			p.FormError = err.Error()
+			renderRosterImportTemplate(w, r, p)
+			return
+		}
+		p.IdColumn = r.FormValue("idColumn")
+		p.NameColumn = r.FormValue("nameColumn")
+
+		// the file is either uploaded now, or carried from the preview
+		var content []byte
+		if file, _, fileErr := r.FormFile("roster"); fileErr == nil {
+			content, fileErr = ioutil.ReadAll(file)
+			file.Close()
+			if fileErr != nil {
+				p.FormError = fileErr.Error()
+			}
+		} else if carried := r.FormValue("content"); carried != "" {
+			decoded, decodeErr := base64.StdEncoding.DecodeString(carried)
+			if decodeErr != nil {
+				p.FormError = BAD_POST
+			}
+			content = decoded
+		} else {
+			p.FormError = BAD_POST
+		}
+
+		if p.FormError == "" {
+			mapping := database.RosterMapping{IdColumn: p.IdColumn, NameColumn: p.NameColumn}
+			preview, err := database.PreviewRoster(store, content, mapping)
+			if err != nil {
+				p.FormError = err.Error()
+			} else if r.FormValue("apply") != "" {
+				n, applyErr := database.ApplyRoster(store, preview)
+				if applyErr != nil {
+					p.FormError = applyErr.Error()
+					p.Preview = preview
+					p.Content = base64.StdEncoding.EncodeToString(content)
+				} else {
+					p.FormMessage = fmt.Sprintf("已保存 %d 名学生", n)
+				}
+			} else {
+				p.Preview = preview
+				p.Content = base64.StdEncoding.EncodeToString(content)
+			}
+		}
+	}
+
+	renderRosterImportTemplate(w, r, p)
+}
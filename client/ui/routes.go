@@ -0,0 +1,125 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RoutePermissions are what a role needs (see database.ROLE_PERMISSIONS)
+// to read a route of the WebApp, i.e., GET it, and to post to it
+type RoutePermissions struct {
+	Read, Write string
+	Ajax        bool // it replies in json (see AllowAjax)
+	Device      bool // it is about the device rather than a class
+	// Class returns the class (term) of the request, if it may be about
+	// another than the current one
+	Class func(r *http.Request, store database.Store) int64
+}
+
+// ROUTE_PERMISSIONS are those of every route for a logged in teacher,
+// by path: the role checked is the one the teacher has in the class of
+// the request (see database.ClassRole), or their own for a Device route
+var ROUTE_PERMISSIONS = map[string]*RoutePermissions{
+	SYSTEM_URL:             {Read: database.PERM_SHUTDOWN, Write: database.PERM_SHUTDOWN, Device: true},
+	"/stulist/":            {Read: database.PERM_VIEW, Write: database.PERM_VIEW},
+	"/submitted/":          {Read: database.PERM_VIEW, Write: database.PERM_VIEW},
+	"/delete/":             {Read: database.PERM_ROSTER, Write: database.PERM_ROSTER},
+	"/submit/":             {Read: database.PERM_MARK, Write: database.PERM_MARK},
+	"/unsubmit/":           {Read: database.PERM_MARK, Write: database.PERM_MARK},
+	"/input/":              {Read: database.PERM_ROSTER, Write: database.PERM_ROSTER},
+	"/cards/":              {Read: database.PERM_ROSTER, Write: database.PERM_ROSTER},
+	"/import/":             {Read: database.PERM_ROSTER, Write: database.PERM_ROSTER},
+	"/export/":             {Read: database.PERM_EXPORT, Write: database.PERM_EXPORT, Class: termParam},
+	"/attendance/":         {Read: database.PERM_VIEW, Write: database.PERM_MANAGE},
+	"/attendance/export/":  {Read: database.PERM_EXPORT, Write: database.PERM_EXPORT},
+	"/assignments/":        {Read: database.PERM_VIEW, Write: database.PERM_MANAGE},
+	"/assignments/select/": {Read: database.PERM_MARK, Write: database.PERM_MARK},
+	TERMS_URL:              {Read: database.PERM_VIEW, Write: database.PERM_MANAGE, Class: termInPath},
+	"/grades/":             {Read: database.PERM_VIEW, Write: database.PERM_MARK, Class: assignmentInPath},
+	"/groups/":             {Read: database.PERM_VIEW, Write: database.PERM_MARK, Class: assignmentInPath},
+	"/stats/":              {Read: database.PERM_VIEW, Write: database.PERM_VIEW},
+	"/unknown/":            {Read: database.PERM_VIEW, Write: database.PERM_ROSTER},
+	"/trash/":              {Read: database.PERM_ROSTER, Write: database.PERM_ROSTER},
+	UNDO_DELETE_URL:        {Read: database.PERM_ROSTER, Write: database.PERM_ROSTER},
+	UNDO_UNSUBMIT_URL:      {Read: database.PERM_MARK, Write: database.PERM_MARK},
+	"/account/":            {Read: database.PERM_MANAGE, Write: database.PERM_MANAGE, Device: true},
+	"/email/":              {Read: database.PERM_EXPORT, Write: database.PERM_EXPORT},
+	OUTBOX_URL:             {Read: database.PERM_MANAGE, Write: database.PERM_MANAGE, Device: true},
+	TEACHERS_URL:           {Read: database.PERM_ADMIN, Write: database.PERM_ADMIN, Device: true},
+
+	// ajax
+	"/remove/":     {Read: database.PERM_ROSTER, Write: database.PERM_ROSTER, Ajax: true},
+	"/status/":     {Read: database.PERM_VIEW, Write: database.PERM_VIEW, Ajax: true},
+	"/search/":     {Read: database.PERM_VIEW, Write: database.PERM_VIEW, Ajax: true},
+	"/metrics/":    {Read: database.PERM_MANAGE, Write: database.PERM_MANAGE, Ajax: true, Device: true},
+	EVENTS_URL:     {Read: database.PERM_VIEW, Write: database.PERM_VIEW, Ajax: true},
+	"/stats/data/": {Read: database.PERM_VIEW, Write: database.PERM_VIEW, Ajax: true},
+}
+
+// Guard wraps the handler of the route with Allow, or AllowAjax, and its
+// ROUTE_PERMISSIONS; it panics on a route which has none, so that no
+// route is ever served without them
+func Guard(store database.Store, path string, h http.HandlerFunc) http.HandlerFunc {
+	p, exists := ROUTE_PERMISSIONS[path]
+	if !exists {
+		panic(fmt.Sprintf("No permissions for the route %s", path))
+	}
+	if p.Ajax {
+		return AllowAjax(store, p, h)
+	}
+	return Allow(store, p, h)
+}
+
+// pathId returns the id in the url path, e.g. 3 in /terms/3, or 0
+func pathId(r *http.Request) int64 {
+	urlPaths := strings.Split(r.URL.Path[1:], "/")
+	if len(urlPaths) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseInt(urlPaths[1], 10, 64)
+	return id
+}
+
+// termInPath is the class of a request with the term in its url path
+// (see Terms)
+func termInPath(r *http.Request, store database.Store) int64 {
+	return pathId(r)
+}
+
+// assignmentInPath is the class of a request with an assignment in its
+// url path (see Grades): the term of the assignment
+func assignmentInPath(r *http.Request, store database.Store) int64 {
+	a, err := store.GetAssignment(pathId(r))
+	if err != nil {
+		return database.ACTIVE_TERM
+	}
+	return a.Term
+}
+
+// termParam is the class of a request with the term as its 'term' url
+// parameter, if any (see Export)
+func termParam(r *http.Request, store database.Store) int64 {
+	term, _ := strconv.ParseInt(r.URL.Query().Get("term"), 10, 64)
+	return term
+}
+
+// requestClass returns the class (term) the request is about
+func requestClass(r *http.Request, store database.Store, p *RoutePermissions) int64 {
+	if p.Class == nil {
+		return database.ACTIVE_TERM
+	}
+	return p.Class(r, store)
+}
+
+// HandleRoute serves the route with its handler, guarded (see Guard)
+func HandleRoute(store database.Store, path string, h http.HandlerFunc) {
+	http.HandleFunc(path, Guard(store, path, h))
+}
@@ -0,0 +1,171 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	ALL_ROLES = "teacher ta kiosk"
+	MARKERS   = "teacher ta"
+	TEACHERS  = "teacher"
+)
+
+// ROUTE_ROLES are the roles which may GET, and POST to, each route
+var ROUTE_ROLES = map[string][2]string{
+	SYSTEM_URL:             {TEACHERS, TEACHERS},
+	"/stulist/":            {ALL_ROLES, ALL_ROLES},
+	"/submitted/":          {ALL_ROLES, ALL_ROLES},
+	"/delete/":             {TEACHERS, TEACHERS},
+	"/submit/":             {MARKERS, MARKERS},
+	"/unsubmit/":           {MARKERS, MARKERS},
+	"/input/":              {TEACHERS, TEACHERS},
+	"/cards/":              {TEACHERS, TEACHERS},
+	"/import/":             {TEACHERS, TEACHERS},
+	"/export/":             {TEACHERS, TEACHERS},
+	"/attendance/":         {ALL_ROLES, TEACHERS},
+	"/attendance/export/":  {TEACHERS, TEACHERS},
+	"/assignments/":        {ALL_ROLES, TEACHERS},
+	"/assignments/select/": {MARKERS, MARKERS},
+	TERMS_URL:              {ALL_ROLES, TEACHERS},
+	"/grades/":             {ALL_ROLES, MARKERS},
+	"/groups/":             {ALL_ROLES, MARKERS},
+	"/stats/":              {ALL_ROLES, ALL_ROLES},
+	"/unknown/":            {ALL_ROLES, TEACHERS},
+	"/trash/":              {TEACHERS, TEACHERS},
+	UNDO_DELETE_URL:        {TEACHERS, TEACHERS},
+	UNDO_UNSUBMIT_URL:      {MARKERS, MARKERS},
+	"/account/":            {TEACHERS, TEACHERS},
+	"/email/":              {TEACHERS, TEACHERS},
+	OUTBOX_URL:             {TEACHERS, TEACHERS},
+	TEACHERS_URL:           {TEACHERS, TEACHERS},
+	"/remove/":             {TEACHERS, TEACHERS},
+	"/status/":             {ALL_ROLES, ALL_ROLES},
+	"/search/":             {ALL_ROLES, ALL_ROLES},
+	"/metrics/":            {TEACHERS, TEACHERS},
+	EVENTS_URL:             {ALL_ROLES, ALL_ROLES},
+	"/stats/data/":         {ALL_ROLES, ALL_ROLES},
+}
+
+// TestRoutePermissions tries every route with every role, and with none
+func TestRoutePermissions(t *testing.T) {
+	store := database.NewMemoryStore()
+	teachers := make(map[string]*database.Teacher)
+	for _, role := range database.ROLES {
+		teachers[role] = testTeacher(t, store, role, role)
+	}
+	if len(ROUTE_ROLES) != len(ROUTE_PERMISSIONS) {
+		t.Fatalf("%d routes, but the roles of %d", len(ROUTE_PERMISSIONS), len(ROUTE_ROLES))
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+	for path, p := range ROUTE_PERMISSIONS {
+		roles, exists := ROUTE_ROLES[path]
+		if !exists {
+			t.Errorf("%s: no roles", path)
+			continue
+		}
+		h := Guard(store, path, ok)
+		for i, method := range []string{"GET", "POST"} {
+			var form url.Values
+			if method == "POST" {
+				form = url.Values{}
+			}
+			for _, role := range database.ROLES {
+				w := httptest.NewRecorder()
+				h(w, testRequest(t, store, method, path, teachers[role], form))
+				want := http.StatusForbidden
+				if strings.Contains(" "+roles[i]+" ", " "+role+" ") {
+					want = http.StatusOK
+				}
+				if w.Code != want {
+					t.Errorf("%s %s as %s: got %d, want %d", method, path, role, w.Code, want)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			h(w, testRequest(t, store, method, path, nil, form))
+			want := http.StatusFound
+			if p.Ajax {
+				want = http.StatusUnauthorized
+			}
+			if w.Code != want {
+				t.Errorf("%s %s logged out: got %d, want %d", method, path, w.Code, want)
+			}
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("guarded a route without permissions")
+		}
+	}()
+	Guard(store, "/nowhere/", ok)
+}
+
+// TestClassRoles tries the routes with a role in a class other than the
+// teacher's own
+func TestClassRoles(t *testing.T) {
+	store := database.NewMemoryStore()
+	testTeacher(t, store, "teacher", database.ROLE_TEACHER)
+	kiosk := testTeacher(t, store, "hall", database.ROLE_KIOSK)
+	ta := testTeacher(t, store, "ta", database.ROLE_TA)
+	now := time.Now()
+	a, err := database.EnsureCurrentAssignment(store, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed, err := store.CloseTerm(&database.Term{Name: "2024", Closed: now.Unix()}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		teacher *database.Teacher
+		term    int64
+		role    string
+	}{
+		{kiosk, database.ACTIVE_TERM, database.ROLE_TA},
+		{ta, closed, database.ROLE_KIOSK},
+		{ta, database.ACTIVE_TERM, database.ROLE_TEACHER},
+	} {
+		if err := database.SetClassRole(store, c.teacher.Id, c.term, c.role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }
+	grades := "/grades/" + strconv.FormatInt(a.Id, 10)
+	for _, tt := range []struct {
+		route, path string
+		teacher     *database.Teacher
+		want        int
+	}{
+		{"/submit/", "/submit/", kiosk, http.StatusOK},
+		{"/grades/", grades, kiosk, http.StatusForbidden}, // of the closed term, where they are a kiosk still
+		{"/grades/", grades, ta, http.StatusForbidden},
+		{TERMS_URL, TERMS_URL + strconv.FormatInt(closed, 10), ta, http.StatusOK}, // a GET needs only view
+		{"/delete/", "/delete/", ta, http.StatusOK},
+		{"/delete/", "/delete/", kiosk, http.StatusForbidden},
+		{TEACHERS_URL, TEACHERS_URL, ta, http.StatusForbidden}, // the device's, by their own role
+		{SYSTEM_URL, SYSTEM_URL, ta, http.StatusForbidden},
+	} {
+		method, form := "POST", url.Values{}
+		if tt.route == TERMS_URL {
+			method, form = "GET", nil
+		}
+		w := httptest.NewRecorder()
+		Guard(store, tt.route, ok)(w, testRequest(t, store, method, tt.path, tt.teacher, form))
+		if w.Code != tt.want {
+			t.Errorf("%s %s as %s: got %d, want %d", method, tt.path, tt.teacher.Username, w.Code, tt.want)
+		}
+	}
+}
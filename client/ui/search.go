@@ -0,0 +1,58 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"encoding/json"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+)
+
+/* JSON response struct */
+type SearchResult struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// filterRoster returns the roster entries of the students matching the
+// query, in the order of the search results
+func filterRoster(store database.Store, roster []*database.StudentStatus, query string) ([]*database.StudentStatus, error) {
+	matches, err := database.SearchStudents(store, query, len(roster))
+	if err != nil {
+		return nil, err
+	}
+
+	byId := make(map[string]*database.StudentStatus)
+	for _, status := range roster {
+		byId[status.Student.Id] = status
+	}
+	results := make([]*database.StudentStatus, 0, len(matches))
+	for _, student := range matches {
+		if status, ok := byId[student.Id]; ok {
+			results = append(results, status)
+		}
+	}
+	return results, nil
+}
+
+// StudentSearch responds to an ajax request with the students matching
+// the 'q' parameter (by name, stuid, pinyin or initials) as a json list
+func StudentSearch(r *http.Request, store database.Store, opts ...interface{}) string {
+	matches, err := database.SearchStudents(store, r.FormValue("q"), database.SEARCH_LIMIT)
+	if err != nil {
+		return ajaxReply(AjaxAck{Message: "", Error: err.Error()})
+	}
+
+	results := make([]*SearchResult, 0, len(matches))
+	for _, student := range matches {
+		results = append(results, &SearchResult{Id: student.Id, Name: student.Name})
+	}
+	reply, err := json.Marshal(results)
+	if err != nil {
+		return ajaxReply(AjaxAck{Message: "", Error: err.Error()})
+	}
+	return string(reply)
+}
@@ -0,0 +1,287 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the cookie which keeps a teacher logged in, and for how long
+	SESSION_COOKIE   = "piscan_session"
+	SESSION_LIFETIME = 12 * time.Hour
+
+	// the cookie which ties the login form to the browser it was shown
+	// in, before there is a session (see loginToken)
+	LOGIN_COOKIE       = "piscan_login"
+	LOGIN_NONCE_LENGTH = 16
+
+	LOGIN_URL  = "/login/"
+	LOGOUT_URL = "/logout/"
+
+	// Errors
+	NOT_LOGGED_IN = "Please log in first"
+)
+
+var (
+	LOGIN_TEMPLATE_FILES = []string{"login.html", "head.html", "scripts.html"}
+	LOGIN_TEMPLATES      *template.Template
+
+	// BAD_SESSION is returned for a missing, forged or expired cookie
+	BAD_SESSION = errors.New("No valid session")
+)
+
+type LoginForm struct {
+	Title     string
+	Username  string
+	Next      string
+	FormError string
+}
+
+// contextKey keys the values the handlers add to the request context
+type contextKey int
+
+const (
+	teacherKey contextKey = iota
+	csrfKey
+	peerKey // the signature of a peer's pull (see RequirePeer)
+)
+
+// signSession returns the signature of the session of the Teacher which
+// expires at the given unix time; the password hash is part of it, so a
+// new password ends all the sessions of the old one
+func signSession(key []byte, t *database.Teacher, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d|%d|%s", t.Id, expires, t.Hash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// StartSession sets the signed session cookie which logs the Teacher in
+func StartSession(w http.ResponseWriter, store database.Store, t *database.Teacher, now time.Time) error {
+	key, err := database.GetSessionKey(store)
+	if err != nil {
+		return err
+	}
+	expires := now.Add(SESSION_LIFETIME)
+	value := fmt.Sprintf("%d.%d.%s", t.Id, expires.Unix(), signSession(key, t, expires.Unix()))
+	http.SetCookie(w, &http.Cookie{Name: SESSION_COOKIE,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode})
+	return nil
+}
+
+// EndSession clears the session cookie
+func EndSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: SESSION_COOKIE,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode})
+}
+
+// SessionTeacher returns the Teacher logged in by the session cookie of
+// the request, or BAD_SESSION
+func SessionTeacher(r *http.Request, store database.Store, now time.Time) (*database.Teacher, error) {
+	cookie, err := r.Cookie(SESSION_COOKIE)
+	if err != nil {
+		return nil, BAD_SESSION
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return nil, BAD_SESSION
+	}
+	id, idErr := strconv.ParseInt(parts[0], 10, 64)
+	expires, expiresErr := strconv.ParseInt(parts[1], 10, 64)
+	if idErr != nil || expiresErr != nil || expires <= now.Unix() {
+		return nil, BAD_SESSION
+	}
+
+	t, err := store.GetTeacher(id)
+	if err == database.NOT_FOUND {
+		return nil, BAD_SESSION
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := database.GetSessionKey(store)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(signSession(key, t, expires))) {
+		return nil, BAD_SESSION
+	}
+	return t, nil
+}
+
+// RequestTeacher returns the Teacher logged in for the request (see
+// RequireLogin), or nil
+func RequestTeacher(r *http.Request) *database.Teacher {
+	t, _ := r.Context().Value(teacherKey).(*database.Teacher)
+	return t
+}
+
+// authenticate invokes the handler with the logged in Teacher, and the
+// CSRF token of their session, in the request context, or else the
+// rejection
+func authenticate(store database.Store, h, reject http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := SessionTeacher(r, store, time.Now())
+		if err == BAD_SESSION {
+			reject(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		key, err := database.GetSessionKey(store)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cookie, _ := r.Cookie(SESSION_COOKIE)
+		ctx := context.WithValue(r.Context(), teacherKey, t)
+		ctx = context.WithValue(ctx, csrfKey, csrfToken(key, cookie.Value))
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// RequireLogin wraps the handler of a page (e.g., one made with
+// MakeHTMLHandler) so it is only served to a logged in teacher, sending
+// anyone else to the login page, and back once they have logged in
+func RequireLogin(store database.Store, h http.HandlerFunc) http.HandlerFunc {
+	return authenticate(store, h, func(w http.ResponseWriter, r *http.Request) {
+		target := LOGIN_URL
+		if r.Method == "GET" && r.URL.Path != "/" {
+			target = fmt.Sprintf("%s?next=%s", LOGIN_URL, url.QueryEscape(r.URL.RequestURI()))
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+}
+
+// RequireAjaxLogin is RequireLogin for the ajax calls (e.g., those made
+// with MakeHandler), which get a 401 json reply instead of the redirect
+func RequireAjaxLogin(store database.Store, h http.HandlerFunc) http.HandlerFunc {
+	return authenticate(store, h, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, ajaxReply(AjaxAck{Error: NOT_LOGGED_IN}))
+	})
+}
+
+// loginToken returns the CSRF token of the login form shown with the
+// nonce of the LOGIN_COOKIE, so another site cannot post the form to log
+// the browser in as someone else
+func loginToken(key []byte, nonce string) string {
+	return csrfToken(key, LOGIN_COOKIE+"|"+nonce)
+}
+
+// setLoginCookie sets the LOGIN_COOKIE to the nonce, or clears it if
+// there is none
+func setLoginCookie(w http.ResponseWriter, nonce string) {
+	cookie := &http.Cookie{Name: LOGIN_COOKIE,
+		Value:    nonce,
+		Path:     LOGIN_URL,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode}
+	if nonce == "" {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+// safeNext returns the page to go to after logging in, which must be on
+// this server
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return HOME_URL
+	}
+	return next
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderLoginTemplate(w http.ResponseWriter, r *http.Request, f *LoginForm) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, LOGIN_TEMPLATES, f)
+	}
+}
+
+// Login shows the login form (in response to a GET request), and logs
+// the teacher in (in response to a POST which carries the token of the
+// form, see loginToken), going on to the page they asked for first
+func Login(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	r.ParseForm()
+	f := &LoginForm{Title: "登录", Next: safeNext(r.Form.Get("next"))}
+	key, err := database.GetSessionKey(store)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce := ""
+	if cookie, err := r.Cookie(LOGIN_COOKIE); err == nil {
+		nonce = cookie.Value
+	}
+
+	status := http.StatusOK
+	if "POST" == r.Method {
+		f.Username = r.PostForm.Get("username")
+		status = http.StatusUnauthorized
+		if nonce == "" || !hmac.Equal([]byte(r.PostForm.Get(CSRF_FIELD)), []byte(loginToken(key, nonce))) {
+			f.FormError, status = "登录页面已过期，请重试", http.StatusForbidden
+		} else if t, err := database.Login(store, f.Username, r.PostForm.Get("password"), time.Now()); err == database.BAD_LOGIN {
+			f.FormError = "用户名或密码错误"
+		} else if err != nil {
+			f.FormError = err.Error()
+		} else if err = StartSession(w, store, t, time.Now()); err != nil {
+			f.FormError = err.Error()
+		} else {
+			setLoginCookie(w, "")
+			http.Redirect(w, r, f.Next, http.StatusFound)
+			return
+		}
+	}
+
+	if nonce == "" {
+		b := make([]byte, LOGIN_NONCE_LENGTH)
+		if _, err := rand.Read(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		nonce = base64.RawURLEncoding.EncodeToString(b)
+		setLoginCookie(w, nonce)
+	}
+	w.WriteHeader(status)
+	renderLoginTemplate(w, r.WithContext(context.WithValue(r.Context(), csrfKey, loginToken(key, nonce))), f)
+}
+
+// Logout ends the session, and returns to the login page; it only takes
+// a POST (with the CSRF token, see RequireLogin), so a link on another
+// site cannot log the teacher out
+func Logout(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	if "POST" != r.Method {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, BAD_REQUEST, http.StatusMethodNotAllowed)
+		return
+	}
+	EndSession(w)
+	http.Redirect(w, r, LOGIN_URL, http.StatusFound)
+}
@@ -0,0 +1,106 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var CSRF_FIELD_VALUE = regexp.MustCompile(`name="` + CSRF_FIELD + `" value="([^"]+)"`)
+
+func TestLogin(t *testing.T) {
+	InitializeTemplates("templates")
+	store := database.NewMemoryStore()
+	if _, _, err := database.SetTeacherPassword(store, "wang", "王老师", "password1", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(LOGIN_URL, MakeHTMLHandler(Login, store))
+	mux.HandleFunc(LOGOUT_URL, RequireLogin(store, MakeHTMLHandler(Logout, store)))
+	mux.HandleFunc(HOME_URL, RequireLogin(store, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + RequestTeacher(r).Name))
+	}))
+	serve := func(r *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+	post := func(path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serve(r, cookies...)
+	}
+
+	// the form is shown with a token, tied to the cookie set with it
+	w := serve(httptest.NewRequest("GET", LOGIN_URL, nil))
+	match := CSRF_FIELD_VALUE.FindStringSubmatch(w.Body.String())
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || match == nil || len(cookies) != 1 || cookies[0].Name != LOGIN_COOKIE {
+		t.Fatalf("got %d %v %s", w.Code, cookies, w.Body.String())
+	}
+	login, token := cookies[0], match[1]
+	credentials := func(token string) url.Values {
+		return url.Values{"username": {"wang"}, "password": {"password1"}, CSRF_FIELD: {token}}
+	}
+
+	// a login posted from another site has neither
+	if w := post(LOGIN_URL, credentials("")); w.Code != http.StatusForbidden {
+		t.Fatalf("logged in without the token: %d", w.Code)
+	}
+	if w := post(LOGIN_URL, credentials(token)); w.Code != http.StatusForbidden {
+		t.Fatalf("logged in without the cookie: %d", w.Code)
+	}
+	other := &http.Cookie{Name: LOGIN_COOKIE, Value: "another"}
+	if w := post(LOGIN_URL, credentials(token), other); w.Code != http.StatusForbidden {
+		t.Fatalf("logged in with another cookie: %d", w.Code)
+	}
+	if w := post(LOGIN_URL, url.Values{"username": {"wang"}, "password": {"wrong"}, CSRF_FIELD: {token}}, login); w.Code != http.StatusUnauthorized {
+		t.Fatalf("logged in with the wrong password: %d", w.Code)
+	}
+
+	w = post(LOGIN_URL, credentials(token), login)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != HOME_URL {
+		t.Fatalf("got %d %v", w.Code, w.Header())
+	}
+	var session *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SESSION_COOKIE {
+			session = c
+		} else if c.Name == LOGIN_COOKIE && c.MaxAge >= 0 {
+			t.Fatal("the login cookie was kept")
+		}
+	}
+	if session == nil {
+		t.Fatal("no session")
+	}
+	if w := serve(httptest.NewRequest("GET", HOME_URL, nil), session); w.Body.String() != "hello 王老师" {
+		t.Fatalf("got %d %s", w.Code, w.Body.String())
+	}
+
+	// logging out takes a post, with the token of the session
+	if w := serve(httptest.NewRequest("GET", LOGOUT_URL, nil), session); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("logged out by a GET: %d", w.Code)
+	}
+	if w := post(LOGOUT_URL, url.Values{}, session); w.Code != http.StatusForbidden {
+		t.Fatalf("logged out without the token: %d", w.Code)
+	}
+	teacher, err := store.GetTeacherByUsername("wang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serve(testRequest(t, store, "POST", LOGOUT_URL, teacher, url.Values{}))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != LOGIN_URL || w.Result().Cookies()[0].MaxAge >= 0 {
+		t.Fatalf("got %d %v", w.Code, w.Result().Cookies())
+	}
+}
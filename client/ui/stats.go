@@ -0,0 +1,103 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"encoding/json"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+const (
+	// the height of the tallest bar of the time-of-day histogram, in px
+	HISTOGRAM_HEIGHT = 80
+)
+
+var (
+	STATS_TEMPLATE_FILES = []string{"stats.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	STATS_TEMPLATES      *template.Template
+)
+
+// HourBar is one bar of the time-of-day histogram of scans
+type HourBar struct {
+	Hour   int
+	Count  int
+	Height int // in px, relative to the busiest hour
+}
+
+type StatsPage struct {
+	Title     string
+	ActiveTab *ActiveTab
+	Stats     *database.SubmissionStats
+	Hours     []*HourBar
+	Behind    int // how many students are falling behind
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderStatsTemplate(w http.ResponseWriter, r *http.Request, p *StatsPage) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, STATS_TEMPLATES, p)
+	}
+}
+
+// hourBars scales the histogram to HISTOGRAM_HEIGHT
+func hourBars(hours [database.HOURS_PER_DAY]int) []*HourBar {
+	busiest := 0
+	for _, n := range hours {
+		if n > busiest {
+			busiest = n
+		}
+	}
+	bars := make([]*HourBar, len(hours))
+	for hour, n := range hours {
+		bars[hour] = &HourBar{Hour: hour, Count: n}
+		if busiest > 0 {
+			bars[hour].Height = n * HISTOGRAM_HEIGHT / busiest
+		}
+	}
+	return bars
+}
+
+// Stats shows the dashboard of submission statistics for the active term:
+// the completion and on-time rates of each assignment, when scans happen,
+// and the students falling behind
+func Stats(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	stats, err := database.GetSubmissionStats(store, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p := &StatsPage{Title: "Statistics",
+		ActiveTab: &ActiveTab{Stats: true, ShowTabs: true},
+		Stats:     stats,
+		Hours:     hourBars(stats.Hours)}
+	for _, st := range stats.Students {
+		if st.Behind {
+			p.Behind++
+		}
+	}
+
+	renderStatsTemplate(w, r, p)
+}
+
+/* Ajax Response Functions (as strings via MakeHandler) */
+
+// StatsData replies with the same statistics as the dashboard, as json
+func StatsData(r *http.Request, store database.Store, opts ...interface{}) string {
+	stats, err := database.GetSubmissionStats(store, time.Now())
+	if err != nil {
+		return ajaxReply(AjaxAck{Error: err.Error()})
+	}
+	reply, err := json.Marshal(stats)
+	if err != nil {
+		return ajaxReply(AjaxAck{Error: err.Error()})
+	}
+	return string(reply)
+}
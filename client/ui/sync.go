@@ -0,0 +1,264 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// where each WebApp serves the changes in its log to its peers
+	SYNC_CHANGES_URL = "/sync/changes/"
+
+	// how long a peer has to answer
+	SYNC_TIMEOUT = 30 * time.Second
+
+	// the environment variable the WebApp reads the key shared by the
+	// devices from, if it is not given a key file, and how long it must be
+	SYNC_KEY_ENV    = "PISCAN_SYNC_KEY"
+	SYNC_KEY_LENGTH = 16
+
+	// a pull is signed with the key, as of a time, which must be within
+	// this long of the clock of the peer
+	SYNC_TIME_HEADER      = "X-Sync-Time"
+	SYNC_SIGNATURE_HEADER = "X-Sync-Signature"
+	SYNC_SKEW             = 5 * time.Minute
+
+	// the changes are sent sealed with the key
+	MIME_SEALED = "application/octet-stream"
+)
+
+var (
+	NO_SYNC_KEY        = errors.New("Sync needs the key shared by the devices (see -syncKeyFile)")
+	SHORT_SYNC_KEY     = fmt.Errorf("The sync key must be at least %d characters", SYNC_KEY_LENGTH)
+	BAD_SYNC_SIGNATURE = errors.New("The pull is not signed with the sync key, or its time is too far off")
+	BAD_SYNC_REPLY     = errors.New("The reply is not sealed with the sync key")
+)
+
+// SyncKey is the secret the devices share: a peer signs its pulls with
+// it, and the changes are sealed with it, so neither the log nor the
+// names in it are given to anyone else on the network
+type SyncKey struct {
+	mac  []byte
+	aead cipher.AEAD
+}
+
+// NewSyncKey derives the signing and sealing keys from the secret
+func NewSyncKey(secret []byte) (*SyncKey, error) {
+	if len(secret) < SYNC_KEY_LENGTH {
+		return nil, SHORT_SYNC_KEY
+	}
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("piscan sync seal"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SyncKey{mac: derive("piscan sync sign"), aead: aead}, nil
+}
+
+// ReadSyncKey returns the key in the file (without a trailing newline),
+// or, if none is given, in the SYNC_KEY_ENV variable, or nil if that is
+// not set either
+func ReadSyncKey(keyFile string) (*SyncKey, error) {
+	secret := os.Getenv(SYNC_KEY_ENV)
+	if keyFile != "" {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		secret = strings.TrimRight(string(content), "\r\n")
+	}
+	if secret == "" {
+		return nil, nil
+	}
+	return NewSyncKey([]byte(secret))
+}
+
+// sign returns the signature of a pull of the uri (the path and query)
+// made at the unix time
+func (k *SyncKey) sign(method, uri string, when int64) string {
+	mac := hmac.New(sha256.New, k.mac)
+	fmt.Fprintf(mac, "%s\n%s\n%d", method, uri, when)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the signature of the pull, if it is signed with the key
+// within SYNC_SKEW of now
+func (k *SyncKey) verify(r *http.Request, now time.Time) (string, error) {
+	when, err := strconv.ParseInt(r.Header.Get(SYNC_TIME_HEADER), 10, 64)
+	if err != nil {
+		return "", BAD_SYNC_SIGNATURE
+	}
+	if skew := now.Sub(time.Unix(when, 0)); skew > SYNC_SKEW || skew < -SYNC_SKEW {
+		return "", BAD_SYNC_SIGNATURE
+	}
+	signature := k.sign(r.Method, r.URL.RequestURI(), when)
+	if !hmac.Equal([]byte(signature), []byte(r.Header.Get(SYNC_SIGNATURE_HEADER))) {
+		return "", BAD_SYNC_SIGNATURE
+	}
+	return signature, nil
+}
+
+// seal encrypts the reply to the pull with the signature, so it cannot be
+// passed off as the reply to another
+func (k *SyncKey) seal(reply []byte, signature string) []byte {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // crypto/rand never fails on linux
+	}
+	return k.aead.Seal(nonce, nonce, reply, []byte(signature))
+}
+
+// open decrypts the reply to the pull with the signature
+func (k *SyncKey) open(sealed []byte, signature string) ([]byte, error) {
+	size := k.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, BAD_SYNC_REPLY
+	}
+	reply, err := k.aead.Open(nil, sealed[:size], sealed[size:], []byte(signature))
+	if err != nil {
+		return nil, BAD_SYNC_REPLY
+	}
+	return reply, nil
+}
+
+// RequirePeer wraps the handler of the changes so it is only served to a
+// peer: a pull signed with the sync key (there is no teacher logged in),
+// whose signature it adds to the request context; anyone else, and
+// everyone if this device has no key, gets a 403
+func RequirePeer(key *SyncKey, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key == nil {
+			http.Error(w, NO_SYNC_KEY.Error(), http.StatusForbidden)
+			return
+		}
+		signature, err := key.verify(r, time.Now())
+		if err != nil {
+			log.Println(fmt.Sprintf("Denied %s %s to %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err))
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), peerKey, signature)))
+	}
+}
+
+// SyncChanges replies with the changes in the log of this device after
+// the 'since' cursor, sealed with the sync key, for a peer to pull (see
+// PullPeer); opts[0] is the SyncKey
+func SyncChanges(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	s, isSyncer := store.(database.Syncer)
+	key, hasKey := opts[0].(*SyncKey)
+	signature, signed := r.Context().Value(peerKey).(string)
+	if !isSyncer || !hasKey || !signed {
+		http.Error(w, BAD_REQUEST, http.StatusForbidden)
+		return
+	}
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil {
+		since = 0
+	}
+
+	changes, err := s.GetChanges(since, database.SYNC_BATCH)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reply, err := json.Marshal(changes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", MIME_SEALED)
+	w.Write(key.seal(reply, signature))
+}
+
+// PullPeer applies the changes in the log of the peer WebApp at the
+// address (e.g., 'http://192.168.1.12:8080') which this device does not
+// have yet, returning how many there were
+func PullPeer(store database.Syncer, key *SyncKey, peer string) (int, error) {
+	client := &http.Client{Timeout: SYNC_TIMEOUT}
+	return store.Pull(peer, func(since int64) (*database.SyncChanges, error) {
+		uri := fmt.Sprintf("%s?since=%d", SYNC_CHANGES_URL, since)
+		req, err := http.NewRequest("GET", strings.TrimRight(peer, "/")+uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		when := time.Now().Unix()
+		signature := key.sign(req.Method, req.URL.RequestURI(), when)
+		req.Header.Set(SYNC_TIME_HEADER, strconv.FormatInt(when, 10))
+		req.Header.Set(SYNC_SIGNATURE_HEADER, signature)
+
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s: %s", peer, res.Status, bytes.TrimSpace(body))
+		}
+
+		reply, err := key.open(body, signature)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", peer, err)
+		}
+		changes := new(database.SyncChanges)
+		if err := json.Unmarshal(reply, changes); err != nil {
+			return nil, err
+		}
+		return changes, nil
+	})
+}
+
+// SyncForever pulls the changes of each of the peers at every interval,
+// invoking errorFn on any failure
+func SyncForever(store database.Store, key *SyncKey, peers []string, interval time.Duration, errorFn func(error)) {
+	s, ok := store.(database.Syncer)
+	if !ok {
+		errorFn(errors.New("Sync needs the sqlite client db"))
+		return
+	}
+	if key == nil {
+		errorFn(NO_SYNC_KEY)
+		return
+	}
+	for range time.Tick(interval) {
+		for _, peer := range peers {
+			if _, err := PullPeer(s, key, peer); err != nil {
+				errorFn(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"bytes"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const TEST_SYNC_SECRET = "a secret shared by the devices"
+
+// openSyncStore returns a SQLiteStore on a new db file in a temp dir
+func openSyncStore(t *testing.T) *database.SQLiteStore {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := database.OpenStore(database.ConnCoordinates{DBPath: t.TempDir(), DBFile: "test.sqlite", DBTablesPath: wd + "/../database"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// testSyncKey returns the key derived from the secret
+func testSyncKey(t *testing.T, secret string) *SyncKey {
+	key, err := NewSyncKey([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSync(t *testing.T) {
+	if _, err := NewSyncKey([]byte("short")); err != SHORT_SYNC_KEY {
+		t.Fatalf("got %v, want SHORT_SYNC_KEY", err)
+	}
+	key := testSyncKey(t, TEST_SYNC_SECRET)
+	a, b := openSyncStore(t), openSyncStore(t)
+	if err := a.AddStudent(&database.Student{Id: "001", Name: "张三"}); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(key *SyncKey) *httptest.Server {
+		mux := http.NewServeMux()
+		mux.HandleFunc(SYNC_CHANGES_URL, RequirePeer(key, MakeHTMLHandler(SyncChanges, a, key)))
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	srv := serve(key)
+
+	if n, err := PullPeer(b, key, srv.URL+"/"); err != nil || n == 0 {
+		t.Fatalf("pulled %d, %v", n, err)
+	}
+	if st, err := b.GetStudent("001"); err != nil || st.Name != "张三" {
+		t.Fatalf("got %v %v", st, err)
+	}
+	if n, err := PullPeer(b, key, srv.URL); err != nil || n != 0 {
+		t.Fatalf("pulled %d again, %v", n, err)
+	}
+
+	// a device with another key can neither pull nor be pulled from
+	other := testSyncKey(t, "another secret, not the shared one")
+	if _, err := PullPeer(b, other, srv.URL); err == nil {
+		t.Fatal("pulled with the wrong key")
+	}
+	if _, err := PullPeer(b, key, serve(nil).URL); err == nil {
+		t.Fatal("pulled from a device without a key")
+	}
+
+	get := func(when int64, signature string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+SYNC_CHANGES_URL+"?since=0", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if when != 0 {
+			req.Header.Set(SYNC_TIME_HEADER, strconv.FormatInt(when, 10))
+			req.Header.Set(SYNC_SIGNATURE_HEADER, signature)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+	uri := SYNC_CHANGES_URL + "?since=0"
+	now, stale := time.Now().Unix(), time.Now().Add(-2*SYNC_SKEW).Unix()
+	for name, res := range map[string]*http.Response{
+		"unsigned":       get(0, ""),
+		"wrong key":      get(now, other.sign("GET", uri, now)),
+		"stale":          get(stale, key.sign("GET", uri, stale)),
+		"another method": get(now, key.sign("POST", uri, now)),
+	} {
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: got %d, want 403", name, res.StatusCode)
+		}
+	}
+
+	// the changes are sealed, names included
+	signature := key.sign("GET", uri, now)
+	res := get(now, signature)
+	sealed, err := ioutil.ReadAll(res.Body)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d, %v", res.StatusCode, err)
+	}
+	if bytes.Contains(sealed, []byte("张三")) || bytes.Contains(sealed, []byte("001")) {
+		t.Fatal("the changes were sent in plain text")
+	}
+	if reply, err := key.open(sealed, signature); err != nil || !bytes.Contains(reply, []byte("张三")) {
+		t.Fatalf("got %s, %v", reply, err)
+	}
+	// and only open as the reply to the pull they answer
+	if _, err := key.open(sealed, key.sign("GET", uri, now+1)); err != BAD_SYNC_REPLY {
+		t.Fatalf("got %v, want BAD_SYNC_REPLY", err)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"html/template"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SYSTEM_URL = "/system/"
+
+	// system actions
+	SYSTEM_POWEROFF        = "poweroff"
+	SYSTEM_REBOOT          = "reboot"
+	SYSTEM_DELAY           = "delay"
+	SYSTEM_CANCEL          = "cancel"
+	SYSTEM_RESTART_SCANNER = "restart-scanner"
+	SYSTEM_RESTART_WEBAPP  = "restart-webapp"
+
+	// the longest a shutdown may be put off, in minutes
+	MAX_SHUTDOWN_DELAY = 24 * 60
+
+	// Errors
+	BAD_DELAY = "The delay must be between 1 and %d minutes"
+)
+
+var (
+	SYSTEM_TEMPLATE_FILES = []string{"system.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	SYSTEM_TEMPLATES      *template.Template
+
+	// SYSTEM_ACTIONS in the order to offer them; the commands work on the
+	// pi b/c the default user has sudo privilege, and the services are the
+	// init.d scripts (see the README)
+	SYSTEM_ACTIONS = []*SystemAction{
+		{Name: SYSTEM_POWEROFF, Label: "Shut down", Icon: "fa-power-off",
+			Question: "确定要关机吗？", Done: "正在关机",
+			Command: []string{"sudo", "shutdown", "-h", "now"}},
+		{Name: SYSTEM_REBOOT, Label: "Reboot", Icon: "fa-repeat",
+			Question: "确定要重启吗？", Done: "正在重启",
+			Command: []string{"sudo", "shutdown", "-r", "now"}},
+		{Name: SYSTEM_DELAY, Label: "Shut down later", Icon: "fa-clock-o",
+			Question: "确定要在 %d 分钟后关机吗？", Done: "将在 %d 分钟后关机",
+			Command: []string{"sudo", "shutdown", "-h", "+%d"}},
+		{Name: SYSTEM_RESTART_SCANNER, Label: "Restart the scanner", Icon: "fa-barcode",
+			Question: "确定要重启扫描程序吗？", Done: "正在重启扫描程序",
+			Command: []string{"sudo", "/etc/init.d/scanner.sh", "restart"}},
+		{Name: SYSTEM_RESTART_WEBAPP, Label: "Restart the WebApp", Icon: "fa-refresh",
+			Question: "确定要重启网页程序吗？", Done: "正在重启网页程序，请稍后刷新页面",
+			Command: []string{"sudo", "/etc/init.d/webapp.sh", "restart"}}}
+
+	// cancelling a delayed shutdown needs no confirmation
+	SYSTEM_CANCEL_COMMAND = []string{"sudo", "shutdown", "-c"}
+
+	// when the delayed shutdown is due, if there is one
+	scheduledShutdown struct {
+		sync.Mutex
+		at time.Time
+	}
+)
+
+// CommandRunner runs the system commands of the system page; the WebApp
+// uses ExecRunner, and the tests a fake which just records them
+type CommandRunner interface {
+	Run(name string, args ...string) (string, error)
+}
+
+// ExecRunner runs the commands on the device
+type ExecRunner struct{}
+
+// Run runs the command, returning what it printed
+func (ExecRunner) Run(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	return string(out), err
+}
+
+type SystemAction struct {
+	Name     string
+	Label    string
+	Icon     string
+	Question string // asked before running it
+	Done     string // said once it has run
+	Command  []string
+}
+
+type SystemPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Actions     []*SystemAction
+	Confirm     *SystemAction // the action waiting to be confirmed
+	Question    string
+	Minutes     int
+	MaxMinutes  int
+	Scheduled   string // when the delayed shutdown is due
+	Output      string
+	FormError   string
+	FormMessage string
+}
+
+// findSystemAction returns the SystemAction with the name, or nil
+func findSystemAction(name string) *SystemAction {
+	for _, a := range SYSTEM_ACTIONS {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// systemCommand returns the command of the action, with the delay of a
+// delayed shutdown filled in
+func systemCommand(a *SystemAction, minutes int) []string {
+	cmd := make([]string, len(a.Command))
+	for i, arg := range a.Command {
+		if strings.Contains(arg, "%d") {
+			arg = fmt.Sprintf(arg, minutes)
+		}
+		cmd[i] = arg
+	}
+	return cmd
+}
+
+// phrase fills in the delay of a delayed shutdown
+func phrase(s string, minutes int) string {
+	if strings.Contains(s, "%d") {
+		return fmt.Sprintf(s, minutes)
+	}
+	return s
+}
+
+// runSystemCommand runs the command, logging who asked for it
+func runSystemCommand(runner CommandRunner, r *http.Request, cmd []string) (string, error) {
+	who := "?"
+	if t := RequestTeacher(r); t != nil {
+		who = t.Username
+	}
+	log.Println(fmt.Sprintf("Running '%s' for %s", strings.Join(cmd, " "), who))
+	return runner.Run(cmd[0], cmd[1:]...)
+}
+
+// systemAction confirms the posted action (i.e., shows the question) or,
+// once confirmed, runs it, returning the message to show
+func systemAction(r *http.Request, runner CommandRunner, p *SystemPage) (string, error) {
+	action := r.PostForm.Get("action")
+	if action == SYSTEM_CANCEL {
+		out, err := runSystemCommand(runner, r, SYSTEM_CANCEL_COMMAND)
+		p.Output = out
+		if err != nil {
+			return "", err
+		}
+		scheduledShutdown.Lock()
+		scheduledShutdown.at = time.Time{}
+		scheduledShutdown.Unlock()
+		return "已取消关机", nil
+	}
+
+	a := findSystemAction(action)
+	if a == nil {
+		return "", errors.New(BAD_POST)
+	}
+	if a.Name == SYSTEM_DELAY {
+		minutes, err := strconv.Atoi(r.PostForm.Get("minutes"))
+		if err != nil || minutes < 1 || minutes > MAX_SHUTDOWN_DELAY {
+			return "", fmt.Errorf(BAD_DELAY, MAX_SHUTDOWN_DELAY)
+		}
+		p.Minutes = minutes
+	}
+	if r.PostForm.Get("confirm") == "" {
+		p.Confirm = a
+		p.Question = phrase(a.Question, p.Minutes)
+		return "", nil
+	}
+
+	out, err := runSystemCommand(runner, r, systemCommand(a, p.Minutes))
+	p.Output = out
+	if err != nil {
+		return "", err
+	}
+	if a.Name == SYSTEM_DELAY {
+		scheduledShutdown.Lock()
+		scheduledShutdown.at = time.Now().Add(time.Duration(p.Minutes) * time.Minute)
+		scheduledShutdown.Unlock()
+	}
+	return phrase(a.Done, p.Minutes), nil
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderSystemTemplate(w http.ResponseWriter, r *http.Request, p *SystemPage) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, SYSTEM_TEMPLATES, p)
+	}
+}
+
+// System shows the system controls (in response to a GET request), and
+// asks to confirm the posted one, or runs it once confirmed (in response
+// to a POST); the CommandRunner is the first of the opts
+func System(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	p := &SystemPage{Title: "系统",
+		ActiveTab:  &ActiveTab{System: true, ShowTabs: true},
+		Actions:    SYSTEM_ACTIONS,
+		Minutes:    15,
+		MaxMinutes: MAX_SHUTDOWN_DELAY}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+		var runner CommandRunner
+		if len(opts) > 0 {
+			runner, _ = opts[0].(CommandRunner)
+		}
+		if runner == nil {
+			p.FormError = BAD_REQUEST
+		} else if msg, err := systemAction(r, runner, p); err != nil {
+			p.FormError = err.Error()
+		} else {
+			p.FormMessage = msg
+		}
+	}
+
+	scheduledShutdown.Lock()
+	if at := scheduledShutdown.at; at.After(time.Now()) {
+		p.Scheduled = at.Format("15:04")
+	}
+	scheduledShutdown.Unlock()
+
+	renderSystemTemplate(w, r, p)
+}
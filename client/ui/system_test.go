@@ -0,0 +1,121 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"errors"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingRunner records the commands instead of running them, and
+// fails them all if it is broken
+type recordingRunner struct {
+	ran    [][]string
+	broken bool
+}
+
+func (f *recordingRunner) Run(name string, args ...string) (string, error) {
+	f.ran = append(f.ran, append([]string{name}, args...))
+	if f.broken {
+		return "nope", errors.New("exit status 1")
+	}
+	return "", nil
+}
+
+func TestSystem(t *testing.T) {
+	InitializeTemplates("templates")
+	store := database.NewMemoryStore()
+	teacher := testTeacher(t, store, "teacher", database.ROLE_TEACHER)
+	runner := &recordingRunner{}
+	h := Guard(store, SYSTEM_URL, MakeHTMLHandler(System, store, runner))
+	serve := func(method string, form url.Values) string {
+		w := httptest.NewRecorder()
+		h(w, testRequest(t, store, method, SYSTEM_URL, teacher, form))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %v: got %d", method, form, w.Code)
+		}
+		return w.Body.String()
+	}
+	ran := func(want ...[]string) {
+		if !reflect.DeepEqual(runner.ran, want) {
+			t.Fatalf("ran %q, want %q", runner.ran, want)
+		}
+		runner.ran = nil
+	}
+
+	// a GET never runs anything
+	if body := serve("GET", nil); !strings.Contains(body, "Reboot") {
+		t.Fatal(body)
+	}
+	ran()
+
+	for _, a := range SYSTEM_ACTIONS {
+		form := url.Values{"action": {a.Name}, "minutes": {"30"}}
+		// a post which is not confirmed only asks
+		if body := serve("POST", form); !strings.Contains(body, phrase(a.Question, 30)) {
+			t.Fatalf("%s: did not ask, %s", a.Name, body)
+		}
+		ran()
+
+		// and, confirmed, runs the exact command
+		form.Set("confirm", "1")
+		if body := serve("POST", form); !strings.Contains(body, phrase(a.Done, 30)) {
+			t.Fatalf("%s: %s", a.Name, body)
+		}
+		ran(systemCommand(a, 30))
+	}
+	if want := []string{"sudo", "shutdown", "-h", "+30"}; !reflect.DeepEqual(systemCommand(findSystemAction(SYSTEM_DELAY), 30), want) {
+		t.Fatalf("got %q, want %q", systemCommand(findSystemAction(SYSTEM_DELAY), 30), want)
+	}
+
+	// a delay out of bounds is refused, confirmed or not
+	for _, minutes := range []string{"0", "-5", strconv.Itoa(MAX_SHUTDOWN_DELAY + 1), "soon", ""} {
+		for _, confirm := range []string{"", "1"} {
+			body := serve("POST", url.Values{"action": {SYSTEM_DELAY}, "minutes": {minutes}, "confirm": {confirm}})
+			if !strings.Contains(body, strconv.Itoa(MAX_SHUTDOWN_DELAY)) {
+				t.Fatalf("%q minutes: %s", minutes, body)
+			}
+		}
+	}
+	ran()
+	for _, minutes := range []int{1, MAX_SHUTDOWN_DELAY} {
+		serve("POST", url.Values{"action": {SYSTEM_DELAY}, "minutes": {strconv.Itoa(minutes)}, "confirm": {"1"}})
+		ran([]string{"sudo", "shutdown", "-h", "+" + strconv.Itoa(minutes)})
+	}
+
+	// cancelling clears the delayed shutdown
+	scheduledShutdown.Lock()
+	scheduled := scheduledShutdown.at
+	scheduledShutdown.Unlock()
+	if !scheduled.After(time.Now()) {
+		t.Fatal("no shutdown scheduled")
+	}
+	if body := serve("POST", url.Values{"action": {SYSTEM_CANCEL}}); !strings.Contains(body, "已取消关机") {
+		t.Fatal(body)
+	}
+	ran(SYSTEM_CANCEL_COMMAND)
+	scheduledShutdown.Lock()
+	scheduled = scheduledShutdown.at
+	scheduledShutdown.Unlock()
+	if !scheduled.IsZero() {
+		t.Fatalf("still scheduled at %v", scheduled)
+	}
+
+	// an unknown action runs nothing, and a failure is shown
+	serve("POST", url.Values{"action": {"rm -rf /"}, "confirm": {"1"}})
+	ran()
+	runner.broken = true
+	if body := serve("POST", url.Values{"action": {SYSTEM_REBOOT}, "confirm": {"1"}}); !strings.Contains(body, "exit status 1") {
+		t.Fatal(body)
+	}
+	ran(systemCommand(findSystemAction(SYSTEM_REBOOT), 0))
+}
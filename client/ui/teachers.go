@@ -0,0 +1,263 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TEACHERS_URL = "/teachers/"
+
+	// teacher actions
+	TEACHER_ADD      = "add"
+	TEACHER_ROLE     = "role"
+	TEACHER_PASSWORD = "password"
+	TEACHER_REMOVE   = "remove"
+	TEACHER_CLASS    = "class"
+
+	// Errors
+	NOT_PERMITTED = "Sorry, you are not allowed to do that"
+)
+
+var (
+	TEACHER_TEMPLATE_FILES = []string{"teachers.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	TEACHER_TEMPLATES      *template.Template
+)
+
+type TeacherPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Teacher     *database.Teacher // the one logged in
+	Teachers    []*database.Teacher
+	Roles       []string
+	Permissions []string
+	Matrix      map[string]map[string]bool // role: permission: granted
+	Classes     []*database.Term           // the current class (as ACTIVE_TERM), then the closed ones
+	ClassRoles  map[int64][]*ClassRole     // by teacher
+	FormError   string
+	FormMessage string
+}
+
+// permitted reports whether the teacher logged in for the request (see
+// RequireLogin) has the read permission, for a GET request, or else the
+// write one, in the class of the request (or on the device, for a Device
+// route), logging the request if not
+func permitted(r *http.Request, store database.Store, p *RoutePermissions) bool {
+	perm := p.Write
+	if r.Method == "GET" || r.Method == "HEAD" {
+		perm = p.Read
+	}
+	t := RequestTeacher(r)
+	if t == nil {
+		return false
+	}
+	role, scope := t.Role, "the device"
+	if !p.Device {
+		term := requestClass(r, store, p)
+		var err error
+		if role, err = database.ClassRole(store, t, term); err != nil {
+			log.Println(err)
+			return false
+		}
+		scope = fmt.Sprintf("class %d", term)
+	}
+	if database.RoleCan(role, perm) {
+		return true
+	}
+	log.Println(fmt.Sprintf("Denied %s %s to %s (%s in %s): it needs the '%s' permission", r.Method, r.URL.Path, t.Username, role, scope, perm))
+	return false
+}
+
+// Allow wraps the handler of a page (e.g., one made with MakeHTMLHandler)
+// so it is only served to a logged in teacher whose role has the read
+// permission (for a GET request), or the write one (for a POST); see
+// database.ROLE_PERMISSIONS
+func Allow(store database.Store, p *RoutePermissions, h http.HandlerFunc) http.HandlerFunc {
+	return RequireLogin(store, func(w http.ResponseWriter, r *http.Request) {
+		if !permitted(r, store, p) {
+			http.Error(w, NOT_PERMITTED, http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// AllowAjax is Allow for the ajax calls (e.g., those made with
+// MakeHandler), which get a json reply instead
+func AllowAjax(store database.Store, p *RoutePermissions, h http.HandlerFunc) http.HandlerFunc {
+	return RequireAjaxLogin(store, func(w http.ResponseWriter, r *http.Request) {
+		if !permitted(r, store, p) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, ajaxReply(AjaxAck{Error: NOT_PERMITTED}))
+			return
+		}
+		h(w, r)
+	})
+}
+
+// roleMatrix tabulates database.ROLE_PERMISSIONS for the template
+func roleMatrix() map[string]map[string]bool {
+	matrix := make(map[string]map[string]bool)
+	for _, role := range database.ROLES {
+		matrix[role] = make(map[string]bool)
+		for _, perm := range database.PERMISSIONS {
+			matrix[role][perm] = database.RoleCan(role, perm)
+		}
+	}
+	return matrix
+}
+
+// changeTeacher applies the posted teacher action, returning the message
+// to show on success
+// ClassRole is a role a teacher has in one class, in place of their own
+type ClassRole struct {
+	Class *database.Term
+	Role  string
+}
+
+func changeTeacher(r *http.Request, store database.Store, me *database.Teacher) (string, error) {
+	action := r.PostForm.Get("action")
+	if action == TEACHER_ADD {
+		username := strings.TrimSpace(r.PostForm.Get("username"))
+		if _, err := store.GetTeacherByUsername(username); err == nil {
+			return "", database.DUPLICATE_TEACHER
+		} else if err != database.NOT_FOUND {
+			return "", err
+		}
+		t, _, err := database.SetTeacherPassword(store, username, strings.TrimSpace(r.PostForm.Get("name")), r.PostForm.Get("password"), time.Now())
+		if err != nil {
+			return "", err
+		}
+		if _, err := database.SetTeacherRole(store, t.Id, r.PostForm.Get("role")); err != nil {
+			store.DeleteTeacher(t.Id)
+			return "", err
+		}
+		return fmt.Sprintf("%s: 已添加", t.Username), nil
+	}
+
+	id, err := strconv.ParseInt(r.PostForm.Get("teacher"), 10, 64)
+	if err != nil {
+		return "", errors.New(BAD_POST)
+	}
+	t, err := store.GetTeacher(id)
+	if err != nil {
+		return "", err
+	}
+
+	switch action {
+	case TEACHER_ROLE:
+		if _, err = database.SetTeacherRole(store, id, r.PostForm.Get("role")); err == nil {
+			return fmt.Sprintf("%s: 角色已更改", t.Username), nil
+		}
+	case TEACHER_PASSWORD:
+		if _, _, err = database.SetTeacherPassword(store, t.Username, "", r.PostForm.Get("password"), time.Now()); err == nil {
+			return fmt.Sprintf("%s: 密码已更改", t.Username), nil
+		}
+	case TEACHER_CLASS:
+		term, termErr := strconv.ParseInt(r.PostForm.Get("term"), 10, 64)
+		if termErr != nil {
+			return "", errors.New(BAD_POST)
+		}
+		if err = database.SetClassRole(store, id, term, r.PostForm.Get("role")); err == nil {
+			return fmt.Sprintf("%s: 班级角色已更改", t.Username), nil
+		}
+	case TEACHER_REMOVE:
+		if id == me.Id {
+			return "", errors.New("不能删除自己的账号")
+		}
+		if err = database.RemoveTeacher(store, id); err == nil {
+			return fmt.Sprintf("%s: 已删除", t.Username), nil
+		}
+	default:
+		err = errors.New(BAD_POST)
+	}
+	return "", err
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderTeacherTemplate(w http.ResponseWriter, r *http.Request, p *TeacherPage) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, TEACHER_TEMPLATES, p)
+	}
+}
+
+// Teachers lists the teachers who may log in, with their roles and what
+// each role may do (in response to a GET request), and adds, changes or
+// removes one (in response to a POST)
+func Teachers(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	p := &TeacherPage{Title: "教师",
+		ActiveTab:   &ActiveTab{Account: true, ShowTabs: true},
+		Teacher:     RequestTeacher(r),
+		Roles:       database.ROLES,
+		Permissions: database.PERMISSIONS,
+		Matrix:      roleMatrix()}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+		if p.Teacher == nil {
+			p.FormError = NOT_LOGGED_IN
+		} else if msg, err := changeTeacher(r, store, p.Teacher); err != nil {
+			p.FormError = err.Error()
+		} else {
+			p.FormMessage = msg
+		}
+	}
+
+	teachers, err := store.GetTeachers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Teachers = teachers
+	if err := classRoles(store, p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderTeacherTemplate(w, r, p)
+}
+
+// classRoles fills in the classes of the page, and the class roles of its
+// teachers
+func classRoles(store database.Store, p *TeacherPage) error {
+	name, err := database.GetClassName(store)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		name = "current class"
+	}
+	closed, err := store.GetTerms()
+	if err != nil {
+		return err
+	}
+	p.Classes = append([]*database.Term{{Id: database.ACTIVE_TERM, Name: name}}, closed...)
+
+	p.ClassRoles = make(map[int64][]*ClassRole)
+	for _, t := range p.Teachers {
+		roles, err := store.GetClassRoles(t.Id)
+		if err != nil {
+			return err
+		}
+		for _, class := range p.Classes {
+			if role, ok := roles[class.Id]; ok {
+				p.ClassRoles[t.Id] = append(p.ClassRoles[t.Id], &ClassRole{Class: class, Role: role})
+			}
+		}
+	}
+	return nil
+}
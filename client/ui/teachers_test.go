@@ -0,0 +1,56 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTeachersClassRole(t *testing.T) {
+	InitializeTemplates("templates")
+	store := database.NewMemoryStore()
+	teacher := testTeacher(t, store, "teacher", database.ROLE_TEACHER)
+	ta := testTeacher(t, store, "ta", database.ROLE_KIOSK)
+	h := Guard(store, TEACHERS_URL, MakeHTMLHandler(Teachers, store))
+	serve := func(form url.Values) string {
+		w := httptest.NewRecorder()
+		h(w, testRequest(t, store, "POST", TEACHERS_URL, teacher, form))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: got %d", form, w.Code)
+		}
+		return w.Body.String()
+	}
+	set := func(term, role string) string {
+		return serve(url.Values{"action": {TEACHER_CLASS}, "teacher": {strconv.FormatInt(ta.Id, 10)}, "term": {term}, "role": {role}})
+	}
+
+	if body := set("0", database.ROLE_TA); !strings.Contains(body, "ta: 班级角色已更改") || !strings.Contains(body, "current class: ta") {
+		t.Fatal(body)
+	}
+	if can, err := database.ClassCan(store, ta, database.ACTIVE_TERM, database.PERM_MARK); err != nil || !can {
+		t.Fatalf("got %v %v", can, err)
+	}
+	for _, term := range []string{"x", "99"} {
+		if body := set(term, database.ROLE_TA); strings.Contains(body, "班级角色已更改") {
+			t.Fatalf("%s: %s", term, body)
+		}
+	}
+	if body := set("0", "owner"); !strings.Contains(body, database.BAD_ROLE.Error()) {
+		t.Fatal(body)
+	}
+
+	// the own role again
+	if body := set("0", ""); strings.Contains(body, "current class: ta") {
+		t.Fatal(body)
+	}
+	if roles, err := store.GetClassRoles(ta.Id); err != nil || len(roles) != 0 {
+		t.Fatalf("got %v %v", roles, err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// where the archive of a closed term is shown, by its id
+	TERMS_URL = "/terms/"
+)
+
+var (
+	TERM_TEMPLATE_FILES = []string{"term.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	TERM_TEMPLATES      *template.Template
+)
+
+type TermPage struct {
+	Title     string
+	ActiveTab *ActiveTab
+	Archive   *database.TermArchive
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderTermTemplate(w http.ResponseWriter, r *http.Request, p *TermPage) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, TERM_TEMPLATES, p)
+	}
+}
+
+// Terms shows the archive of the closed term in the url path (in response
+// to a GET request), or closes the active term (in response to a POST):
+// its assignments, submissions and roster are archived under the posted
+// name, and a new term starts, with the same roster if 'carry' is set
+func Terms(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	if "POST" == r.Method {
+		r.ParseForm()
+		name := strings.TrimSpace(r.PostForm.Get("name"))
+		if name == "" {
+			http.Error(w, BAD_POST, http.StatusBadRequest)
+			return
+		}
+		if _, err := database.CloseTerm(store, name, "", r.PostForm.Get("carry") != "", time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, ASSIGNMENTS_URL, http.StatusFound)
+		return
+	}
+
+	// derive the term id from the url path
+	urlPaths := strings.Split(r.URL.Path[1:], "/")
+	if len(urlPaths) < 2 || len(urlPaths[1]) == 0 {
+		http.Redirect(w, r, ASSIGNMENTS_URL, http.StatusFound)
+		return
+	}
+	termId, idErr := strconv.ParseInt(urlPaths[1], 10, 64)
+	if idErr != nil {
+		http.Error(w, BAD_REQUEST, http.StatusBadRequest)
+		return
+	}
+
+	archive, err := database.GetTermArchive(store, termId)
+	if err != nil {
+		if err == database.NOT_FOUND {
+			http.Error(w, BAD_REQUEST, http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	renderTermTemplate(w, r, &TermPage{Title: archive.Term.Name,
+		ActiveTab: &ActiveTab{Assignments: true, ShowTabs: true},
+		Archive:   archive})
+}
@@ -0,0 +1,157 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// trash actions
+	TRASH_RESTORE_STUDENT    = "student"
+	TRASH_RESTORE_SUBMISSION = "submission"
+
+	// how long a bulk delete can be undone from the page it returns to,
+	// and the query parameter (the unix time of the delete) which says so
+	UNDO_WINDOW = 5 * time.Minute
+	UNDO_PARAM  = "undo"
+
+	// the routes which undo a bulk delete of students, which brings
+	// them back onto the roster, and of submissions
+	UNDO_DELETE_URL   = "/undo/"
+	UNDO_UNSUBMIT_URL = "/undo/unsubmit/"
+)
+
+var (
+	TRASH_TEMPLATE_FILES = []string{"trash.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	TRASH_TEMPLATES      *template.Template
+)
+
+type TrashPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Trash       *database.Trash
+	FormError   string
+	FormMessage string
+}
+
+// Undo is a bulk delete which can still be undone
+type Undo struct {
+	Deleted int64  // unix time of the delete
+	Action  string // the route which undoes it
+	Expires int64  // seconds left
+}
+
+// undoURL returns the target page, with the offer to undo the delete
+// made at the given time
+func undoURL(target string, when time.Time) string {
+	return fmt.Sprintf("%s?%s=%d", target, UNDO_PARAM, when.Unix())
+}
+
+// getUndo returns the delete the request offers to undo, by posting to
+// the action, if it is still recent enough, or nil
+func getUndo(r *http.Request, action string, now time.Time) *Undo {
+	deleted, err := strconv.ParseInt(r.FormValue(UNDO_PARAM), 10, 64)
+	if err != nil || deleted <= 0 {
+		return nil
+	}
+	left := time.Unix(deleted, 0).Add(UNDO_WINDOW).Sub(now)
+	if left <= 0 {
+		return nil
+	}
+	return &Undo{Deleted: deleted, Action: action, Expires: int64(left.Seconds())}
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderTrashTemplate(w http.ResponseWriter, r *http.Request, p *TrashPage) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, TRASH_TEMPLATES, p)
+	}
+}
+
+// Trash lists the deleted students and submissions (in response to a GET
+// request), and restores one of them (in response to a POST)
+func Trash(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	p := &TrashPage{Title: "回收站",
+		ActiveTab: &ActiveTab{ShowTabs: true}}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+		stuid := r.PostForm.Get("stuid")
+
+		var err error
+		switch r.PostForm.Get("action") {
+		case TRASH_RESTORE_STUDENT:
+			err = store.RestoreStudent(stuid)
+		case TRASH_RESTORE_SUBMISSION:
+			assignmentId, parseErr := strconv.ParseInt(r.PostForm.Get("assignment"), 10, 64)
+			if parseErr != nil {
+				p.FormError = BAD_POST
+			} else {
+				err = store.RestoreSubmission(stuid, assignmentId)
+			}
+		default:
+			p.FormError = BAD_POST
+		}
+
+		if err != nil {
+			p.FormError = fmt.Sprintf("%s: %s", stuid, err.Error())
+		} else if p.FormError == "" {
+			p.FormMessage = fmt.Sprintf("%s: 已恢复", stuid)
+		}
+	}
+
+	trash, err := database.GetTrash(store)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Trash = trash
+
+	renderTrashTemplate(w, r, p)
+}
+
+// undoDeleted accepts a form post of the time of a bulk delete, and
+// restores what it deleted with the restore function, if it is still
+// recent enough, before returning to the next page; otherwise, it goes
+// to the trash, where each can be restored separately
+func undoDeleted(w http.ResponseWriter, r *http.Request, restore func(time.Time) (int, error), next string) {
+	if "POST" != r.Method {
+		http.Error(w, BAD_REQUEST, http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+
+	undo := getUndo(r, r.URL.Path, time.Now())
+	if undo == nil {
+		http.Redirect(w, r, TRASH_URL, http.StatusFound)
+		return
+	}
+	if _, err := restore(time.Unix(undo.Deleted, 0)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// UndoDelete undoes a bulk delete of students (see undoDeleted), with
+// the submissions deleted along with them, returning to the students
+func UndoDelete(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	undoDeleted(w, r, store.RestoreDeleted, HOME_URL)
+}
+
+// UndoUnsubmit undoes a bulk unsubmit (see undoDeleted), restoring only
+// submissions, so whoever may mark them cannot bring students back onto
+// the roster, and returns to the submitted list
+func UndoUnsubmit(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	undoDeleted(w, r, store.RestoreDeletedSubmissions, SUBMITTED_URL)
+}
@@ -0,0 +1,76 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestUndo undoes a delete of students and an unsubmit made at the same
+// time, as a ta, who may only bring back the submissions, and a teacher
+func TestUndo(t *testing.T) {
+	store := database.NewMemoryStore()
+	for id, name := range map[string]string{"001": "张三", "002": "李四"} {
+		if err := store.AddStudent(&database.Student{Id: id, Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	a, err := database.EnsureCurrentAssignment(store, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Submit("002", a.Id, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteStudent("001", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Unsubmit("002", a.Id, now); err != nil {
+		t.Fatal(err)
+	}
+	teacher := testTeacher(t, store, "teacher", database.ROLE_TEACHER)
+	ta := testTeacher(t, store, "ta", database.ROLE_TA)
+
+	undo := func(path string, teacher *database.Teacher, deleted int64, h func(http.ResponseWriter, *http.Request, database.Store, ...interface{})) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		form := url.Values{UNDO_PARAM: {strconv.FormatInt(deleted, 10)}}
+		Guard(store, path, func(w http.ResponseWriter, r *http.Request) { h(w, r, store) })(w, testRequest(t, store, "POST", path, teacher, form))
+		return w
+	}
+	students := func() int {
+		students, err := store.GetStudents()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(students)
+	}
+
+	if w := undo(UNDO_DELETE_URL, ta, now.Unix(), UndoDelete); w.Code != http.StatusForbidden || students() != 1 {
+		t.Fatalf("got %d, and %d students", w.Code, students())
+	}
+	w := undo(UNDO_UNSUBMIT_URL, ta, now.Unix(), UndoUnsubmit)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != SUBMITTED_URL {
+		t.Fatalf("got %d %v", w.Code, w.Header())
+	}
+	if subs, err := store.GetSubmissions(a.Id); err != nil || len(subs) != 1 || students() != 1 {
+		t.Fatalf("got %v %v, and %d students; want only the submission back", subs, err, students())
+	}
+
+	w = undo(UNDO_DELETE_URL, teacher, now.Unix(), UndoDelete)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != HOME_URL || students() != 2 {
+		t.Fatalf("got %d %v, and %d students", w.Code, w.Header(), students())
+	}
+
+	// too late, it goes to the trash instead
+	if w := undo(UNDO_UNSUBMIT_URL, teacher, now.Add(-UNDO_WINDOW).Unix(), UndoUnsubmit); w.Header().Get("Location") != TRASH_URL {
+		t.Fatalf("got %d %v", w.Code, w.Header())
+	}
+}
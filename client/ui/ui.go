@@ -10,13 +10,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/RogerZhangHS/PiScan/client/database"
-	"github.com/mxk/go-sqlite/sqlite3"
 	"html/template"
 	"io/ioutil"
 	"net/http"
 	"path"
-	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -25,11 +24,15 @@ const (
 	BAD_POST    = "Sorry, we cannot respond to that request. Please try again."
 
 	// Info messages
-	EMAIL_SENT = "The selected items have been sent to your email address"
+	EMAIL_SENT = "The selected students will be sent to your email address"
 
 	// urls
-	HOME_URL    = "/scanned/"
-	ACCOUNT_URL = "/account/"
+	HOME_URL        = "/stulist/"
+	SUBMITTED_URL   = "/submitted/"
+	ACCOUNT_URL     = "/account/"
+	ASSIGNMENTS_URL = "/assignments/"
+	UNKNOWN_URL     = "/unknown/"
+	TRASH_URL       = "/trash/"
 )
 
 var (
@@ -43,7 +46,7 @@ var (
 
 	UNSUPPORTED_TEMPLATE_FILE = "browser_not_supported.html"
 
-	ITEM_LIST_TEMPLATE_FILES = []string{"items.html", "head.html", "navigation_tabs.html", "actions.html", "modal.html", "scripts.html"}
+	ITEM_LIST_TEMPLATE_FILES = []string{"items.html", "item.html", "head.html", "navigation_tabs.html", "actions.html", "modal.html", "scripts.html"}
 	ITEM_EDIT_TEMPLATE_FILES = []string{"define_item.html", "head.html", "scripts.html"}
 
 	ITEM_LIST_TEMPLATES *template.Template
@@ -59,10 +62,18 @@ func Redirect(target string) http.HandlerFunc {
 	}
 }
 
-// Respond to requests using HTML templates and the standard Content-Type (i.e., "text/html")
-func MakeHTMLHandler(fn func(http.ResponseWriter, *http.Request, database.ConnCoordinates, ...interface{}), db database.ConnCoordinates, opts ...interface{}) http.HandlerFunc {
+// Respond to requests using HTML templates and the standard Content-Type (i.e., "text/html");
+// the store is shared by all requests for the life of the WebApp
+func MakeHTMLHandler(fn func(http.ResponseWriter, *http.Request, database.Store, ...interface{}), store database.Store, opts ...interface{}) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fn(w, r, db, opts...)
+		if err := checkCSRF(w, r); err == BAD_CSRF {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fn(w, r, store, opts...)
 	}
 }
 
@@ -74,17 +85,22 @@ func UnsupportedBrowserHandler(templatesFolder string) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		fmt.Fprintf(w, string(body))
+		w.Write(body)
 	}
 }
 
 // Respond to requests that are not "text/html" Content-Types (e.g., for ajax calls)
-func MakeHandler(fn func(*http.Request, database.ConnCoordinates, ...interface{}) string, db database.ConnCoordinates, mediaType string, opts ...interface{}) http.HandlerFunc {
+func MakeHandler(fn func(*http.Request, database.Store, ...interface{}) string, store database.Store, mediaType string, opts ...interface{}) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", fmt.Sprintf("%s; charset=utf-8", mediaType))
-		data := fn(r, db, opts...)
+		if err := checkCSRF(w, r); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, ajaxReply(AjaxAck{Error: err.Error()}))
+			return
+		}
+		data := fn(r, store, opts...)
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
-		fmt.Fprintf(w, data)
+		fmt.Fprint(w, data)
 	}
 }
 
@@ -94,11 +110,26 @@ type AjaxAck struct {
 	Error   string `json:"err,omitempty"`
 }
 
+// ajaxReply converts the ajax reply object to json
+func ajaxReply(ack AjaxAck) string {
+	ackObj, ackObjErr := json.Marshal(ack)
+	if ackObjErr != nil {
+		return ackObjErr.Error()
+	}
+	return string(ackObj)
+}
+
 /* HTML template structs */
 type ActiveTab struct {
-	Scanned    bool
-	Submission bool
-	ShowTabs   bool
+	Scanned     bool
+	Submission  bool
+	Assignments bool
+	Unknown     bool
+	Attendance  bool
+	Stats       bool
+	Account     bool
+	System      bool
+	ShowTabs    bool
 }
 
 type Action struct {
@@ -111,51 +142,63 @@ type StudentPage struct {
 	Title       string
 	ActiveTab   *ActiveTab
 	Actions     []*Action
-	Students       []*database.Student
+	Account     *database.Account
+	Assignment  *database.Assignment
+	Students    []*database.StudentStatus
 	Scanned     bool
+	Query       string
+	Undo        *Undo
 	PageMessage string
 }
 
 type StudentForm struct {
-	StuName      string
-	Item         *database.Student
-	CancelUrl    string
-	FormError    string
-	FormMessage  string
-	Unregistered bool
+	Title       string
+	Item        *database.Student
+	OriginalId  string
+	Cards       []*database.Card
+	CancelUrl   string
+	FormError   string
+	FormMessage string
 }
 
 /* General db access functions */
 
 // getStudents returns a list of all students and submitted students, and the correct
 // corresponding options for the HTML page template
-func getStudents(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, submitted bool) {
-	// 尝试连接至本地数据库
-	db, err := database.InitializeDB(dbCoords)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+func getStudents(w http.ResponseWriter, r *http.Request, store database.Store, submitted bool) {
+	// get the Account for this request
+	acc, accErr := database.GetDesignatedAccount(store)
+	if accErr != nil {
+		http.Error(w, accErr.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer db.Close()
 
-	// 根据具体情况确定获取数据库内条目的函数
-	fetch := func(db *sqlite3.Conn) ([]*database.Student, error) {
-		if submitted {
-			return database.GetSignedStudents(db)
-		} else {
-			return database.GetAllStudents(db)
-		}
+	// the students are listed against the current assignment
+	assignment, assignmentErr := database.CurrentAssignment(store)
+	if assignmentErr != nil && assignmentErr != database.NOT_FOUND {
+		http.Error(w, assignmentErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	var assignmentId int64 = database.BAD_PK
+	if assignment != nil {
+		assignmentId = assignment.Id
 	}
 
-	// get all the desired students for this Account
-	students := make([]*database.Student, 0)
-	studentsList, studentsErr := fetch(db)
+	// 根据具体情况确定获取数据库内条目的函数
+	students, studentsErr := database.GetRoster(store, assignmentId, submitted)
 	if studentsErr != nil {
 		http.Error(w, studentsErr.Error(), http.StatusInternalServerError)
 		return
 	}
-	for _, student := range studentsList {
-		students = append(students, student)
+
+	// narrow the list to the search results, if any, best match first
+	query := strings.TrimSpace(r.FormValue("q"))
+	if query != "" {
+		students, studentsErr = filterRoster(store, students, query)
+		if studentsErr != nil {
+			http.Error(w, studentsErr.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	// actions
@@ -165,6 +208,7 @@ func getStudents(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 	} else {
 		actions = append(actions, &Action{Link: "/submit/", Icon: "fa fa-star", Action: "将学生加入提交名单中"})
 	}
+	actions = append(actions, &Action{Link: "/email/", Icon: "fa fa-envelope", Action: "发送至邮箱"})
 	actions = append(actions, &Action{Link: "/delete/", Icon: "fa fa-trash", Action: "删除该学生"})
 
 	// define the page title
@@ -177,10 +221,20 @@ func getStudents(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 	titleBuffer.WriteString(" 学生")
 
 	p := &StudentPage{Title: titleBuffer.String(),
-		Scanned:         !submitted,
-		ActiveTab:       &ActiveTab{Scanned: !submitted, Submission: submitted, ShowTabs: true},
-		Actions:         actions,
-		Students:        students}
+		Scanned:    !submitted,
+		ActiveTab:  &ActiveTab{Scanned: !submitted, Submission: submitted, ShowTabs: true},
+		Actions:    actions,
+		Account:    acc,
+		Assignment: assignment,
+		Students:   students,
+		Query:      query}
+
+	// offer to undo a bulk delete just made from this page
+	if submitted {
+		p.Undo = getUndo(r, UNDO_UNSUBMIT_URL, time.Now())
+	} else {
+		p.Undo = getUndo(r, UNDO_DELETE_URL, time.Now())
+	}
 
 	// check for any message to display on page load
 	r.ParseForm()
@@ -191,200 +245,210 @@ func getStudents(w http.ResponseWriter, r *http.Request, dbCoords database.ConnC
 		}
 	}
 
-	renderItemListTemplate(w, p)
+	renderItemListTemplate(w, r, p)
 }
 
-// deleteItem attempts to lookup and remove the Item for the Account and
-// Item.Id combination, returning a bool on success/fail, and the db lookup
-// error (if any)
-func deleteItem(db *sqlite3.Conn, stuid string) (bool, error) {
-	result := false
-
-	student, studentErr := database.GetSingleItem(db, stuid)
-	if studentErr == nil {
-		if student.stuid == stuid {
-			database.Delete(db,stuid)
-			result = true
-		}
+// deleteItem attempts to lookup and remove the Student with the given
+// stuid (to the trash), returning a bool on success/fail, and the db
+// lookup error (if any)
+func deleteItem(store database.Store, stuid string) (bool, error) {
+	err := store.DeleteStudent(stuid, time.Now())
+	if err == database.NOT_FOUND {
+		return false, nil
 	}
-
-	return result, studentErr
+	return err == nil, err
 }
 
-// processItems fetches all the Items for the given Account, and the compares
-// them to the id list posted from the form. All the matches get applied
-// the given function: delete, favorite, unfavorite, etc.
-func processItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, fn func(*database.Item, *sqlite3.Conn), successTarget string) {
-	// attempt to connect to the db
-	db, err := database.InitializeDB(dbCoords)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer db.Close()
-
-	// get the Account for this request
-	acc, accErr := database.GetDesignatedAccount(db)
-	if accErr != nil {
-		http.Error(w, accErr.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// get all the Items for this Account
-	// and store them in a map by their Idscanned/
-	items, itemsErr := database.GetItems(db, acc)
-	if itemsErr != nil {
-		http.Error(w, itemsErr.Error(), http.StatusInternalServerError)
+// processItems fetches all the Students, and the compares them to the
+// stuid list posted from the form. All the matches get applied the given
+// function: delete, submit, unsubmit, etc.
+func processItems(w http.ResponseWriter, r *http.Request, store database.Store, fn func(*database.Student, database.Store) error, successTarget string) {
+	// get all the Students and store them in a map by their Id
+	students, studentsErr := store.GetStudents()
+	if studentsErr != nil {
+		http.Error(w, studentsErr.Error(), http.StatusInternalServerError)
 		return
 	}
-	accountItems := make(map[int64]*database.Item)
-	for _, item := range items {
-		accountItems[item.Id] = item
+	roster := make(map[string]*database.Student)
+	for _, student := range students {
+		roster[student.Id] = student
 	}
 
-	// get the list of item ids from the POST values
+	// get the list of stuids from the POST values
 	// and apply the processing function
 	if "POST" == r.Method {
 		r.ParseForm()
 		if idVals, exists := r.PostForm["item"]; exists {
-			for _, idString := range idVals {
-				id, idErr := strconv.ParseInt(idString, 10, 64)
-				if idErr == nil {
-					if accountItem, ok := accountItems[id]; ok {
-						fn(accountItem, db)
+			for _, id := range idVals {
+				if student, ok := roster[id]; ok {
+					if err := fn(student, store); err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
 					}
 				}
 			}
 		}
 	}
 
-	// finally, return home, to the scanned items list
+	// finally, return home, to the student list
 	http.Redirect(w, r, successTarget, http.StatusFound)
 }
 
+// processSubmissions is processItems for functions which act on the
+// submission of the current Assignment, creating it if need be
+func processSubmissions(w http.ResponseWriter, r *http.Request, store database.Store, fn func(*database.Student, *database.Assignment, database.Store) error, successTarget string) {
+	assignment, err := database.EnsureCurrentAssignment(store, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	apply := func(s *database.Student, store database.Store) error {
+		return fn(s, assignment, store)
+	}
+	processItems(w, r, store, apply, successTarget)
+}
+
 /* HTML Response Functions (via templates) */
 
-func renderItemListTemplate(w http.ResponseWriter, p *StudentPage) {
+func renderItemListTemplate(w http.ResponseWriter, r *http.Request, p *StudentPage) {
 	if TEMPLATES_INITIALIZED {
-		ITEM_LIST_TEMPLATES.Execute(w, p)
+		executeTemplate(w, r, ITEM_LIST_TEMPLATES, p)
 	}
 }
 
-func renderItemEditTemplate(w http.ResponseWriter, f *StudentForm) {
+func renderItemEditTemplate(w http.ResponseWriter, r *http.Request, f *StudentForm) {
 	if TEMPLATES_INITIALIZED {
-		ITEM_EDIT_TEMPLATES.Execute(w, f)
+		executeTemplate(w, r, ITEM_EDIT_TEMPLATES, f)
 	}
 }
 
 // InitializeTemplates confirms the given folder string leads to the html
 // template files, otherwise templates.Must() will complain
 func InitializeTemplates(folder string) {
-	ITEM_LIST_TEMPLATES = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, ITEM_LIST_TEMPLATE_FILES)...))
-	ITEM_EDIT_TEMPLATES = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, ITEM_EDIT_TEMPLATE_FILES)...))
-	ACCOUNT_EDIT_TEMPLATES = template.Must(template.ParseFiles(TEMPLATE_LIST(folder, ACCOUNT_EDIT_TEMPLATE_FILES)...))
+	ITEM_LIST_TEMPLATES = parseTemplates(folder, ITEM_LIST_TEMPLATE_FILES)
+	ITEM_EDIT_TEMPLATES = parseTemplates(folder, ITEM_EDIT_TEMPLATE_FILES)
+	ACCOUNT_EDIT_TEMPLATES = parseTemplates(folder, ACCOUNT_EDIT_TEMPLATE_FILES)
+	ASSIGNMENT_LIST_TEMPLATES = parseTemplates(folder, ASSIGNMENT_LIST_TEMPLATE_FILES)
+	ROSTER_IMPORT_TEMPLATES = parseTemplates(folder, ROSTER_IMPORT_TEMPLATE_FILES)
+	UNKNOWN_SCAN_TEMPLATES = parseTemplates(folder, UNKNOWN_SCAN_TEMPLATE_FILES)
+	TRASH_TEMPLATES = parseTemplates(folder, TRASH_TEMPLATE_FILES)
+	TERM_TEMPLATES = parseTemplates(folder, TERM_TEMPLATE_FILES)
+	GRADE_TEMPLATES = parseTemplates(folder, GRADE_TEMPLATE_FILES)
+	ATTENDANCE_TEMPLATES = parseTemplates(folder, ATTENDANCE_TEMPLATE_FILES)
+	GROUP_TEMPLATES = parseTemplates(folder, GROUP_TEMPLATE_FILES)
+	STATS_TEMPLATES = parseTemplates(folder, STATS_TEMPLATE_FILES)
+	OUTBOX_TEMPLATES = parseTemplates(folder, OUTBOX_TEMPLATE_FILES)
+	LOGIN_TEMPLATES = parseTemplates(folder, LOGIN_TEMPLATE_FILES)
+	TEACHER_TEMPLATES = parseTemplates(folder, TEACHER_TEMPLATE_FILES)
+	SYSTEM_TEMPLATES = parseTemplates(folder, SYSTEM_TEMPLATE_FILES)
 	TEMPLATES_INITIALIZED = true
 }
 
-// ScannedItems returns all the products scanned, favorited or not, barcode
-// lookup successful or not
-func ScannedItems(w http.ResponseWriter, r *http.Request, db database.ConnCoordinates, opts ...interface{}) {
-	getStudents(w, r, db, false)
+// ScannedItems returns all the students, whether they have submitted the
+// current assignment or not
+func ScannedItems(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	getStudents(w, r, store, false)
 }
 
-// FavoritedItems returns all the products scanned and favorited by this
-// Account
-func FavoritedItems(w http.ResponseWriter, r *http.Request, db database.ConnCoordinates, opts ...interface{}) {
-	getStudents(w, r, db, true)
+// SubmittedItems returns only the students who have submitted the current
+// assignment
+func SubmittedItems(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	getStudents(w, r, store, true)
+}
+
+// deletedTarget is the page to return to after a bulk delete made at the
+// given time, offering to undo it, if there was anything to delete
+func deletedTarget(r *http.Request, target string, when time.Time) string {
+	r.ParseForm()
+	if len(r.PostForm["item"]) == 0 {
+		return target
+	}
+	return undoURL(target, when)
 }
 
-// DeleteItems accepts a form post of one or more Item.Id values, and
-// attempts to remove them from the client db. Unless it hits a critical
-// error, it returns home, to the list of scanned items
-func DeleteItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
-	del := func(i *database.Item, db *sqlite3.Conn) {
-		i.Delete(db)
+// DeleteItems accepts a form post of one or more stuid values, and
+// attempts to move them to the trash. Unless it hits a critical error, it
+// returns home, to the list of students, offering to undo the delete
+func DeleteItems(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	now := time.Now()
+	del := func(s *database.Student, store database.Store) error {
+		return store.DeleteStudent(s.Id, now)
 	}
-	processItems(w, r, dbCoords, del, "/")
+	processItems(w, r, store, del, deletedTarget(r, HOME_URL, now))
 }
 
-// FavoriteItems accepts a form post of one or more Item.Id values, and
-// attempts to change their status in the client db to 'favorite'
-func FavoriteItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
-	fav := func(i *database.Item, db *sqlite3.Conn) {
-		i.Favorite(db)
+// SubmitItems accepts a form post of one or more stuid values, and
+// attempts to mark them as having submitted the current assignment
+func SubmitItems(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	sub := func(s *database.Student, a *database.Assignment, store database.Store) error {
+		return store.Submit(s.Id, a.Id, time.Now())
 	}
-	processItems(w, r, dbCoords, fav, "/favorites/")
+	processSubmissions(w, r, store, sub, SUBMITTED_URL)
 }
 
-// UnfavoriteItems accepts a form post of one or more Item.Id values,
-// and attempts to change their status in the client db to not 'favorite'
-func UnfavoriteItems(w http.ResponseWriter, r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) {
-	fav := func(i *database.Item, db *sqlite3.Conn) {
-		i.Unfavorite(db)
+// UnsubmitItems accepts a form post of one or more stuid values, and
+// attempts to move their submission of the current assignment to the
+// trash, offering to undo it
+func UnsubmitItems(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	now := time.Now()
+	unsub := func(s *database.Student, a *database.Assignment, store database.Store) error {
+		return store.Unsubmit(s.Id, a.Id, now)
 	}
-	processItems(w, r, dbCoords, fav, "/favorites/")
+	processSubmissions(w, r, store, unsub, deletedTarget(r, SUBMITTED_URL, now))
 }
 
 /* Ajax Response Functions (as strings via MakeHandler) */
 
-// RemoveSingleItem looks up the single item represented by the itemId form
-// post variable, and attempts to delete it, if it exists. The reply is a
-// jsonified string, passed back to MakeHandler() to be coupled with the
-// right mime type
-func RemoveSingleItem(r *http.Request, dbCoords database.ConnCoordinates, opts ...interface{}) string {
+// RemoveSingleItem looks up the single student represented by the itemId
+// form post variable, and attempts to delete it, if it exists. The reply
+// is a jsonified string, passed back to MakeHandler() to be coupled with
+// the right mime type
+func RemoveSingleItem(r *http.Request, store database.Store, opts ...interface{}) string {
 	// prepare the ajax reply object
 	ack := AjaxAck{Message: "", Error: ""}
 
-	// attempt to connect to the db
-	db, err := database.InitializeDB(dbCoords)
-	if err != nil {
-		ack.Error = err.Error()
-	}
-	defer db.Close()
-
-	if err == nil {
-		// get the Account for this request
-		acc, accErr := database.GetDesignatedAccount(db)
-		if accErr != nil {
-			ack.Error = accErr.Error()
-		}
-
-		// find the specific Item to remove
-		// get the item id from the POST values
-		if "POST" == r.Method {
-			r.ParseForm()
-			if idVal, exists := r.PostForm["itemId"]; exists {
-				if len(idVal) > 0 {
-					id, idErr := strconv.ParseInt(idVal[0], 10, 64)
-					if idErr != nil {
-						ack.Error = idErr.Error()
+	// find the specific Student to remove
+	// get the stuid from the POST values
+	if "POST" == r.Method {
+		r.ParseForm()
+		if idVal, exists := r.PostForm["itemId"]; exists {
+			if len(idVal) > 0 && len(idVal[0]) > 0 {
+				deleteSuccess, deleteErr := deleteItem(store, idVal[0])
+				if deleteSuccess {
+					ack.Message = "Ok"
+				} else {
+					if deleteErr != nil {
+						ack.Error = deleteErr.Error()
 					} else {
-						deleteSuccess, deleteErr := deleteItem(db, acc, id)
-						if deleteSuccess {
-							ack.Message = "Ok"
-						} else {
-							if deleteErr != nil {
-								ack.Error = deleteErr.Error()
-							} else {
-								ack.Error = "No such item"
-							}
-						}
+						ack.Error = "No such student"
 					}
-				} else {
-					ack.Error = "Missing item id"
 				}
 			} else {
-				ack.Error = BAD_POST
+				ack.Error = "Missing student id"
 			}
 		} else {
-			ack.Error = BAD_REQUEST
+			ack.Error = BAD_POST
 		}
+	} else {
+		ack.Error = BAD_REQUEST
 	}
 
-	// convert the ajax reply object to json
-	ackObj, ackObjErr := json.Marshal(ack)
-	if ackObjErr != nil {
-		return ackObjErr.Error()
+	return ajaxReply(ack)
+}
+
+// DatabaseMetrics replies with the statement and busy retry counts of the
+// store, if it keeps them (i.e., the sqlite db file)
+func DatabaseMetrics(r *http.Request, store database.Store, opts ...interface{}) string {
+	m, ok := store.(interface {
+		Metrics() database.StoreMetrics
+	})
+	if !ok {
+		return ajaxReply(AjaxAck{Error: BAD_REQUEST})
 	}
-	return string(ackObj)
+
+	metricsObj, err := json.Marshal(m.Metrics())
+	if err != nil {
+		return ajaxReply(AjaxAck{Error: err.Error()})
+	}
+	return string(metricsObj)
 }
@@ -0,0 +1,112 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTeacher adds a teacher with the role to the store
+func testTeacher(t *testing.T, store database.Store, username, role string) *database.Teacher {
+	teacher, _, err := database.SetTeacherPassword(store, username, "", "password1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != database.ROLE_TEACHER {
+		if teacher, err = database.SetTeacherRole(store, teacher.Id, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return teacher
+}
+
+// testRequest returns a form post (or a GET, if the form is nil) made by
+// the teacher (if any) from a page of their session, with its csrf token
+func testRequest(t *testing.T, store database.Store, method, path string, teacher *database.Teacher, form url.Values) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if teacher != nil {
+		w := httptest.NewRecorder()
+		if err := StartSession(w, store, teacher, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		cookie := w.Result().Cookies()[0]
+		r.AddCookie(cookie)
+		key, err := database.GetSessionKey(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set(CSRF_HEADER, csrfToken(key, cookie.Value))
+	}
+	return r
+}
+
+func TestItemsMemoryStore(t *testing.T) {
+	InitializeTemplates("templates")
+	store := database.NewMemoryStore()
+	for id, name := range map[string]string{"001": "张三", "002": "李四"} {
+		if err := store.AddStudent(&database.Student{Id: id, Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := database.EnsureCurrentAssignment(store, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	teacher := testTeacher(t, store, "teacher", database.ROLE_TEACHER)
+	kiosk := testTeacher(t, store, "kiosk", database.ROLE_KIOSK)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(HOME_URL, Allow(store, &RoutePermissions{Read: database.PERM_VIEW, Write: database.PERM_VIEW}, MakeHTMLHandler(ScannedItems, store)))
+	mux.HandleFunc("/submit/", Allow(store, ROUTE_PERMISSIONS["/submit/"], MakeHTMLHandler(SubmitItems, store)))
+	mux.HandleFunc("/remove/", AllowAjax(store, ROUTE_PERMISSIONS["/remove/"], MakeHandler(RemoveSingleItem, store, "application/json")))
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(testRequest(t, store, "GET", HOME_URL, kiosk, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "李四") {
+		t.Fatalf("got %d %s", w.Code, w.Body.String())
+	}
+
+	// the kiosk may not mark a submission, nor may anyone logged out
+	submit := url.Values{"item": {"001", "002"}}
+	if w := serve(testRequest(t, store, "POST", "/submit/", kiosk, submit)); w.Code != http.StatusForbidden {
+		t.Fatalf("got %d, want 403", w.Code)
+	}
+	if w := serve(testRequest(t, store, "POST", "/submit/", nil, submit)); w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), LOGIN_URL) {
+		t.Fatalf("got %d %s, want the login page", w.Code, w.Header().Get("Location"))
+	}
+	if subs, _ := store.GetSubmissions(a.Id); len(subs) != 0 {
+		t.Fatalf("got %d submissions, want none", len(subs))
+	}
+
+	if w := serve(testRequest(t, store, "POST", "/submit/", teacher, submit)); w.Code != http.StatusFound {
+		t.Fatalf("got %d, want a redirect", w.Code)
+	}
+	if subs, _ := store.GetSubmissions(a.Id); len(subs) != 2 {
+		t.Fatalf("got %d submissions, want 2", len(subs))
+	}
+
+	w = serve(testRequest(t, store, "POST", "/remove/", teacher, url.Values{"itemId": {"002"}}))
+	if w.Body.String() != `{"msg":"Ok"}` {
+		t.Fatalf("got %s", w.Body.String())
+	}
+	if _, err := store.GetStudent("002"); err != database.NOT_FOUND {
+		t.Fatalf("got %v, want the student in the trash", err)
+	}
+	if subs, _ := store.GetSubmissions(a.Id); len(subs) != 1 {
+		t.Fatalf("got %d submissions, want 1", len(subs))
+	}
+}
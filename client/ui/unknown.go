@@ -0,0 +1,108 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package ui provides http request handlers for the Pi client WebApp
+
+package ui
+
+import (
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+const (
+	// unknown barcode resolutions
+	UNKNOWN_LINK    = "link"
+	UNKNOWN_CREATE  = "create"
+	UNKNOWN_DISMISS = "dismiss"
+)
+
+var (
+	UNKNOWN_SCAN_TEMPLATE_FILES = []string{"unknown.html", "head.html", "navigation_tabs.html", "modal.html", "scripts.html"}
+	UNKNOWN_SCAN_TEMPLATES      *template.Template
+)
+
+type UnknownScanPage struct {
+	Title       string
+	ActiveTab   *ActiveTab
+	Barcodes    []*database.PendingBarcode
+	Students    []*database.Student
+	Encrypted   bool // so a new student needs a stuid other than the barcode
+	FormError   string
+	FormMessage string
+}
+
+/* HTML Response Functions (via templates) */
+
+func renderUnknownScanTemplate(w http.ResponseWriter, r *http.Request, p *UnknownScanPage) {
+	if TEMPLATES_INITIALIZED {
+		executeTemplate(w, r, UNKNOWN_SCAN_TEMPLATES, p)
+	}
+}
+
+// UnknownScans lists the scanned barcodes which matched no student (in
+// response to a GET request), and resolves one of them (in response to a
+// POST): linking it to an existing student as their new card, creating a
+// new student from it, or dismissing it. Linking or creating submits its
+// queued scans, as of the time they were made.
+func UnknownScans(w http.ResponseWriter, r *http.Request, store database.Store, opts ...interface{}) {
+	p := &UnknownScanPage{Title: "未知条码",
+		ActiveTab: &ActiveTab{Unknown: true, ShowTabs: true}}
+
+	if "POST" == r.Method {
+		r.ParseForm()
+		barcode := r.PostForm.Get("barcode")
+
+		var (
+			submitted int
+			err       error
+		)
+		switch r.PostForm.Get("action") {
+		case UNKNOWN_LINK:
+			submitted, err = database.LinkUnknownBarcode(store, barcode, r.PostForm.Get("stuid"))
+		case UNKNOWN_CREATE:
+			name := strings.TrimSpace(r.PostForm.Get("name"))
+			if name == "" {
+				p.FormError = BAD_POST
+			} else {
+				submitted, err = database.CreateFromUnknownBarcode(store, barcode, strings.TrimSpace(r.PostForm.Get("stuid")), name)
+			}
+		case UNKNOWN_DISMISS:
+			err = store.DismissUnknownScans(barcode)
+		default:
+			p.FormError = BAD_POST
+		}
+
+		if err == database.NOT_FOUND || err == database.DUPLICATE_STUDENT || err == database.DUPLICATE_CARD || err == database.STUID_IS_BARCODE {
+			p.FormError = err.Error()
+		} else if err != nil {
+			p.FormError = fmt.Sprintf("%s: %s", barcode, err.Error())
+		} else if p.FormError == "" && r.PostForm.Get("action") != UNKNOWN_DISMISS {
+			p.FormMessage = fmt.Sprintf("%s: 已补交 %d 份作业", barcode, submitted)
+		}
+	}
+
+	barcodes, err := database.GetPendingBarcodes(store)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Barcodes = barcodes
+
+	students, err := store.GetStudents()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.Students = students
+
+	if p.Encrypted, err = database.IsEncryptedStore(store); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	renderUnknownScanTemplate(w, r, p)
+}
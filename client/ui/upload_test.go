@@ -0,0 +1,83 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package ui
+
+import (
+	"encoding/json"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"github.com/RogerZhangHS/PiScan/server/api"
+	"github.com/RogerZhangHS/PiScan/server/digest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueueUploads(t *testing.T) {
+	store := openSyncStore(t)
+	if err := store.AddStudent(&database.Student{Id: "001", Name: "张三"}); err != nil {
+		t.Fatal(err)
+	}
+	a, err := database.EnsureCurrentAssignment(store, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Submit("001", a.Id, time.Unix(100, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is uploaded until the device is registered
+	if n, err := QueueUploads(store); err != nil || n != 0 {
+		t.Fatalf("queued %d, %v", n, err)
+	}
+	acc, err := database.GetDesignatedAccount(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.Update(store, "teacher@example.com", acc.APICode); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := QueueUploads(store); err != nil || n != 1 {
+		t.Fatalf("queued %d, %v; want 1", n, err)
+	}
+	if n, err := QueueUploads(store); err != nil || n != 0 {
+		t.Fatalf("queued %d again, %v", n, err)
+	}
+	if err := store.AddStudent(&database.Student{Id: "002", Name: "李四"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Submit("002", a.Id, time.Unix(200, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := QueueUploads(store); err != nil || n != 1 {
+		t.Fatalf("queued %d, %v; want 1", n, err)
+	}
+
+	// the API server gets each upload, signed by the device
+	uploaded := make([]*api.Submission, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.URL.Path != api.SUBMISSIONS_URL || r.Method != "POST" || !digest.ValuesMatch(acc.APICode, r.Form) {
+			t.Errorf("got %s %s %v", r.Method, r.URL.Path, r.Form)
+		}
+		batch := make([]*api.Submission, 0)
+		if err := json.Unmarshal([]byte(r.Form.Get("submissions")), &batch); err != nil {
+			t.Error(err)
+		}
+		uploaded = append(uploaded, batch...)
+		w.Write([]byte((&api.SimpleMessage{Ack: "1"}).Encode()))
+	}))
+	defer srv.Close()
+	client := &http.Client{Timeout: OUTBOX_TIMEOUT}
+	sent, err := database.DrainOutbox(store, time.Now(), func(m *database.OutboxMessage) error {
+		return sendOutboxMessage(client, srv.URL, m)
+	})
+	if err != nil || sent != 2 {
+		t.Fatalf("sent %d, %v; want 2", sent, err)
+	}
+	if len(uploaded) != 2 || uploaded[0].StudentName != "张三" || uploaded[0].Title != a.Title || uploaded[0].Posted != 100 || uploaded[0].Assignment == "" {
+		t.Fatalf("uploaded %+v", uploaded)
+	}
+}
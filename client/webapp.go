@@ -8,11 +8,14 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/Banrai/PiScan/client/database"
-	"github.com/Banrai/PiScan/client/ui"
+	"github.com/RogerZhangHS/PiScan/client/database"
+	"github.com/RogerZhangHS/PiScan/client/rest"
+	"github.com/RogerZhangHS/PiScan/client/ui"
 	"log"
 	"net/http"
 	"path"
+	"strings"
+	"time"
 )
 
 const (
@@ -20,24 +23,41 @@ const (
 	SERVER_HOST = "localhost"
 	SERVER_PORT = 8080
 
+	// api server constants (the optional, central server)
+	API_SERVER_HOST = "http://localhost"
+	API_SERVER_PORT = 9001
+
 	// non-html mime types (ajax replies)
 	MIME_JSON = "application/json"
 )
 
 func main() {
 	var (
-		host, apiHost, templatesFolder, dbPath, dbFile string
-		port, apiPort                                  int
+		host, apiHost, templatesFolder, dbPath, dbFile, backupDir, keyFile, peers, syncKeyFile string
+		port, apiPort, retentionDays                                                           int
+		backupInterval, purgeAfter, syncInterval, outboxInterval, eventsInterval               time.Duration
 	)
 	flag.StringVar(&host, "host", SERVER_HOST, fmt.Sprintf("Host name or IP address for this server (defaults to '%s')", SERVER_HOST))
 	flag.IntVar(&port, "port", SERVER_PORT, fmt.Sprintf("Port addess for this server (defaults to '%d')", SERVER_PORT))
+	flag.StringVar(&apiHost, "apiHost", API_SERVER_HOST, fmt.Sprintf("Host name or IP address (with scheme) for the API server (defaults to '%s')", API_SERVER_HOST))
+	flag.IntVar(&apiPort, "apiPort", API_SERVER_PORT, fmt.Sprintf("Port addess for the API server (defaults to '%d')", API_SERVER_PORT))
 	flag.StringVar(&templatesFolder, "templates", "", "Path to the html templates (REQUIRED)")
 	flag.StringVar(&dbPath, "dbPath", database.SQLITE_PATH, fmt.Sprintf("Path to the sqlite file (defaults to '%s')", database.SQLITE_PATH))
 	flag.StringVar(&dbFile, "dbFile", database.SQLITE_FILE, fmt.Sprintf("The sqlite database file (defaults to '%s')", database.SQLITE_FILE))
+	flag.StringVar(&backupDir, "backupDir", "", fmt.Sprintf("Folder for the database snapshots (defaults to '%s' under dbPath)", database.BACKUP_DIR))
+	flag.DurationVar(&backupInterval, "backupInterval", database.BACKUP_INTERVAL, fmt.Sprintf("How often to snapshot the database, or 0 for never (defaults to '%s')", database.BACKUP_INTERVAL))
+	flag.DurationVar(&purgeAfter, "purgeAfter", database.PURGE_AFTER, fmt.Sprintf("How long deleted students and submissions stay in the trash, or 0 for ever (defaults to '%s')", database.PURGE_AFTER))
+	flag.StringVar(&keyFile, "keyFile", "", fmt.Sprintf("File with the passphrase which encrypts the client db (defaults to the %s environment variable, if set)", database.PASSPHRASE_ENV))
+	flag.IntVar(&retentionDays, "retentionDays", 0, "Anonymize the students who left the roster more than this many days ago, daily, or 0 for never (defaults to 0)")
+	flag.StringVar(&peers, "peers", "", "The other devices' WebApps to sync with, as a comma separated list of addresses, e.g. 'http://192.168.1.12:8080' (defaults to none)")
+	flag.StringVar(&syncKeyFile, "syncKeyFile", "", fmt.Sprintf("File with the key the devices share, which sync needs (defaults to the %s environment variable, if set)", ui.SYNC_KEY_ENV))
+	flag.DurationVar(&syncInterval, "syncInterval", database.SYNC_INTERVAL, fmt.Sprintf("How often to pull the changes of the peers (defaults to '%s')", database.SYNC_INTERVAL))
+	flag.DurationVar(&outboxInterval, "outboxInterval", database.OUTBOX_INTERVAL, fmt.Sprintf("How often to retry sending the messages queued for the API server (defaults to '%s')", database.OUTBOX_INTERVAL))
+	flag.DurationVar(&eventsInterval, "eventsInterval", ui.EVENTS_INTERVAL, fmt.Sprintf("How often to read the scans and changes to push to the open pages (defaults to '%s')", ui.EVENTS_INTERVAL))
 	flag.Parse()
 
 	// make sure the required parameters are passed when run
-	if templatesFolder == "" || apiHost == "" {
+	if templatesFolder == "" {
 		fmt.Println("WebApp usage:")
 		flag.PrintDefaults()
 	} else {
@@ -47,26 +67,139 @@ func main() {
 
 		// coordinates for connecting to the sqlite database (from the command line options)
 		dbCoordinates := database.ConnCoordinates{DBPath: dbPath, DBFile: dbFile}
+		passphrase, keyErr := database.ReadPassphrase(keyFile)
+		if keyErr != nil {
+			log.Fatal(keyErr)
+		}
+		dbCoordinates.Passphrase = passphrase
+
+		// one connection pool to the sqlite database, shared by all requests
+		store, storeErr := database.OpenStore(dbCoordinates)
+		if storeErr != nil {
+			log.Fatal(storeErr)
+		}
+		defer store.Close()
+
+		// the cards an encrypted db cannot hide, since they are the stuids
+		if passphrase != nil {
+			cards, err := database.GetStuidCards(store)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, c := range cards {
+				log.Println(fmt.Sprintf("The card of %s is their stuid, which is not encrypted: replace it with a new card", c.StudentId))
+			}
+		}
+
+		// take (and rotate) snapshots of the database in the background
+		if backupInterval > 0 {
+			if backupDir == "" {
+				backupDir = path.Join(dbPath, database.BACKUP_DIR)
+			}
+			go store.SnapshotForever(backupDir, backupInterval, database.DEFAULT_RETENTION, func(e error) {
+				log.Println(e)
+			})
+		}
+
+		// empty the trash of what was deleted long enough ago
+		if purgeAfter > 0 {
+			go database.PurgeForever(store, purgeAfter, database.PURGE_INTERVAL, func(e error) {
+				log.Println(e)
+			})
+		}
+
+		// anonymize the former students past the retention period
+		if retentionDays > 0 {
+			go database.AnonymizeForever(store, retentionDays, database.RETENTION_INTERVAL, func(report *database.RetentionReport) {
+				for _, line := range report.Lines() {
+					log.Println(line)
+				}
+			}, func(e error) {
+				log.Println(e)
+			})
+		}
+
+		// pull the changes made on the other devices, which need the key
+		// to pull those made here
+		syncKey, syncKeyErr := ui.ReadSyncKey(syncKeyFile)
+		if syncKeyErr != nil {
+			log.Fatal(syncKeyErr)
+		}
+		if peers != "" && syncKey == nil {
+			log.Fatal(ui.NO_SYNC_KEY)
+		}
+		if peers != "" && syncInterval > 0 {
+			go ui.SyncForever(store, syncKey, strings.Split(peers, ","), syncInterval, func(e error) {
+				log.Println(e)
+			})
+		}
 
 		// prepare the apiHost:apiPort for handler functions that need them
+		apiServer := fmt.Sprintf("%s:%d", apiHost, apiPort)
 		extraCoordinates := make([]interface{}, 1)
-		extraCoordinates[0] = fmt.Sprintf("%s:%d", apiHost, apiPort)
+		extraCoordinates[0] = apiServer
+
+		// send what is queued for the API server, in order, as soon as it
+		// can be reached
+		go ui.OutboxForever(store, apiServer, outboxInterval, func(e error) {
+			log.Println(e)
+		})
+
+		// push the scans, and the changes to the submissions, to the
+		// pages open on the WebApp as they happen
+		broker := ui.NewEventBroker()
+		go ui.EventsForever(store, broker, eventsInterval, func(e error) {
+			log.Println(e)
+		})
 
 		/* define the server handlers */
 
-		// dynamic request handlers: html
-		http.HandleFunc("/", ui.Redirect("/stulist/"))
-		http.HandleFunc("/browser", ui.UnsupportedBrowserHandler(templatesFolder)) //OK
-		http.HandleFunc("/shutdown/", ui.ShutdownClientHandler()) //OK
-		http.HandleFunc("/stulist/", ui.MakeHTMLHandler(ui.ScannedItems, dbCoordinates))
-		http.HandleFunc("/delete/", ui.MakeHTMLHandler(ui.DeleteItems, dbCoordinates))
-		http.HandleFunc("/submit/", ui.MakeHTMLHandler(ui.FavoriteItems, dbCoordinates))
-		http.HandleFunc("/unsubmit/", ui.MakeHTMLHandler(ui.UnfavoriteItems, dbCoordinates))
-		http.HandleFunc("/input/", ui.MakeHTMLHandler(ui.InputUnknownItem, dbCoordinates, extraCoordinates...))
+		// dynamic request handlers: html (all but the login page only for
+		// a logged in teacher whose role has the permission to read, i.e.,
+		// GET, or the one to write, i.e., POST; see ui.ROUTE_PERMISSIONS)
+		http.HandleFunc("/", ui.Redirect(ui.HOME_URL))
+		http.HandleFunc("/browser", ui.UnsupportedBrowserHandler(templatesFolder))
+		http.HandleFunc(ui.LOGIN_URL, ui.MakeHTMLHandler(ui.Login, store))
+		http.HandleFunc(ui.LOGOUT_URL, ui.RequireLogin(store, ui.MakeHTMLHandler(ui.Logout, store)))
+		ui.HandleRoute(store, ui.SYSTEM_URL, ui.MakeHTMLHandler(ui.System, store, ui.ExecRunner{}))
+		http.HandleFunc("/shutdown/", ui.Redirect(ui.SYSTEM_URL))
+		ui.HandleRoute(store, "/stulist/", ui.MakeHTMLHandler(ui.ScannedItems, store))
+		ui.HandleRoute(store, "/submitted/", ui.MakeHTMLHandler(ui.SubmittedItems, store))
+		ui.HandleRoute(store, "/delete/", ui.MakeHTMLHandler(ui.DeleteItems, store))
+		ui.HandleRoute(store, "/submit/", ui.MakeHTMLHandler(ui.SubmitItems, store))
+		ui.HandleRoute(store, "/unsubmit/", ui.MakeHTMLHandler(ui.UnsubmitItems, store))
+		ui.HandleRoute(store, "/input/", ui.MakeHTMLHandler(ui.InputUnknownItem, store))
+		ui.HandleRoute(store, "/cards/", ui.MakeHTMLHandler(ui.ManageCards, store))
+		ui.HandleRoute(store, "/import/", ui.MakeHTMLHandler(ui.ImportRoster, store))
+		ui.HandleRoute(store, "/export/", ui.MakeHTMLHandler(ui.ExportGradebook, store))
+		ui.HandleRoute(store, "/attendance/", ui.MakeHTMLHandler(ui.Attendance, store))
+		ui.HandleRoute(store, "/attendance/export/", ui.MakeHTMLHandler(ui.ExportAttendance, store))
+		ui.HandleRoute(store, "/assignments/", ui.MakeHTMLHandler(ui.Assignments, store))
+		ui.HandleRoute(store, "/assignments/select/", ui.MakeHTMLHandler(ui.SelectAssignment, store))
+		ui.HandleRoute(store, ui.TERMS_URL, ui.MakeHTMLHandler(ui.Terms, store))
+		ui.HandleRoute(store, "/grades/", ui.MakeHTMLHandler(ui.Grades, store))
+		ui.HandleRoute(store, "/groups/", ui.MakeHTMLHandler(ui.Groups, store))
+		ui.HandleRoute(store, "/stats/", ui.MakeHTMLHandler(ui.Stats, store))
+		ui.HandleRoute(store, "/unknown/", ui.MakeHTMLHandler(ui.UnknownScans, store))
+		ui.HandleRoute(store, "/trash/", ui.MakeHTMLHandler(ui.Trash, store))
+		ui.HandleRoute(store, ui.UNDO_DELETE_URL, ui.MakeHTMLHandler(ui.UndoDelete, store))
+		ui.HandleRoute(store, ui.UNDO_UNSUBMIT_URL, ui.MakeHTMLHandler(ui.UndoUnsubmit, store))
+		ui.HandleRoute(store, "/account/", ui.MakeHTMLHandler(ui.EditAccount, store))
+		ui.HandleRoute(store, "/email/", ui.MakeHTMLHandler(ui.EmailItems, store))
+		ui.HandleRoute(store, ui.OUTBOX_URL, ui.MakeHTMLHandler(ui.Outbox, store))
+		ui.HandleRoute(store, ui.TEACHERS_URL, ui.MakeHTMLHandler(ui.Teachers, store))
 
 		// ajax
-		http.HandleFunc("/remove/", ui.MakeHandler(ui.RemoveSingleItem, dbCoordinates, MIME_JSON))
-		http.HandleFunc("/status/", ui.MakeHandler(ui.ConfirmServerAccount, dbCoordinates, MIME_JSON, extraCoordinates...))
+		ui.HandleRoute(store, "/remove/", ui.MakeHandler(ui.RemoveSingleItem, store, MIME_JSON))
+		ui.HandleRoute(store, "/status/", ui.MakeHandler(ui.ConfirmServerAccount, store, MIME_JSON, extraCoordinates...))
+		ui.HandleRoute(store, "/search/", ui.MakeHandler(ui.StudentSearch, store, MIME_JSON))
+		ui.HandleRoute(store, "/metrics/", ui.MakeHandler(ui.DatabaseMetrics, store, MIME_JSON))
+		ui.HandleRoute(store, ui.EVENTS_URL, ui.MakeHTMLHandler(ui.Events, store, broker))
+		ui.HandleRoute(store, "/stats/data/", ui.MakeHandler(ui.StatsData, store, MIME_JSON))
+		// the peers pull the changes with the sync key instead of a session
+		http.HandleFunc(ui.SYNC_CHANGES_URL, ui.RequirePeer(syncKey, ui.MakeHTMLHandler(ui.SyncChanges, store, syncKey)))
+		// scripts use the REST API with a token instead of a session
+		http.HandleFunc(rest.API_URL, rest.Handler(store))
 
 		// static resources
 		http.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir(path.Join(templatesFolder, "../css/")))))
@@ -115,7 +115,7 @@ func read(dev *os.File) ([]InputEvent, error) {
 	// remove trailing structures
 	for i := range events {
 		if events[i].Time.Sec == 0 {
-			events = append(events[:i])
+			events = events[:i]
 			break
 		}
 	}
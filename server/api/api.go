@@ -0,0 +1,78 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package api defines the messages exchanged by the Pi clients and the
+// API server
+
+package api
+
+import (
+	"encoding/json"
+)
+
+const (
+	// API server endpoints
+	REGISTER_URL    = "/register"
+	STATUS_URL      = "/status"
+	CONFIRM_URL     = "/confirm/"
+	CONTRIBUTE_URL  = "/contribute/"
+	EMAIL_URL       = "/email/"
+	SUBMISSIONS_URL = "/submissions/"
+
+	// the request parameter with the idempotency key of a request which
+	// may be retried: the server applies it once, and repeats its reply
+	IDEMPOTENCY_PARAM = "idempotencyKey"
+
+	// the /status ack of an account with at least one confirmed device,
+	// or of one without (also the /register ack of the device)
+	VERIFIED = "true"
+	PENDING  = "false"
+)
+
+// Error is the reason a request failed, as sent in a SimpleMessage
+type Error struct {
+	Message string `json:"msg"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// NewError returns the Error for the message
+func NewError(message string) *Error {
+	return &Error{Message: message}
+}
+
+// SimpleMessage is the json reply of the API server to every request:
+// either an Ack, or the Err explaining the failure
+type SimpleMessage struct {
+	Ack string `json:"ack"`
+	Err *Error `json:"err,omitempty"`
+}
+
+// Encode returns the json representation of the message
+func (m *SimpleMessage) Encode() string {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return `{"ack":"","err":{"msg":"Server error"}}`
+	}
+	return string(b)
+}
+
+// Submission is one student's hand-in of an assignment, as scanned on a
+// Pi client; a submission upload carries a list of them, json encoded,
+// in its "submissions" parameter
+type Submission struct {
+	StudentId   string `json:"stuid"`
+	StudentName string `json:"name"`
+	Assignment  string `json:"assignment"` // the assignment uid, the same on all synced devices
+	Title       string `json:"title"`
+	Posted      int64  `json:"posted"` // unix time of the scan
+}
+
+// SubmissionList is the reply to a request for the submissions of an
+// account: the Ack is how many there are
+type SubmissionList struct {
+	SimpleMessage
+	Submissions []*Submission `json:"submissions"`
+}
@@ -0,0 +1,301 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the mysql database on the API server
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"io/ioutil"
+	"path"
+)
+
+const (
+	// Default database coordinates
+	MYSQL_HOST = "localhost"
+	MYSQL_PORT = 3306
+	MYSQL_NAME = "piscan"
+
+	// Default sql definitions file
+	TABLE_SQL_DEFINITIONS = "tables.sql"
+
+	// database/sql driver name and connection options (the table
+	// definitions file is several statements)
+	MYSQL_DRIVER  = "mysql"
+	MYSQL_OPTIONS = "charset=utf8mb4&multiStatements=true"
+
+	// Connection pool size
+	MYSQL_MAX_CONNS = 16
+
+	// MySQL error number of a lock wait timeout or deadlock, after which
+	// the transaction may be retried
+	MYSQL_LOCK_TIMEOUT = 1205
+	MYSQL_DEADLOCK     = 1213
+	MYSQL_RETRIES      = 3
+
+	// Prepared Statements
+	// Accounts and devices
+	ADD_ACCOUNT       = "insert into account (email, registered) values (?, ?) on duplicate key update id = last_insert_id(id)"
+	GET_ACCOUNT       = "select id, email, registered from account where email = ?"
+	GET_ACCOUNT_BY_ID = "select id, email, registered from account where id = ?"
+	GET_DEVICE        = "select api_code, account, confirm_code, registered, verified from device where api_code = ?"
+	GET_DEVICES       = "select api_code, account, confirm_code, registered, verified from device where account = ? order by registered, api_code"
+	ADD_DEVICE        = "insert into device (api_code, account, confirm_code, registered, verified) values (?, ?, ?, ?, 0) on duplicate key update account = values(account), confirm_code = values(confirm_code), registered = values(registered), verified = 0"
+	FIND_CONFIRMATION = "select api_code, account, verified from device where confirm_code = ?"
+	CONFIRM_DEVICE    = "update device set verified = ? where api_code = ? and verified = 0"
+
+	// Contributed data
+	CONTRIBUTE      = "insert into student (account, stuid, name, updated) values (?, ?, ?, ?) on duplicate key update name = values(name), updated = values(updated)"
+	ADD_SUBMISSION  = "insert into submission (account, stuid, name, assignment, title, posted, device, uploaded) values (?, ?, ?, ?, ?, ?, ?, ?) on duplicate key update name = values(name), title = values(title), device = if(values(posted) < posted, values(device), device), posted = least(posted, values(posted)), uploaded = values(uploaded)"
+	GET_SUBMISSIONS = "select stuid, name, assignment, title, posted, device, uploaded from submission where account = ? and (? = '' or assignment = ?) order by posted, stuid"
+
+	// Idempotent replies
+	GET_REPLY     = "select reply from reply where idempotency_key = ?"
+	SAVE_REPLY    = "insert into reply (idempotency_key, reply, created) values (?, ?, ?) on duplicate key update reply = values(reply)"
+	PURGE_REPLIES = "delete from reply where created < ?"
+)
+
+// ConnCoordinates holds the mysql server address and credentials, and
+// the (optional) path to the table definitions to create
+type ConnCoordinates struct {
+	DBHost       string
+	DBPort       int
+	DBName       string
+	DBUser       string
+	DBPass       string
+	DBTablesPath string
+}
+
+// InitializeDB connects to the mysql db at the given coordinates, creating
+// the tables if coords.DBTablesPath is defined
+func InitializeDB(coords ConnCoordinates) (*sql.DB, error) {
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?%s", coords.DBUser, coords.DBPass, coords.DBHost, coords.DBPort, coords.DBName, MYSQL_OPTIONS)
+	db, dbErr := sql.Open(MYSQL_DRIVER, dsn)
+	if dbErr != nil {
+		return db, dbErr
+	}
+	db.SetMaxOpenConns(MYSQL_MAX_CONNS)
+	db.SetMaxIdleConns(MYSQL_MAX_CONNS)
+	if pingErr := db.Ping(); pingErr != nil {
+		db.Close()
+		return nil, pingErr
+	}
+
+	// load the table definitions file, if coords.DBTablesPath is defined
+	if len(coords.DBTablesPath) > 0 {
+		content, err := ioutil.ReadFile(path.Join(coords.DBTablesPath, TABLE_SQL_DEFINITIONS))
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		// attempt to create (if not exists) each table
+		if _, err = db.Exec(string(content)); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// OpenStore connects to the mysql db at the given coordinates, and
+// returns it as a Store, to be shared for the life of the process
+func OpenStore(coords ConnCoordinates) (*MySQLStore, error) {
+	db, err := InitializeDB(coords)
+	if err != nil {
+		return nil, err
+	}
+	return &MySQLStore{db: db}, nil
+}
+
+// MySQLStore is the Store of a mysql db
+type MySQLStore struct {
+	db *sql.DB
+}
+
+// Close releases the connection pool
+func (s *MySQLStore) Close() error {
+	return s.db.Close()
+}
+
+// notFound translates the sql no rows error to NOT_FOUND
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return NOT_FOUND
+	}
+	return err
+}
+
+// transaction runs fn inside a single transaction, committing only if it
+// succeeds, and retrying the whole transaction after a deadlock
+func (s *MySQLStore) transaction(fn func(*sql.Tx) error) error {
+	var err error
+	for i := 0; i < MYSQL_RETRIES; i++ {
+		var tx *sql.Tx
+		if tx, err = s.db.Begin(); err != nil {
+			return err
+		}
+		if err = fn(tx); err == nil {
+			if err = tx.Commit(); err == nil {
+				return nil
+			}
+		} else {
+			tx.Rollback()
+		}
+		if e, ok := err.(*mysql.MySQLError); !ok || (e.Number != MYSQL_DEADLOCK && e.Number != MYSQL_LOCK_TIMEOUT) {
+			return err
+		}
+	}
+	return err
+}
+
+// scanDevice reads a device row
+func scanDevice(row interface {
+	Scan(dest ...interface{}) error
+}) (*Device, error) {
+	d := new(Device)
+	err := row.Scan(&d.APICode, &d.Account, &d.ConfirmCode, &d.Registered, &d.Verified)
+	return d, notFound(err)
+}
+
+// Register adds (or moves) the device with the api code to the account
+// of the email address, creating the account the first time
+func (s *MySQLStore) Register(email, apiCode, confirmCode string, now int64) (*Device, error) {
+	var device *Device
+	err := s.transaction(func(tx *sql.Tx) error {
+		res, err := tx.Exec(ADD_ACCOUNT, email, now)
+		if err != nil {
+			return err
+		}
+		account, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		// a device already confirmed for this account stays so
+		device, err = scanDevice(tx.QueryRow(GET_DEVICE, apiCode))
+		if err == nil && device.Account == account && device.Verified > 0 {
+			return nil
+		} else if err != nil && err != NOT_FOUND {
+			return err
+		}
+
+		if _, err = tx.Exec(ADD_DEVICE, apiCode, account, confirmCode, now); err != nil {
+			return err
+		}
+		device = &Device{APICode: apiCode, Account: account, ConfirmCode: confirmCode, Registered: now}
+		return nil
+	})
+	return device, err
+}
+
+// Confirm verifies the device with the confirm code, returning its
+// Account, or NOT_FOUND
+func (s *MySQLStore) Confirm(confirmCode string, now int64) (*Account, error) {
+	a := new(Account)
+	err := s.transaction(func(tx *sql.Tx) error {
+		var apiCode string
+		var verified int64
+		if err := tx.QueryRow(FIND_CONFIRMATION, confirmCode).Scan(&apiCode, &a.Id, &verified); err != nil {
+			return notFound(err)
+		}
+		if verified == 0 {
+			if _, err := tx.Exec(CONFIRM_DEVICE, now, apiCode); err != nil {
+				return err
+			}
+		}
+		return notFound(tx.QueryRow(GET_ACCOUNT_BY_ID, a.Id).Scan(&a.Id, &a.Email, &a.Registered))
+	})
+	return a, err
+}
+
+// GetAccount returns the Account of the email address, or NOT_FOUND
+func (s *MySQLStore) GetAccount(email string) (*Account, error) {
+	a := new(Account)
+	err := s.db.QueryRow(GET_ACCOUNT, email).Scan(&a.Id, &a.Email, &a.Registered)
+	return a, notFound(err)
+}
+
+// GetDevices returns the devices registered to the account
+func (s *MySQLStore) GetDevices(account int64) ([]*Device, error) {
+	devices := make([]*Device, 0)
+	rows, err := s.db.Query(GET_DEVICES, account)
+	if err != nil {
+		return devices, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return devices, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// Contribute adds (or renames) the student in the roster of the account
+func (s *MySQLStore) Contribute(account int64, student *Student) error {
+	_, err := s.db.Exec(CONTRIBUTE, account, student.Id, student.Name, student.Updated)
+	return err
+}
+
+// AddSubmissions merges the uploaded submissions into those of the
+// account, keeping the earliest scan of each
+func (s *MySQLStore) AddSubmissions(account int64, submissions []*Submission) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(ADD_SUBMISSION)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, sub := range submissions {
+			if _, err := stmt.Exec(account, sub.StudentId, sub.StudentName, sub.Assignment, sub.Title, sub.Posted, sub.Device, sub.Uploaded); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetSubmissions returns the submissions of the account for the
+// assignment uid, or for all its assignments if blank
+func (s *MySQLStore) GetSubmissions(account int64, assignment string) ([]*Submission, error) {
+	submissions := make([]*Submission, 0)
+	rows, err := s.db.Query(GET_SUBMISSIONS, account, assignment, assignment)
+	if err != nil {
+		return submissions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		sub := new(Submission)
+		if err := rows.Scan(&sub.StudentId, &sub.StudentName, &sub.Assignment, &sub.Title, &sub.Posted, &sub.Device, &sub.Uploaded); err != nil {
+			return submissions, err
+		}
+		submissions = append(submissions, sub)
+	}
+	return submissions, rows.Err()
+}
+
+// GetReply returns the reply saved for the idempotency key, or NOT_FOUND
+func (s *MySQLStore) GetReply(key string) (string, error) {
+	var reply string
+	err := s.db.QueryRow(GET_REPLY, key).Scan(&reply)
+	return reply, notFound(err)
+}
+
+// SaveReply keeps the reply to the request with the idempotency key,
+// dropping those saved before the given time
+func (s *MySQLStore) SaveReply(key, reply string, now, before int64) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(PURGE_REPLIES, before); err != nil {
+			return err
+		}
+		_, err := tx.Exec(SAVE_REPLY, key, reply, now)
+		return err
+	})
+}
@@ -0,0 +1,203 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the mysql database on the API server
+
+package database
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryStore is an in-memory Store, for tests and for running the API
+// server without a mysql db
+type MemoryStore struct {
+	mu          sync.Mutex
+	accounts    map[string]*Account // by email
+	devices     map[string]*Device  // by api code
+	students    map[int64]map[string]*Student
+	submissions map[int64]map[submissionKey]*Submission
+	replies     map[string]*savedReply // by idempotency key
+	lastId      int64
+}
+
+// submissionKey mirrors the primary key of the mysql submission table,
+// within an account
+type submissionKey struct {
+	stuid, assignment string
+}
+
+// savedReply is a row of the mysql reply table
+type savedReply struct {
+	reply   string
+	created int64
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts:    make(map[string]*Account),
+		devices:     make(map[string]*Device),
+		students:    make(map[int64]map[string]*Student),
+		submissions: make(map[int64]map[submissionKey]*Submission),
+		replies:     make(map[string]*savedReply)}
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+/* Accounts and devices */
+
+func (m *MemoryStore) Register(email, apiCode, confirmCode string, now int64) (*Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, exists := m.accounts[email]
+	if !exists {
+		m.lastId++
+		a = &Account{Id: m.lastId, Email: email, Registered: now}
+		m.accounts[email] = a
+	}
+
+	if d, exists := m.devices[apiCode]; exists && d.Account == a.Id && d.Verified > 0 {
+		copied := *d
+		return &copied, nil
+	}
+	d := &Device{APICode: apiCode, Account: a.Id, ConfirmCode: confirmCode, Registered: now}
+	m.devices[apiCode] = d
+	copied := *d
+	return &copied, nil
+}
+
+func (m *MemoryStore) Confirm(confirmCode string, now int64) (*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, d := range m.devices {
+		if d.ConfirmCode == confirmCode {
+			if d.Verified == 0 {
+				d.Verified = now
+			}
+			for _, a := range m.accounts {
+				if a.Id == d.Account {
+					copied := *a
+					return &copied, nil
+				}
+			}
+		}
+	}
+	return nil, NOT_FOUND
+}
+
+func (m *MemoryStore) GetAccount(email string) (*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, exists := m.accounts[email]
+	if !exists {
+		return nil, NOT_FOUND
+	}
+	copied := *a
+	return &copied, nil
+}
+
+func (m *MemoryStore) GetDevices(account int64) ([]*Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	devices := make([]*Device, 0)
+	for _, d := range m.devices {
+		if d.Account == account {
+			copied := *d
+			devices = append(devices, &copied)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].Registered == devices[j].Registered {
+			return devices[i].APICode < devices[j].APICode
+		}
+		return devices[i].Registered < devices[j].Registered
+	})
+	return devices, nil
+}
+
+/* Contributed data */
+
+func (m *MemoryStore) Contribute(account int64, student *Student) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.students[account] == nil {
+		m.students[account] = make(map[string]*Student)
+	}
+	copied := *student
+	m.students[account][student.Id] = &copied
+	return nil
+}
+
+func (m *MemoryStore) AddSubmissions(account int64, submissions []*Submission) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.submissions[account] == nil {
+		m.submissions[account] = make(map[submissionKey]*Submission)
+	}
+	for _, sub := range submissions {
+		key := submissionKey{sub.StudentId, sub.Assignment}
+		copied := *sub
+		if existing, exists := m.submissions[account][key]; exists && existing.Posted <= sub.Posted {
+			copied.Posted = existing.Posted
+			copied.Device = existing.Device
+		}
+		m.submissions[account][key] = &copied
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetSubmissions(account int64, assignment string) ([]*Submission, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	submissions := make([]*Submission, 0)
+	for _, sub := range m.submissions[account] {
+		if assignment == "" || sub.Assignment == assignment {
+			copied := *sub
+			submissions = append(submissions, &copied)
+		}
+	}
+	sort.Slice(submissions, func(i, j int) bool {
+		if submissions[i].Posted == submissions[j].Posted {
+			return submissions[i].StudentId < submissions[j].StudentId
+		}
+		return submissions[i].Posted < submissions[j].Posted
+	})
+	return submissions, nil
+}
+
+/* Idempotent replies */
+
+func (m *MemoryStore) GetReply(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved, exists := m.replies[key]
+	if !exists {
+		return "", NOT_FOUND
+	}
+	return saved.reply, nil
+}
+
+func (m *MemoryStore) SaveReply(key, reply string, now, before int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, saved := range m.replies {
+		if saved.created < before {
+			delete(m.replies, k)
+		}
+	}
+	m.replies[key] = &savedReply{reply: reply, created: now}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package database provides access to the mysql database on the API server
+
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// How long the reply to a request with an idempotency key is kept
+	REPLY_RETENTION = 30 * 24 * time.Hour
+)
+
+var (
+	// NOT_FOUND is returned by Store lookups which match nothing
+	NOT_FOUND = errors.New("No such record")
+)
+
+// Account is a registered email address, shared by all the devices of
+// its owner
+type Account struct {
+	Id         int64
+	Email      string
+	Registered int64 // unix time
+}
+
+// Device is a Pi client registered to an Account, which signs its
+// requests with its api code
+type Device struct {
+	APICode     string
+	Account     int64
+	ConfirmCode string
+	Registered  int64 // unix time
+	Verified    int64 // unix time, or 0 until the owner confirms it
+}
+
+// Student is a roster entry contributed by a device
+type Student struct {
+	Id      string
+	Name    string
+	Updated int64 // unix time of the last contribution
+}
+
+// Submission is a student's hand-in of an assignment, as uploaded by the
+// devices of an Account
+type Submission struct {
+	StudentId   string
+	StudentName string
+	Assignment  string // the assignment uid on the devices
+	Title       string
+	Posted      int64  // unix time of the earliest scan
+	Device      string // api code of the device which scanned it first
+	Uploaded    int64  // unix time of the last upload
+}
+
+// Store is the API server datastore
+type Store interface {
+	// Accounts and devices
+	// Register adds (or moves) the device with the api code to the
+	// account of the email address, which needs confirming unless the
+	// device already belonged to it
+	Register(email, apiCode, confirmCode string, now int64) (*Device, error)
+	// Confirm verifies the device with the confirm code, returning its
+	// Account, or NOT_FOUND
+	Confirm(confirmCode string, now int64) (*Account, error)
+	GetAccount(email string) (*Account, error)
+	GetDevices(account int64) ([]*Device, error)
+
+	// Contributed data
+	Contribute(account int64, student *Student) error
+	// AddSubmissions merges the uploaded submissions into those of the
+	// account, keeping the earliest scan of each
+	AddSubmissions(account int64, submissions []*Submission) error
+	// GetSubmissions returns the submissions of the account for the
+	// assignment uid, or for all its assignments if blank
+	GetSubmissions(account int64, assignment string) ([]*Submission, error)
+
+	// Idempotent replies
+	// GetReply returns the reply saved for the idempotency key, or
+	// NOT_FOUND
+	GetReply(key string) (string, error)
+	// SaveReply keeps the reply to the request with the idempotency key,
+	// dropping those saved before the given time
+	SaveReply(key, reply string, now, before int64) error
+
+	Close() error
+}
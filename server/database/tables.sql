@@ -0,0 +1,66 @@
+-- These tables comprise the datastore of the API server, using MySQL for
+-- the database. It aggregates the data of many Pi clients: each teacher
+-- registers an account by email address, from one or more devices, and
+-- everything the devices send is kept under that account.
+
+-- `account` is each registered email address
+
+CREATE TABLE IF NOT EXISTS account (
+  id bigint PRIMARY KEY AUTO_INCREMENT,
+  email varchar(255) NOT NULL UNIQUE,
+  registered bigint NOT NULL -- unix time
+) DEFAULT CHARSET=utf8mb4;
+
+-- `device` is each Pi client registered to an account, which signs its
+-- requests with its api code; the owner confirms it by following the
+-- link with the confirm_code, emailed on registration
+
+CREATE TABLE IF NOT EXISTS device (
+  api_code varchar(64) PRIMARY KEY,
+  account bigint NOT NULL,
+  confirm_code varchar(64) NOT NULL UNIQUE,
+  registered bigint NOT NULL, -- unix time
+  verified bigint NOT NULL DEFAULT 0, -- unix time, 0 until confirmed
+  FOREIGN KEY (account) REFERENCES account(id) ON DELETE CASCADE
+) DEFAULT CHARSET=utf8mb4;
+
+-- `student` is the roster the devices of an account contributed
+
+CREATE TABLE IF NOT EXISTS student (
+  account bigint NOT NULL,
+  stuid varchar(255) NOT NULL,
+  name varchar(255) NOT NULL,
+  updated bigint NOT NULL, -- unix time of the last contribution
+  PRIMARY KEY (account, stuid),
+  FOREIGN KEY (account) REFERENCES account(id) ON DELETE CASCADE
+) DEFAULT CHARSET=utf8mb4;
+
+-- `submission` is each student's hand-in of an assignment, as uploaded
+-- by any of the devices of an account: synced devices share the
+-- assignment uids, so the same hand-in scanned on two of them is one
+-- row, kept with the earliest scan
+
+CREATE TABLE IF NOT EXISTS submission (
+  account bigint NOT NULL,
+  stuid varchar(255) NOT NULL,
+  name varchar(255) NOT NULL,
+  assignment varchar(64) NOT NULL, -- the assignment uid on the clients
+  title varchar(255) NOT NULL,
+  posted bigint NOT NULL, -- unix time of the earliest scan
+  device varchar(64) NOT NULL, -- api code of the device which scanned it first
+  uploaded bigint NOT NULL, -- unix time of the last upload
+  PRIMARY KEY (account, stuid, assignment),
+  KEY submission_assignment (account, assignment),
+  FOREIGN KEY (account) REFERENCES account(id) ON DELETE CASCADE
+) DEFAULT CHARSET=utf8mb4;
+
+-- `reply` is the reply to each request which carried an idempotency key
+-- (the Pi clients' outbox sends one with each), so a retry of a request
+-- already applied gets the same reply, instead of being applied again
+
+CREATE TABLE IF NOT EXISTS reply (
+  idempotency_key varchar(64) PRIMARY KEY,
+  reply text NOT NULL,
+  created bigint NOT NULL, -- unix time
+  KEY reply_created (created)
+) DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,46 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package digest signs and verifies the requests between the Pi clients
+// and the API server
+
+package digest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+)
+
+const (
+	// the request parameter which carries the digest of the others
+	DIGEST_PARAM = "hmac"
+)
+
+// GenerateDigest returns the (base64 encoded) HMAC-SHA256 of the message,
+// with the given key
+func GenerateDigest(key, message string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// DigestMatches reports whether the digest is the one of the message with
+// the given key, comparing them in constant time
+func DigestMatches(key, message, digest string) bool {
+	return hmac.Equal([]byte(GenerateDigest(key, message)), []byte(digest))
+}
+
+// ValuesMatch reports whether the digest parameter of the request values
+// is the one the sender computed over all the others (url encoded, as the
+// clients do) with the given key
+func ValuesMatch(key string, v url.Values) bool {
+	signed := url.Values{}
+	for name, values := range v {
+		if name != DIGEST_PARAM {
+			signed[name] = values
+		}
+	}
+	return DigestMatches(key, signed.Encode(), v.Get(DIGEST_PARAM))
+}
@@ -0,0 +1,59 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// Package emailer sends the API server's email messages
+
+package emailer
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"time"
+)
+
+// Sender delivers a plain text email message
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPServer is a Sender through an smtp server, authenticating with the
+// (optional) user and password
+type SMTPServer struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	From     string
+}
+
+// Send delivers the message to the recipient through the smtp server
+func (s *SMTPServer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if s.User != "" {
+		auth = smtp.PlainAuth("", s.User, s.Password, s.Host)
+	}
+
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "From: %s\r\n", s.From)
+	fmt.Fprintf(msg, "To: %s\r\n", to)
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(body)
+
+	return smtp.SendMail(fmt.Sprintf("%s:%d", s.Host, s.Port), auth, s.From, []string{to}, msg.Bytes())
+}
+
+// Logger is a Sender which only logs the messages, for running the API
+// server without an smtp server
+type Logger struct{}
+
+// Send logs the message
+func (l *Logger) Send(to, subject, body string) error {
+	log.Println(fmt.Sprintf("Email to %s: %s\n%s", to, subject, body))
+	return nil
+}
@@ -0,0 +1,499 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+// This code initializes and runs the API server, with which the Pi
+// clients register, and to which they send their data
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/server/api"
+	"github.com/RogerZhangHS/PiScan/server/database"
+	"github.com/RogerZhangHS/PiScan/server/digest"
+	"github.com/RogerZhangHS/PiScan/server/emailer"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// server constants
+	SERVER_HOST = "localhost"
+	SERVER_PORT = 9001
+
+	// smtp constants
+	SMTP_PORT  = 587
+	EMAIL_FROM = "noreply@localhost"
+
+	// where the passwords are read from, if not given on the command line
+	DB_PASSWORD_ENV   = "PISCAN_DB_PASSWORD"
+	SMTP_PASSWORD_ENV = "PISCAN_SMTP_PASSWORD"
+
+	// the ack of a request which needs no other reply
+	OK = "ok"
+
+	// the most submissions a single upload may carry
+	MAX_SUBMISSIONS = 1000
+
+	// how soon a device which has not been confirmed yet should retry
+	UNVERIFIED_RETRY = 10 * time.Minute
+
+	// random bytes in each emailed confirmation code
+	CONFIRM_CODE_BYTES = 16
+
+	// mime types
+	MIME_JSON = "application/json"
+	MIME_TEXT = "text/plain; charset=utf-8"
+	MIME_HTML = "text/html; charset=utf-8"
+
+	// the page of the emailed link, which only confirms the device once
+	// its button is pressed (so a mail scanner fetching the link does not)
+	CONFIRM_PAGE = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>PiScan</title></head>
+<body>
+<p>请确认此设备属于您的 PiScan 账户。如果您没有注册, 请关闭此页面。</p>
+<form method="post"><button type="submit">确认此设备</button></form>
+</body>
+</html>
+`
+)
+
+var (
+	BAD_REQUEST     = errors.New("Bad request")
+	BAD_METHOD      = errors.New("Method not allowed")
+	BAD_DIGEST      = errors.New("Invalid request digest")
+	UNKNOWN_ACCOUNT = errors.New("No such account")
+	UNVERIFIED      = errors.New("This device has not been confirmed yet")
+	TOO_MANY        = fmt.Errorf("Uploads are limited to %d submissions", MAX_SUBMISSIONS)
+)
+
+// Server holds what the request handlers share
+type Server struct {
+	Store     database.Store
+	Mail      emailer.Sender
+	PublicURL string // the address of this server in the confirmation links
+}
+
+// errorStatus returns the http status code for the handler error
+func errorStatus(err error) int {
+	switch err {
+	case BAD_REQUEST, TOO_MANY:
+		return http.StatusBadRequest
+	case BAD_METHOD:
+		return http.StatusMethodNotAllowed
+	case BAD_DIGEST, UNVERIFIED:
+		return http.StatusForbidden
+	case UNKNOWN_ACCOUNT:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// handler wraps the function of the route, which returns the reply or an
+// error, as an http.HandlerFunc replying in json; a signed POST with an
+// idempotency key which succeeded before gets the same reply, without
+// running it again (see replyKey)
+func (s *Server) handler(route string, fn func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", MIME_JSON)
+		key := s.replyKey(route, r)
+		if key != "" {
+			if saved, err := s.Store.GetReply(key); err == nil {
+				fmt.Fprint(w, saved)
+				return
+			} else if err != database.NOT_FOUND {
+				log.Println(err)
+			}
+		}
+
+		reply, err := fn(r)
+		if err != nil {
+			if err == UNVERIFIED {
+				// the owner may yet confirm the device
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(UNVERIFIED_RETRY.Seconds())))
+			}
+			w.WriteHeader(errorStatus(err))
+			reply = &api.SimpleMessage{Err: api.NewError(err.Error())}
+		}
+		body, encodeErr := json.Marshal(reply)
+		if encodeErr != nil {
+			log.Println(encodeErr)
+			http.Error(w, encodeErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if key != "" && err == nil {
+			now := time.Now()
+			if saveErr := s.Store.SaveReply(key, string(body), now.Unix(), now.Add(-database.REPLY_RETENTION).Unix()); saveErr != nil {
+				log.Println(saveErr)
+			}
+		}
+		w.Write(body)
+	}
+}
+
+// requireMethod parses the request values, and makes sure the request
+// used one of the methods
+func requireMethod(r *http.Request, methods ...string) error {
+	for _, method := range methods {
+		if r.Method == method {
+			return r.ParseForm()
+		}
+	}
+	return BAD_METHOD
+}
+
+// replyKey returns the key the reply to the request is saved under: its
+// idempotency key, scoped by the route and by whoever signed it (the email
+// address of a registration, or a confirmed device of the account), so
+// one device cannot replay or overwrite the replies of another; or "" if
+// it is a GET (which changes nothing), has no idempotency key or is not
+// signed, and so is never saved
+func (s *Server) replyKey(route string, r *http.Request) string {
+	key := r.FormValue(api.IDEMPOTENCY_PARAM)
+	email := r.Form.Get("email")
+	if r.Method == "GET" || key == "" || email == "" {
+		return ""
+	}
+
+	signer := email
+	if !digest.ValuesMatch(email, r.Form) {
+		signer = ""
+		acc, err := s.Store.GetAccount(email)
+		if err != nil {
+			return ""
+		}
+		devices, err := s.Store.GetDevices(acc.Id)
+		if err != nil {
+			return ""
+		}
+		for _, device := range devices {
+			if device.Verified != 0 && digest.ValuesMatch(device.APICode, r.Form) {
+				signer = device.APICode
+				break
+			}
+		}
+		if signer == "" {
+			return ""
+		}
+	}
+	scoped := sha256.Sum256([]byte(strings.Join([]string{route, signer, key}, "\n")))
+	return hex.EncodeToString(scoped[:])
+}
+
+// randomCode returns a random hex string
+func randomCode() (string, error) {
+	b := make([]byte, CONFIRM_CODE_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authenticate returns the Account of the request's email address, and
+// the confirmed Device of that account whose api code signed the request
+func (s *Server) authenticate(r *http.Request) (*database.Account, *database.Device, error) {
+	acc, err := s.Store.GetAccount(r.Form.Get("email"))
+	if err == database.NOT_FOUND {
+		return nil, nil, UNKNOWN_ACCOUNT
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	devices, err := s.Store.GetDevices(acc.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, device := range devices {
+		if digest.ValuesMatch(device.APICode, r.Form) {
+			if device.Verified == 0 {
+				return nil, nil, UNVERIFIED
+			}
+			return acc, device, nil
+		}
+	}
+	return nil, nil, BAD_DIGEST
+}
+
+// Register adds the device with the 'api' code to the account of the
+// 'email' address, and emails the link confirming it; the request is
+// signed with the email address, since the server has no api code yet
+func (s *Server) Register(r *http.Request) (interface{}, error) {
+	if err := requireMethod(r, "GET", "POST"); err != nil {
+		return nil, err
+	}
+	email, apiCode := r.Form.Get("email"), r.Form.Get("api")
+	if _, err := mail.ParseAddress(email); err != nil || apiCode == "" {
+		return nil, BAD_REQUEST
+	}
+	if !digest.ValuesMatch(email, r.Form) {
+		return nil, BAD_DIGEST
+	}
+
+	confirmCode, err := randomCode()
+	if err != nil {
+		return nil, err
+	}
+	device, err := s.Store.Register(email, apiCode, confirmCode, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	if device.Verified > 0 {
+		return &api.SimpleMessage{Ack: api.VERIFIED}, nil
+	}
+
+	link := strings.Join([]string{strings.TrimRight(s.PublicURL, "/"), api.CONFIRM_URL, device.ConfirmCode}, "")
+	body := fmt.Sprintf("PiScan 设备注册\n\n请打开以下链接, 并在页面上确认此设备属于您的账户 %s:\n\n%s\n\n如果您没有注册, 请忽略此邮件。\n", email, link)
+	if err := s.Mail.Send(email, "请确认您的 PiScan 设备", body); err != nil {
+		return nil, err
+	}
+	return &api.SimpleMessage{Ack: api.PENDING}, nil
+}
+
+// Status replies whether the account of the 'email' address has a
+// confirmed device; like Register, the request is signed with the email
+func (s *Server) Status(r *http.Request) (interface{}, error) {
+	if err := requireMethod(r, "GET", "POST"); err != nil {
+		return nil, err
+	}
+	email := r.Form.Get("email")
+	if !digest.ValuesMatch(email, r.Form) {
+		return nil, BAD_DIGEST
+	}
+
+	acc, err := s.Store.GetAccount(email)
+	if err == database.NOT_FOUND {
+		return nil, UNKNOWN_ACCOUNT
+	} else if err != nil {
+		return nil, err
+	}
+	devices, err := s.Store.GetDevices(acc.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if device.Verified > 0 {
+			return &api.SimpleMessage{Ack: api.VERIFIED}, nil
+		}
+	}
+	return &api.SimpleMessage{Ack: api.PENDING}, nil
+}
+
+// Confirm shows the page of the link emailed by Register (a GET), whose
+// form verifies the device with the code in the url path (a POST),
+// replying in plain text for the browser
+func (s *Server) Confirm(w http.ResponseWriter, r *http.Request) {
+	code := strings.TrimPrefix(r.URL.Path, api.CONFIRM_URL)
+	if code == "" {
+		http.Error(w, BAD_REQUEST.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", MIME_HTML)
+		fmt.Fprint(w, CONFIRM_PAGE)
+		return
+	case "POST":
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, BAD_METHOD.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", MIME_TEXT)
+	acc, err := s.Store.Confirm(code, time.Now().Unix())
+	if err == database.NOT_FOUND {
+		http.Error(w, "此链接无效或已过期", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "谢谢! 此设备已确认属于 %s。\n", acc.Email)
+}
+
+// Contribute adds the student ('barcode' and 'stuName') to the roster
+// of the account
+func (s *Server) Contribute(r *http.Request) (interface{}, error) {
+	if err := requireMethod(r, "POST"); err != nil {
+		return nil, err
+	}
+	acc, _, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	student := &database.Student{Id: strings.TrimSpace(r.Form.Get("barcode")),
+		Name:    strings.TrimSpace(r.Form.Get("stuName")),
+		Updated: time.Now().Unix()}
+	if student.Id == "" || student.Name == "" {
+		return nil, BAD_REQUEST
+	}
+	if err := s.Store.Contribute(acc.Id, student); err != nil {
+		return nil, err
+	}
+	return &api.SimpleMessage{Ack: OK}, nil
+}
+
+// Email sends the list of student names (each 'item') to the email
+// address of the account
+func (s *Server) Email(r *http.Request) (interface{}, error) {
+	if err := requireMethod(r, "POST"); err != nil {
+		return nil, err
+	}
+	acc, _, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	items := r.Form["item"]
+	if len(items) == 0 {
+		return nil, BAD_REQUEST
+	}
+	body := fmt.Sprintf("您选择的学生 (%d):\n\n%s\n", len(items), strings.Join(items, "\n"))
+	if err := s.Mail.Send(acc.Email, "PiScan 学生名单", body); err != nil {
+		return nil, err
+	}
+	return &api.SimpleMessage{Ack: OK}, nil
+}
+
+// Submissions merges the uploaded 'submissions' (a POST, see
+// api.Submission) into those of the account, or lists them (a GET, of
+// the optional 'assignment' uid) as an api.SubmissionList
+func (s *Server) Submissions(r *http.Request) (interface{}, error) {
+	if err := requireMethod(r, "GET", "POST"); err != nil {
+		return nil, err
+	}
+	acc, device, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Method == "GET" {
+		submissions, err := s.Store.GetSubmissions(acc.Id, r.Form.Get("assignment"))
+		if err != nil {
+			return nil, err
+		}
+		list := &api.SubmissionList{Submissions: make([]*api.Submission, 0, len(submissions))}
+		for _, sub := range submissions {
+			list.Submissions = append(list.Submissions, &api.Submission{StudentId: sub.StudentId,
+				StudentName: sub.StudentName,
+				Assignment:  sub.Assignment,
+				Title:       sub.Title,
+				Posted:      sub.Posted})
+		}
+		list.Ack = strconv.Itoa(len(list.Submissions))
+		return list, nil
+	}
+
+	uploaded := make([]*api.Submission, 0)
+	if err := json.Unmarshal([]byte(r.Form.Get("submissions")), &uploaded); err != nil {
+		return nil, BAD_REQUEST
+	}
+	if len(uploaded) > MAX_SUBMISSIONS {
+		return nil, TOO_MANY
+	}
+	now := time.Now().Unix()
+	submissions := make([]*database.Submission, 0, len(uploaded))
+	for _, sub := range uploaded {
+		if sub == nil || sub.StudentId == "" || sub.Assignment == "" || sub.Posted <= 0 {
+			return nil, BAD_REQUEST
+		}
+		submissions = append(submissions, &database.Submission{StudentId: sub.StudentId,
+			StudentName: sub.StudentName,
+			Assignment:  sub.Assignment,
+			Title:       sub.Title,
+			Posted:      sub.Posted,
+			Device:      device.APICode,
+			Uploaded:    now})
+	}
+	if err := s.Store.AddSubmissions(acc.Id, submissions); err != nil {
+		return nil, err
+	}
+	return &api.SimpleMessage{Ack: strconv.Itoa(len(submissions))}, nil
+}
+
+func main() {
+	var (
+		host, publicURL, dbHost, dbName, dbUser, dbPass, tablesPath, smtpHost, smtpUser, smtpPass, emailFrom string
+		port, dbPort, smtpPort                                                                               int
+		inMemory                                                                                             bool
+	)
+	flag.StringVar(&host, "host", SERVER_HOST, fmt.Sprintf("Host name or IP address for this server (defaults to '%s')", SERVER_HOST))
+	flag.IntVar(&port, "port", SERVER_PORT, fmt.Sprintf("Port addess for this server (defaults to '%d')", SERVER_PORT))
+	flag.StringVar(&publicURL, "publicURL", "", "The address (with scheme) of this server in the emailed confirmation links (defaults to http://host:port)")
+	flag.StringVar(&dbHost, "dbHost", database.MYSQL_HOST, fmt.Sprintf("Host name or IP address of the mysql server (defaults to '%s')", database.MYSQL_HOST))
+	flag.IntVar(&dbPort, "dbPort", database.MYSQL_PORT, fmt.Sprintf("Port address of the mysql server (defaults to '%d')", database.MYSQL_PORT))
+	flag.StringVar(&dbName, "dbName", database.MYSQL_NAME, fmt.Sprintf("The mysql database (defaults to '%s')", database.MYSQL_NAME))
+	flag.StringVar(&dbUser, "dbUser", "", "The mysql user (REQUIRED, unless -inMemory)")
+	flag.StringVar(&dbPass, "dbPass", "", fmt.Sprintf("The mysql password (defaults to the %s environment variable, if set)", DB_PASSWORD_ENV))
+	flag.StringVar(&tablesPath, "tables", "", fmt.Sprintf("Path to the %s file, to create the tables on startup (defaults to none)", database.TABLE_SQL_DEFINITIONS))
+	flag.BoolVar(&inMemory, "inMemory", false, "Keep the data in memory instead of mysql, e.g. for testing (defaults to false)")
+	flag.StringVar(&smtpHost, "smtpHost", "", "Host name or IP address of the smtp server (defaults to none: emails are only logged)")
+	flag.IntVar(&smtpPort, "smtpPort", SMTP_PORT, fmt.Sprintf("Port address of the smtp server (defaults to '%d')", SMTP_PORT))
+	flag.StringVar(&smtpUser, "smtpUser", "", "The smtp user (defaults to none)")
+	flag.StringVar(&smtpPass, "smtpPass", "", fmt.Sprintf("The smtp password (defaults to the %s environment variable, if set)", SMTP_PASSWORD_ENV))
+	flag.StringVar(&emailFrom, "emailFrom", EMAIL_FROM, fmt.Sprintf("The sender address of the emails (defaults to '%s')", EMAIL_FROM))
+	flag.Parse()
+
+	// make sure the required parameters are passed when run
+	if dbUser == "" && !inMemory {
+		fmt.Println("APIServer usage:")
+		flag.PrintDefaults()
+	} else {
+		/* set the server ready for use */
+		if dbPass == "" {
+			dbPass = os.Getenv(DB_PASSWORD_ENV)
+		}
+		if smtpPass == "" {
+			smtpPass = os.Getenv(SMTP_PASSWORD_ENV)
+		}
+		if publicURL == "" {
+			publicURL = fmt.Sprintf("http://%s:%d", host, port)
+		}
+
+		// the datastore, shared by all requests
+		var store database.Store = database.NewMemoryStore()
+		if !inMemory {
+			dbCoordinates := database.ConnCoordinates{DBHost: dbHost, DBPort: dbPort, DBName: dbName, DBUser: dbUser, DBPass: dbPass, DBTablesPath: tablesPath}
+			mysqlStore, storeErr := database.OpenStore(dbCoordinates)
+			if storeErr != nil {
+				log.Fatal(storeErr)
+			}
+			store = mysqlStore
+		}
+		defer store.Close()
+
+		var sender emailer.Sender = &emailer.Logger{}
+		if smtpHost != "" {
+			sender = &emailer.SMTPServer{Host: smtpHost, Port: smtpPort, User: smtpUser, Password: smtpPass, From: emailFrom}
+		}
+
+		server := &Server{Store: store, Mail: sender, PublicURL: publicURL}
+
+		/* define the server handlers */
+		http.HandleFunc(api.REGISTER_URL, server.handler(api.REGISTER_URL, server.Register))
+		http.HandleFunc(api.STATUS_URL, server.handler(api.STATUS_URL, server.Status))
+		http.HandleFunc(api.CONFIRM_URL, server.Confirm)
+		http.HandleFunc(api.CONTRIBUTE_URL, server.handler(api.CONTRIBUTE_URL, server.Contribute))
+		http.HandleFunc(api.EMAIL_URL, server.handler(api.EMAIL_URL, server.Email))
+		http.HandleFunc(api.SUBMISSIONS_URL, server.handler(api.SUBMISSIONS_URL, server.Submissions))
+
+		/* start the server */
+		log.Println(fmt.Sprintf("Starting the APIServer %s", fmt.Sprintf("%s:%d", host, port)))
+		log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", host, port), nil))
+	}
+}
@@ -0,0 +1,285 @@
+// Copyright Banrai LLC. All rights reserved. Use of this source code is
+// governed by the license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/RogerZhangHS/PiScan/server/api"
+	"github.com/RogerZhangHS/PiScan/server/database"
+	"github.com/RogerZhangHS/PiScan/server/digest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// mailbox is a Sender which keeps the bodies of the messages
+type mailbox []string
+
+func (m *mailbox) Send(to, subject, body string) error {
+	*m = append(*m, body)
+	return nil
+}
+
+// sign adds the digest of the values, keyed as the clients do
+func sign(key string, v url.Values) url.Values {
+	v.Set(digest.DIGEST_PARAM, digest.GenerateDigest(key, v.Encode()))
+	return v
+}
+
+// newRequest returns the request with the values, in the url of a GET and
+// in the body of anything else
+func newRequest(method, path string, v url.Values) *http.Request {
+	if method == "GET" {
+		return httptest.NewRequest(method, path+"?"+v.Encode(), nil)
+	}
+	r := httptest.NewRequest(method, path, strings.NewReader(v.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+// serve runs the handler of the route on the request
+func serve(s *Server, route string, fn func(*http.Request) (interface{}, error), r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.handler(route, fn)(w, r)
+	return w
+}
+
+// register registers the device to the account of the email address,
+// returning the path of the emailed link
+func register(t *testing.T, s *Server, email, apiCode string) string {
+	sent := s.Mail.(*mailbox)
+	before := len(*sent)
+	v := sign(email, url.Values{"email": {email}, "api": {apiCode}})
+	if w := serve(s, api.REGISTER_URL, s.Register, newRequest("GET", api.REGISTER_URL, v)); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	if len(*sent) != before+1 {
+		t.Fatalf("sent %d emails", len(*sent)-before)
+	}
+	body := (*sent)[before]
+	start := strings.Index(body, s.PublicURL+api.CONFIRM_URL)
+	if start < 0 {
+		t.Fatalf("no link in %q", body)
+	}
+	return strings.Fields(body[start+len(s.PublicURL):])[0]
+}
+
+// confirm presses the button of the page of the link
+func confirm(t *testing.T, s *Server, link string) {
+	w := httptest.NewRecorder()
+	s.Confirm(w, httptest.NewRequest("POST", link, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+}
+
+// verified reports whether the device is confirmed
+func verified(t *testing.T, s *Server, email, apiCode string) bool {
+	acc, err := s.Store.GetAccount(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := s.Store.GetDevices(acc.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, device := range devices {
+		if device.APICode == apiCode {
+			return device.Verified > 0
+		}
+	}
+	t.Fatalf("no device %s", apiCode)
+	return false
+}
+
+func testServer() *Server {
+	return &Server{Store: database.NewMemoryStore(), Mail: new(mailbox), PublicURL: "https://piscan.example.com"}
+}
+
+func TestConfirm(t *testing.T) {
+	s := testServer()
+	link := register(t, s, "a@example.com", "pi-1")
+
+	// opening the link only shows the page
+	w := httptest.NewRecorder()
+	s.Confirm(w, httptest.NewRequest("GET", link, nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != MIME_HTML || !strings.Contains(w.Body.String(), `<form method="post">`) {
+		t.Fatalf("got %d %v %s", w.Code, w.Header(), w.Body)
+	}
+	if verified(t, s, "a@example.com", "pi-1") {
+		t.Fatal("confirmed by opening the link")
+	}
+
+	confirm(t, s, link)
+	if !verified(t, s, "a@example.com", "pi-1") {
+		t.Fatal("not confirmed by the form")
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		status       int
+	}{
+		{"POST", api.CONFIRM_URL + "nosuchcode", http.StatusNotFound},
+		{"POST", api.CONFIRM_URL, http.StatusBadRequest},
+		{"PUT", link, http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		s.Confirm(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.status {
+			t.Fatalf("%s %s: got %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := testServer()
+	confirm(t, s, register(t, s, "a@example.com", "pi-1"))
+	register(t, s, "a@example.com", "pi-2")
+	confirm(t, s, register(t, s, "b@example.com", "pi-3"))
+
+	for _, tt := range []struct {
+		email, key string
+		err        error
+	}{
+		{"a@example.com", "pi-1", nil},
+		{"a@example.com", "pi-2", UNVERIFIED},
+		{"a@example.com", "pi-3", BAD_DIGEST}, // a device of another account
+		{"a@example.com", "a@example.com", BAD_DIGEST},
+		{"a@example.com", "pi-4", BAD_DIGEST},
+		{"c@example.com", "pi-1", UNKNOWN_ACCOUNT},
+	} {
+		r := newRequest("POST", api.CONTRIBUTE_URL, sign(tt.key, url.Values{"email": {tt.email}, "barcode": {"001"}}))
+		r.ParseForm()
+		acc, device, err := s.authenticate(r)
+		if err != tt.err {
+			t.Fatalf("%s signed by %s: got %v, want %v", tt.email, tt.key, err, tt.err)
+		}
+		if err == nil && (acc.Email != tt.email || device.APICode != tt.key) {
+			t.Fatalf("got %+v %+v", acc, device)
+		}
+	}
+}
+
+func TestReplyKey(t *testing.T) {
+	s := testServer()
+	confirm(t, s, register(t, s, "a@example.com", "pi-1"))
+	confirm(t, s, register(t, s, "a@example.com", "pi-2"))
+	register(t, s, "a@example.com", "pi-3")
+
+	key := func(method, route, signer string, v url.Values) string {
+		v.Set("email", "a@example.com")
+		if signer != "" {
+			sign(signer, v)
+		}
+		r := newRequest(method, route, v)
+		r.ParseForm()
+		return s.replyKey(route, r)
+	}
+	withKey := func() url.Values {
+		return url.Values{api.IDEMPOTENCY_PARAM: {"k1"}}
+	}
+
+	device := key("POST", api.SUBMISSIONS_URL, "pi-1", withKey())
+	if device == "" || key("POST", api.SUBMISSIONS_URL, "pi-1", withKey()) != device {
+		t.Fatalf("got %q", device)
+	}
+	// scoped by the signer and the route
+	scoped := map[string]string{
+		"another device": key("POST", api.SUBMISSIONS_URL, "pi-2", withKey()),
+		"another route":  key("POST", api.CONTRIBUTE_URL, "pi-1", withKey()),
+		"the email":      key("POST", api.SUBMISSIONS_URL, "a@example.com", withKey()),
+	}
+	for name, k := range scoped {
+		if k == "" || k == device {
+			t.Fatalf("%s: got %q", name, k)
+		}
+	}
+	// and never saved unless a signed POST with a key
+	never := map[string]string{
+		"a GET":                 key("GET", api.SUBMISSIONS_URL, "pi-1", withKey()),
+		"no key":                key("POST", api.SUBMISSIONS_URL, "pi-1", url.Values{}),
+		"not signed":            key("POST", api.SUBMISSIONS_URL, "", withKey()),
+		"an unconfirmed device": key("POST", api.SUBMISSIONS_URL, "pi-3", withKey()),
+		"an unknown device":     key("POST", api.SUBMISSIONS_URL, "pi-4", withKey()),
+	}
+	for name, k := range never {
+		if k != "" {
+			t.Fatalf("%s: got %q", name, k)
+		}
+	}
+}
+
+// upload posts the submissions, signed by the device
+func upload(s *Server, apiCode, idempotencyKey string, submissions interface{}) *httptest.ResponseRecorder {
+	encoded, _ := json.Marshal(submissions)
+	v := url.Values{"email": {"a@example.com"}, "submissions": {string(encoded)}}
+	if idempotencyKey != "" {
+		v.Set(api.IDEMPOTENCY_PARAM, idempotencyKey)
+	}
+	return serve(s, api.SUBMISSIONS_URL, s.Submissions, newRequest("POST", api.SUBMISSIONS_URL, sign(apiCode, v)))
+}
+
+// uploaded returns how many submissions the account has
+func uploaded(t *testing.T, s *Server) int {
+	acc, err := s.Store.GetAccount("a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	submissions, err := s.Store.GetSubmissions(acc.Id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(submissions)
+}
+
+// submissions returns n valid submissions
+func submissions(n int) []*api.Submission {
+	results := make([]*api.Submission, 0, n)
+	for i := 0; i < n; i++ {
+		results = append(results, &api.Submission{StudentId: fmt.Sprintf("%04d", i), Assignment: "a1", Posted: 1})
+	}
+	return results
+}
+
+func TestSubmissions(t *testing.T) {
+	s := testServer()
+	confirm(t, s, register(t, s, "a@example.com", "pi-1"))
+	confirm(t, s, register(t, s, "a@example.com", "pi-2"))
+
+	// an upload which is too large, or invalid, is refused whole
+	for name, body := range map[string]interface{}{
+		"too many":      submissions(MAX_SUBMISSIONS + 1),
+		"not a list":    "x",
+		"a null":        []*api.Submission{{StudentId: "001", Assignment: "a1", Posted: 1}, nil},
+		"no student":    []*api.Submission{{Assignment: "a1", Posted: 1}},
+		"no assignment": []*api.Submission{{StudentId: "001", Posted: 1}},
+		"no scan time":  []*api.Submission{{StudentId: "001", Assignment: "a1"}},
+	} {
+		if w := upload(s, "pi-1", "", body); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got %d %s", name, w.Code, w.Body)
+		}
+	}
+	if w := upload(s, "pi-1", "", submissions(MAX_SUBMISSIONS+1)); !strings.Contains(w.Body.String(), TOO_MANY.Error()) {
+		t.Fatalf("got %s", w.Body)
+	}
+	if n := uploaded(t, s); n != 0 {
+		t.Fatalf("kept %d submissions", n)
+	}
+
+	if w := upload(s, "pi-1", "k1", submissions(MAX_SUBMISSIONS)); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"1000"`) {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+
+	// a retry gets the saved reply, but the same key from another device
+	// is a request of its own
+	if w := upload(s, "pi-1", "k1", submissions(1)); !strings.Contains(w.Body.String(), `"1000"`) {
+		t.Fatalf("got %s, want the saved reply", w.Body)
+	}
+	if w := upload(s, "pi-2", "k1", submissions(2)); !strings.Contains(w.Body.String(), `"2"`) {
+		t.Fatalf("got %s, want a reply of its own", w.Body)
+	}
+}